@@ -0,0 +1,199 @@
+package api
+
+import (
+	"net/http"
+	"rs3/database"
+	"time"
+)
+
+// AdminPrefix is the path under which the admin endpoints
+// are served. They are not part of the API proper, and are
+// only served to clients whose certificates give them the
+// admin role.
+const AdminPrefix = "/admin/v1"
+
+// lockout is a view of an account or IP address with
+// recent failed logins.
+type lockout struct {
+	Name     string     `json:"name"`
+	Account  bool       `json:"account"` // Whether name is an email address.
+	Failures int        `json:"failures"`
+	Locked   *time.Time `json:"locked,omitempty"` // Until when logins are refused.
+}
+
+// inviteView is a view of an unused invite.
+type inviteView struct {
+	ID      string    `json:"id"`
+	Note    string    `json:"note"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// newInvite is the body of a request to create an invite.
+type newInvite struct {
+	Note string `json:"note"` // Who it is for.
+	Days int    `json:"days"` // Until it expires; defaults to a week.
+}
+
+// invite is a new invite, with its code, which is only
+// shown once.
+type invite struct {
+	inviteView
+	Code string `json:"code"`
+}
+
+var lockoutName = &param{"name", "path", "string", "", "The email address or IP address.", true}
+var userID = &param{"uid", "path", "string", "", "The user's ID.", true}
+var inviteID = &param{"id", "path", "string", "", "The invite's ID.", true}
+
+var adminRoutes []*route
+
+func init() {
+	adminRoutes = []*route{
+		{
+			Method:  "GET",
+			Path:    "/lockouts",
+			ID:      "listLockouts",
+			Summary: "List the accounts and IP addresses with recent failed logins.",
+			Result:  []lockout{},
+			handle:  listLockouts,
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/lockouts/{name}",
+			ID:      "unlock",
+			Summary: "Forget an account's or IP address's failed logins, lifting any lockout.",
+			Params:  []*param{lockoutName},
+			Status:  204,
+			handle:  unlock,
+		},
+		{
+			Method:  "GET",
+			Path:    "/invites",
+			ID:      "listInvites",
+			Summary: "List the unused invites.",
+			Result:  []inviteView{},
+			handle:  listInvites,
+		},
+		{
+			Method:  "POST",
+			Path:    "/invites",
+			ID:      "createInvite",
+			Summary: "Create an invite, which lets someone register once. Its code is only shown once.",
+			Body:    newInvite{},
+			Result:  invite{},
+			Status:  201,
+			handle:  createInvite,
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/invites/{id}",
+			ID:      "revokeInvite",
+			Summary: "Revoke an unused invite.",
+			Params:  []*param{inviteID},
+			Status:  204,
+			handle:  revokeInvite,
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/users/{uid}/two-factor",
+			ID:      "resetTwoFactor",
+			Summary: "Turn off a user's two-factor authentication.",
+			Params:  []*param{userID},
+			Status:  204,
+			handle:  resetTwoFactor,
+		},
+	}
+}
+
+// ServeAdmin handles a request to the admin endpoints. The
+// caller must already be known to be an administrator.
+func ServeAdmin(w http.ResponseWriter, r *http.Request) {
+	rt, vars, err := match(r, AdminPrefix, adminRoutes)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	v, err := rt.handle(&request{r, w, nil, "", vars})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	respond(w, r, rt, v)
+}
+
+func listLockouts(r *request) (interface{}, error) {
+	out := []lockout{}
+	for _, l := range database.LoginFailures() {
+		v := lockout{Name: l.Name, Account: l.Account, Failures: l.Failures}
+		if !l.Locked.IsZero() {
+			locked := l.Locked
+			v.Locked = &locked
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func unlock(r *request) (interface{}, error) {
+	err := database.Unlock(r.vars["name"])
+	if err != nil {
+		return nil, notFound("%s", err.Error())
+	}
+	return nil, nil
+}
+
+func resetTwoFactor(r *request) (interface{}, error) {
+	uid, err := database.StringToUid(r.vars["uid"])
+	if err != nil {
+		return nil, badRequest("Error: invalid user ID.")
+	}
+	err = database.ResetTOTP(uid)
+	if _, ok := err.(*database.UserDoesNotExist); ok {
+		return nil, notFound("Error: no such user.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func newInviteView(i *database.Invite) inviteView {
+	return inviteView{i.ID, i.Note, i.Created, i.Expires}
+}
+
+func listInvites(r *request) (interface{}, error) {
+	out := []inviteView{}
+	for _, i := range database.Invites() {
+		out = append(out, newInviteView(i))
+	}
+	return out, nil
+}
+
+func createInvite(r *request) (interface{}, error) {
+	body := new(newInvite)
+	err := r.decode(body)
+	if err != nil {
+		return nil, err
+	}
+	life := database.InviteLife
+	if body.Days < 0 {
+		return nil, badRequest("Error: invalid number of days.")
+	}
+	if body.Days > 0 {
+		life = time.Duration(body.Days) * 24 * time.Hour
+	}
+	code, i, err := database.NewInvite(body.Note, life)
+	if err != nil {
+		return nil, internal(err)
+	}
+	return &invite{newInviteView(i), code}, nil
+}
+
+func revokeInvite(r *request) (interface{}, error) {
+	err := database.RevokeInvite(r.vars["id"])
+	if err != nil {
+		return nil, notFound("Error: no such invite.")
+	}
+	return nil, nil
+}
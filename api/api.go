@@ -0,0 +1,327 @@
+// Package api implements a versioned JSON API for scripts
+// and other tools, covering the user's profile, feeds,
+// folders and items.
+//
+// Clients send a personal API token in an "Authorization:
+// Bearer <token>" header. Alternatively, they can exchange
+// the user's email and password, or an app password, for a
+// token at POST /api/v1/token. Tokens are scoped: read-only
+// tokens may only make GET requests, and only admin tokens
+// may manage tokens and app passwords. Responses carry
+// ETags: GET requests with a matching If-None-Match are
+// answered with 304 Not Modified, and changes with an
+// If-Match which no longer matches are refused with 412
+// Precondition Failed. Every error has a JSON body of the
+// form {"error": {"code": "...", "message": "..."}}.
+//
+// The API is described by an OpenAPI document, generated
+// from the routes below and served at /api/v1/openapi.json.
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"rs3/database"
+	"strings"
+)
+
+// Prefix is the path under which the API is served.
+const Prefix = "/api/v1"
+
+// MaxBody is the largest request body accepted, in bytes.
+const MaxBody = 1 << 20
+
+// Error is the body of an error response.
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// errorBody wraps an Error in its response.
+type errorBody struct {
+	Error *Error `json:"error"`
+}
+
+func badRequest(format string, v ...interface{}) *Error {
+	return &Error{400, "bad_request", fmt.Sprintf(format, v...)}
+}
+
+func notFound(format string, v ...interface{}) *Error {
+	return &Error{404, "not_found", fmt.Sprintf(format, v...)}
+}
+
+// internal logs an unexpected error, returning an Error
+// which reveals nothing about it.
+func internal(err error) *Error {
+	fmt.Println("Failed to serve API request:")
+	fmt.Println(err)
+	return &Error{500, "internal", "Internal server error."}
+}
+
+// fail converts an error from the database into an Error.
+func fail(err error) *Error {
+	switch err := err.(type) {
+	case *Error:
+		return err
+	case *database.UserDoesNotExist, *database.AuthenticationError:
+		return &Error{401, "unauthorized", "Error: invalid credentials."}
+	case *database.FeedDoesNotExist:
+		return notFound("Error: no such subscription.")
+	case *database.ItemDoesNotExist:
+		return notFound("Error: no such item.")
+	case *database.TokenDoesNotExist:
+		return notFound("Error: no such token.")
+	case *database.FeedAlreadyExists:
+		return &Error{409, "conflict", "Error: already subscribed."}
+	case *database.UndoExpired:
+		return &Error{410, "gone", "Error: too late to undo."}
+	}
+	return badRequest("%s", err.Error())
+}
+
+// document is a response body which is not JSON.
+type document struct {
+	Type string
+	Body []byte
+}
+
+// request is an authenticated API request, along with the
+// values of its path parameters.
+type request struct {
+	*http.Request
+	w     http.ResponseWriter
+	uid   []byte
+	scope string
+	vars  map[string]string
+}
+
+// decode reads the request's JSON body into v.
+func (r *request) decode(v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(r.w, r.Body, MaxBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		return badRequest("Error: invalid request body: %s.", err)
+	}
+	return nil
+}
+
+// Serve handles a request to the API.
+func Serve(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, authenticate)
+}
+
+// ServeAs handles a request to the API from a client which
+// has already been authenticated by other means, such as a
+// client certificate, as the user with the given scope.
+func ServeAs(w http.ResponseWriter, r *http.Request, uid []byte, scope string) {
+	serve(w, r, func(*http.Request) ([]byte, string, bool) {
+		return uid, scope, true
+	})
+}
+
+// serve handles a request to the API, using auth to find
+// who made it.
+func serve(w http.ResponseWriter, r *http.Request, auth func(*http.Request) ([]byte, string, bool)) {
+	rt, vars, err := match(r, Prefix, routes)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	req := &request{r, w, nil, "", vars}
+	if !rt.Public {
+		uid, scope, ok := auth(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rs3"`)
+			serveError(w, &Error{401, "unauthorized", "Error: missing or invalid token."})
+			return
+		}
+		if !database.Allows(scope, rt.scope()) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rs3", error="insufficient_scope", scope="`+rt.scope()+`"`)
+			serveError(w, &Error{403, "insufficient_scope", "Error: this needs a token with " + rt.scope() + " access."})
+			return
+		}
+		req.uid = uid
+		req.scope = scope
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" && r.Method != "GET" {
+		current := get(rt.Path)
+		if current != nil {
+			v, err := current.handle(req)
+			if err != nil {
+				serveError(w, err)
+				return
+			}
+			body, _, err := encode(v)
+			if err != nil {
+				serveError(w, internal(err))
+				return
+			}
+			if !matchETag(match, etag(body)) {
+				serveError(w, &Error{412, "precondition_failed", "Error: the resource has changed."})
+				return
+			}
+		}
+	}
+
+	v, err := rt.handle(req)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	respond(w, r, rt, v)
+}
+
+// match finds the route for the request among those
+// under the prefix, returning the values of its path
+// parameters.
+func match(r *http.Request, prefix string, routes []*route) (*route, map[string]string, error) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	var allowed []string
+	for _, rt := range routes {
+		vars, ok := rt.match(parts)
+		if !ok {
+			continue
+		}
+		if rt.Method == r.Method || (rt.Method == "GET" && r.Method == "HEAD") {
+			return rt, vars, nil
+		}
+		allowed = append(allowed, rt.Method)
+	}
+	if allowed != nil {
+		return nil, nil, &Error{405, "method_not_allowed", "Error: allowed methods are " + strings.Join(allowed, ", ") + "."}
+	}
+	return nil, nil, notFound("Error: no such endpoint.")
+}
+
+// match compares the route's path with the segments of
+// a request's path.
+func (rt *route) match(parts []string) (map[string]string, bool) {
+	pattern := strings.Split(strings.Trim(rt.Path, "/"), "/")
+	if len(pattern) != len(parts) {
+		return nil, false
+	}
+	vars := make(map[string]string)
+	for i, p := range pattern {
+		s, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, false
+		}
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if s == "" {
+				return nil, false
+			}
+			vars[p[1:len(p)-1]] = s
+		} else if p != s {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+// get returns the GET route with the given path, if any.
+func get(path string) *route {
+	for _, rt := range routes {
+		if rt.Method == "GET" && rt.Path == path {
+			return rt
+		}
+	}
+	return nil
+}
+
+// authenticate checks the request's bearer token,
+// returning the user's uid and the token's scope.
+func authenticate(r *http.Request) ([]byte, string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, "", false
+	}
+	uid, scope, err := database.ClientUser(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	if err != nil {
+		return nil, "", false
+	}
+	return uid, scope, true
+}
+
+// encode returns the response body for v and its type.
+func encode(v interface{}) ([]byte, string, error) {
+	if doc, ok := v.(*document); ok {
+		return doc.Body, doc.Type, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, "application/json; charset=utf-8", nil
+}
+
+// etag returns the entity tag for a response body.
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// matchETag returns whether an If-Match or If-None-Match
+// header matches the entity tag.
+func matchETag(header, tag string) bool {
+	for _, s := range strings.Split(header, ",") {
+		s = strings.TrimPrefix(strings.TrimSpace(s), "W/")
+		if s == "*" || s == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// respond writes a successful response. GET requests
+// whose If-None-Match matches are answered with 304.
+func respond(w http.ResponseWriter, r *http.Request, rt *route, v interface{}) {
+	if v == nil {
+		w.WriteHeader(204)
+		return
+	}
+	body, typ, err := encode(v)
+	if err != nil {
+		serveError(w, internal(err))
+		return
+	}
+	tag := etag(body)
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Method == "GET" || r.Method == "HEAD" {
+		if match := r.Header.Get("If-None-Match"); match != "" && matchETag(match, tag) {
+			w.WriteHeader(304)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", typ)
+	status := rt.Status
+	if status == 0 {
+		status = 200
+	}
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
+
+// serveError writes an error response.
+func serveError(w http.ResponseWriter, err error) {
+	e := fail(err)
+	b, _ := json.Marshal(&errorBody{e})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(e.Status)
+	w.Write(b)
+}
@@ -0,0 +1,568 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"rs3/database"
+	"rs3/security"
+	"strings"
+	"testing"
+	"time"
+)
+
+const feedXML = `<?xml version="1.0"?>
+<rss version="2.0">
+<channel>
+	<title>%[1]s</title>
+	<link>http://example.com/</link>
+	<item>
+		<title>First post on %[1]s</title>
+		<link>http://example.com/%[1]s/1</link>
+		<guid>tag:example.com,2013:%[1]s/1</guid>
+		<description>About apples.</description>
+		<pubDate>Mon, 01 Apr 2013 10:00:00 +0000</pubDate>
+	</item>
+	<item>
+		<title>Second post on %[1]s</title>
+		<link>http://example.com/%[1]s/2</link>
+		<guid>tag:example.com,2013:%[1]s/2</guid>
+		<description>About &lt;b&gt;pears&lt;/b&gt;.</description>
+		<pubDate>Tue, 02 Apr 2013 10:00:00 +0000</pubDate>
+	</item>
+</channel>
+</rss>`
+
+// setup creates a user subscribed to a two-item feed in
+// the folder "Tech", returning a token for the user and
+// the server of feeds. Each path on the server is a feed
+// titled after it, with items of its own.
+func setup(t *testing.T, email string) (string, *httptest.Server) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, feedXML, strings.TrimPrefix(r.URL.Path, "/"))
+	}))
+	t.Cleanup(srv.Close)
+
+	salt := security.NewSalt()
+	uid, err := security.Hash(email, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwd, err := security.Hash("password", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AddUser(uid, pwd, salt, "Reader", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := srv.URL + "/tech.xml"
+	err = database.AddFeeds(uid, "", feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.SetFolder(uid, feed, "Tech")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := do(t, "", "POST", "/token", fmt.Sprintf(`{"email":%q,"password":"password"}`, email), nil)
+	if w.Code != 201 {
+		t.Fatalf("Expected a token, got %d: %s", w.Code, w.Body)
+	}
+	v := new(token)
+	decode(t, w, v)
+	return v.Token, srv
+}
+
+// do makes a request to the API.
+func do(t *testing.T, token, method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	var in io.Reader
+	if body != "" {
+		in = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, Prefix+path, in)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	Serve(w, r)
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	err := json.Unmarshal(w.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("Invalid JSON %q: %v", w.Body, err)
+	}
+}
+
+// checkError checks that the response is an error with
+// the given status and code.
+func checkError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	if w.Code != status {
+		t.Errorf("Expected status %d, got %d: %s", status, w.Code, w.Body)
+		return
+	}
+	body := new(errorBody)
+	decode(t, w, body)
+	if body.Error == nil || body.Error.Code != code || body.Error.Message == "" {
+		t.Errorf("Expected an error body with code %q, got %s", code, w.Body)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tok, _ := setup(t, "errors@example.com")
+	checkError(t, do(t, "", "GET", "/profile", "", nil), 401, "unauthorized")
+	checkError(t, do(t, "bogus.token", "GET", "/profile", "", nil), 401, "unauthorized")
+	checkError(t, do(t, "", "POST", "/token", `{"email":"errors@example.com","password":"wrong"}`, nil), 401, "unauthorized")
+	checkError(t, do(t, tok, "GET", "/nothing", "", nil), 404, "not_found")
+	checkError(t, do(t, tok, "DELETE", "/profile", "", nil), 405, "method_not_allowed")
+	checkError(t, do(t, tok, "PATCH", "/profile", `{"colour":"red"}`, nil), 400, "bad_request")
+	checkError(t, do(t, tok, "PATCH", "/profile", `{"sort":"sideways"}`, nil), 400, "bad_request")
+	checkError(t, do(t, tok, "GET", "/items/99", "", nil), 404, "not_found")
+	checkError(t, do(t, tok, "GET", "/subscriptions/bm9wZQ", "", nil), 404, "not_found")
+
+	// Password guesses are throttled.
+	for i := 0; i < database.AccountFreeAttempts-1; i++ {
+		checkError(t, do(t, "", "POST", "/token", `{"email":"errors@example.com","password":"wrong"}`, nil), 401, "unauthorized")
+	}
+	w := do(t, "", "POST", "/token", `{"email":"errors@example.com","password":"password"}`, nil)
+	checkError(t, w, 429, "too_many_requests")
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header.")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	tok, _ := setup(t, "profile@example.com")
+	w := do(t, tok, "PATCH", "/profile", `{"nickname":"Scripter","time_zone":"Europe/London","sort":"oldest"}`, nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	p := new(profile)
+	decode(t, w, p)
+	if p.Nickname != "Scripter" || p.TimeZone != "Europe/London" || p.Sort != "oldest" || p.Unread != 2 {
+		t.Errorf("Profile not updated: %+v", p)
+	}
+
+	// A bad time zone changes nothing.
+	w = do(t, tok, "PATCH", "/profile", `{"nickname":"Other","time_zone":"Mars/Olympus"}`, nil)
+	checkError(t, w, 400, "bad_request")
+	decode(t, do(t, tok, "GET", "/profile", "", nil), p)
+	if p.Nickname != "Scripter" {
+		t.Errorf("Expected the nickname to be unchanged, got %q.", p.Nickname)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	tok, srv := setup(t, "subscriptions@example.com")
+	w := do(t, tok, "POST", "/subscriptions", fmt.Sprintf(`{"url":%q,"folder":"News"}`, srv.URL+"/news.xml"), nil)
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+	sub := new(subscription)
+	decode(t, w, sub)
+	if sub.Title != "news.xml" || sub.Folder != "News" || sub.Unread != 2 || !sub.Privacy {
+		t.Errorf("Wrong subscription: %+v", sub)
+	}
+	if loc := w.Header().Get("Location"); loc != Prefix+"/subscriptions/"+sub.ID {
+		t.Errorf("Wrong location %q.", loc)
+	}
+
+	checkError(t, do(t, tok, "POST", "/subscriptions", fmt.Sprintf(`{"url":%q}`, srv.URL+"/news.xml"), nil), 409, "conflict")
+	checkError(t, do(t, tok, "POST", "/subscriptions", fmt.Sprintf(`{"url":%q}`, srv.URL+"/missing.xml"), nil), 400, "bad_request")
+	checkError(t, do(t, tok, "POST", "/subscriptions", `{"url":"file:///etc/passwd"}`, nil), 400, "bad_request")
+
+	w = do(t, tok, "PATCH", "/subscriptions/"+sub.ID, `{"folder":"Tech","privacy":false,"sort":"newest"}`, nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	decode(t, w, sub)
+	if sub.Folder != "Tech" || sub.Privacy || sub.Sort != "newest" {
+		t.Errorf("Subscription not updated: %+v", sub)
+	}
+
+	var list []*subscription
+	decode(t, do(t, tok, "GET", "/subscriptions", "", nil), &list)
+	if len(list) != 2 || list[1].URL != srv.URL+"/news.xml" {
+		t.Errorf("Expected two subscriptions, got %+v", list)
+	}
+
+	var folders []*folder
+	decode(t, do(t, tok, "GET", "/folders", "", nil), &folders)
+	if len(folders) != 1 || folders[0].Name != "Tech" || len(folders[0].Subscriptions) != 2 || folders[0].Unread != 4 {
+		t.Errorf("Expected one folder of two feeds, got %+v", folders)
+	}
+
+	w = do(t, tok, "DELETE", "/subscriptions/"+sub.ID, "", nil)
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body)
+	}
+	checkError(t, do(t, tok, "GET", "/subscriptions/"+sub.ID, "", nil), 404, "not_found")
+	p := new(profile)
+	decode(t, do(t, tok, "GET", "/profile", "", nil), p)
+	if p.Unread != 2 {
+		t.Errorf("Expected the feed's items to be gone, got %d unread.", p.Unread)
+	}
+}
+
+func TestFolders(t *testing.T) {
+	tok, _ := setup(t, "folders@example.com")
+	w := do(t, tok, "PATCH", "/folders/Tech", `{"name":"Tech/Science"}`, nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	checkError(t, do(t, tok, "GET", "/folders/Tech", "", nil), 404, "not_found")
+	w = do(t, tok, "GET", "/folders/"+url.PathEscape("Tech/Science"), "", nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected the renamed folder, got %d: %s", w.Code, w.Body)
+	}
+
+	w = do(t, tok, "DELETE", "/folders/"+url.PathEscape("Tech/Science"), "", nil)
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body)
+	}
+	var list []*subscription
+	decode(t, do(t, tok, "GET", "/subscriptions", "", nil), &list)
+	if len(list) != 1 || list[0].Folder != "" {
+		t.Errorf("Expected the feed to be kept, unfiled, got %+v", list)
+	}
+}
+
+func TestItems(t *testing.T) {
+	tok, _ := setup(t, "items@example.com")
+	page := new(itemPage)
+	decode(t, do(t, tok, "GET", "/items?sort=oldest&limit=1", "", nil), page)
+	if len(page.Items) != 1 || page.Items[0].Title != "First post on tech.xml" || page.Next == "" {
+		t.Fatalf("Expected the first of two pages, got %+v", page)
+	}
+	next := page.Next
+	page = new(itemPage)
+	decode(t, do(t, tok, "GET", "/items?sort=oldest&limit=1&cursor="+next, "", nil), page)
+	if len(page.Items) != 1 || page.Items[0].Title != "Second post on tech.xml" || page.Next != "" {
+		t.Fatalf("Expected the last page, got %+v", page)
+	}
+	id := page.Items[0].ID
+
+	w := do(t, tok, "PATCH", fmt.Sprintf("/items/%d", id), `{"read":true,"starred":true}`, nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	it := new(item)
+	decode(t, w, it)
+	if !it.Read || !it.Starred || it.Folder != "Tech" {
+		t.Errorf("Item not updated: %+v", it)
+	}
+	decode(t, do(t, tok, "GET", "/items?unread=true", "", nil), page)
+	if len(page.Items) != 1 || page.Items[0].Title != "First post on tech.xml" {
+		t.Errorf("Expected only the first post unread, got %+v", page)
+	}
+	decode(t, do(t, tok, "GET", "/items?starred=1&folder=Tech", "", nil), page)
+	if len(page.Items) != 1 || page.Items[0].ID != id {
+		t.Errorf("Expected only the second post starred, got %+v", page)
+	}
+	checkError(t, do(t, tok, "GET", "/items?unread=maybe", "", nil), 400, "bad_request")
+
+	w = do(t, tok, "POST", "/items/read", `{"before":"2013-04-02T00:00:00Z"}`, nil)
+	result := new(readResult)
+	decode(t, w, result)
+	if result.Marked != 1 {
+		t.Errorf("Expected one item marked, got %d.", result.Marked)
+	}
+	p := new(profile)
+	decode(t, do(t, tok, "GET", "/profile", "", nil), p)
+	if p.Unread != 0 {
+		t.Errorf("Expected nothing unread, got %d.", p.Unread)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	tok, _ := setup(t, "search@example.com")
+	page := new(itemPage)
+	decode(t, do(t, tok, "GET", "/search?q=PEARS", "", nil), page)
+	if len(page.Items) != 1 || page.Items[0].Title != "Second post on tech.xml" {
+		t.Errorf("Expected the post about pears, got %+v", page)
+	}
+	decode(t, do(t, tok, "GET", "/search?q=first", "", nil), page)
+	if len(page.Items) != 1 || page.Items[0].Title != "First post on tech.xml" {
+		t.Errorf("Expected the first post, got %+v", page)
+	}
+	// Markup is not searched.
+	decode(t, do(t, tok, "GET", "/search?q=%3Cb%3E", "", nil), page)
+	if len(page.Items) != 0 {
+		t.Errorf("Expected no results, got %+v", page)
+	}
+	checkError(t, do(t, tok, "GET", "/search", "", nil), 400, "bad_request")
+}
+
+func TestETags(t *testing.T) {
+	tok, _ := setup(t, "etags@example.com")
+	w := do(t, tok, "GET", "/profile", "", nil)
+	tag := w.Header().Get("ETag")
+	if tag == "" {
+		t.Fatal("Expected an ETag.")
+	}
+	w = do(t, tok, "GET", "/profile", "", http.Header{"If-None-Match": {tag}})
+	if w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("Expected 304, got %d: %s", w.Code, w.Body)
+	}
+
+	w = do(t, tok, "PATCH", "/profile", `{"nickname":"First"}`, http.Header{"If-Match": {tag}})
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("ETag") == tag {
+		t.Error("Expected a new ETag.")
+	}
+	// The profile has changed since tag was issued.
+	w = do(t, tok, "PATCH", "/profile", `{"nickname":"Second"}`, http.Header{"If-Match": {tag}})
+	checkError(t, w, 412, "precondition_failed")
+	w = do(t, tok, "GET", "/profile", "", http.Header{"If-None-Match": {tag}})
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"nickname":"First"`) {
+		t.Errorf("Expected the changed profile, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestOPML(t *testing.T) {
+	tok, srv := setup(t, "opml@example.com")
+	w := do(t, tok, "GET", "/opml", "", nil)
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/x-opml") {
+		t.Fatalf("Expected OPML, got %d: %s", w.Code, w.Header())
+	}
+	for _, s := range []string{`<outline text="Tech"`, `xmlUrl="` + srv.URL + `/tech.xml"`} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("Expected the export to contain %s, got %s", s, w.Body)
+		}
+	}
+
+	opml := fmt.Sprintf(`<?xml version="1.0"?>
+<opml version="1.0">
+	<head><title>Export</title></head>
+	<body>
+		<outline text="%s/tech.xml" xmlUrl="%s/tech.xml"/>
+		<outline text="Sport">
+			<outline text="Football" type="rss" xmlUrl="%s/football.xml"/>
+			<outline text="Missing" type="rss" xmlUrl="%s/missing.xml"/>
+		</outline>
+	</body>
+</opml>`, srv.URL, srv.URL, srv.URL, srv.URL)
+	w = do(t, tok, "POST", "/opml", opml, nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	result := new(importResult)
+	decode(t, w, result)
+	if len(result.Added) != 1 || result.Added[0].Folder != "Sport" || result.Added[0].Title != "football.xml" {
+		t.Errorf("Expected the football feed to be added, got %+v", result.Added)
+	}
+	if len(result.Existing) != 1 || len(result.Failed) != 1 || result.Failed[0].URL != srv.URL+"/missing.xml" {
+		t.Errorf("Expected one existing feed and one failure, got %+v", result)
+	}
+	checkError(t, do(t, tok, "POST", "/opml", "<opml", nil), 400, "bad_request")
+}
+
+func TestTokens(t *testing.T) {
+	tok, _ := setup(t, "tokens@example.com")
+	checkError(t, do(t, tok, "GET", "/tokens", "", nil), 403, "insufficient_scope")
+
+	uid, _, err := database.ClientUser(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := database.NewToken(uid, "Admin script", database.ScopeAdmin, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A read-only token can look but not touch.
+	w := do(t, admin, "POST", "/tokens", `{"name":"Dashboard","kind":"token","scope":"read"}`, nil)
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+	c := new(credential)
+	decode(t, w, c)
+	if c.Secret == "" || c.Token.Scope != "read" || c.Token.Kind != "token" {
+		t.Fatalf("Wrong credential: %s", w.Body)
+	}
+	if w := do(t, c.Secret, "GET", "/profile", "", nil); w.Code != 200 {
+		t.Errorf("Expected a read-only token to read, got %d: %s", w.Code, w.Body)
+	}
+	checkError(t, do(t, c.Secret, "PATCH", "/profile", `{"nickname":"Nope"}`, nil), 403, "insufficient_scope")
+
+	// App passwords log in with their own scope, however
+	// they are typed.
+	w = do(t, admin, "POST", "/tokens", `{"name":"Phone","kind":"password","scope":"read"}`, nil)
+	p := new(credential)
+	decode(t, w, p)
+	if !regexp.MustCompile(`^[a-z]{4}-[a-z]{4}-[a-z]{4}-[a-z]{4}$`).MatchString(p.Secret) {
+		t.Fatalf("Wrong app password format %q.", p.Secret)
+	}
+	typed := strings.ToUpper(strings.Replace(p.Secret, "-", " ", -1))
+	w = do(t, "", "POST", "/token", fmt.Sprintf(`{"email":"tokens@example.com","password":%q,"name":"Phone"}`, typed), nil)
+	if w.Code != 201 {
+		t.Fatalf("Expected to log in with the app password, got %d: %s", w.Code, w.Body)
+	}
+	phone := new(token)
+	decode(t, w, phone)
+	checkError(t, do(t, phone.Token, "POST", "/items/read", `{}`, nil), 403, "insufficient_scope")
+	checkError(t, do(t, p.Secret, "GET", "/profile", "", nil), 401, "unauthorized")
+
+	var list []*tokenView
+	decode(t, do(t, admin, "GET", "/tokens", "", nil), &list)
+	used := make(map[string]bool)
+	for _, v := range list {
+		used[v.Name] = v.LastUsed != nil
+	}
+	if len(list) != 5 || !used["Dashboard"] || !used["Phone"] || !used["Admin script"] {
+		t.Errorf("Expected five tokens, with last use recorded, got %s", do(t, admin, "GET", "/tokens", "", nil).Body)
+	}
+
+	if w := do(t, admin, "DELETE", "/tokens/"+c.Token.ID, "", nil); w.Code != 204 {
+		t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body)
+	}
+	checkError(t, do(t, c.Secret, "GET", "/profile", "", nil), 401, "unauthorized")
+	checkError(t, do(t, admin, "DELETE", "/tokens/"+c.Token.ID, "", nil), 404, "not_found")
+
+	checkError(t, do(t, admin, "POST", "/tokens", `{"name":"Old","kind":"token","scope":"read","expires":"2013-01-01T00:00:00Z"}`, nil), 400, "bad_request")
+	checkError(t, do(t, admin, "POST", "/tokens", `{"name":"Root","kind":"token","scope":"root"}`, nil), 400, "bad_request")
+	expired, _, err := database.NewToken(uid, "Expired", database.ScopeRead, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkError(t, do(t, expired, "GET", "/profile", "", nil), 401, "unauthorized")
+}
+
+func TestOpenAPI(t *testing.T) {
+	w := do(t, "", "GET", "/openapi.json", "", nil)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var doc struct {
+		Paths      map[string]map[string]map[string]interface{}
+		Components struct {
+			Schemas map[string]interface{}
+		}
+	}
+	decode(t, w, &doc)
+	ids := make(map[string]bool)
+	for _, rt := range routes {
+		op, ok := doc.Paths[rt.Path][strings.ToLower(rt.Method)]
+		if !ok {
+			t.Errorf("%s %s is not described.", rt.Method, rt.Path)
+			continue
+		}
+		if ids[rt.ID] {
+			t.Errorf("Duplicate operation ID %q.", rt.ID)
+		}
+		ids[rt.ID] = true
+		if op["operationId"] != rt.ID {
+			t.Errorf("%s %s: wrong operation ID %v.", rt.Method, rt.Path, op["operationId"])
+		}
+
+		// Every path parameter must be declared.
+		declared := make(map[string]bool)
+		for _, p := range rt.Params {
+			if p.In == "path" {
+				declared[p.Name] = true
+			}
+		}
+		for _, m := range regexp.MustCompile(`{([a-z]+)}`).FindAllStringSubmatch(rt.Path, -1) {
+			if !declared[m[1]] {
+				t.Errorf("%s %s: parameter %s is not declared.", rt.Method, rt.Path, m[1])
+			}
+			delete(declared, m[1])
+		}
+		for name := range declared {
+			t.Errorf("%s %s: parameter %s is not in the path.", rt.Method, rt.Path, name)
+		}
+	}
+
+	// Every reference must resolve.
+	for _, m := range regexp.MustCompile(`"#/components/schemas/([A-Za-z]+)"`).FindAllStringSubmatch(w.Body.String(), -1) {
+		if doc.Components.Schemas[m[1]] == nil {
+			t.Errorf("Schema %s is missing.", m[1])
+		}
+	}
+	if !strings.Contains(w.Body.String(), `"time_zone":{"type":"string"}`) {
+		t.Error("Expected the profile's fields to be described.")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ServeAdmin(w, httptest.NewRequest(method, AdminPrefix+path, nil))
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		database.LoginFailed("admin@example.com", "198.51.100.1")
+	}
+	w := admin("GET", "/lockouts")
+	if w.Code != 200 {
+		t.Fatalf("Expected lockouts, got %d: %s", w.Code, w.Body)
+	}
+	var lockouts []lockout
+	decode(t, w, &lockouts)
+	found := 0
+	for _, l := range lockouts {
+		if (l.Name == "admin@example.com" && l.Account) || (l.Name == "198.51.100.1" && !l.Account) {
+			if l.Failures != 3 {
+				t.Errorf("Expected 3 failures, got %+v", l)
+			}
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("Expected the account and address in %s", w.Body)
+	}
+
+	if w := admin("DELETE", "/lockouts/admin@example.com"); w.Code != 204 {
+		t.Errorf("Expected unlock, got %d: %s", w.Code, w.Body)
+	}
+	checkError(t, admin("DELETE", "/lockouts/admin@example.com"), 404, "not_found")
+	checkError(t, admin("DELETE", "/users/z/two-factor"), 400, "bad_request")
+	checkError(t, admin("DELETE", "/users/AAAA/two-factor"), 404, "not_found")
+	checkError(t, admin("GET", "/profile"), 404, "not_found")
+	checkError(t, admin("POST", "/lockouts"), 405, "method_not_allowed")
+
+	r := httptest.NewRequest("POST", AdminPrefix+"/invites", strings.NewReader(`{"note":"Bob","days":2}`))
+	w = httptest.NewRecorder()
+	ServeAdmin(w, r)
+	if w.Code != 201 {
+		t.Fatalf("Expected an invite, got %d: %s", w.Code, w.Body)
+	}
+	inv := new(invite)
+	decode(t, w, inv)
+	if inv.Code == "" || inv.Note != "Bob" || inv.Expires.Sub(inv.Created) != 48*time.Hour {
+		t.Errorf("Unexpected invite %s", w.Body)
+	}
+	if err := database.CheckInvite(strings.ToUpper(inv.Code)); err != nil {
+		t.Errorf("Expected the invite code to work, got %v", err)
+	}
+	var invites []inviteView
+	decode(t, admin("GET", "/invites"), &invites)
+	if len(invites) != 1 || invites[0].ID != inv.ID {
+		t.Errorf("Expected the invite to be listed, got %+v", invites)
+	}
+	if w := admin("DELETE", "/invites/"+inv.ID); w.Code != 204 {
+		t.Errorf("Expected the invite to be revoked, got %d: %s", w.Code, w.Body)
+	}
+	if err := database.CheckInvite(inv.Code); err == nil {
+		t.Error("Expected the revoked invite code to be refused.")
+	}
+	checkError(t, admin("DELETE", "/invites/"+inv.ID), 404, "not_found")
+}
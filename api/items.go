@@ -0,0 +1,231 @@
+package api
+
+import (
+	"rs3/database"
+	"strconv"
+	"time"
+)
+
+type item struct {
+	ID           int64     `json:"id"`
+	Subscription string    `json:"subscription"` // ID.
+	Feed         string    `json:"feed"`
+	Folder       string    `json:"folder"`
+	Title        string    `json:"title"`
+	URL          string    `json:"url"`
+	Content      string    `json:"content"` // Sanitised HTML.
+	Published    time.Time `json:"published"`
+	Updated      time.Time `json:"updated"`
+	Read         bool      `json:"read"`
+	Starred      bool      `json:"starred"`
+	Tags         []string  `json:"tags"`
+	Sources      []*source `json:"sources"`
+}
+
+// source is one of the feeds through which the item's
+// story reached the user.
+type source struct {
+	Feed string `json:"feed"`
+	URL  string `json:"url"`
+}
+
+type itemPage struct {
+	Items []*item `json:"items"`
+	Next  string  `json:"next,omitempty"` // Cursor for the next page.
+}
+
+// itemEdit holds the fields to change. Omitted fields are
+// left as they are.
+type itemEdit struct {
+	Read    *bool `json:"read"`
+	Starred *bool `json:"starred"`
+}
+
+type markRead struct {
+	Subscription string     `json:"subscription"` // ID.
+	Folder       string     `json:"folder"`
+	Before       *time.Time `json:"before"`
+}
+
+type readResult struct {
+	Marked int `json:"marked"`
+}
+
+func newItem(v *database.ItemView) *item {
+	out := &item{
+		ID:           v.ID,
+		Subscription: feedID(v.FeedURL),
+		Feed:         v.Feed,
+		Folder:       v.Folder,
+		Title:        v.Title,
+		URL:          v.Link,
+		Content:      v.Content,
+		Published:    v.Published,
+		Updated:      v.Updated,
+		Read:         v.Read,
+		Starred:      v.Starred,
+		Tags:         v.Tags,
+		Sources:      make([]*source, len(v.Sources)),
+	}
+	if out.Tags == nil {
+		out.Tags = []string{}
+	}
+	for i, s := range v.Sources {
+		out.Sources[i] = &source{s.Feed, s.Link}
+	}
+	return out
+}
+
+// query builds a database query from the request's query
+// parameters.
+func query(r *request) (*database.Query, error) {
+	form := r.URL.Query()
+	q := &database.Query{
+		Folder: form.Get("folder"),
+		Sort:   form.Get("sort"),
+		Search: form.Get("q"),
+		Cursor: form.Get("cursor"),
+	}
+	if id := form.Get("subscription"); id != "" {
+		f, err := feed(r.uid, id)
+		if err != nil {
+			return nil, err
+		}
+		q.Subscription = f.UpdateURL
+	}
+	for name, v := range map[string]*bool{"unread": &q.Unread, "starred": &q.Starred} {
+		if s := form.Get(name); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, badRequest("Error: invalid %s %q.", name, s)
+			}
+			*v = b
+		}
+	}
+	for name, v := range map[string]*time.Time{"before": &q.Before, "after": &q.After} {
+		if s := form.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, badRequest("Error: invalid %s %q.", name, s)
+			}
+			*v = t
+		}
+	}
+	if s := form.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, badRequest("Error: invalid limit %q.", s)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// page returns the page of items matching q.
+func page(uid []byte, q *database.Query) (*itemPage, error) {
+	p, err := database.Items(uid, q)
+	if err != nil {
+		return nil, err
+	}
+	out := &itemPage{Items: make([]*item, len(p.Items)), Next: p.Next}
+	for i, v := range p.Items {
+		out.Items[i] = newItem(v)
+	}
+	return out, nil
+}
+
+func listItems(r *request) (interface{}, error) {
+	q, err := query(r)
+	if err != nil {
+		return nil, err
+	}
+	return page(r.uid, q)
+}
+
+func searchItems(r *request) (interface{}, error) {
+	q, err := query(r)
+	if err != nil {
+		return nil, err
+	}
+	if q.Search == "" {
+		return nil, badRequest("Error: no search text given.")
+	}
+	return page(r.uid, q)
+}
+
+// find returns the item with the ID in the request's path.
+func find(r *request) (*database.ItemView, error) {
+	id, err := strconv.ParseInt(r.vars["id"], 10, 64)
+	if err != nil {
+		return nil, new(database.ItemDoesNotExist)
+	}
+	p, err := database.Items(r.uid, &database.Query{IDs: []int64{id}})
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Items) == 0 {
+		return nil, new(database.ItemDoesNotExist)
+	}
+	return p.Items[0], nil
+}
+
+func getItem(r *request) (interface{}, error) {
+	v, err := find(r)
+	if err != nil {
+		return nil, err
+	}
+	return newItem(v), nil
+}
+
+func editItem(r *request) (interface{}, error) {
+	v, err := find(r)
+	if err != nil {
+		return nil, err
+	}
+	edit := new(itemEdit)
+	err = r.decode(edit)
+	if err != nil {
+		return nil, err
+	}
+	if edit.Read != nil {
+		if *edit.Read {
+			err = database.MarkRead(r.uid, v.Key)
+		} else {
+			err = database.MarkUnread(r.uid, v.Key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if edit.Starred != nil {
+		err = database.SetStarred(r.uid, v.Key, *edit.Starred)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return getItem(r)
+}
+
+func markAllRead(r *request) (interface{}, error) {
+	req := new(markRead)
+	err := r.decode(req)
+	if err != nil {
+		return nil, err
+	}
+	q := &database.Query{Folder: req.Folder}
+	if req.Subscription != "" {
+		f, err := feed(r.uid, req.Subscription)
+		if err != nil {
+			return nil, err
+		}
+		q.Subscription = f.UpdateURL
+	}
+	if req.Before != nil {
+		q.Before = *req.Before
+	}
+	_, n, err := database.MarkAllRead(r.uid, q)
+	if err != nil {
+		return nil, err
+	}
+	return &readResult{n}, nil
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// The OpenAPI document is built from the routes on first
+// use, so that it always matches the handlers.
+var (
+	spec     map[string]interface{}
+	specOnce sync.Once
+)
+
+func getOpenAPI(r *request) (interface{}, error) {
+	specOnce.Do(func() {
+		spec = openAPI()
+	})
+	return spec, nil
+}
+
+// object is a JSON object in the OpenAPI document.
+type object map[string]interface{}
+
+// openAPI describes the routes as an OpenAPI 3 document.
+func openAPI() map[string]interface{} {
+	g := &generator{object{}}
+	paths := object{}
+	for _, rt := range routes {
+		item, ok := paths[rt.Path].(object)
+		if !ok {
+			item = object{}
+			paths[rt.Path] = item
+		}
+		item[strings.ToLower(rt.Method)] = g.operation(rt)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "RS3",
+			"version":     "1",
+			"description": "Scripting access to the user's feeds, folders and items.",
+		},
+		"servers":  []object{{"url": Prefix}},
+		"paths":    paths,
+		"security": []object{{"token": []string{}}},
+		"components": object{
+			"schemas": g.schemas,
+			"securitySchemes": object{
+				"token": object{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// generator builds schemas for Go types, collecting those
+// of structs to be referred to by name.
+type generator struct {
+	schemas object
+}
+
+func (g *generator) operation(rt *route) object {
+	op := object{
+		"operationId": rt.ID,
+		"summary":     rt.Summary,
+	}
+	if rt.Public {
+		op["security"] = []object{}
+	} else {
+		op["description"] = "Needs a token with " + rt.scope() + " access."
+	}
+	if len(rt.Params) > 0 {
+		params := make([]object, len(rt.Params))
+		for i, p := range rt.Params {
+			schema := object{"type": p.Type}
+			if p.Format != "" {
+				schema["format"] = p.Format
+			}
+			params[i] = object{
+				"name":        p.Name,
+				"in":          p.In,
+				"description": p.Description,
+				"required":    p.Required,
+				"schema":      schema,
+			}
+		}
+		op["parameters"] = params
+	}
+	if rt.Body != nil {
+		op["requestBody"] = object{"required": true, "content": g.content(rt.Body)}
+	}
+
+	status := rt.Status
+	if status == 0 {
+		status = 200
+	}
+	success := object{"description": http.StatusText(status)}
+	if rt.Result != nil {
+		success["content"] = g.content(rt.Result)
+	}
+	responses := object{
+		strconv.Itoa(status): success,
+		"default": object{
+			"description": "An error.",
+			"content":     g.content(errorBody{}),
+		},
+	}
+	if rt.Method == "GET" {
+		responses["304"] = object{"description": "The resource matches If-None-Match."}
+	}
+	if rt.Method != "GET" && get(rt.Path) != nil {
+		responses["412"] = object{
+			"description": "The resource does not match If-Match.",
+			"content":     g.content(errorBody{}),
+		}
+	}
+	op["responses"] = responses
+	return op
+}
+
+// content describes a request or response body.
+func (g *generator) content(v interface{}) object {
+	if doc, ok := v.(*document); ok {
+		return object{doc.Type: object{"schema": object{"type": "string"}}}
+	}
+	return object{"application/json": object{"schema": g.schema(reflect.TypeOf(v))}}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema describes a Go type as JSON encodes it.
+func (g *generator) schema(t reflect.Type) object {
+	if t == timeType {
+		return object{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return object{"type": "integer"}
+	case reflect.Int64:
+		return object{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return object{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := g.schemas[name]; !ok {
+			// Record the name first, in case the type
+			// refers to itself.
+			g.schemas[name] = nil
+			g.schemas[name] = g.object(t)
+		}
+		return object{"$ref": "#/components/schemas/" + name}
+	}
+	return object{}
+}
+
+// object describes a struct's exported fields.
+func (g *generator) object(t reflect.Type) object {
+	props := object{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+	}
+	return object{"type": "object", "properties": props}
+}
+
+// schemaName names a struct's schema after its type, in
+// upper camel case.
+func schemaName(t reflect.Type) string {
+	r := []rune(t.Name())
+	if len(r) == 0 {
+		return "Object"
+	}
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
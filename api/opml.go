@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"rs3/database"
+)
+
+// opmlType is the content type of OPML files.
+const opmlType = "text/x-opml; charset=utf-8"
+
+type opml struct {
+	XMLName  xml.Name   `xml:"opml"`
+	Version  string     `xml:"version,attr"`
+	Title    string     `xml:"head>title"`
+	Outlines []*outline `xml:"body>outline"`
+}
+
+// outline is either a feed, or a folder of feeds.
+type outline struct {
+	Text     string     `xml:"text,attr"`
+	Title    string     `xml:"title,attr,omitempty"`
+	Type     string     `xml:"type,attr,omitempty"`
+	XMLURL   string     `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string     `xml:"htmlUrl,attr,omitempty"`
+	Outlines []*outline `xml:"outline"`
+}
+
+func exportOPML(r *request) (interface{}, error) {
+	feeds, err := database.Feeds(r.uid)
+	if err != nil {
+		return nil, err
+	}
+	doc := &opml{Version: "2.0", Title: "RS3 subscriptions"}
+	folders := make(map[string]*outline)
+	for _, f := range feeds {
+		o := &outline{f.Title, f.Title, "rss", f.UpdateURL, f.Link, nil}
+		name := database.Folder(r.uid, f)
+		if name == "" {
+			doc.Outlines = append(doc.Outlines, o)
+			continue
+		}
+		folder, ok := folders[name]
+		if !ok {
+			folder = &outline{Text: name, Title: name}
+			folders[name] = folder
+			doc.Outlines = append(doc.Outlines, folder)
+		}
+		folder.Outlines = append(folder.Outlines, o)
+	}
+	b, err := xml.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, internal(err)
+	}
+	return &document{opmlType, append([]byte(xml.Header), b...)}, nil
+}
+
+// failure is a feed which could not be imported.
+type failure struct {
+	URL     string `json:"url"`
+	Message string `json:"message"`
+}
+
+type importResult struct {
+	Added    []*subscription `json:"added"`
+	Existing []string        `json:"existing"` // URLs.
+	Failed   []*failure      `json:"failed"`
+}
+
+func importOPML(r *request) (interface{}, error) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(r.w, r.Body, MaxBody))
+	if err != nil {
+		return nil, badRequest("Error: could not read the OPML file.")
+	}
+	doc := new(opml)
+	err = xml.Unmarshal(b, doc)
+	if err != nil {
+		return nil, badRequest("Error: invalid OPML: %s.", err)
+	}
+
+	result := &importResult{[]*subscription{}, []string{}, []*failure{}}
+	var walk func(outlines []*outline, folder string) error
+	walk = func(outlines []*outline, folder string) error {
+		for _, o := range outlines {
+			if o.XMLURL == "" {
+				err := walk(o.Outlines, o.Text)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			f, err := database.Subscribe(r.uid, o.XMLURL)
+			switch err.(type) {
+			case nil:
+			case *database.FeedAlreadyExists:
+				result.Existing = append(result.Existing, o.XMLURL)
+				continue
+			case *database.UserDoesNotExist:
+				return err
+			default:
+				result.Failed = append(result.Failed, &failure{o.XMLURL, err.Error()})
+				continue
+			}
+			if folder != "" {
+				err = database.SetFolder(r.uid, f.UpdateURL, folder)
+				if err != nil {
+					return err
+				}
+			}
+			counts, err := database.UnreadCounts(r.uid)
+			if err != nil {
+				return err
+			}
+			sub, err := view(r.uid, f, counts)
+			if err != nil {
+				return err
+			}
+			result.Added = append(result.Added, sub)
+		}
+		return nil
+	}
+	err = walk(doc.Outlines, "")
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"rs3/auth"
+	"rs3/database"
+	"strconv"
+	"time"
+)
+
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"` // The user's, or an app password.
+	Name     string `json:"name"`     // Of the script, for the user's list of tokens.
+}
+
+type token struct {
+	Token string `json:"token"`
+}
+
+func createToken(r *request) (interface{}, error) {
+	creds := new(credentials)
+	err := r.decode(creds)
+	if err != nil {
+		return nil, err
+	}
+	uid, scope, err := auth.ClientLogin(creds.Email, creds.Password, auth.ClientIP(r.Request))
+	if t, ok := err.(*database.LoginThrottled); ok {
+		r.w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(t.Until).Seconds())+1))
+		return nil, &Error{429, "too_many_requests", "Error: too many failed logins; try again later."}
+	}
+	if err != nil {
+		return nil, &Error{401, "unauthorized", "Error: incorrect email or password."}
+	}
+	if creds.Name == "" {
+		creds.Name = "API client"
+	}
+	t, err := database.NewClientToken(uid, creds.Name, scope)
+	if err != nil {
+		return nil, internal(err)
+	}
+	return &token{t}, nil
+}
+
+type profile struct {
+	ID       string `json:"id"`
+	Nickname string `json:"nickname"`
+	TimeZone string `json:"time_zone"`
+	Sort     string `json:"sort"`
+	Unread   int    `json:"unread"`
+}
+
+// profileEdit holds the fields to change. Omitted fields
+// are left as they are.
+type profileEdit struct {
+	Nickname *string `json:"nickname"`
+	TimeZone *string `json:"time_zone"`
+	Sort     *string `json:"sort"`
+}
+
+func getProfile(r *request) (interface{}, error) {
+	nick, err := database.ClientNickname(r.uid)
+	if err != nil {
+		return nil, err
+	}
+	zone, order, err := database.Preferences(r.uid)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := database.UnreadCounts(r.uid)
+	if err != nil {
+		return nil, err
+	}
+	return &profile{database.UidToString(r.uid), nick, zone, order, counts.Unread}, nil
+}
+
+func editProfile(r *request) (interface{}, error) {
+	edit := new(profileEdit)
+	err := r.decode(edit)
+	if err != nil {
+		return nil, err
+	}
+	// Check everything before changing anything. SetSort
+	// checks the order itself, so it goes first.
+	if edit.Nickname != nil && *edit.Nickname == "" {
+		return nil, badRequest("Error: nickname cannot be empty.")
+	}
+	if edit.TimeZone != nil {
+		_, err = time.LoadLocation(*edit.TimeZone)
+		if err != nil {
+			return nil, badRequest("Error: unknown time zone %q.", *edit.TimeZone)
+		}
+	}
+	if edit.Sort != nil {
+		err = database.SetSort(r.uid, "", *edit.Sort)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if edit.TimeZone != nil {
+		err = database.SetTimeZone(r.uid, *edit.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if edit.Nickname != nil {
+		err = database.SetNickname(r.uid, *edit.Nickname)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return getProfile(r)
+}
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"rs3/database"
+)
+
+// route describes an endpoint, both for dispatching
+// requests and for the OpenAPI document.
+type route struct {
+	Method  string
+	Path    string // Relative to Prefix, with parameters in braces.
+	ID      string // Unique name of the operation.
+	Summary string
+	Public  bool     // Needs no token.
+	Scope   string   // Needed by the token, if not the default.
+	Params  []*param // Path and query parameters.
+	Body    interface{}
+	Result  interface{}
+	Status  int // Of success, if not 200.
+	handle  func(*request) (interface{}, error)
+}
+
+// scope returns the scope a token needs to use the route:
+// read access for GET requests, and write access for
+// others, unless the route says otherwise.
+func (rt *route) scope() string {
+	switch {
+	case rt.Scope != "":
+		return rt.Scope
+	case rt.Method == "GET":
+		return database.ScopeRead
+	}
+	return database.ScopeWrite
+}
+
+// param describes a path or query parameter.
+type param struct {
+	Name        string
+	In          string // "path" or "query".
+	Type        string // A JSON schema type.
+	Format      string
+	Description string
+	Required    bool
+}
+
+var subscriptionID = &param{"id", "path", "string", "", "The subscription's ID.", true}
+var folderName = &param{"name", "path", "string", "", "The folder's name.", true}
+var tokenID = &param{"id", "path", "string", "", "The token's ID.", true}
+var itemID = &param{"id", "path", "integer", "int64", "The item's ID.", true}
+
+// itemParams are the query parameters which select items.
+var itemParams = []*param{
+	{"subscription", "query", "string", "", "Only items from the subscription with this ID.", false},
+	{"folder", "query", "string", "", "Only items from subscriptions in this folder.", false},
+	{"unread", "query", "boolean", "", "Only unread items.", false},
+	{"starred", "query", "boolean", "", "Only starred items.", false},
+	{"before", "query", "string", "date-time", "Only items published before this time.", false},
+	{"after", "query", "string", "date-time", "Only items published after this time.", false},
+	{"sort", "query", "string", "", "One of feed, newest, oldest or arrival. Defaults to the user's preference.", false},
+	{"cursor", "query", "string", "", "The next value from the previous page.", false},
+	{"limit", "query", "integer", "", "The number of items per page, at most 200.", false},
+}
+
+// search is the query parameter which searches items.
+var search = &param{"q", "query", "string", "", "Text which the item's title or content must contain.", false}
+
+var routes []*route
+
+func init() {
+	routes = []*route{
+		{
+			Method:  "POST",
+			Path:    "/token",
+			ID:      "createToken",
+			Summary: "Exchange the user's email and password, or an app password, for a token.",
+			Public:  true,
+			Body:    credentials{},
+			Result:  token{},
+			Status:  201,
+			handle:  createToken,
+		},
+		{
+			Method:  "GET",
+			Path:    "/openapi.json",
+			ID:      "getOpenAPI",
+			Summary: "Describe the API.",
+			Public:  true,
+			Result:  map[string]interface{}{},
+			handle:  getOpenAPI,
+		},
+		{
+			Method:  "GET",
+			Path:    "/profile",
+			ID:      "getProfile",
+			Summary: "Get the user's profile and preferences.",
+			Result:  profile{},
+			handle:  getProfile,
+		},
+		{
+			Method:  "PATCH",
+			Path:    "/profile",
+			ID:      "editProfile",
+			Summary: "Change the user's nickname or preferences.",
+			Body:    profileEdit{},
+			Result:  profile{},
+			handle:  editProfile,
+		},
+		{
+			Method:  "GET",
+			Path:    "/tokens",
+			ID:      "listTokens",
+			Summary: "List the user's tokens and app passwords.",
+			Scope:   database.ScopeAdmin,
+			Result:  []tokenView{},
+			handle:  listTokens,
+		},
+		{
+			Method:  "POST",
+			Path:    "/tokens",
+			ID:      "createCredential",
+			Summary: "Create a personal API token or an app password. Its secret is only shown once.",
+			Scope:   database.ScopeAdmin,
+			Body:    newCredential{},
+			Result:  credential{},
+			Status:  201,
+			handle:  createCredential,
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/tokens/{id}",
+			ID:      "revokeToken",
+			Summary: "Revoke a token or app password.",
+			Scope:   database.ScopeAdmin,
+			Params:  []*param{tokenID},
+			Status:  204,
+			handle:  revokeToken,
+		},
+		{
+			Method:  "GET",
+			Path:    "/subscriptions",
+			ID:      "listSubscriptions",
+			Summary: "List the user's subscriptions.",
+			Result:  []subscription{},
+			handle:  listSubscriptions,
+		},
+		{
+			Method:  "POST",
+			Path:    "/subscriptions",
+			ID:      "createSubscription",
+			Summary: "Subscribe to a feed.",
+			Body:    newSubscription{},
+			Result:  subscription{},
+			Status:  201,
+			handle:  createSubscription,
+		},
+		{
+			Method:  "GET",
+			Path:    "/subscriptions/{id}",
+			ID:      "getSubscription",
+			Summary: "Get a subscription.",
+			Params:  []*param{subscriptionID},
+			Result:  subscription{},
+			handle:  getSubscription,
+		},
+		{
+			Method:  "PATCH",
+			Path:    "/subscriptions/{id}",
+			ID:      "editSubscription",
+			Summary: "Change a subscription's folder or settings.",
+			Params:  []*param{subscriptionID},
+			Body:    subscriptionEdit{},
+			Result:  subscription{},
+			handle:  editSubscription,
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/subscriptions/{id}",
+			ID:      "deleteSubscription",
+			Summary: "Unsubscribe from a feed, forgetting its items.",
+			Params:  []*param{subscriptionID},
+			Status:  204,
+			handle:  deleteSubscription,
+		},
+		{
+			Method:  "GET",
+			Path:    "/folders",
+			ID:      "listFolders",
+			Summary: "List the user's folders.",
+			Result:  []folder{},
+			handle:  listFolders,
+		},
+		{
+			Method:  "GET",
+			Path:    "/folders/{name}",
+			ID:      "getFolder",
+			Summary: "Get a folder.",
+			Params:  []*param{folderName},
+			Result:  folder{},
+			handle:  getFolder,
+		},
+		{
+			Method:  "PATCH",
+			Path:    "/folders/{name}",
+			ID:      "renameFolder",
+			Summary: "Rename a folder, merging it with any folder which has the new name.",
+			Params:  []*param{folderName},
+			Body:    folderEdit{},
+			Result:  folder{},
+			handle:  renameFolder,
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/folders/{name}",
+			ID:      "deleteFolder",
+			Summary: "Delete a folder, keeping its subscriptions.",
+			Params:  []*param{folderName},
+			Status:  204,
+			handle:  deleteFolder,
+		},
+		{
+			Method:  "GET",
+			Path:    "/items",
+			ID:      "listItems",
+			Summary: "List a page of items.",
+			Params:  append(itemParams, search),
+			Result:  itemPage{},
+			handle:  listItems,
+		},
+		{
+			Method:  "GET",
+			Path:    "/items/{id}",
+			ID:      "getItem",
+			Summary: "Get an item.",
+			Params:  []*param{itemID},
+			Result:  item{},
+			handle:  getItem,
+		},
+		{
+			Method:  "PATCH",
+			Path:    "/items/{id}",
+			ID:      "editItem",
+			Summary: "Mark an item as read or unread, or star or unstar it.",
+			Params:  []*param{itemID},
+			Body:    itemEdit{},
+			Result:  item{},
+			handle:  editItem,
+		},
+		{
+			Method:  "POST",
+			Path:    "/items/read",
+			ID:      "markRead",
+			Summary: "Mark all items, or those in a subscription or folder, as read.",
+			Body:    markRead{},
+			Result:  readResult{},
+			handle:  markAllRead,
+		},
+		{
+			Method:  "GET",
+			Path:    "/search",
+			ID:      "search",
+			Summary: "Search the user's items.",
+			Params:  append([]*param{{"q", "query", "string", "", search.Description, true}}, itemParams...),
+			Result:  itemPage{},
+			handle:  searchItems,
+		},
+		{
+			Method:  "GET",
+			Path:    "/opml",
+			ID:      "exportOPML",
+			Summary: "Export the user's subscriptions as OPML.",
+			Result:  &document{Type: opmlType},
+			handle:  exportOPML,
+		},
+		{
+			Method:  "POST",
+			Path:    "/opml",
+			ID:      "importOPML",
+			Summary: "Subscribe to the feeds in an OPML file, filing them in its folders.",
+			Body:    &document{Type: opmlType},
+			Result:  importResult{},
+			handle:  importOPML,
+		},
+	}
+}
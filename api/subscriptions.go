@@ -0,0 +1,295 @@
+package api
+
+import (
+	"encoding/base64"
+	"github.com/SlyMarbo/rss"
+	"net/url"
+	"rs3/database"
+)
+
+type subscription struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Title   string `json:"title"`
+	SiteURL string `json:"site_url"`
+	Folder  string `json:"folder"`
+	Sort    string `json:"sort"`
+	Privacy bool   `json:"privacy"`
+	Extract bool   `json:"extract"`
+	Unread  int    `json:"unread"`
+}
+
+type newSubscription struct {
+	URL    string `json:"url"`
+	Folder string `json:"folder"`
+}
+
+// subscriptionEdit holds the fields to change. Omitted
+// fields are left as they are.
+type subscriptionEdit struct {
+	Folder  *string `json:"folder"`
+	Sort    *string `json:"sort"`
+	Privacy *bool   `json:"privacy"`
+	Extract *bool   `json:"extract"`
+}
+
+// feedID returns the ID of the feed with the given URL:
+// the URL in unpadded base64url, so that it fits in a path.
+func feedID(url string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(url))
+}
+
+// feed returns the user's feed with the given ID.
+func feed(uid []byte, id string) (*rss.Feed, error) {
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, new(database.FeedDoesNotExist)
+	}
+	feeds, err := database.Feeds(uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range feeds {
+		if f.UpdateURL == string(b) {
+			return f, nil
+		}
+	}
+	return nil, new(database.FeedDoesNotExist)
+}
+
+// view returns the subscription to the feed.
+func view(uid []byte, feed *rss.Feed, counts *database.Counts) (*subscription, error) {
+	sub, err := database.Settings(uid, feed.UpdateURL)
+	if err != nil {
+		return nil, err
+	}
+	return &subscription{
+		ID:      feedID(feed.UpdateURL),
+		URL:     feed.UpdateURL,
+		Title:   feed.Title,
+		SiteURL: feed.Link,
+		Folder:  sub.Folder,
+		Sort:    sub.Sort,
+		Privacy: !sub.NoPrivacy,
+		Extract: sub.Extract,
+		Unread:  counts.Feeds[feed.UpdateURL],
+	}, nil
+}
+
+func listSubscriptions(r *request) (interface{}, error) {
+	feeds, err := database.Feeds(r.uid)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := database.UnreadCounts(r.uid)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*subscription, 0, len(feeds))
+	for _, f := range feeds {
+		sub, err := view(r.uid, f, counts)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sub)
+	}
+	return out, nil
+}
+
+func getSubscription(r *request) (interface{}, error) {
+	f, err := feed(r.uid, r.vars["id"])
+	if err != nil {
+		return nil, err
+	}
+	counts, err := database.UnreadCounts(r.uid)
+	if err != nil {
+		return nil, err
+	}
+	return view(r.uid, f, counts)
+}
+
+func createSubscription(r *request) (interface{}, error) {
+	req := new(newSubscription)
+	err := r.decode(req)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, badRequest("Error: invalid feed URL %q.", req.URL)
+	}
+
+	f, err := database.Subscribe(r.uid, u.String())
+	switch err.(type) {
+	case nil:
+	case *database.FeedAlreadyExists, *database.UserDoesNotExist:
+		return nil, err
+	default:
+		return nil, badRequest("Error: could not fetch %q: %s", req.URL, err)
+	}
+	if req.Folder != "" {
+		err = database.SetFolder(r.uid, f.UpdateURL, req.Folder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.w.Header().Set("Location", Prefix+"/subscriptions/"+feedID(f.UpdateURL))
+	counts, err := database.UnreadCounts(r.uid)
+	if err != nil {
+		return nil, err
+	}
+	return view(r.uid, f, counts)
+}
+
+func editSubscription(r *request) (interface{}, error) {
+	f, err := feed(r.uid, r.vars["id"])
+	if err != nil {
+		return nil, err
+	}
+	edit := new(subscriptionEdit)
+	err = r.decode(edit)
+	if err != nil {
+		return nil, err
+	}
+
+	// SetSort checks the order, so it goes first, leaving
+	// the subscription unchanged if the order is unknown.
+	if edit.Sort != nil {
+		err = database.SetSort(r.uid, f.UpdateURL, *edit.Sort)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if edit.Folder != nil {
+		err = database.SetFolder(r.uid, f.UpdateURL, *edit.Folder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if edit.Privacy != nil {
+		err = database.SetPrivacy(r.uid, f.UpdateURL, *edit.Privacy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if edit.Extract != nil {
+		err = database.SetExtraction(r.uid, f.UpdateURL, *edit.Extract)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return getSubscription(r)
+}
+
+func deleteSubscription(r *request) (interface{}, error) {
+	f, err := feed(r.uid, r.vars["id"])
+	if err != nil {
+		return nil, err
+	}
+	return nil, database.Unsubscribe(r.uid, f.UpdateURL)
+}
+
+type folder struct {
+	Name          string   `json:"name"`
+	Subscriptions []string `json:"subscriptions"` // IDs.
+	Unread        int      `json:"unread"`
+}
+
+type folderEdit struct {
+	Name string `json:"name"`
+}
+
+// folders returns the user's folders, in the order of
+// their first feeds.
+func folders(uid []byte) ([]*folder, error) {
+	feeds, err := database.Feeds(uid)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := database.UnreadCounts(uid)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*folder, 0, 5)
+	index := make(map[string]*folder)
+	for _, f := range feeds {
+		name := database.Folder(uid, f)
+		if name == "" {
+			continue
+		}
+		v, ok := index[name]
+		if !ok {
+			v = &folder{Name: name, Subscriptions: make([]string, 0, 1)}
+			index[name] = v
+			out = append(out, v)
+		}
+		v.Subscriptions = append(v.Subscriptions, feedID(f.UpdateURL))
+		v.Unread += counts.Feeds[f.UpdateURL]
+	}
+	return out, nil
+}
+
+// findFolder returns the user's folder with the given name.
+func findFolder(uid []byte, name string) (*folder, error) {
+	list, err := folders(uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range list {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	return nil, notFound("Error: no folder %q.", name)
+}
+
+func listFolders(r *request) (interface{}, error) {
+	return folders(r.uid)
+}
+
+func getFolder(r *request) (interface{}, error) {
+	return findFolder(r.uid, r.vars["name"])
+}
+
+func renameFolder(r *request) (interface{}, error) {
+	v, err := findFolder(r.uid, r.vars["name"])
+	if err != nil {
+		return nil, err
+	}
+	edit := new(folderEdit)
+	err = r.decode(edit)
+	if err != nil {
+		return nil, err
+	}
+	if edit.Name == "" {
+		return nil, badRequest("Error: folder name cannot be empty.")
+	}
+	err = refile(r.uid, v, edit.Name)
+	if err != nil {
+		return nil, err
+	}
+	return findFolder(r.uid, edit.Name)
+}
+
+func deleteFolder(r *request) (interface{}, error) {
+	v, err := findFolder(r.uid, r.vars["name"])
+	if err != nil {
+		return nil, err
+	}
+	return nil, refile(r.uid, v, "")
+}
+
+// refile moves the folder's feeds into the named folder.
+func refile(uid []byte, v *folder, name string) error {
+	for _, id := range v.Subscriptions {
+		f, err := feed(uid, id)
+		if err != nil {
+			return err
+		}
+		err = database.SetFolder(uid, f.UpdateURL, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
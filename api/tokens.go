@@ -0,0 +1,88 @@
+package api
+
+import (
+	"rs3/database"
+	"time"
+)
+
+type tokenView struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Kind     string     `json:"kind"` // client, token, password or oauth.
+	Scope    string     `json:"scope"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires"`
+	LastUsed *time.Time `json:"last_used"`
+}
+
+type newCredential struct {
+	Name    string     `json:"name"`
+	Kind    string     `json:"kind"`  // token or password.
+	Scope   string     `json:"scope"` // read, write or admin.
+	Expires *time.Time `json:"expires"`
+}
+
+// credential is a new token or app password, with its
+// secret.
+type credential struct {
+	Token  *tokenView `json:"token"`
+	Secret string     `json:"secret"`
+}
+
+func newTokenView(t *database.Token) *tokenView {
+	v := &tokenView{t.ID, t.Name, t.Kind, t.Scope, t.Created, nil, nil}
+	if !t.Expires.IsZero() {
+		v.Expires = &t.Expires
+	}
+	if !t.LastUsed.IsZero() {
+		v.LastUsed = &t.LastUsed
+	}
+	return v
+}
+
+func listTokens(r *request) (interface{}, error) {
+	list, err := database.Tokens(r.uid)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*tokenView, len(list))
+	for i, t := range list {
+		out[i] = newTokenView(t)
+	}
+	return out, nil
+}
+
+func createCredential(r *request) (interface{}, error) {
+	req := new(newCredential)
+	err := r.decode(req)
+	if err != nil {
+		return nil, err
+	}
+	var expires time.Time
+	if req.Expires != nil {
+		if req.Expires.Before(time.Now()) {
+			return nil, badRequest("Error: expiry is in the past.")
+		}
+		expires = *req.Expires
+	}
+
+	var secret string
+	var t *database.Token
+	switch req.Kind {
+	case database.KindToken:
+		secret, t, err = database.NewToken(r.uid, req.Name, req.Scope, expires)
+	case database.KindPassword:
+		secret, t, err = database.NewAppPassword(r.uid, req.Name, req.Scope, expires)
+	default:
+		return nil, badRequest("Error: kind must be token or password.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.w.Header().Set("Location", Prefix+"/tokens/"+t.ID)
+	return &credential{newTokenView(t), secret}, nil
+}
+
+func revokeToken(r *request) (interface{}, error) {
+	return nil, database.RevokeToken(r.uid, r.vars["id"])
+}
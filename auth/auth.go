@@ -0,0 +1,363 @@
+// Package auth checks who users are, with RS3's own
+// accounts or with other sources of them: an htpasswd file,
+// an LDAP directory, or a reverse proxy which has already
+// authenticated them.
+//
+// The sources are Authenticators, which are tried in the
+// order given in the configuration file. Users who log in
+// through one other than the database are given an RS3
+// account the first time. They are only linked to an
+// existing account with their email address if it has no
+// password, or if the administrator trusts the backend to
+// say which addresses its users own.
+//
+// Scripts and administrators' tools may instead present
+// client certificates, which Certificates maps to users
+// and to the admin role.
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"rs3/database"
+	sec "rs3/security"
+	"strings"
+)
+
+// Account is a user an Authenticator has vouched for.
+type Account struct {
+	Backend  string // Name of the Authenticator.
+	Username string // As known to the Authenticator.
+	Email    string
+	Name     string
+	Uid      []byte // The RS3 user, if the Authenticator knows it.
+	Link     bool   // Whether it may be linked to an existing account by email address.
+}
+
+// Authenticator checks usernames and passwords. It returns
+// a *database.AuthenticationError if they are wrong, and
+// other errors if it could not tell.
+type Authenticator interface {
+	Authenticate(username, password string) (*Account, error)
+}
+
+// RequestAuthenticator finds who made a request without
+// asking them, such as from headers set by a trusted proxy.
+// It returns a nil Account if it cannot tell.
+type RequestAuthenticator interface {
+	AuthenticateRequest(r *http.Request) (*Account, error)
+}
+
+// Chain is a list of Authenticators, which are tried in
+// turn. Members may also be RequestAuthenticators.
+type Chain []interface{}
+
+// Default is the chain used for logins. Unless configured
+// otherwise, it uses only RS3's own accounts.
+var Default = Chain{Database{}}
+
+// Authenticate returns the account of the first member of
+// the chain to accept the username and password. If none
+// does, but one could not tell, such as because its server
+// is down, its error is returned, rather than saying the
+// password is wrong.
+func (c Chain) Authenticate(username, password string) (*Account, error) {
+	var failed error
+	for _, a := range c {
+		a, ok := a.(Authenticator)
+		if !ok {
+			continue
+		}
+		account, err := a.Authenticate(username, password)
+		if err == nil {
+			return account, nil
+		}
+		if _, ok := err.(*database.AuthenticationError); !ok && failed == nil {
+			failed = err
+		}
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	return nil, new(database.AuthenticationError)
+}
+
+// AuthenticateRequest returns the account of the first
+// member of the chain to recognise who made the request, or
+// nil if none does.
+func (c Chain) AuthenticateRequest(r *http.Request) (*Account, error) {
+	for _, a := range c {
+		a, ok := a.(RequestAuthenticator)
+		if !ok {
+			continue
+		}
+		account, err := a.AuthenticateRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		if account != nil {
+			return account, nil
+		}
+	}
+	return nil, nil
+}
+
+// LinkRefused is the error given when a backend's user has
+// the email address of an existing account, which they may
+// not be linked to.
+type LinkRefused struct {
+	Backend string
+	Email   string
+}
+
+func (err *LinkRefused) Error() string {
+	return fmt.Sprintf("Error: %s user may not be linked to the existing account %q.", err.Backend, err.Email)
+}
+
+// Provision returns the uid of the RS3 user for the
+// account. Accounts from other backends are given a new
+// RS3 user the first time.
+//
+// Like single sign-on providers, backends may not own the
+// email addresses they give, which users can often edit,
+// such as LDAP's mail attribute. So an account is linked to
+// the existing RS3 user with its email address only if that
+// user has no password, or the backend is configured with
+// Link. Otherwise, a *LinkRefused error is returned.
+func Provision(a *Account) ([]byte, error) {
+	if a.Uid != nil {
+		return a.Uid, nil
+	}
+	uid, err := database.IdentityUser(a.Backend, a.Username)
+	if err == nil {
+		return uid, nil
+	}
+	if _, ok := err.(*database.IdentityDoesNotExist); !ok {
+		return nil, err
+	}
+
+	email := database.NormaliseEmail(a.Email)
+	if email == "" {
+		return nil, fmt.Errorf("Error: %s gave no email address for %q.", a.Backend, a.Username)
+	}
+	if existing, salt := database.Account(email); salt != nil {
+		uid, err := sec.Hash(existing, salt)
+		if err != nil {
+			return nil, err
+		}
+		if !a.Link {
+			password, err := database.HasPassword(uid)
+			if err != nil {
+				return nil, err
+			}
+			if password {
+				return nil, &LinkRefused{a.Backend, email}
+			}
+		}
+		err = database.LinkIdentity(uid, a.Backend, a.Username, email)
+		if err != nil {
+			return nil, err
+		}
+		return uid, nil
+	}
+	uid, err = database.CreateIdentityUser(email, a.Name, a.Backend, a.Username)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Created user %q for %s.\n", email, a.Backend)
+	return uid, nil
+}
+
+// ClientLogin checks the username and password with which
+// an app or script logs in, returning the RS3 user and the
+// scope the app is allowed. The password may be one of the
+// user's app passwords, with its scope, or one which a
+// backend accepts, with database.ScopeWrite.
+//
+// Apps cannot ask for TOTP codes, so users with two-factor
+// authentication must use app passwords.
+//
+// Logins are throttled like those from the login page, by
+// account and by the IP address they come from. If they
+// must wait, a *database.LoginThrottled error is returned.
+func ClientLogin(username, password, ip string) ([]byte, string, error) {
+	username = database.NormaliseEmail(username)
+	attempt, err := database.BeginLogin(username, ip)
+	if err != nil {
+		return nil, "", err
+	}
+	uid, scope, err := clientLogin(username, password)
+	if _, ok := err.(*database.AuthenticationError); !ok && err != nil {
+		// A backend could not tell, so the password may
+		// have been right.
+		attempt.Withdraw()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	attempt.Succeeded()
+	return uid, scope, nil
+}
+
+func clientLogin(username, password string) ([]byte, string, error) {
+	uid, scope, err := database.CheckAppPassword(username, password)
+	if err == nil {
+		return uid, scope, nil
+	}
+	if _, ok := err.(*database.AuthenticationError); !ok {
+		return nil, "", err
+	}
+	account, err := Default.Authenticate(username, password)
+	if err != nil {
+		return nil, "", err
+	}
+	uid, err = Provision(account)
+	if err != nil {
+		return nil, "", err
+	}
+	enabled, _, err := database.TwoFactorEnabled(uid)
+	if err != nil {
+		return nil, "", err
+	}
+	if enabled {
+		return nil, "", new(database.AuthenticationError)
+	}
+	return uid, database.ScopeWrite, nil
+}
+
+// ClientIP returns the address the request came from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// email returns the username if it is an email address, or
+// else the username at the domain.
+func email(username, domain string) string {
+	if strings.Contains(username, "@") || domain == "" {
+		return username
+	}
+	return username + "@" + domain
+}
+
+// Config describes a chain of backends, as read by Load.
+type Config struct {
+	Backends []*Backend
+}
+
+// Backend configures one member of a chain. Type is one of
+// database, htpasswd, ldap or proxy, and the other fields
+// are those of the Authenticator of that type. Name
+// defaults to the type, and must differ between backends
+// of the same type.
+type Backend struct {
+	Type   string
+	Name   string
+	Domain string // Added to usernames to make email addresses.
+	Link   bool   // Whether users may be linked to existing accounts by email address.
+
+	// htpasswd
+	Path string
+
+	// ldap
+	URL            string
+	StartTLS       bool
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	Filter         string
+	EmailAttribute string
+	NameAttribute  string
+
+	// proxy
+	Header   string
+	Networks []string
+}
+
+// Load reads a Config from a JSON file, and returns its
+// chain.
+func Load(path string) (Chain, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, err
+	}
+	return c.Chain()
+}
+
+// Chain returns the configured chain.
+func (c *Config) Chain() (Chain, error) {
+	if len(c.Backends) == 0 {
+		return nil, errors.New("Error: no authentication backends configured.")
+	}
+	var chain Chain
+	names := make(map[string]bool)
+	for _, b := range c.Backends {
+		if b.Name == "" {
+			b.Name = b.Type
+		}
+		if names[b.Name] {
+			return nil, fmt.Errorf("Error: authentication backend %q is configured twice.", b.Name)
+		}
+		names[b.Name] = true
+
+		switch b.Type {
+		case "database":
+			chain = append(chain, Database{})
+		case "htpasswd":
+			if b.Path == "" {
+				return nil, errors.New("Error: htpasswd path not given.")
+			}
+			chain = append(chain, &Htpasswd{Name: b.Name, Path: b.Path, Domain: b.Domain, Link: b.Link})
+		case "ldap":
+			if b.URL == "" || b.BaseDN == "" {
+				return nil, errors.New("Error: LDAP URL and base DN not given.")
+			}
+			chain = append(chain, &LDAP{
+				Name:           b.Name,
+				URL:            b.URL,
+				StartTLS:       b.StartTLS,
+				BindDN:         b.BindDN,
+				BindPassword:   b.BindPassword,
+				BaseDN:         b.BaseDN,
+				Filter:         b.Filter,
+				EmailAttribute: b.EmailAttribute,
+				NameAttribute:  b.NameAttribute,
+				Domain:         b.Domain,
+				Link:           b.Link,
+			})
+		case "proxy":
+			p, err := NewProxy(b.Name, b.Header, b.Networks, b.Domain)
+			if err != nil {
+				return nil, err
+			}
+			p.Link = b.Link
+			chain = append(chain, p)
+		default:
+			return nil, fmt.Errorf("Error: unknown authentication backend %q.", b.Type)
+		}
+	}
+	return chain, nil
+}
+
+// Database checks passwords against RS3's own accounts.
+type Database struct{}
+
+func (_ Database) Authenticate(username, password string) (*Account, error) {
+	uid, err := database.CheckPassword(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{Backend: "database", Username: username, Email: username, Uid: uid}, nil
+}
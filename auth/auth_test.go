@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rs3/database"
+	sec "rs3/security"
+	"testing"
+	"time"
+)
+
+func TestApr1(t *testing.T) {
+	// From openssl passwd -apr1.
+	if h := apr1("myPassword", "r31....."); h != "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/" {
+		t.Errorf("Got %q.", h)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rs3-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+
+	bob, err := bcrypt.GenerateFromPassword([]byte("bob's password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := "# Users\n" +
+		"alice:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n" +
+		"Bob@Example.com:" + string(bob) + "\n" +
+		"carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n" +
+		"dave:plain\n"
+	err = ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Htpasswd{Name: "htpasswd", Path: path, Domain: "example.org"}
+	for _, c := range []struct {
+		username, password, email string
+	}{
+		{"alice", "myPassword", "alice@example.org"},
+		{"bob@example.com", "bob's password", "bob@example.com"},
+		{"carol", "password", "carol@example.org"},
+	} {
+		a, err := h.Authenticate(c.username, c.password)
+		if err != nil {
+			t.Errorf("%s: %v", c.username, err)
+			continue
+		}
+		if a.Backend != "htpasswd" || a.Email != c.email {
+			t.Errorf("%s: unexpected account %+v.", c.username, a)
+		}
+	}
+
+	for _, c := range [][2]string{
+		{"alice", "mypassword"},
+		{"bob@example.com", "alice's password"},
+		{"carol", ""},
+		{"erin", "password"},
+	} {
+		_, err := h.Authenticate(c[0], c[1])
+		if _, ok := err.(*database.AuthenticationError); !ok {
+			t.Errorf("Expected %q to be refused, got %v.", c[0], err)
+		}
+	}
+	_, err = h.Authenticate("dave", "plain")
+	if _, ok := err.(*database.AuthenticationError); ok || err == nil {
+		t.Errorf("Expected plain text password to be an error, got %v.", err)
+	}
+
+	// Changes to the file are picked up.
+	err = ioutil.WriteFile(path, []byte("carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	_, err = h.Authenticate("alice", "myPassword")
+	if _, ok := err.(*database.AuthenticationError); !ok {
+		t.Errorf("Expected removed user to be refused, got %v.", err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	p, err := NewProxy("proxy", "", []string{"10.0.0.0/8", "::1/128"}, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remote, user, username string
+	}{
+		{"10.1.2.3:1234", "Alice", "alice"},
+		{"[::1]:1234", "bob@example.com", "bob@example.com"},
+		{"10.1.2.3:1234", "", ""},
+		{"192.168.1.1:1234", "alice", ""},
+		{"[::2]:1234", "alice", ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.user != "" {
+			r.Header.Set("X-Forwarded-User", c.user)
+		}
+		a, err := p.AuthenticateRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case c.username == "" && a != nil:
+			t.Errorf("%s: expected no account, got %+v.", c.remote, a)
+		case c.username != "" && (a == nil || a.Username != c.username):
+			t.Errorf("%s: expected %q, got %+v.", c.remote, c.username, a)
+		}
+	}
+
+	_, err = NewProxy("proxy", "", nil, "")
+	if err == nil {
+		t.Error("Expected proxy with no networks to be refused.")
+	}
+}
+
+type testAuthenticator struct {
+	name string
+	err  error
+}
+
+func (a testAuthenticator) Authenticate(username, password string) (*Account, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	if password != a.name {
+		return nil, new(database.AuthenticationError)
+	}
+	return &Account{Backend: a.name, Username: username, Email: username}, nil
+}
+
+func TestChain(t *testing.T) {
+	p, err := NewProxy("proxy", "", []string{"127.0.0.0/8"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Chain{
+		testAuthenticator{"first", nil},
+		p,
+		testAuthenticator{"broken", errors.New("Error: unavailable.")},
+		testAuthenticator{"second", nil},
+	}
+	for _, password := range []string{"first", "second"} {
+		a, err := c.Authenticate("alice", password)
+		if err != nil || a.Backend != password {
+			t.Errorf("Expected %s to accept, got %+v %v.", password, a, err)
+		}
+	}
+	_, err = c.Authenticate("alice", "broken")
+	if err == nil || err.Error() != "Error: unavailable." {
+		t.Errorf("Expected the backend's error, got %v.", err)
+	}
+	_, err = c[:2].Authenticate("alice", "broken")
+	if _, ok := err.(*database.AuthenticationError); !ok {
+		t.Errorf("Expected refusal, got %v.", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-User", "alice")
+	a, err := c.AuthenticateRequest(r)
+	if err != nil || a == nil || a.Backend != "proxy" {
+		t.Errorf("Expected proxy to authenticate, got %+v %v.", a, err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	c := &Config{Backends: []*Backend{
+		{Type: "proxy", Networks: []string{"10.0.0.0/8"}},
+		{Type: "htpasswd", Path: "htpasswd"},
+		{Type: "ldap", Name: "directory", URL: "ldaps://ldap.example.com", BaseDN: "dc=example,dc=com"},
+		{Type: "database"},
+	}}
+	chain, err := c.Chain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 4 {
+		t.Fatalf("Expected 4 backends, got %d.", len(chain))
+	}
+	if l, ok := chain[2].(*LDAP); !ok || l.Name != "directory" {
+		t.Errorf("Unexpected LDAP backend %+v.", chain[2])
+	}
+
+	for _, b := range [][]*Backend{
+		nil,
+		{{Type: "unknown"}},
+		{{Type: "htpasswd"}},
+		{{Type: "ldap", URL: "ldap://ldap.example.com"}},
+		{{Type: "proxy", Networks: []string{"10.0.0.0"}}},
+		{{Type: "htpasswd", Path: "a"}, {Type: "htpasswd", Path: "b"}},
+	} {
+		_, err := (&Config{Backends: b}).Chain()
+		if err == nil {
+			t.Errorf("Expected %+v to be refused.", b)
+		}
+	}
+}
+
+// addUser creates an RS3 account, with the password if it
+// is given, returning its uid.
+func addUser(t *testing.T, email, password string) []byte {
+	salt := sec.NewSalt()
+	uid, err := sec.Hash(email, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pwd []byte
+	if password != "" {
+		pwd, err = sec.Hash(password, salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = database.AddUser(uid, pwd, salt, email, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uid
+}
+
+func TestProvision(t *testing.T) {
+	local := addUser(t, "local@example.com", "password")
+	empty := addUser(t, "empty@example.com", "")
+
+	// Accounts with passwords of their own are not taken
+	// over by a backend giving the same address.
+	_, err := Provision(&Account{Backend: "ldap", Username: "mallory", Email: "Local@example.com"})
+	if _, ok := err.(*LinkRefused); !ok {
+		t.Errorf("Expected linking to be refused, got %v.", err)
+	}
+	if _, err := database.IdentityUser("ldap", "mallory"); err == nil {
+		t.Error("Expected no identity to be linked.")
+	}
+
+	for _, c := range []struct {
+		account *Account
+		uid     []byte
+	}{
+		{&Account{Backend: "ldap", Username: "empty", Email: "empty@example.com"}, empty},
+		{&Account{Backend: "htpasswd", Username: "local", Email: "local@example.com", Link: true}, local},
+	} {
+		uid, err := Provision(c.account)
+		if err != nil || !bytes.Equal(uid, c.uid) {
+			t.Errorf("%s: expected to be linked, got %v.", c.account.Username, err)
+		}
+	}
+
+	// New users are given accounts, and once linked, are
+	// found by their username.
+	uid, err := Provision(&Account{Backend: "ldap", Username: "new", Email: "new@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Provision(&Account{Backend: "ldap", Username: "new", Email: "changed@example.com"})
+	if err != nil || !bytes.Equal(uid, again) {
+		t.Errorf("Expected the same account, got %v.", err)
+	}
+}
+
+func TestClientLogin(t *testing.T) {
+	uid := addUser(t, "client@example.com", "password")
+	app, _, err := database.NewAppPassword(uid, "Phone", database.ScopeRead, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := Default
+	defer func() { Default = old }()
+	Default = Chain{Database{}, testAuthenticator{"backend", nil}}
+
+	for _, c := range []struct {
+		username, password, scope string
+	}{
+		{"client@example.com", "password", database.ScopeWrite},
+		{"client@example.com", app, database.ScopeRead},
+		{"backend@example.com", "backend", database.ScopeWrite},
+	} {
+		got, scope, err := ClientLogin(c.username, c.password, "192.0.2.10")
+		if err != nil || got == nil || scope != c.scope {
+			t.Errorf("%s with %q: expected %s access, got %q, %v.", c.username, c.password, c.scope, scope, err)
+		}
+	}
+	_, _, err = ClientLogin("client@example.com", "wrong", "192.0.2.10")
+	if _, ok := err.(*database.AuthenticationError); !ok {
+		t.Errorf("Expected refusal, got %v.", err)
+	}
+
+	// With two-factor authentication, only app passwords
+	// are accepted.
+	dir, err := ioutil.TempDir("", "rs3-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	database.SecretKeyPath = filepath.Join(dir, "secrets.key")
+	secret, _, err := database.BeginTOTP(uid, "client@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := sec.TOTP(secret, sec.TOTPStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.EnableTOTP(uid, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ClientLogin("client@example.com", "password", "192.0.2.10")
+	if _, ok := err.(*database.AuthenticationError); !ok {
+		t.Errorf("Expected the password to be refused with two-factor authentication, got %v.", err)
+	}
+	_, scope, err := ClientLogin("client@example.com", app, "192.0.2.10")
+	if err != nil || scope != database.ScopeRead {
+		t.Errorf("Expected the app password to be accepted, got %q, %v.", scope, err)
+	}
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"rs3/database"
+	sec "rs3/security"
+)
+
+// Certificates maps client certificates, issued by a CA
+// which the administrator trusts, to users and to the
+// admin role. They are checked on a listener of their
+// own, so that browsers are never asked for one.
+type Certificates struct {
+	Address  string // To listen on, such as ":8443".
+	CA       string // PEM file of the CAs which issue client certificates.
+	Subjects []*Subject
+
+	pool *x509.CertPool
+}
+
+// Subject says what a certificate may do. Any of the
+// CA's certificates with the subject may do it.
+type Subject struct {
+	Subject string // Distinguished name, such as "CN=backup,O=Example".
+	User    string // Email address of the user it acts as, if any.
+	Scope   string // Of its access to the user's data; defaults to read.
+	Admin   bool   // Whether it may use the admin endpoints.
+}
+
+// CertificateUser is who a client certificate identifies.
+type CertificateUser struct {
+	Subject string
+	Uid     []byte // Nil unless the subject acts as a user.
+	Scope   string
+	Admin   bool
+}
+
+// LoadCertificates reads Certificates from a JSON file,
+// along with the CA file it names.
+func LoadCertificates(path string) (*Certificates, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Certificates)
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.CA == "" {
+		return nil, errors.New("Error: client certificate CA not given.")
+	}
+	pem, err := ioutil.ReadFile(c.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Error: no certificates found in %s.", c.CA)
+	}
+	return c, c.init(pool)
+}
+
+// init checks the subjects, and sets the pool of CAs.
+func (c *Certificates) init(pool *x509.CertPool) error {
+	if c.Address == "" {
+		return errors.New("Error: client certificate address not given.")
+	}
+	seen := make(map[string]bool)
+	for _, s := range c.Subjects {
+		if s.Subject == "" {
+			return errors.New("Error: client certificate subject not given.")
+		}
+		if seen[s.Subject] {
+			return fmt.Errorf("Error: client certificate subject %q is given twice.", s.Subject)
+		}
+		seen[s.Subject] = true
+		if s.User == "" && !s.Admin {
+			return fmt.Errorf("Error: client certificate subject %q has no user and is not an admin.", s.Subject)
+		}
+		if s.Scope == "" {
+			s.Scope = database.ScopeRead
+		}
+		if !database.Allows(s.Scope, database.ScopeRead) {
+			return fmt.Errorf("Error: unknown scope %q.", s.Scope)
+		}
+	}
+	c.pool = pool
+	return nil
+}
+
+// TLSConfig returns the TLS configuration for the
+// listener, which requires a certificate from the CA.
+func (c *Certificates) TLSConfig() *tls.Config {
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  c.pool,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// Identify returns who the request's client certificate
+// identifies. Only certificates which TLS has verified
+// against the CA are considered, so it is safe to call on
+// requests from any listener.
+func (c *Certificates) Identify(r *http.Request) (*CertificateUser, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errors.New("Error: no verified client certificate.")
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.String()
+	for _, s := range c.Subjects {
+		if s.Subject != subject {
+			continue
+		}
+		u := &CertificateUser{Subject: subject, Scope: s.Scope, Admin: s.Admin}
+		if s.User != "" {
+			email, salt := database.Account(s.User)
+			if salt == nil {
+				return nil, fmt.Errorf("Error: client certificate %q acts as %q, who has no account.", subject, s.User)
+			}
+			uid, err := sec.Hash(email, salt)
+			if err != nil {
+				return nil, err
+			}
+			u.Uid = uid
+		}
+		return u, nil
+	}
+	return nil, fmt.Errorf("Error: unknown client certificate %q.", subject)
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"rs3/database"
+	sec "rs3/security"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key}
+}
+
+// issue returns a client certificate for the subject.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificates(t *testing.T) {
+	salt := sec.NewSalt()
+	uid, err := sec.Hash("certs@example.com", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwd, err := sec.Hash("password", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AddUser(uid, pwd, salt, "Certs", "certs@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	c := &Certificates{Address: ":8443", Subjects: []*Subject{
+		{Subject: "CN=backup,O=Example", User: "Certs@Example.com", Scope: database.ScopeWrite},
+		{Subject: "CN=ops,O=Example", Admin: true},
+		{Subject: "CN=ghost,O=Example", User: "ghost@example.com"},
+	}}
+	err = c.init(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := c.Identify(r)
+		if err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		fmt.Fprintf(w, "%x %s %v", u.Uid, u.Scope, u.Admin)
+	}))
+	srv.TLS = c.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(certs ...tls.Certificate) (int, string, error) {
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certs
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		var body bytes.Buffer
+		body.ReadFrom(resp.Body)
+		return resp.StatusCode, body.String(), nil
+	}
+
+	for _, c := range []struct {
+		subject pkix.Name
+		status  int
+		body    string
+	}{
+		{pkix.Name{CommonName: "backup", Organization: []string{"Example"}}, 200, fmt.Sprintf("%x write false", uid)},
+		{pkix.Name{CommonName: "ops", Organization: []string{"Example"}}, 200, " read true"},
+		{pkix.Name{CommonName: "backup"}, 403, ""},
+		{pkix.Name{CommonName: "ghost", Organization: []string{"Example"}}, 403, ""},
+	} {
+		status, body, err := get(ca.issue(t, c.subject))
+		if err != nil {
+			t.Errorf("%s: %v", c.subject, err)
+			continue
+		}
+		if status != c.status || (c.body != "" && body != c.body) {
+			t.Errorf("%s: expected %d %q, got %d %q.", c.subject, c.status, c.body, status, body)
+		}
+	}
+
+	// Certificates from other CAs, and none at all, are
+	// refused during the handshake.
+	other := newTestCA(t)
+	if _, _, err := get(other.issue(t, pkix.Name{CommonName: "ops", Organization: []string{"Example"}})); err == nil {
+		t.Error("Expected certificate from another CA to be refused.")
+	}
+	if _, _, err := get(); err == nil {
+		t.Error("Expected request without a certificate to be refused.")
+	}
+
+	// Requests without verified certificates are not
+	// identified.
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, err := c.Identify(r); err == nil {
+		t.Error("Expected request without TLS to be refused.")
+	}
+}
+
+func TestCertificatesConfig(t *testing.T) {
+	pool := x509.NewCertPool()
+	for _, subjects := range [][]*Subject{
+		{{Subject: ""}},
+		{{Subject: "CN=a", Admin: true}, {Subject: "CN=a", Admin: true}},
+		{{Subject: "CN=a"}},
+		{{Subject: "CN=a", User: "a@example.com", Scope: "everything"}},
+	} {
+		c := &Certificates{Address: ":8443", Subjects: subjects}
+		if err := c.init(pool); err == nil {
+			t.Errorf("Expected %+v to be refused.", subjects[0])
+		}
+	}
+	if err := (&Certificates{}).init(pool); err == nil {
+		t.Error("Expected missing address to be refused.")
+	}
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"rs3/database"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Htpasswd checks passwords against an Apache htpasswd
+// file, which is read again whenever it changes. bcrypt,
+// apr1 (MD5) and SHA-1 hashes are supported; crypt and
+// plain text passwords are not.
+type Htpasswd struct {
+	Name   string
+	Path   string
+	Domain string // Added to usernames to make email addresses.
+	Link   bool   // Whether users may be linked to existing accounts by email address.
+
+	mutex   sync.Mutex
+	modTime time.Time
+	users   map[string]string // Username -> hash.
+}
+
+// dummyBcrypt is checked for unknown users, so that they
+// take as long as known ones.
+var dummyBcrypt, _ = bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+
+// hash returns the hash of the user's password, reading
+// the file if it has changed.
+func (h *Htpasswd) hash(username string) (string, bool, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	info, err := os.Stat(h.Path)
+	if err != nil {
+		return "", false, err
+	}
+	if h.users == nil || !info.ModTime().Equal(h.modTime) {
+		f, err := os.Open(h.Path)
+		if err != nil {
+			return "", false, err
+		}
+		defer f.Close()
+		users := make(map[string]string)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			i := strings.Index(line, ":")
+			if i < 0 {
+				continue
+			}
+			users[database.NormaliseEmail(line[:i])] = line[i+1:]
+		}
+		err = scanner.Err()
+		if err != nil {
+			return "", false, err
+		}
+		h.users = users
+		h.modTime = info.ModTime()
+	}
+	hash, ok := h.users[database.NormaliseEmail(username)]
+	return hash, ok, nil
+}
+
+func (h *Htpasswd) Authenticate(username, password string) (*Account, error) {
+	hash, ok, err := h.hash(username)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyBcrypt, []byte(password))
+		return nil, new(database.AuthenticationError)
+	}
+	match, err := checkHtpasswd(password, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !match {
+		return nil, new(database.AuthenticationError)
+	}
+	username = database.NormaliseEmail(username)
+	return &Account{Backend: h.Name, Username: username, Email: email(username, h.Domain), Link: h.Link}, nil
+}
+
+// checkHtpasswd returns whether the password matches the
+// htpasswd hash.
+func checkHtpasswd(password, hash string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(hash, "$", 4)
+		if len(parts) != 4 {
+			return false, errors.New("Error: malformed apr1 hash.")
+		}
+		return subtle.ConstantTimeCompare([]byte(apr1(password, parts[2])), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(want), []byte(hash)) == 1, nil
+	}
+	return false, errors.New("Error: unsupported htpasswd hash.")
+}
+
+// apr1 returns Apache's MD5-based hash of the password,
+// with the salt.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const letters = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(password); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		ctx.Write(alt[:n])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{password[0]})
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		ctx := md5.New()
+		if i&1 == 1 {
+			ctx.Write([]byte(password))
+		} else {
+			ctx.Write(sum)
+		}
+		if i%3 != 0 {
+			ctx.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			ctx.Write([]byte(password))
+		}
+		if i&1 == 1 {
+			ctx.Write(sum)
+		} else {
+			ctx.Write([]byte(password))
+		}
+		sum = ctx.Sum(nil)
+	}
+
+	out := []byte(magic + salt + "$")
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, letters[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+	return string(out)
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net/url"
+	"rs3/database"
+	"strings"
+)
+
+// LDAP checks passwords by binding to an LDAP directory as
+// the user. The user's entry is first found by searching
+// under BaseDN with Filter, in which %s is replaced by the
+// username, binding as BindDN to search if it is given.
+type LDAP struct {
+	Name           string
+	URL            string // ldap:// or ldaps://
+	StartTLS       bool
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	Filter         string // Defaults to (uid=%s).
+	EmailAttribute string // Defaults to mail.
+	NameAttribute  string // Defaults to cn.
+	Domain         string // Added to usernames with no email address.
+	Link           bool   // Whether users may be linked to existing accounts by email address.
+}
+
+func (l *LDAP) Authenticate(username, password string) (*Account, error) {
+	username = strings.TrimSpace(username)
+
+	// Most servers treat a bind with no password as an
+	// anonymous bind, which succeeds.
+	if username == "" || password == "" {
+		return nil, new(database.AuthenticationError)
+	}
+
+	conn, err := ldap.DialURL(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if l.StartTLS {
+		u, err := url.Parse(l.URL)
+		if err != nil {
+			return nil, err
+		}
+		err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if l.BindDN != "" {
+		err = conn.Bind(l.BindDN, l.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("Error: failed to bind as %s: %v", l.BindDN, err)
+		}
+	}
+
+	filter := l.Filter
+	if filter == "" {
+		filter = "(uid=%s)"
+	}
+	emailAttribute := l.EmailAttribute
+	if emailAttribute == "" {
+		emailAttribute = "mail"
+	}
+	nameAttribute := l.NameAttribute
+	if nameAttribute == "" {
+		nameAttribute = "cn"
+	}
+	search := ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		strings.Replace(filter, "%s", ldap.EscapeFilter(username), -1), []string{emailAttribute, nameAttribute}, nil)
+	result, err := conn.Search(search)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	if result == nil || len(result.Entries) == 0 {
+		return nil, new(database.AuthenticationError)
+	}
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("Error: LDAP username %q is ambiguous.", username)
+	}
+	entry := result.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, new(database.AuthenticationError)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	username = database.NormaliseEmail(username)
+	a := &Account{
+		Backend:  l.Name,
+		Username: username,
+		Email:    entry.GetAttributeValue(emailAttribute),
+		Name:     entry.GetAttributeValue(nameAttribute),
+		Link:     l.Link,
+	}
+	if a.Email == "" {
+		a.Email = email(username, l.Domain)
+	}
+	return a, nil
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"rs3/database"
+	"strings"
+	"testing"
+)
+
+// ldapEntry is an entry in a fakeLDAP directory.
+type ldapEntry struct {
+	DN       string
+	Password string
+	Attrs    map[string]string
+}
+
+// fakeLDAP is an LDAP server with just enough of the
+// protocol for the tests: simple binds, and searches with
+// equality filters.
+type fakeLDAP struct {
+	listener net.Listener
+	entries  []*ldapEntry
+}
+
+func newFakeLDAP(t *testing.T, entries ...*ldapEntry) *fakeLDAP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeLDAP{listener: l, entries: entries}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeLDAP) URL() string {
+	return "ldap://" + f.listener.Addr().String()
+}
+
+func (f *fakeLDAP) Close() {
+	f.listener.Close()
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	msg.AppendChild(op)
+	return msg
+}
+
+func ldapResult(tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return op
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		req := packet.Children[1]
+		var responses []*ber.Packet
+		switch req.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := req.Children[1].Value.(string)
+			password := req.Children[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			for _, e := range f.entries {
+				if e.DN == dn && e.Password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			responses = append(responses, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			filter := req.Children[6]
+			if filter.Tag == ldap.FilterEqualityMatch {
+				attr, _ := filter.Children[0].Value.(string)
+				value := filter.Children[1].Data.String()
+				for _, e := range f.entries {
+					if e.Attrs[attr] != value {
+						continue
+					}
+					op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+					op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "DN"))
+					attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+					for k, v := range e.Attrs {
+						a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+						a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k, "Type"))
+						values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+						values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+						a.AppendChild(values)
+						attrs.AppendChild(a)
+					}
+					op.AppendChild(attrs)
+					responses = append(responses, op)
+				}
+			}
+			responses = append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+		for _, op := range responses {
+			_, err = conn.Write(ldapMessage(id, op).Bytes())
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	f := newFakeLDAP(t,
+		&ldapEntry{"cn=service,dc=example,dc=com", "service", map[string]string{"uid": "service"}},
+		&ldapEntry{"uid=alice,ou=people,dc=example,dc=com", "alice's password", map[string]string{
+			"uid":  "alice",
+			"mail": "Alice@Example.com",
+			"cn":   "Alice",
+		}},
+		&ldapEntry{"uid=bob,ou=people,dc=example,dc=com", "bob's password", map[string]string{"uid": "bob"}},
+	)
+	defer f.Close()
+
+	l := &LDAP{
+		Name:         "ldap",
+		URL:          f.URL(),
+		BindDN:       "cn=service,dc=example,dc=com",
+		BindPassword: "service",
+		BaseDN:       "dc=example,dc=com",
+		Domain:       "example.org",
+	}
+
+	a, err := l.Authenticate("alice", "alice's password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Backend != "ldap" || a.Username != "alice" || a.Email != "Alice@Example.com" || a.Name != "Alice" || a.Uid != nil {
+		t.Errorf("Unexpected account %+v.", a)
+	}
+
+	a, err = l.Authenticate("bob", "bob's password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Email != "bob@example.org" || a.Name != "" {
+		t.Errorf("Unexpected account %+v.", a)
+	}
+
+	for _, c := range [][2]string{
+		{"alice", "bob's password"},
+		{"alice", ""},
+		{"carol", "alice's password"},
+		{"*", "alice's password"},
+		{"", "alice's password"},
+	} {
+		_, err := l.Authenticate(c[0], c[1])
+		if _, ok := err.(*database.AuthenticationError); !ok {
+			t.Errorf("Expected %q to be refused, got %v.", c[0], err)
+		}
+	}
+
+	// A misconfigured service account is an error, not a
+	// wrong password.
+	l.BindPassword = "wrong"
+	_, err = l.Authenticate("alice", "alice's password")
+	if err == nil || !strings.Contains(err.Error(), "cn=service") {
+		t.Errorf("Expected failure to bind, got %v.", err)
+	}
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"rs3/database"
+	"strings"
+)
+
+// Proxy trusts a header, such as X-Forwarded-User, naming
+// the user, but only on requests made directly by a proxy
+// in one of its networks. The proxy must remove the header
+// from the requests it forwards, so that users cannot set
+// it themselves.
+type Proxy struct {
+	Name     string
+	Header   string
+	Networks []*net.IPNet
+	Domain   string // Added to usernames to make email addresses.
+	Link     bool   // Whether users may be linked to existing accounts by email address.
+}
+
+// NewProxy returns a Proxy which trusts the header from
+// the networks, given in CIDR notation. The header
+// defaults to X-Forwarded-User.
+func NewProxy(name, header string, networks []string, domain string) (*Proxy, error) {
+	if len(networks) == 0 {
+		return nil, errors.New("Error: no trusted proxy networks given.")
+	}
+	if header == "" {
+		header = "X-Forwarded-User"
+	}
+	p := &Proxy{Name: name, Header: header, Domain: domain}
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("Error: invalid proxy network %q.", n)
+		}
+		p.Networks = append(p.Networks, ipnet)
+	}
+	return p, nil
+}
+
+// Trusted returns whether the request came directly from a
+// trusted proxy.
+func (p *Proxy) Trusted(r *http.Request) bool {
+	ip := net.ParseIP(ClientIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) AuthenticateRequest(r *http.Request) (*Account, error) {
+	username := database.NormaliseEmail(r.Header.Get(p.Header))
+	if username == "" || !p.Trusted(r) {
+		return nil, nil
+	}
+	if strings.ContainsAny(username, " ,;") {
+		return nil, fmt.Errorf("Error: invalid %s header %q.", p.Header, username)
+	}
+	return &Account{Backend: p.Name, Username: username, Email: email(username, p.Domain), Link: p.Link}, nil
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	sec "rs3/security"
+	"strings"
+	"sync"
+)
+
+// Logins to accounts which do not exist are checked against
+// these, so that they take as long as those which do.
+var (
+	dummySalt    = sec.NewSalt()
+	dummyHash    string
+	dummyHashErr error
+	dummyOnce    sync.Once
+)
+
+// checkDummyPassword checks the password against a hash
+// which no login will match, taking as long as checking it
+// against a user's.
+func checkDummyPassword(password string) error {
+	dummyOnce.Do(func() {
+		dummyHash, dummyHashErr = sec.HashPassword("")
+	})
+	if dummyHashErr != nil {
+		return dummyHashErr
+	}
+	_, _, err := sec.CheckPassword(password, dummyHash)
+	return err
+}
+
+// CheckPassword returns the uid of the user with the given
+// email address and password. It takes as long whether or
+// not the account exists.
+func CheckPassword(email, password string) ([]byte, error) {
+	email, salt := Account(email)
+	exists := salt != nil
+	if !exists {
+		salt = dummySalt
+	}
+	uid, err := sec.Hash(email, salt)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = checkDummyPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		return nil, new(AuthenticationError)
+	}
+	err = CheckUserPassword(uid, password)
+	if err != nil {
+		if _, ok := err.(*UserDoesNotExist); ok {
+			return nil, new(AuthenticationError)
+		}
+		return nil, err
+	}
+	return uid, nil
+}
+
+// ClientNickname returns the user's nickname. Unlike
+// Nickname, it needs no session cookie, as API clients
+// have none, and pages have already checked theirs.
+func ClientNickname(uid []byte) (string, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return "", new(UserDoesNotExist)
+	}
+	return user.Nick, nil
+}
+
+// SetNickname changes the user's nickname. Like
+// ClientNickname, it is for API clients, which have no
+// session cookie for UpdateNickname.
+func SetNickname(uid []byte, nickname string) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	user.Nick = nickname
+	return nil
+}
+
+// SetFeverPassword sets the password with which Fever
+// clients log in as the user, or disables Fever access if
+// the password is empty. Fever clients send an API key of
+// md5("email:password"), so the user's email is needed too.
+// It is normalised, as it is when logging in, so the key
+// does not depend on how the address was typed here. A
+// *security.WeakPassword error is returned if the password
+// is too easy to guess.
+func SetFeverPassword(uid []byte, email, password string) error {
+	account, salt := Account(email)
+	if salt == nil {
+		return new(AuthenticationError)
+	}
+	hash, err := sec.Hash(account, salt)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, uid) {
+		return new(AuthenticationError)
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	key := ""
+	if password != "" {
+		err = sec.CheckPasswordStrength(password, account, user.Nick)
+		if err != nil {
+			return err
+		}
+		sum := md5.Sum([]byte(NormaliseEmail(email) + ":" + password))
+		key = hashToken(hex.EncodeToString(sum[:]))
+	}
+	user.FeverKey = key
+	return nil
+}
+
+// FeverUser returns the uid of the user with the given
+// Fever API key.
+func FeverUser(key string) ([]byte, error) {
+	if key == "" {
+		return nil, new(AuthenticationError)
+	}
+	hash := []byte(hashToken(strings.ToLower(key)))
+
+	db.RLock()
+	defer db.RUnlock()
+	for _, user := range db.Users {
+		if user.FeverKey != "" && subtle.ConstantTimeCompare([]byte(user.FeverKey), hash) == 1 {
+			return user.Uid, nil
+		}
+	}
+	return nil, new(AuthenticationError)
+}
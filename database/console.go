@@ -8,7 +8,9 @@ import (
   "os"
   "rs3/security"
   "runtime/pprof"
+  "strconv"
   "strings"
+  "time"
 )
 
 type tokens []string
@@ -50,9 +52,13 @@ func Console() {
           continue
         }
 
-        username := tokens[2]
+        username := NormaliseEmail(tokens[2])
         password := tokens[3]
         nickname := tokens[4]
+        if err := security.CheckPasswordStrength(password, username, nickname); err != nil {
+          fmt.Println(err)
+          break
+        }
         salt := security.NewSalt()
 
         uid, err := security.Hash(username, salt)
@@ -60,53 +66,50 @@ func Console() {
           fmt.Fprintln(os.Stderr, "Error: failed to hash username.")
         }
 
-        pwd, err := security.Hash(password, salt)
-        if err != nil {
-          fmt.Fprintln(os.Stderr, "Error: failed to hash username.")
-        }
-
-        err = AddUser(uid, pwd, salt, nickname, username)
+        err = CreateUser(uid, salt, password, nickname, username)
         if err != nil {
           fmt.Fprintln(os.Stderr, err.Error())
         }
 
       case "feed":
-        if tokens.expect("add", "feed", "[uid]", "[cookie]", "[url]") {
+        if tokens.expect("add", "feed", "[uid]", "[url]") {
           continue
         }
-				
+
         uid, err := StringToUid(tokens[2])
         if err != nil {
           fmt.Println("Error parsing uid:")
           fmt.Println(err)
+          break
         }
-        cookie := tokens[3]
-        feed := tokens[4]
+        feed := tokens[3]
 
-        err = AddFeeds(uid, cookie, feed)
+        err = AddFeeds(uid, "", feed)
         if err != nil {
           fmt.Println("Error adding feed:")
           fmt.Println(err)
+          break
         }
         fmt.Printf("Added feed %q.\n", feed)
 
       case "feeds":
-				if tokens.expect("add", "feeds", "[uid]", "[cookie]", "[url...]") {
-					continue
-				}
-				
+        if tokens.expect("add", "feeds", "[uid]", "[url...]") {
+          continue
+        }
+
         uid, err := StringToUid(tokens[2])
         if err != nil {
           fmt.Println("Error parsing uid:")
           fmt.Println(err)
+          break
         }
-        cookie := tokens[3]
 
-        for _, feed := range tokens[4:] {
-          err = AddFeeds(uid, cookie, feed)
+        for _, feed := range tokens[3:] {
+          err = AddFeeds(uid, "", feed)
           if err != nil {
             fmt.Println("Error adding feed:")
             fmt.Println(err)
+            continue
           }
           fmt.Printf("Added feed %q.\n", feed)
         }
@@ -118,8 +121,7 @@ func Console() {
 				continue
 			}
 			
-      username := tokens[1]
-      salt := Salt(username)
+      username, salt := Account(tokens[1])
 
       uid, err := security.Hash(username, salt)
       if err != nil {
@@ -131,6 +133,61 @@ func Console() {
         fmt.Fprintln(os.Stderr, err.Error())
       }
 
+    // Reset a user's password.
+    case tokens[0] == "password":
+      if tokens.expect("password", "[uid]", "[password]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      err = SetPassword(uid, tokens[2])
+      if err != nil {
+        fmt.Println("Failed to set password:")
+        fmt.Println(err)
+      }
+
+    // Turn off a user's two-factor authentication.
+    case tokens[0] == "reset-2fa":
+      if tokens.expect("reset-2fa", "[uid]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      err = ResetTOTP(uid)
+      if err != nil {
+        fmt.Println("Failed to reset two-factor authentication:")
+        fmt.Println(err)
+      }
+
+    // List accounts and addresses with failed logins.
+    case tokens[0] == "lockouts":
+      list := Lockouts()
+      for _, s := range list {
+        fmt.Println(s)
+      }
+      fmt.Printf("\n\nTotal: %3d\n", len(list))
+
+    // Lift a login lockout.
+    case tokens[0] == "unlock":
+      if tokens.expect("unlock", "[email|ip]") {
+        continue
+      }
+
+      err := Unlock(tokens[1])
+      if err != nil {
+        fmt.Println(err)
+      }
+
     // Check a user's feeds.
     case tokens[0] == "feeds":
 			if tokens.expect("feeds", "[uid]") {
@@ -178,7 +235,7 @@ func Console() {
       if ok {
         for _, feed := range user.Feeds {
           start := feed.Unread
-          err := feed.Update()
+          err := refresh(user, feed)
           if err != nil {
             fmt.Printf("Error while updating feed %q:\n", feed.Title)
             fmt.Println(err)
@@ -191,6 +248,440 @@ func Console() {
         fmt.Println("Error: could not find user.")
       }
 
+    // Toggle privacy filtering for a feed.
+    case tokens[0] == "privacy":
+      if tokens.expect("privacy", "[uid]", "[feed url]", "[on|off]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      err = SetPrivacy(uid, tokens[2], tokens[3] != "off")
+      if err != nil {
+        fmt.Println("Failed to set privacy filtering:")
+        fmt.Println(err)
+      }
+
+    // Toggle full-article extraction for a feed.
+    case tokens[0] == "extract":
+      if tokens.expect("extract", "[uid]", "[feed url]", "[on|off]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      err = SetExtraction(uid, tokens[2], tokens[3] == "on")
+      if err != nil {
+        fmt.Println("Failed to set article extraction:")
+        fmt.Println(err)
+      }
+
+    // Move a feed into a folder.
+    case tokens[0] == "folder":
+      if tokens.expect("folder", "[uid]", "[feed url]", "[name]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      err = SetFolder(uid, tokens[2], strings.Join(tokens[3:], " "))
+      if err != nil {
+        fmt.Println("Failed to set folder:")
+        fmt.Println(err)
+      }
+
+    // Mark a user's items as read in bulk.
+    case tokens[0] == "markread":
+      if tokens.expect("markread", "[uid]", "[all|feed|folder] [feed url|folder name] [optional age, e.g. 7d]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      rest := tokens[3:]
+      q := new(Query)
+      if n := len(rest); n > 0 {
+        if age, err := ParseAge(rest[n-1]); err == nil {
+          q.Before = time.Now().Add(-age)
+          rest = rest[:n-1]
+        }
+      }
+      switch tokens[2] {
+      case "all":
+      case "feed":
+        q.Subscription = strings.Join(rest, " ")
+      case "folder":
+        q.Folder = strings.Join(rest, " ")
+      }
+      if tokens[2] != "all" && q.Subscription == "" && q.Folder == "" {
+        fmt.Println("Error: expected all, or a feed or folder.")
+        break
+      }
+      _, n, err := MarkAllRead(uid, q)
+      if err != nil {
+        fmt.Println("Failed to mark items read:")
+        fmt.Println(err)
+        break
+      }
+      fmt.Printf("Marked %d items read.\n", n)
+
+    // Set the order of a feed, or of the all items view.
+    case tokens[0] == "sort":
+      if tokens.expect("sort", "[uid]", "[feed url|all]", "[feed|newest|oldest|default]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      feed, order := tokens[2], tokens[3]
+      if feed == "all" {
+        feed = ""
+      }
+      if order == "default" {
+        order = ""
+      }
+      err = SetSort(uid, feed, order)
+      if err != nil {
+        fmt.Println("Failed to set sort order:")
+        fmt.Println(err)
+      }
+
+    // Set a user's Fever password.
+    case tokens[0] == "fever":
+      if tokens.expect("fever", "[uid]", "[email]", "[password, or none to disable]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      password := tokens[3]
+      if password == "none" {
+        password = ""
+      }
+      err = SetFeverPassword(uid, tokens[2], password)
+      if err != nil {
+        fmt.Println("Failed to set Fever password:")
+        fmt.Println(err)
+      }
+
+    // List a user's API tokens and app passwords.
+    case tokens[0] == "tokens":
+      if tokens.expect("tokens", "[uid]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      list, err := Tokens(uid)
+      if err != nil {
+        fmt.Println("Failed to get tokens:")
+        fmt.Println(err)
+        break
+      }
+      for _, t := range list {
+        last := "never"
+        if !t.LastUsed.IsZero() {
+          last = t.LastUsed.Format(time.RFC3339)
+        }
+        expires := "never"
+        if !t.Expires.IsZero() {
+          expires = t.Expires.Format(time.RFC3339)
+        }
+        fmt.Printf("%s  %-8s %-5s %q, last used %s, expires %s\n", t.ID, t.Kind, t.Scope, t.Name, last, expires)
+      }
+      fmt.Printf("\n\nTotal tokens: %3d\n", len(list))
+
+    // Create an API token or app password.
+    case tokens[0] == "token":
+      if tokens.expect("token", "[uid]", "[token|password]", "[read|write|admin]", "[days|never]", "[name...]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      var expires time.Time
+      if tokens[4] != "never" {
+        days, err := strconv.Atoi(tokens[4])
+        if err != nil || days <= 0 {
+          fmt.Println("Error: invalid number of days.")
+          break
+        }
+        expires = time.Now().AddDate(0, 0, days)
+      }
+      name := strings.Join(tokens[5:], " ")
+      var secret string
+      switch tokens[2] {
+      case KindToken:
+        secret, _, err = NewToken(uid, name, tokens[3], expires)
+      case KindPassword:
+        secret, _, err = NewAppPassword(uid, name, tokens[3], expires)
+      default:
+        err = fmt.Errorf("Error: unknown kind %q.", tokens[2])
+      }
+      if err != nil {
+        fmt.Println("Failed to create token:")
+        fmt.Println(err)
+        break
+      }
+      fmt.Println(secret)
+
+    // Revoke an API token or app password.
+    case tokens[0] == "revoke":
+      if tokens.expect("revoke", "[uid]", "[id]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      err = RevokeToken(uid, tokens[2])
+      if err != nil {
+        fmt.Println("Failed to revoke token:")
+        fmt.Println(err)
+      }
+
+    // Manage OAuth clients.
+    case tokens[0] == "oauth":
+      if tokens.expect("oauth", "[add|list|remove]") {
+        continue
+      }
+
+      switch tokens[1] {
+      case "add":
+        if tokens.expect("oauth", "add", "[public|confidential]", "[redirect uri,...]", "[name...]") {
+          continue
+        }
+        if tokens[2] != "public" && tokens[2] != "confidential" {
+          fmt.Printf("Error: unknown client type %q.\n", tokens[2])
+          break
+        }
+        client, secret, err := RegisterOAuthClient(strings.Join(tokens[4:], " "), tokens[2] == "confidential",
+          strings.Split(tokens[3], ","))
+        if err != nil {
+          fmt.Println("Failed to register client:")
+          fmt.Println(err)
+          break
+        }
+        fmt.Printf("Client ID:     %s\n", client.ID)
+        if secret != "" {
+          fmt.Printf("Client secret: %s\n", secret)
+        }
+
+      case "list":
+        list := OAuthClients()
+        for _, c := range list {
+          kind := "public"
+          if c.Confidential() {
+            kind = "confidential"
+          }
+          fmt.Printf("%s  %-12s %q, redirects to %s\n", c.ID, kind, c.Name, strings.Join(c.RedirectURIs, ", "))
+        }
+        fmt.Printf("\n\nTotal clients: %3d\n", len(list))
+
+      case "remove":
+        if tokens.expect("oauth", "remove", "[id]") {
+          continue
+        }
+        err := RemoveOAuthClient(tokens[2])
+        if err != nil {
+          fmt.Println("Failed to remove client:")
+          fmt.Println(err)
+        }
+
+      default:
+        fmt.Printf("Error: unknown oauth command %q.\n", tokens[1])
+      }
+
+    // Create an invite, which lets someone register.
+    case tokens[0] == "invite":
+      if tokens.expect("invite", "[days]", "[note...]") {
+        continue
+      }
+
+      days, err := strconv.Atoi(tokens[1])
+      if err != nil || days <= 0 {
+        fmt.Println("Error: invalid number of days.")
+        break
+      }
+      code, invite, err := NewInvite(strings.Join(tokens[2:], " "), time.Duration(days)*24*time.Hour)
+      if err != nil {
+        fmt.Println("Failed to create invite:")
+        fmt.Println(err)
+        break
+      }
+      fmt.Printf("Invite %s, expiring %s:\n", invite.ID, invite.Expires.Format(time.RFC1123))
+      fmt.Println(code)
+
+    // List unused invites.
+    case tokens[0] == "invites":
+      list := Invites()
+      for _, i := range list {
+        fmt.Printf("%s  expires %s  %q\n", i.ID, i.Expires.Format(time.RFC3339), i.Note)
+      }
+      fmt.Printf("\n\nTotal invites: %3d\n", len(list))
+
+    // Revoke an unused invite.
+    case tokens[0] == "uninvite":
+      if tokens.expect("uninvite", "[id]") {
+        continue
+      }
+
+      err := RevokeInvite(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to revoke invite:")
+        fmt.Println(err)
+      }
+
+    // Set a user's time zone.
+    case tokens[0] == "timezone":
+      if tokens.expect("timezone", "[uid]", "[zone]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      err = SetTimeZone(uid, tokens[2])
+      if err != nil {
+        fmt.Println("Failed to set time zone:")
+        fmt.Println(err)
+      }
+
+    // List a user's filter rules.
+    case tokens[0] == "rules":
+      if tokens.expect("rules", "[uid]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[1])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+      rules, err := Rules(uid)
+      if err != nil {
+        fmt.Println("Failed to get rules:")
+        fmt.Println(err)
+        break
+      }
+      for _, rule := range rules {
+        fmt.Println(rule)
+      }
+      fmt.Printf("\n\nTotal rules: %3d\n", len(rules))
+
+    // Edit a user's filter rules.
+    case tokens[0] == "rule":
+      if tokens.expect("rule", "[add|remove|test]", "[uid]") {
+        continue
+      }
+
+      uid, err := StringToUid(tokens[2])
+      if err != nil {
+        fmt.Println("Failed to parse uid:")
+        fmt.Println(err)
+        break
+      }
+
+      switch tokens[1] {
+      case "add":
+        if tokens.expect("rule", "add", "[uid]", "[action]", "[field:value...]") {
+          continue
+        }
+
+        rule, err := ParseRule(tokens[3], tokens[4:])
+        if err != nil {
+          fmt.Println(err)
+          break
+        }
+        id, err := AddRule(uid, rule)
+        if err != nil {
+          fmt.Println("Failed to add rule:")
+          fmt.Println(err)
+          break
+        }
+        fmt.Printf("Added rule %d.\n", id)
+
+      case "remove":
+        if tokens.expect("rule", "remove", "[uid]", "[id]") {
+          continue
+        }
+
+        id, err := strconv.Atoi(tokens[3])
+        if err != nil {
+          fmt.Println("Failed to parse rule id:")
+          fmt.Println(err)
+          break
+        }
+        err = DeleteRule(uid, id)
+        if err != nil {
+          fmt.Println("Failed to remove rule:")
+          fmt.Println(err)
+        }
+
+      case "test":
+        if tokens.expect("rule", "test", "[uid]", "[field:value...]") {
+          continue
+        }
+
+        rule, err := ParseRule(ActionHighlight, tokens[3:])
+        if err != nil {
+          fmt.Println(err)
+          break
+        }
+        matches, err := TestRule(uid, rule)
+        if err != nil {
+          fmt.Println("Failed to test rule:")
+          fmt.Println(err)
+          break
+        }
+        for _, match := range matches {
+          fmt.Printf("%s: %q\n", match.Feed, match.Title)
+        }
+        fmt.Printf("\n\nMatching items: %3d\n", len(matches))
+
+      default:
+        fmt.Println("Error: command not understood.")
+      }
+
     // Debug.
     case tokens[0] == "debug":
 			if tokens.expect("debug") {
@@ -280,7 +771,7 @@ func Console() {
     fmt.Print(">>> ")
   }
   if err := scanner.Err(); err != nil {
-    log.Panic(os.Stderr, "reading standard input:", err)
+    log.Panicln("reading standard input:", err)
   }
 }
 
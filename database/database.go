@@ -2,12 +2,11 @@ package database
 
 import (
 	"bytes"
-	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/SlyMarbo/rss"
-	"io"
 	sec "rs3/security"
 	"sync"
 	"time"
@@ -20,10 +19,15 @@ func init() {
 }
 
 type database struct {
-	Users      map[string]*User     //uid -> User
-	Salts      map[string]*sec.Salt //email -> Salt
-	Emails     map[string]struct{}  //email -> null (for email existence check)
-	Algorithms map[string]*CacheItem
+	Users         map[string]*User     //uid -> User
+	Salts         map[string]*sec.Salt //email -> Salt
+	Emails        map[string]struct{}  //email -> null (for email existence check)
+	Algorithms    map[string]*CacheItem
+	OAuth         map[string]*OAuthClient  //client ID -> OAuthClient
+	Throttles     map[string]*Throttle     //"account:email" or "ip:address" -> failed logins
+	Invites       map[string]*Invite       //invite ID -> Invite
+	Registrations map[string]*Registration //hash of verification token -> Registration
+	addresses     map[string]string        //normalised email -> email as created, where they differ
 	*sync.RWMutex
 }
 
@@ -39,37 +43,74 @@ func newDatabase() *database {
 		make(map[string]*sec.Salt),
 		make(map[string]struct{}),
 		make(map[string]*CacheItem),
+		make(map[string]*OAuthClient),
+		make(map[string]*Throttle),
+		make(map[string]*Invite),
+		make(map[string]*Registration),
+		make(map[string]string),
 		new(sync.RWMutex),
 	}
 	return &db
 }
 
 type User struct {
-	Uid      []byte
-	Pswrd    []byte
-	Salt     *sec.Salt
-	Nick     string
-	Cookies  CookieJar
-	Feeds    []*rss.Feed
-	FeedUrls []string
-	mutex    *sync.RWMutex
+	Uid           []byte
+	Pswrd         []byte //legacy password hash, before Password
+	Password      string //encoded password hash
+	Salt          *sec.Salt
+	Nick          string
+	Cookies       CookieJar           //session cookies, before Sessions
+	Sessions      []*Session
+	Feeds         []*rss.Feed
+	FeedUrls      []string
+	Subscriptions map[string]*Subscription //feed URL -> Subscription
+	Items         map[string]*ItemMeta     //item key -> ItemMeta
+	Rules         []*Rule
+	Stories       map[string][]string //item key -> duplicate item keys
+	TimeZone      string              //IANA name, such as "Europe/London"
+	Sort          string              //order of the all items view and folders
+	LastItem      int64               //ID of the newest item
+	Clients       []string            //hashes of app tokens, before Tokens
+	Tokens        []*Token            //app tokens, API tokens and app passwords
+	FeverKey      string              //hash of the Fever API key
+	TwoFactor     *TwoFactor          //TOTP two-factor authentication, nil if off
+	Identities    []*Identity         //linked single sign-on accounts
+	undo          *readBatch          //last bulk mark as read
+	stories       map[string][]string //fingerprint key -> keys of items which begin stories
+	mutex         *sync.RWMutex
 }
 
 func newUser(uid, pwd []byte, salt *sec.Salt, nick string) *User {
 	user := User{
 		uid,
 		pwd,
+		"",
 		salt,
 		nick,
-		make(CookieJar, 0),
+		nil,
+		make([]*Session, 0),
 		make([]*rss.Feed, 0),
 		make([]string, 0),
+		make(map[string]*Subscription),
+		make(map[string]*ItemMeta),
+		make([]*Rule, 0),
+		make(map[string][]string),
+		"",
+		"",
+		0,
+		nil,
+		make([]*Token, 0),
+		"",
+		nil,
+		nil,
+		nil,
+		nil,
 		new(sync.RWMutex),
 	}
 	return &user
 }
 
-//256 rand number 
+//256 rand number, stored before sessions
 type Cookie struct {
 	Exp     time.Time
 	Replace time.Time
@@ -78,21 +119,6 @@ type Cookie struct {
 
 type CookieJar []*Cookie
 
-func newCookie() (*Cookie, error) {
-	b := make([]byte, 32) //256 bits
-	_, err := io.ReadFull(rand.Reader, b)
-	if err != nil {
-		return &Cookie{}, err
-	}
-
-	cookie := Cookie{
-		time.Now().Add(7 * 24 * time.Hour),
-		time.Now().Add(14 * 24 * time.Hour),
-		fmt.Sprintf("%16x", string(b)),
-	}
-	return &cookie, nil
-}
-
 func Salt(email string) *sec.Salt {
 	return db.Salts[email]
 }
@@ -108,22 +134,26 @@ func Gzip(str string) *CacheItem {
 //AddUser creates a new user and adds it to the database. It establishes that both the user
 //does not exist and that their email is not in use
 func AddUser(uid, pwd []byte, salt *sec.Salt, nick, email string) error {
-	db.RLock()
-	if _, ok := db.Users[UidToString(uid)]; ok {
-		db.RUnlock()
+	db.Lock()
+	defer db.Unlock()
+	return addUser(newUser(uid, pwd, salt, nick), email)
+}
+
+// addUser adds the user, as AddUser does. The database
+// must be locked.
+func addUser(user *User, email string) error {
+	if _, ok := db.Users[UidToString(user.Uid)]; ok {
 		return new(UserAlreadyExists)
 	}
-	if _, ok := db.Emails[string(uid)]; ok {
-		db.RUnlock()
+	if _, salt := account(email); salt != nil {
 		return new(EmailAlreadyExists)
 	}
-	db.RUnlock()
-	db.Lock()
-	defer db.Unlock()
-	user := newUser(uid, pwd, salt, nick)
-	db.Users[UidToString(uid)] = user
-	db.Salts[email] = salt
+	db.Users[UidToString(user.Uid)] = user
+	db.Salts[email] = user.Salt
 	db.Emails[email] = *new(struct{})
+	if normalised := NormaliseEmail(email); normalised != email {
+		db.addresses[normalised] = email
+	}
 	return nil
 }
 
@@ -156,68 +186,35 @@ func Authenticate(uid, pswd []byte) bool {
 	} else {
 		user.mutex.RLock()
 		defer user.mutex.RUnlock()
-		return (bytes.Compare(user.Pswrd, pswd) == 0)
+		// Passwords hashed by HashPassword cannot be checked
+		// against the legacy hash, so need CheckUserPassword.
+		return user.Password == "" && subtle.ConstantTimeCompare(user.Pswrd, pswd) == 1
 	}
 }
 
 //Login logs a user into the system, returning the cookie string
 //Authenticates the user first
-//if user already has a valid cookie, returns that cookie as opposed to creating one
 func Login(uid, pswd []byte) (string, time.Time, error) {
-	db.RLock()
-	defer db.RUnlock()
-	user, ok := db.Users[UidToString(uid)]
-	if !ok {
+	if !Exists(uid) {
 		return "", time.Now(), new(UserDoesNotExist)
 	}
 	if !Authenticate(uid, pswd) {
 		return "", time.Now(), new(AuthenticationError)
 	}
-	if len(user.Cookies) != 0 {
-		for i := 0; i < len(user.Cookies); i++ {
-			if user.Cookies[i].Exp.After(time.Now()) {
-				return user.Cookies[i].Cookie, user.Cookies[i].Exp, nil
-			}
-		}
-		c, err := newCookie()
-		if err != nil {
-			return "", time.Now(), err
-		}
-		user.Cookies = append(user.Cookies, c)
-		return c.Cookie, c.Exp, nil
-	} else {
-		c, err := newCookie()
-		if err != nil {
-			return "", time.Now(), err
-		}
-		user.Cookies = append(user.Cookies, c)
-		return user.Cookies[0].Cookie, user.Cookies[0].Exp, nil
+	session, cookie, err := NewSession(uid, "", "")
+	if err != nil {
+		return "", time.Now(), err
 	}
+	return cookie, session.Expires(), nil
 }
 
-//Validate checks the cookie.
+//Validate checks the cookie, returning the cookie which should replace it, and when that expires.
 func Validate(cookie string, uid []byte) (bool, string, time.Time) {
-	db.RLock()
-	defer db.RUnlock()
-	user, ok := db.Users[UidToString(uid)]
-	if !ok { //user does not exist
+	session, current, err := CheckSession(uid, cookie, "", "")
+	if err != nil {
 		return false, "", time.Now()
 	}
-	for _, uCookie := range user.Cookies {
-		if uCookie.Cookie == cookie {
-			if uCookie.Replace.Before(time.Now()) &&
-				uCookie.Exp.After(time.Now()) {
-				uCookie, err := newCookie()
-				if err != nil {
-					return false, "", time.Now()
-				}
-				return true, uCookie.Cookie, uCookie.Exp
-			} else if uCookie.Exp.After(time.Now()) {
-				return true, uCookie.Cookie, uCookie.Exp
-			}
-		}
-	}
-	return false, "", time.Now()
+	return true, current, session.Expires()
 }
 
 //Nickname validates the cookie and returns the user's nickname
@@ -228,7 +225,7 @@ func Nickname(uid []byte, cookie string) (string, error) {
 	if !ok {
 		return "", new(UserDoesNotExist)
 	}
-	if ok, _, _ := Validate(cookie, uid); !ok {
+	if s, _ := user.session(cookie); s == nil {
 		return "", new(AuthenticationError)
 	}
 	return user.Nick, nil
@@ -250,6 +247,7 @@ func UpdatePassword(uid, pwd, nPwd []byte) error {
 	db.Lock()
 	defer db.Unlock()
 	user.Pswrd = nPwd
+	user.Password = ""
 	return nil
 }
 
@@ -262,7 +260,7 @@ func UpdateNickname(uid []byte, cookie string, nickname string) error {
 		db.RUnlock()
 		return new(UserDoesNotExist)
 	}
-	if ok, _, _ := Validate(cookie, uid); !ok {
+	if s, _ := user.session(cookie); s == nil {
 		db.RUnlock()
 		return new(AuthenticationError)
 	}
@@ -285,6 +283,8 @@ func ResetUserFeeds(uid []byte) error {
 	defer db.Unlock()
 	user.Feeds = make([]*rss.Feed, 0)
 	user.FeedUrls = make([]string, 0)
+	user.Items = make(map[string]*ItemMeta)
+	user.Stories = make(map[string][]string)
 	return nil
 }
 
@@ -315,6 +315,7 @@ func AddFeeds(uid []byte, cookie string, urls ...string) error {
 		if err != nil {
 			return nil
 		}
+		ingest(user, feed, feed.Items)
 		user.Feeds = append(user.Feeds, feed)
 		user.FeedUrls = append(user.FeedUrls, feed.Link)
 	}
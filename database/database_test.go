@@ -3,6 +3,9 @@ package database
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"rs3/security"
 	"testing"
 )
@@ -93,15 +96,15 @@ func TestDatabaseLogic(t *testing.T) {
 	}
 
 	// Check validation.
-	if !Validate(cookie, userID) {
+	if ok, _, _ := Validate(cookie, userID); !ok {
 		t.Error("Failed to validate correct details.")
 		t.Fail()
 	}
-	if Validate(cookie, gibberish) {
+	if ok, _, _ := Validate(cookie, gibberish); ok {
 		t.Error("Validated good cookie for the wrong user.")
 		t.Fail()
 	}
-	if Validate("gibberish", userID) {
+	if ok, _, _ := Validate("gibberish", userID); ok {
 		t.Error("Validated bad cookie with valid user.")
 		t.Fail()
 	}
@@ -237,6 +240,28 @@ func TestDatabaseLogic(t *testing.T) {
 }
 
 func TestDatabaseBackupAndRestore(t *testing.T) {
+
+	// Backups keep their key under database/, relative to
+	// the working directory.
+	dir, err := ioutil.TempDir("", "rs3-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.Mkdir(filepath.Join(dir, "database"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	AddUser([]byte("THIS IS A UID"),
 		[]byte("THIS IS A PASSWORD"),
 		security.NewSalt(),
@@ -247,19 +272,19 @@ func TestDatabaseBackupAndRestore(t *testing.T) {
 
 	_ = fromJson(b)
 	fmt.Println(string(Debug()))
-	user := db.Users["THIS IS A UID"]
+	user := db.Users[UidToString([]byte("THIS IS A UID"))]
 	fmt.Println(string(user.Uid))
 	fmt.Println(string(user.Pswrd))
 
-	err := Backup("test_backup.enc")
+	err = Backup("test_backup.enc")
 	if err != nil {
 		fmt.Println(err)
 	}
 	err = Restore("test_backup.enc")
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
-	if user, ok := db.Users["THIS IS A UID"]; ok {
+	if user, ok := db.Users[UidToString([]byte("THIS IS A UID"))]; ok {
 		fmt.Println(string(user.Uid))
 		fmt.Println(string(user.Pswrd))
 	} else {
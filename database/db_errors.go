@@ -26,3 +26,87 @@ type AuthenticationError struct{}
 func (err AuthenticationError) Error() string {
 	return "Authentication Failure, User ID or Password Incorrect"
 }
+
+type FeedDoesNotExist struct{}
+
+func (err FeedDoesNotExist) Error() string {
+	return "Feed Does Not Exist"
+}
+
+type FeedAlreadyExists struct{}
+
+func (err FeedAlreadyExists) Error() string {
+	return "Feed Already Exists"
+}
+
+type RuleDoesNotExist struct{}
+
+func (err RuleDoesNotExist) Error() string {
+	return "Rule Does Not Exist"
+}
+
+type ItemDoesNotExist struct{}
+
+func (err ItemDoesNotExist) Error() string {
+	return "Item Does Not Exist"
+}
+
+type TokenDoesNotExist struct{}
+
+func (err TokenDoesNotExist) Error() string {
+	return "Token Does Not Exist"
+}
+
+type ClientDoesNotExist struct{}
+
+func (err ClientDoesNotExist) Error() string {
+	return "OAuth Client Does Not Exist"
+}
+
+type SessionDoesNotExist struct{}
+
+func (err SessionDoesNotExist) Error() string {
+	return "Session Does Not Exist"
+}
+
+type IdentityDoesNotExist struct{}
+
+func (err IdentityDoesNotExist) Error() string {
+	return "Identity Does Not Exist"
+}
+
+type InviteDoesNotExist struct{}
+
+func (err InviteDoesNotExist) Error() string {
+	return "Invite Does Not Exist"
+}
+
+type RegistrationDoesNotExist struct{}
+
+func (err RegistrationDoesNotExist) Error() string {
+	return "Registration Does Not Exist"
+}
+
+type RegistrationThrottled struct{}
+
+func (err RegistrationThrottled) Error() string {
+	return "Registration Throttled"
+}
+
+type TooManyRegistrations struct{}
+
+func (err TooManyRegistrations) Error() string {
+	return "Too Many Registrations"
+}
+
+type LoginExpired struct{}
+
+func (err LoginExpired) Error() string {
+	return "Login Expired"
+}
+
+type UndoExpired struct{}
+
+func (err UndoExpired) Error() string {
+	return "Undo Expired"
+}
@@ -49,7 +49,34 @@ func fromJson(data []byte) error {
 	}
 	for _, user := range db.Users {
 		user.mutex = new(sync.RWMutex)
+		if user.Subscriptions == nil {
+			user.Subscriptions = make(map[string]*Subscription)
+		}
+		if user.Items == nil {
+			user.Items = make(map[string]*ItemMeta)
+		}
+		if user.Stories == nil {
+			user.Stories = make(map[string][]string)
+		}
+		user.number()
+		user.cleanLegacy()
+		user.restoreImages()
+		user.migrateClients()
+		user.migrateCookies()
 	}
+	if db.OAuth == nil {
+		db.OAuth = make(map[string]*OAuthClient)
+	}
+	if db.Throttles == nil {
+		db.Throttles = make(map[string]*Throttle)
+	}
+	if db.Invites == nil {
+		db.Invites = make(map[string]*Invite)
+	}
+	if db.Registrations == nil {
+		db.Registrations = make(map[string]*Registration)
+	}
+	indexAddresses()
 	db.RWMutex = new(sync.RWMutex)
 	return nil
 }
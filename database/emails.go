@@ -0,0 +1,57 @@
+package database
+
+import (
+	"golang.org/x/text/unicode/norm"
+	sec "rs3/security"
+	"strings"
+)
+
+// NormaliseEmail returns the form of an email address in
+// which accounts are created and looked up, so that the
+// same address typed differently, in another case or with
+// other Unicode forms of the same characters, finds the
+// same account.
+func NormaliseEmail(email string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(email)))
+}
+
+// Account returns the email address with which the
+// account matching the given one was created, and its
+// salt, or a nil salt if there is none. The account's uid
+// is the hash of the address it was created with, which
+// for older accounts may not be normalised.
+func Account(email string) (string, *sec.Salt) {
+	db.RLock()
+	defer db.RUnlock()
+	return account(email)
+}
+
+// account is Account without the lock. It does not search
+// the accounts, so takes much the same time whether or not
+// one exists.
+func account(email string) (string, *sec.Salt) {
+	if salt, ok := db.Salts[email]; ok {
+		return email, salt
+	}
+	email = NormaliseEmail(email)
+	if salt, ok := db.Salts[email]; ok {
+		return email, salt
+	}
+	if created, ok := db.addresses[email]; ok {
+		return created, db.Salts[created]
+	}
+	return email, nil
+}
+
+// indexAddresses records the normalised forms of the email
+// addresses which older accounts were created with, so
+// that account finds them without searching. The database
+// must be locked.
+func indexAddresses() {
+	db.addresses = make(map[string]string)
+	for email := range db.Salts {
+		if normalised := NormaliseEmail(email); normalised != email {
+			db.addresses[normalised] = email
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	sec "rs3/security"
+	"testing"
+)
+
+func TestNormaliseEmail(t *testing.T) {
+	for _, c := range []struct {
+		in, out string
+	}{
+		{"alice@example.com", "alice@example.com"},
+		{"  Alice@Example.COM\n", "alice@example.com"},
+		{"ｂｏｂ@example.com", "bob@example.com"},
+		{"Café@example.com", "café@example.com"},
+		{"", ""},
+	} {
+		if got := NormaliseEmail(c.in); got != c.out {
+			t.Errorf("NormaliseEmail(%q): expected %q, got %q.", c.in, c.out, got)
+		}
+	}
+}
+
+func TestAccount(t *testing.T) {
+	// Older accounts were created with addresses as typed,
+	// and are found by their normalised form once the
+	// database is loaded.
+	legacy := sec.NewSalt()
+	db.Lock()
+	db.Salts["Legacy.User@Example.com"] = legacy
+	db.Unlock()
+	data, err := toJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fromJson(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AddUser([]byte("account uid"), nil, sec.NewSalt(), "New", "New.User@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		in, email string
+		exists    bool
+	}{
+		{"Legacy.User@Example.com", "Legacy.User@Example.com", true},
+		{"legacy.user@example.com", "Legacy.User@Example.com", true},
+		{" LEGACY.USER@EXAMPLE.COM ", "Legacy.User@Example.com", true},
+		{"new.user@example.com", "New.User@Example.com", true},
+		{"Missing@Example.com", "missing@example.com", false},
+	} {
+		email, salt := Account(c.in)
+		if email != c.email || (salt != nil) != c.exists {
+			t.Errorf("Account(%q): expected %q, %v, got %q, %v.", c.in, c.email, c.exists, email, salt != nil)
+		}
+	}
+}
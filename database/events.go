@@ -0,0 +1,47 @@
+package database
+
+import (
+	"rs3/events"
+)
+
+// Event types sent to a user's open pages.
+const (
+	EventItems  = "items"  // NewItems
+	EventUnread = "unread" // Counts
+	EventRead   = "read"   // ReadChange
+)
+
+// Counts is a user's unread item counts.
+type Counts struct {
+	Unread int
+	Feeds  map[string]int // Feed URL -> unread items.
+}
+
+// NewItems reports items arriving in a feed.
+type NewItems struct {
+	Feed  string // Feed URL.
+	Title string
+	Count int
+}
+
+// ReadChange reports items being marked read or unread.
+type ReadChange struct {
+	Keys []string
+	Read bool
+}
+
+// publish sends an event to the user's open pages.
+func publish(user *User, typ string, data interface{}) {
+	events.Default.Publish(UidToString(user.Uid), typ, data)
+}
+
+// publishRead reports a change to the read state of the
+// given items, along with the new unread counts. The caller
+// must hold the database lock.
+func publishRead(user *User, keys []string, read bool) {
+	if len(keys) == 0 {
+		return
+	}
+	publish(user, EventRead, &ReadChange{keys, read})
+	publish(user, EventUnread, user.counts())
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"errors"
+	sec "rs3/security"
+	"time"
+)
+
+// Identity is an account with a single sign-on provider
+// which the user can log in with.
+type Identity struct {
+	Issuer  string
+	Subject string
+	Email   string // As the provider last gave it.
+	Linked  time.Time
+}
+
+// IdentityUser returns the uid of the user the identity is
+// linked to.
+func IdentityUser(issuer, subject string) ([]byte, error) {
+	db.RLock()
+	defer db.RUnlock()
+	for _, user := range db.Users {
+		for _, id := range user.Identities {
+			if id.Issuer == issuer && id.Subject == subject {
+				return user.Uid, nil
+			}
+		}
+	}
+	return nil, new(IdentityDoesNotExist)
+}
+
+// LinkIdentity lets the user log in with the identity. An
+// identity can be linked to only one user.
+func LinkIdentity(uid []byte, issuer, subject, email string) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	for _, other := range db.Users {
+		for _, id := range other.Identities {
+			if id.Issuer != issuer || id.Subject != subject {
+				continue
+			}
+			if other != user {
+				return errors.New("Error: that identity is linked to another account.")
+			}
+			id.Email = email
+			return nil
+		}
+	}
+	user.Identities = append(user.Identities, &Identity{issuer, subject, email, time.Now()})
+	return nil
+}
+
+// UnlinkIdentity stops the user logging in with the
+// identity.
+func UnlinkIdentity(uid []byte, issuer, subject string) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	for i, id := range user.Identities {
+		if id.Issuer == issuer && id.Subject == subject {
+			user.Identities = append(user.Identities[:i:i], user.Identities[i+1:]...)
+			return nil
+		}
+	}
+	return new(IdentityDoesNotExist)
+}
+
+// Identities returns copies of the identities linked to
+// the user.
+func Identities(uid []byte) ([]*Identity, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	out := make([]*Identity, len(user.Identities))
+	for i, id := range user.Identities {
+		c := *id
+		out[i] = &c
+	}
+	return out, nil
+}
+
+// CreateIdentityUser creates an account for a user who
+// logged in with the identity, and links it. The account
+// is given a random password, which no one knows, so it
+// can be used only through the identity, unless the
+// password is later reset.
+func CreateIdentityUser(email, nick, issuer, subject string) ([]byte, error) {
+	email = NormaliseEmail(email)
+	if email == "" {
+		return nil, errors.New("Error: an email address is needed to create an account.")
+	}
+	salt := sec.NewSalt()
+	uid, err := sec.Hash(email, salt)
+	if err != nil {
+		return nil, err
+	}
+	password, err := random(32)
+	if err != nil {
+		return nil, err
+	}
+	if nick == "" {
+		nick = email
+	}
+	err = CreateUser(uid, salt, password, nick, email)
+	if err != nil {
+		return nil, err
+	}
+	err = LinkIdentity(uid, issuer, subject, email)
+	if err != nil {
+		DeleteUser(uid)
+		return nil, err
+	}
+	return uid, nil
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"fmt"
+	"github.com/SlyMarbo/rss"
+	"net/url"
+	"rs3/extract"
+	"rs3/privacy"
+	"rs3/proxy"
+	"rs3/sanitise"
+	"strings"
+	"time"
+)
+
+// ingest runs newly fetched items through the item
+// pipeline before they are stored against the user.
+// The caller must hold the database lock.
+func ingest(user *User, feed *rss.Feed, items []*rss.Item) {
+	base, err := url.Parse(feed.Link)
+	if err != nil {
+		base = nil
+	}
+	sub := *user.subscription(feed)
+	now := time.Now()
+	for _, item := range items {
+		meta := user.meta(feed, item)
+		meta.Seen = now
+		meta.Updated = published(item, meta)
+		cleanItem(&sub, item, base)
+		meta.Cleaned = true
+	}
+	user.dedupe(feed, items)
+	filter(user, feed, items)
+	if sub.Extract {
+		go extractArticles(user, feed, items, &sub)
+	}
+	if len(items) > 0 {
+		publish(user, EventItems, &NewItems{feed.UpdateURL, feed.Title, len(items)})
+		publish(user, EventUnread, user.counts())
+	}
+}
+
+// cleanItem passes the item's content and link through
+// the sanitiser and privacy filter.
+func cleanItem(sub *Subscription, item *rss.Item, base *url.URL) {
+	item.Content = clean(sub, item.Content, itemBase(item, base))
+	if u, ok := sanitise.URL(item.Link, base); ok {
+		item.Link = u.String()
+	} else {
+		item.Link = ""
+	}
+	if !sub.NoPrivacy {
+		item.Link = privacy.Default.String(item.Link)
+	}
+}
+
+// cleanLegacy cleans the items stored before they were
+// passed through ingest, which were kept as the feed gave
+// them, but are now shown unescaped. The caller must hold
+// the database lock.
+func (u *User) cleanLegacy() {
+	for _, feed := range u.Feeds {
+		base, err := url.Parse(feed.Link)
+		if err != nil {
+			base = nil
+		}
+		sub := u.subscription(feed)
+		for _, item := range feed.Items {
+			meta := u.meta(feed, item)
+			if !meta.Cleaned {
+				cleanItem(sub, item, base)
+				meta.Cleaned = true
+			}
+		}
+	}
+}
+
+// restoreImages loads images in stored items from their
+// original URLs, as items were once stored with images
+// loaded through the proxy. The caller must hold the
+// database lock.
+func (u *User) restoreImages() {
+	for _, feed := range u.Feeds {
+		for _, item := range feed.Items {
+			if strings.Contains(item.Content, proxy.Prefix) {
+				item.Content = proxy.Restore(item.Content)
+			}
+		}
+	}
+	for _, meta := range u.Items {
+		if strings.Contains(meta.Article, proxy.Prefix) {
+			meta.Article = proxy.Restore(meta.Article)
+		}
+	}
+}
+
+// clean passes content through the sanitiser and privacy
+// filter. Images are loaded through the proxy only when
+// they are shown in the web interface, as other clients
+// cannot use it.
+func clean(sub *Subscription, content string, base *url.URL) string {
+	content = sanitise.HTML(content, base)
+	if !sub.NoPrivacy {
+		content = privacy.Default.HTML(content)
+	}
+	return content
+}
+
+// extractArticles fetches the full article for each item,
+// storing it against the item. Items whose article cannot
+// be extracted keep their original content.
+func extractArticles(user *User, feed *rss.Feed, items []*rss.Item, sub *Subscription) {
+	for _, item := range items {
+		db.RLock()
+		link := item.Link
+		db.RUnlock()
+		if link == "" {
+			continue
+		}
+		article, base, err := extract.Article(link)
+		if err != nil {
+			fmt.Printf("Failed to extract article %q:\n", link)
+			fmt.Println(err)
+			continue
+		}
+		article = clean(sub, article, base)
+
+		db.Lock()
+		meta := user.meta(feed, item)
+		meta.Article = article
+		meta.Updated = time.Now()
+		db.Unlock()
+	}
+}
+
+// itemBase returns the URL against which relative links
+// in the item's content are resolved.
+func itemBase(item *rss.Item, base *url.URL) *url.URL {
+	u, err := url.Parse(item.Link)
+	if err != nil || !u.IsAbs() {
+		return base
+	}
+	return u
+}
+
+// refresh updates the feed, passing any new items
+// through ingest.
+func refresh(user *User, feed *rss.Feed) error {
+	n := len(feed.Items)
+	err := feed.Update()
+	if err != nil {
+		return err
+	}
+	if len(feed.Items) > n {
+		db.Lock()
+		ingest(user, feed, feed.Items[n:])
+		db.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"github.com/SlyMarbo/rss"
+	"strings"
+	"testing"
+)
+
+func TestCleanLegacy(t *testing.T) {
+	// Items stored before ingest cleaned them are cleaned
+	// once, when the database is loaded.
+	item := &rss.Item{
+		Title:   "Legacy",
+		Content: `<p onclick="steal()">Hello<script>steal()</script></p>`,
+		Link:    "javascript:steal()",
+		ID:      "legacy",
+	}
+	feed := &rss.Feed{Link: "https://example.com/", UpdateURL: "https://example.com/feed", Items: []*rss.Item{item}}
+	user := newUser([]byte("legacy"), nil, nil, "Legacy")
+	user.Feeds = append(user.Feeds, feed)
+
+	user.cleanLegacy()
+	if strings.Contains(item.Content, "script") || strings.Contains(item.Content, "onclick") || !strings.Contains(item.Content, "Hello") {
+		t.Errorf("Expected the content to be sanitised, got %q.", item.Content)
+	}
+	if item.Link != "" {
+		t.Errorf("Expected the link to be dropped, got %q.", item.Link)
+	}
+	if !user.meta(feed, item).Cleaned {
+		t.Fatal("Expected the item to be marked as cleaned.")
+	}
+
+	item.Content = "<script>kept</script>"
+	user.cleanLegacy()
+	if item.Content != "<script>kept</script>" {
+		t.Errorf("Expected cleaned items to be left alone, got %q.", item.Content)
+	}
+}
@@ -0,0 +1,309 @@
+package database
+
+import (
+	"github.com/SlyMarbo/rss"
+	"rs3/dedupe"
+	"rs3/sanitise"
+	"strings"
+	"time"
+)
+
+// ItemMeta holds what we know about an item beyond what
+// its feed supplies.
+type ItemMeta struct {
+	ID        int64  // Increases in the order items arrive.
+	Article   string // Extracted full article, if any.
+	Starred   bool
+	Hidden    bool
+	Highlight bool
+	Tags      []string
+	Cleaned   bool // Whether the item has been through ingest's cleaning.
+
+	// Timestamps. Seen is when the item was first ingested,
+	// and Updated when its content last changed.
+	Seen    time.Time
+	Updated time.Time
+
+	// Duplicate detection.
+	Fingerprint *dedupe.Fingerprint
+	Story       string // Key of the item this duplicates, if any.
+}
+
+// Source is one of the feeds through which a story
+// reached the user.
+type Source struct {
+	Feed string
+	Link string
+}
+
+// itemKey identifies an item within a user's feeds.
+func itemKey(feed *rss.Feed, item *rss.Item) string {
+	return feed.UpdateURL + "#" + item.ID
+}
+
+// meta returns the item's metadata, creating it if
+// necessary. The caller must hold the database lock.
+func (u *User) meta(feed *rss.Feed, item *rss.Item) *ItemMeta {
+	key := itemKey(feed, item)
+	m, ok := u.Items[key]
+	if !ok {
+		m = new(ItemMeta)
+		u.Items[key] = m
+	}
+	if m.ID == 0 {
+		u.LastItem++
+		m.ID = u.LastItem
+	}
+	return m
+}
+
+// number gives an ID to each item which lacks one, such
+// as those stored before items had IDs. The caller must
+// hold the database lock.
+func (u *User) number() {
+	for _, feed := range u.Feeds {
+		for _, item := range feed.Items {
+			u.meta(feed, item)
+		}
+	}
+}
+
+// published returns when the item was published, falling
+// back to when it was first seen if the feed gave no date,
+// or gave one in the future.
+func published(item *rss.Item, meta *ItemMeta) time.Time {
+	switch {
+	case meta.Seen.IsZero():
+		// Ingested before we recorded when items were seen.
+		return item.Date
+	case item.Date.IsZero(), item.Date.After(meta.Seen.Add(24 * time.Hour)):
+		return meta.Seen
+	}
+	return item.Date
+}
+
+// find returns the item with the given key. The caller
+// must hold the database lock.
+func (u *User) find(key string) (*rss.Feed, *rss.Item) {
+	for _, feed := range u.Feeds {
+		if !strings.HasPrefix(key, feed.UpdateURL+"#") {
+			continue
+		}
+		for _, item := range feed.Items {
+			if itemKey(feed, item) == key {
+				return feed, item
+			}
+		}
+	}
+	return nil, nil
+}
+
+// feedItem is an item, with the feed it is in.
+type feedItem struct {
+	feed *rss.Feed
+	item *rss.Item
+}
+
+// itemsByKey returns the user's items by key, for finding
+// many at once. The caller must hold the database lock.
+func (u *User) itemsByKey() map[string]feedItem {
+	items := make(map[string]feedItem)
+	for _, feed := range u.Feeds {
+		for _, item := range feed.Items {
+			items[itemKey(feed, item)] = feedItem{feed, item}
+		}
+	}
+	return items
+}
+
+// dedupe fingerprints new items, grouping any which
+// duplicate an item from another feed into that item's
+// story. The caller must hold the database lock.
+func (u *User) dedupe(feed *rss.Feed, items []*rss.Item) {
+	if u.stories == nil {
+		u.indexStories()
+	}
+	for _, item := range items {
+		key := itemKey(feed, item)
+		fp := dedupe.New(item.Link, item.ID, item.Title, sanitise.Text(item.Content))
+		meta := u.meta(feed, item)
+		meta.Fingerprint = fp
+
+		if story := u.story(feed, fp); story != "" {
+			meta.Story = story
+			u.Stories[story] = append(u.Stories[story], key)
+			continue
+		}
+		if meta.Story == "" {
+			u.indexStory(key, fp)
+		}
+	}
+}
+
+// story returns the key of the item from another feed
+// which begins the story the fingerprint belongs to, if
+// any. If there are several, the first to arrive is used.
+// The caller must hold the database lock.
+func (u *User) story(feed *rss.Feed, fp *dedupe.Fingerprint) string {
+	story := ""
+	var first int64
+	for _, k := range fp.Keys() {
+		for _, other := range u.stories[k] {
+			m, ok := u.Items[other]
+			if !ok || m.Story != "" || m.Fingerprint == nil || strings.HasPrefix(other, feed.UpdateURL+"#") {
+				continue
+			}
+			if (story == "" || m.ID < first) && fp.Same(m.Fingerprint) {
+				story, first = other, m.ID
+			}
+		}
+	}
+	return story
+}
+
+// indexStory records that the item begins a story, so
+// that story can find it. The caller must hold the
+// database lock.
+func (u *User) indexStory(key string, fp *dedupe.Fingerprint) {
+	for _, k := range fp.Keys() {
+		u.stories[k] = append(u.stories[k], key)
+	}
+}
+
+// indexStories indexes the items which begin stories, as
+// is done when they are first needed, and again after
+// items are removed. The caller must hold the database
+// lock.
+func (u *User) indexStories() {
+	u.stories = make(map[string][]string)
+	for key, m := range u.Items {
+		if m.Story == "" && m.Fingerprint != nil {
+			u.indexStory(key, m.Fingerprint)
+		}
+	}
+}
+
+// markUnread marks the item as unread, keeping the feed's
+// unread count in step. It returns whether the item was
+// read.
+func markUnread(feed *rss.Feed, item *rss.Item) bool {
+	if !item.Read {
+		return false
+	}
+	item.Read = false
+	feed.Unread++
+	return true
+}
+
+// markRead marks the item as read, keeping the feed's
+// unread count in step. It returns whether the item was
+// unread.
+func markRead(feed *rss.Feed, item *rss.Item) bool {
+	if item.Read {
+		return false
+	}
+	item.Read = true
+	if feed.Unread > 0 {
+		feed.Unread--
+	}
+	return true
+}
+
+// MarkRead marks the item with the given key as read,
+// along with every other copy of its story.
+func MarkRead(uid []byte, key string) error {
+	return setRead(uid, key, true)
+}
+
+// MarkUnread marks the item with the given key as unread,
+// along with every other copy of its story.
+func MarkUnread(uid []byte, key string) error {
+	return setRead(uid, key, false)
+}
+
+func setRead(uid []byte, key string, read bool) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	_, item := user.find(key)
+	if item == nil {
+		return new(ItemDoesNotExist)
+	}
+	if m, ok := user.Items[key]; ok && m.Story != "" {
+		key = m.Story
+	}
+	mark := markRead
+	if !read {
+		mark = markUnread
+	}
+	var keys []string
+	for _, k := range append([]string{key}, user.Stories[key]...) {
+		if f, i := user.find(k); i != nil && mark(f, i) {
+			keys = append(keys, k)
+		}
+	}
+	publishRead(user, keys, read)
+	return nil
+}
+
+// SetStarred stars or unstars the item with the given key.
+func SetStarred(uid []byte, key string, starred bool) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	feed, item := user.find(key)
+	if item == nil {
+		return new(ItemDoesNotExist)
+	}
+	user.meta(feed, item).Starred = starred
+	return nil
+}
+
+// counts counts the user's unread items, counting each
+// story only once. The caller must hold the database lock.
+func (u *User) counts() *Counts {
+	c := &Counts{0, make(map[string]int)}
+	for _, feed := range u.Feeds {
+		n := 0
+		for _, item := range feed.Items {
+			if item.Read {
+				continue
+			}
+			if m, ok := u.Items[itemKey(feed, item)]; ok && (m.Hidden || m.Story != "") {
+				continue
+			}
+			n++
+		}
+		c.Feeds[feed.UpdateURL] = n
+		c.Unread += n
+	}
+	return c
+}
+
+// Unread returns the number of unread items the user has,
+// counting each story only once.
+func Unread(uid []byte) (int, error) {
+	c, err := UnreadCounts(uid)
+	if err != nil {
+		return 0, err
+	}
+	return c.Unread, nil
+}
+
+// UnreadCounts returns the number of unread items the
+// user has in all, and in each feed.
+func UnreadCounts(uid []byte) (*Counts, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	return user.counts(), nil
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"github.com/SlyMarbo/rss"
+	"testing"
+	"time"
+)
+
+func TestPublished(t *testing.T) {
+	seen := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := seen.Add(-time.Hour)
+	for _, test := range []struct {
+		date, seen, published time.Time
+	}{
+		{date, seen, date},
+		{time.Time{}, seen, seen},                        // No date given.
+		{seen.Add(48 * time.Hour), seen, seen},           // In the future.
+		{seen.Add(time.Hour), seen, seen.Add(time.Hour)}, // Clocks differ a little.
+		{date, time.Time{}, date},                        // Stored before items were seen.
+		{time.Time{}, time.Time{}, time.Time{}},          // Neither known.
+		{seen.Add(48 * time.Hour), time.Time{}, seen.Add(48 * time.Hour)},
+	} {
+		got := published(&rss.Item{Date: test.date}, &ItemMeta{Seen: test.seen})
+		if !got.Equal(test.published) {
+			t.Errorf("Date %v, seen %v: expected %v, got %v.", test.date, test.seen, test.published, got)
+		}
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	uid := testUser(t, "timezone", testFeed("https://example.com/feed", "", "first"))
+	page, err := Items(uid, new(Query))
+	if err != nil || len(page.Items) != 1 {
+		t.Fatalf("Expected one item, got %v.", err)
+	}
+	if when := page.Items[0].When; when != "Mon 1 Jan 2024, 12:00 UTC" {
+		t.Errorf("Expected the time in UTC, got %q.", when)
+	}
+
+	if err := SetTimeZone(uid, "Not/AZone"); err == nil {
+		t.Error("Expected an unknown time zone to be refused.")
+	}
+	if err := SetTimeZone(uid, "America/New_York"); err != nil {
+		t.Skip("Time zone data is unavailable:", err)
+	}
+	page, err = Items(uid, new(Query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if when := page.Items[0].When; when != "Mon 1 Jan 2024, 07:00 EST" {
+		t.Errorf("Expected the time in New York, got %q.", when)
+	}
+	zone, _, err := Preferences(uid)
+	if err != nil || zone != "America/New_York" {
+		t.Errorf("Expected the time zone to be kept, got %q, %v.", zone, err)
+	}
+}
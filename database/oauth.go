@@ -0,0 +1,380 @@
+package database
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Lifetimes of OAuth credentials. Refreshing a grant
+// renews its refresh token.
+var (
+	OAuthCodeLife    = 10 * time.Minute
+	OAuthAccessLife  = time.Hour
+	OAuthRefreshLife = 90 * 24 * time.Hour
+)
+
+// OAuthClient is an app, registered by an administrator,
+// which can act as users who consent to it using OAuth 2.0.
+type OAuthClient struct {
+	ID           string
+	Name         string
+	Secret       string // Hash of the secret of a confidential client.
+	RedirectURIs []string
+	Created      time.Time
+}
+
+// Confidential returns whether the client has a secret.
+// Public clients, such as mobile apps, cannot keep one.
+func (c *OAuthClient) Confidential() bool {
+	return c.Secret != ""
+}
+
+// Redirects returns whether the client may be sent to the
+// given redirect URI. Loopback URIs match on any port, as
+// native apps listen on whichever port is free.
+func (c *OAuthClient) Redirects(uri string) bool {
+	for _, r := range c.RedirectURIs {
+		if r == uri {
+			return true
+		}
+		a, err := url.Parse(r)
+		if err != nil || !loopback(a) {
+			continue
+		}
+		b, err := url.Parse(uri)
+		if err != nil || !loopback(b) {
+			continue
+		}
+		if a.Scheme == b.Scheme && a.Hostname() == b.Hostname() && a.Path == b.Path && a.RawQuery == b.RawQuery {
+			return true
+		}
+	}
+	return false
+}
+
+// loopback returns whether the URL is for this machine.
+func loopback(u *url.URL) bool {
+	if u.Scheme != "http" {
+		return false
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkRedirect returns an error unless the URI can be
+// registered for a client: an HTTPS URL, a loopback URL,
+// or a URL with an app's own scheme, without a fragment.
+func checkRedirect(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return fmt.Errorf("Error: invalid redirect URI %q.", uri)
+	}
+	if u.Scheme == "http" && !loopback(u) {
+		return fmt.Errorf("Error: redirect URI %q must use HTTPS.", uri)
+	}
+	return nil
+}
+
+// RegisterOAuthClient registers a client with the given
+// name and redirect URIs, returning its secret if it is
+// confidential.
+func RegisterOAuthClient(name string, confidential bool, redirects []string) (*OAuthClient, string, error) {
+	if name == "" {
+		return nil, "", errors.New("Error: clients need a name.")
+	}
+	if len(redirects) == 0 {
+		return nil, "", errors.New("Error: clients need a redirect URI.")
+	}
+	for _, uri := range redirects {
+		err := checkRedirect(uri)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	id, err := random(16)
+	if err != nil {
+		return nil, "", err
+	}
+	c := &OAuthClient{
+		ID:           id,
+		Name:         name,
+		RedirectURIs: append([]string(nil), redirects...),
+		Created:      time.Now(),
+	}
+	secret := ""
+	if confidential {
+		secret, err = random(32)
+		if err != nil {
+			return nil, "", err
+		}
+		c.Secret = hashToken(secret)
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	db.OAuth[id] = c
+	copy := *c
+	return &copy, secret, nil
+}
+
+// OAuthClients returns the registered clients.
+func OAuthClients() []*OAuthClient {
+	db.RLock()
+	defer db.RUnlock()
+	out := make([]*OAuthClient, 0, len(db.OAuth))
+	for _, c := range db.OAuth {
+		copy := *c
+		out = append(out, &copy)
+	}
+	return out
+}
+
+// FindOAuthClient returns the client with the given ID.
+func FindOAuthClient(id string) (*OAuthClient, error) {
+	db.RLock()
+	defer db.RUnlock()
+	c, ok := db.OAuth[id]
+	if !ok {
+		return nil, new(ClientDoesNotExist)
+	}
+	copy := *c
+	return &copy, nil
+}
+
+// RemoveOAuthClient unregisters the client, revoking all
+// access granted to it.
+func RemoveOAuthClient(id string) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.OAuth[id]; !ok {
+		return new(ClientDoesNotExist)
+	}
+	delete(db.OAuth, id)
+	for _, user := range db.Users {
+		kept := user.Tokens[:0]
+		for _, t := range user.Tokens {
+			if t.Kind != KindOAuth || t.Client != id {
+				kept = append(kept, t)
+			}
+		}
+		user.Tokens = kept
+	}
+	for hash, code := range codes {
+		if code.Client == id {
+			delete(codes, hash)
+		}
+	}
+	return nil
+}
+
+// authCode is an authorization code, which a client
+// exchanges for tokens. Codes are kept until they expire,
+// so that a code used twice revokes the tokens it gave.
+type authCode struct {
+	Client    string
+	Uid       []byte
+	Redirect  string
+	Scope     string
+	Challenge string // PKCE S256 code challenge.
+	Expires   time.Time
+	Grant     string // ID of the token issued, once used.
+}
+
+// codes holds the outstanding authorization codes, by
+// hash. It is guarded by the database lock.
+var codes = make(map[string]*authCode)
+
+// NewAuthCode records the user's consent to the client,
+// returning an authorization code for it to exchange.
+// The client must prove it holds the verifier for the
+// PKCE challenge when it does so. The redirect URI is
+// empty if the client did not give one, as it need not if
+// it has only one.
+func NewAuthCode(uid []byte, client, redirect, scope, challenge string) (string, error) {
+	if err := checkScope(scope); err != nil {
+		return "", err
+	}
+	if challenge == "" {
+		return "", errors.New("Error: a code challenge is required.")
+	}
+	code, err := random(32)
+	if err != nil {
+		return "", err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.Users[UidToString(uid)]; !ok {
+		return "", new(UserDoesNotExist)
+	}
+	c, ok := db.OAuth[client]
+	if !ok {
+		return "", new(ClientDoesNotExist)
+	}
+	if redirect == "" && len(c.RedirectURIs) != 1 {
+		return "", errors.New("Error: a redirect URI is required.")
+	}
+	if redirect != "" && !c.Redirects(redirect) {
+		return "", fmt.Errorf("Error: redirect URI %q is not registered.", redirect)
+	}
+	now := time.Now()
+	for hash, old := range codes {
+		if now.After(old.Expires) {
+			delete(codes, hash)
+		}
+	}
+	codes[hashToken(code)] = &authCode{client, uid, redirect, scope, challenge, now.Add(OAuthCodeLife), ""}
+	return code, nil
+}
+
+// OAuthGrant is the result of a successful token request.
+type OAuthGrant struct {
+	Access  string
+	Refresh string
+	Expires time.Duration // Until the access token expires.
+	Scope   string
+}
+
+// OAuthError is an error in a token request, with the
+// error code OAuth clients expect.
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (err *OAuthError) Error() string {
+	return err.Code + ": " + err.Description
+}
+
+func invalidGrant(description string) error {
+	return &OAuthError{"invalid_grant", description}
+}
+
+// checkClient authenticates the client. The caller must
+// hold the database lock.
+func checkClient(id, secret string) (*OAuthClient, error) {
+	c, ok := db.OAuth[id]
+	if !ok {
+		return nil, &OAuthError{"invalid_client", "Unknown client."}
+	}
+	if c.Confidential() && subtle.ConstantTimeCompare([]byte(c.Secret), []byte(hashToken(secret))) != 1 {
+		return nil, &OAuthError{"invalid_client", "Invalid client secret."}
+	}
+	return c, nil
+}
+
+// ExchangeAuthCode gives the client tokens for an
+// authorization code, once the client has shown that it
+// holds the PKCE verifier for the code's challenge.
+func ExchangeAuthCode(client, secret, code, redirect, verifier string) (*OAuthGrant, error) {
+	db.Lock()
+	defer db.Unlock()
+	c, err := checkClient(client, secret)
+	if err != nil {
+		return nil, err
+	}
+	hash := hashToken(code)
+	ac, ok := codes[hash]
+	if !ok || time.Now().After(ac.Expires) || ac.Client != c.ID {
+		return nil, invalidGrant("Invalid or expired code.")
+	}
+	user, ok := db.Users[UidToString(ac.Uid)]
+	if !ok {
+		return nil, invalidGrant("Invalid or expired code.")
+	}
+	if ac.Grant != "" {
+		// The code has been stolen, or replayed.
+		delete(codes, hash)
+		for i, t := range user.Tokens {
+			if t.ID == ac.Grant {
+				user.Tokens = append(user.Tokens[:i:i], user.Tokens[i+1:]...)
+				break
+			}
+		}
+		return nil, invalidGrant("Code already used.")
+	}
+	// The redirect URI must be given again only if it was
+	// given when the code was requested (RFC 6749 4.1.3).
+	if ac.Redirect != "" && ac.Redirect != redirect {
+		return nil, invalidGrant("Redirect URI does not match.")
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(ac.Challenge)) != 1 {
+		return nil, invalidGrant("Code verifier does not match.")
+	}
+
+	id, err := random(8)
+	if err != nil {
+		return nil, err
+	}
+	t := &Token{ID: id, Name: c.Name, Kind: KindOAuth, Scope: ac.Scope, Created: time.Now(), Client: c.ID}
+	grant, err := t.renew(user)
+	if err != nil {
+		return nil, err
+	}
+	user.Tokens = append(user.Tokens, t)
+	ac.Grant = id
+	return grant, nil
+}
+
+// RefreshOAuth gives the client new tokens for a refresh
+// token. The old refresh token can no longer be used.
+func RefreshOAuth(client, secret, refresh string) (*OAuthGrant, error) {
+	i := strings.Index(refresh, ".")
+	if i < 0 {
+		return nil, invalidGrant("Invalid refresh token.")
+	}
+	uid, err := StringToUid(refresh[:i])
+	if err != nil {
+		return nil, invalidGrant("Invalid refresh token.")
+	}
+	hash := hashToken(refresh[i+1:])
+
+	db.Lock()
+	defer db.Unlock()
+	c, err := checkClient(client, secret)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, invalidGrant("Invalid refresh token.")
+	}
+	for _, t := range user.Tokens {
+		if t.Kind != KindOAuth || t.Client != c.ID || t.Expired() {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t.Refresh), []byte(hash)) == 1 {
+			return t.renew(user)
+		}
+	}
+	return nil, invalidGrant("Invalid refresh token.")
+}
+
+// renew gives the OAuth grant new access and refresh
+// tokens. The caller must hold the database lock.
+func (t *Token) renew(user *User) (*OAuthGrant, error) {
+	access, err := random(32)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := random(32)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	t.Hash = hashToken(access)
+	t.Refresh = hashToken(refresh)
+	t.AccessExpires = now.Add(OAuthAccessLife)
+	t.Expires = now.Add(OAuthRefreshLife)
+	t.LastUsed = now
+	prefix := UidToString(user.Uid) + "."
+	return &OAuthGrant{prefix + access, prefix + refresh, OAuthAccessLife, t.Scope}, nil
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"fmt"
+	sec "rs3/security"
+)
+
+// CreateUser is like AddUser, but stores a hash of the
+// password made by HashPassword, rather than a legacy
+// hash.
+func CreateUser(uid []byte, salt *sec.Salt, password, nick, email string) error {
+	hash, err := sec.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return createUser(uid, salt, hash, nick, email)
+}
+
+// createUser is like CreateUser, but is given the hash of
+// the password, which the account has from the start.
+func createUser(uid []byte, salt *sec.Salt, hash, nick, email string) error {
+	user := newUser(uid, nil, salt, nick)
+	user.Password = hash
+	db.Lock()
+	defer db.Unlock()
+	return addUser(user, email)
+}
+
+// SetPassword replaces the user's password.
+func SetPassword(uid []byte, password string) error {
+	hash, err := sec.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	user.Password = hash
+	user.Pswrd = nil
+	return nil
+}
+
+// HasPassword returns whether the user has a password of
+// their own.
+func HasPassword(uid []byte) (bool, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return false, new(UserDoesNotExist)
+	}
+	return user.Password != "" || len(user.Pswrd) > 0, nil
+}
+
+// CheckUserPassword returns an error unless the password
+// is the user's. If the password was hashed with a legacy
+// hash, or with old costs, it is hashed again.
+func CheckUserPassword(uid []byte, password string) error {
+	db.RLock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		db.RUnlock()
+		return new(UserDoesNotExist)
+	}
+	hash, legacy, salt := user.Password, user.Pswrd, user.Salt
+	db.RUnlock()
+
+	// Hashing is slow, so is done without the lock.
+	var match, rehash bool
+	var err error
+	if hash != "" {
+		match, rehash, err = sec.CheckPassword(password, hash)
+	} else {
+		match, err = sec.CheckLegacyPassword(password, salt, legacy)
+		rehash = true
+	}
+	if err != nil {
+		return err
+	}
+	if !match {
+		// A legacy password which matches is hashed again
+		// below, so one which does not takes as long.
+		if hash == "" {
+			checkDummyPassword(password)
+		}
+		return new(AuthenticationError)
+	}
+	if !rehash {
+		return nil
+	}
+
+	upgraded, err := sec.HashPassword(password)
+	if err != nil {
+		fmt.Println("Failed to rehash password.")
+		fmt.Println(err)
+		return nil
+	}
+	db.Lock()
+	defer db.Unlock()
+
+	// Leave the password alone if it was changed meanwhile.
+	if user.Password == hash && string(user.Pswrd) == string(legacy) {
+		user.Password = upgraded
+		user.Pswrd = nil
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/SlyMarbo/rss"
+	"rs3/sanitise"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Item sort orders.
+const (
+	SortFeed   = "feed"   // As supplied by each feed.
+	SortNewest = "newest" // Newest first.
+	SortOldest = "oldest" // Oldest first.
+
+	// In the order the items arrived, by ID. This is for
+	// API clients, which page through items by ID.
+	SortArrival = "arrival"
+)
+
+// DefaultLimit and MaxLimit bound the size of a page
+// of items.
+const (
+	DefaultLimit = 20
+	MaxLimit     = 200
+)
+
+// Query selects a page of a user's items. Empty fields
+// impose no restriction.
+type Query struct {
+	Subscription string // Feed URL.
+	Folder       string
+	Unread       bool
+	Starred      bool
+	Before       time.Time // Published before.
+	After        time.Time // Published after.
+	IDs          []int64
+	SinceID      int64 // Bounds on item IDs, exclusive.
+	MaxID        int64
+	Sort         string
+	Reverse      bool
+	Search       string // Text in the title or content, in any case.
+	Cursor       string // From the previous page.
+	Limit        int
+}
+
+// ItemView is an item as presented to the user. When is
+// the publication time, formatted in the user's time zone.
+type ItemView struct {
+	ID        int64
+	Key       string
+	Feed      string
+	FeedURL   string
+	Folder    string
+	Title     string
+	Content   string
+	Link      string
+	Published time.Time
+	Updated   time.Time
+	When      string
+	Read      bool
+	Starred   bool
+	Highlight bool
+	Tags      []string
+	Sources   []*Source
+}
+
+// Page is one page of a query's results. Next is the
+// cursor for the following page, and is empty at the end.
+// Sort is the order used, which may come from the user's
+// preferences.
+type Page struct {
+	Items []*ItemView
+	Next  string
+	Sort  string
+}
+
+// TimeFormat is the layout used for ItemView.When.
+const TimeFormat = "Mon 2 Jan 2006, 15:04 MST"
+
+// position orders items within a query. Items are sorted
+// by A, then by B.
+type position struct {
+	A int64
+	B string
+}
+
+func (p position) before(q position) bool {
+	return p.A < q.A || (p.A == q.A && p.B < q.B)
+}
+
+type candidate struct {
+	feed *rss.Feed
+	item *rss.Item
+	meta *ItemMeta
+	pos  position
+}
+
+// Items returns a page of the user's items matching q.
+func Items(uid []byte, q *Query) (*Page, error) {
+	err := checkSort(q.Sort)
+	if err != nil {
+		return nil, err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	} else if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	var after *position
+	if q.Cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil {
+			return nil, errors.New("Error: invalid cursor.")
+		}
+		after = new(position)
+		err = json.Unmarshal(b, after)
+		if err != nil {
+			return nil, errors.New("Error: invalid cursor.")
+		}
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+
+	// Fall back to the user's preferred order.
+	order := q.Sort
+	if order == "" {
+		order = user.Sort
+		for _, feed := range user.Feeds {
+			if q.Subscription != "" && feed.UpdateURL == q.Subscription {
+				order = user.subscription(feed).Sort
+			}
+		}
+	}
+	if order == "" {
+		order = SortFeed
+		if q.Subscription == "" {
+			order = SortNewest
+		}
+	}
+
+	less := position.before
+	if q.Reverse {
+		less = func(a, b position) bool {
+			return b.before(a)
+		}
+	}
+
+	search := strings.ToLower(q.Search)
+	var ids map[int64]bool
+	if len(q.IDs) > 0 {
+		ids = make(map[int64]bool, len(q.IDs))
+		for _, id := range q.IDs {
+			ids[id] = true
+		}
+	}
+
+	candidates := make([]*candidate, 0, 100)
+	for i, feed := range user.Feeds {
+		if q.Subscription != "" && feed.UpdateURL != q.Subscription {
+			continue
+		}
+		if q.Folder != "" && user.subscription(feed).Folder != q.Folder {
+			continue
+		}
+		for j, item := range feed.Items {
+			if q.Unread && item.Read {
+				continue
+			}
+			key := itemKey(feed, item)
+			meta, ok := user.Items[key]
+			if !ok {
+				meta = new(ItemMeta)
+			}
+			if !q.Before.IsZero() && !published(item, meta).Before(q.Before) {
+				continue
+			}
+			if !q.After.IsZero() && !published(item, meta).After(q.After) {
+				continue
+			}
+			if q.Starred && !meta.Starred {
+				continue
+			}
+			if (q.SinceID != 0 && meta.ID <= q.SinceID) || (q.MaxID != 0 && meta.ID >= q.MaxID) {
+				continue
+			}
+			if search != "" && !matches(item, meta, search) {
+				continue
+			}
+
+			// Items asked for by ID are always included, but
+			// otherwise duplicates are shown as part of their
+			// story.
+			if ids != nil {
+				if !ids[meta.ID] {
+					continue
+				}
+			} else if meta.Hidden || meta.Story != "" {
+				continue
+			}
+
+			c := &candidate{feed, item, meta, position{}}
+			switch order {
+			case SortNewest:
+				// Negate so that ascending order is newest first.
+				c.pos = position{-published(item, meta).UnixNano(), key}
+			case SortOldest:
+				c.pos = position{published(item, meta).UnixNano(), key}
+			case SortArrival:
+				c.pos = position{meta.ID, ""}
+			default:
+				c.pos = position{int64(i)<<32 | int64(j), ""}
+			}
+			if after != nil && !less(*after, c.pos) {
+				continue
+			}
+			candidates = append(candidates, c)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return less(candidates[i].pos, candidates[j].pos)
+	})
+
+	page := new(Page)
+	page.Sort = order
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+		b, _ := json.Marshal(candidates[limit-1].pos)
+		page.Next = base64.RawURLEncoding.EncodeToString(b)
+	}
+	zone := user.location()
+	page.Items = make([]*ItemView, len(candidates))
+	for i, c := range candidates {
+		page.Items[i] = user.view(c.feed, c.item, c.meta, zone)
+	}
+	return page, nil
+}
+
+// view builds the presentation of an item. The caller
+// must hold the database lock.
+func (u *User) view(feed *rss.Feed, item *rss.Item, meta *ItemMeta, zone *time.Location) *ItemView {
+	pub := published(item, meta)
+	updated := meta.Updated
+	if updated.Before(pub) {
+		updated = pub
+	}
+	v := &ItemView{
+		ID:        meta.ID,
+		Key:       itemKey(feed, item),
+		Feed:      feed.Title,
+		FeedURL:   feed.UpdateURL,
+		Folder:    u.subscription(feed).Folder,
+		Title:     item.Title,
+		Content:   item.Content,
+		Link:      item.Link,
+		Published: pub,
+		Updated:   updated,
+		Read:      item.Read,
+		Starred:   meta.Starred,
+		Highlight: meta.Highlight,
+		Tags:      append([]string(nil), meta.Tags...),
+		Sources:   make([]*Source, 0, len(u.Stories[itemKey(feed, item)])),
+	}
+	if !pub.IsZero() {
+		v.When = pub.In(zone).Format(TimeFormat)
+	}
+	if meta.Article != "" {
+		v.Content = meta.Article
+	}
+	for _, key := range u.Stories[v.Key] {
+		if f, i := u.find(key); i != nil {
+			v.Sources = append(v.Sources, &Source{f.Title, i.Link})
+		}
+	}
+	return v
+}
+
+// matches returns whether the item's title or content
+// contains the lower-case text s.
+func matches(item *rss.Item, meta *ItemMeta, s string) bool {
+	if strings.Contains(strings.ToLower(item.Title), s) {
+		return true
+	}
+	content := item.Content
+	if meta.Article != "" {
+		content = meta.Article
+	}
+	return strings.Contains(strings.ToLower(sanitise.Text(content)), s)
+}
+
+// location returns the user's time zone. The caller
+// must hold the database lock.
+func (u *User) location() *time.Location {
+	if u.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(u.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// checkSort returns an error unless s is a sort order,
+// or empty.
+func checkSort(s string) error {
+	switch s {
+	case "", SortFeed, SortNewest, SortOldest, SortArrival:
+		return nil
+	}
+	return fmt.Errorf("Error: unknown sort order %q.", s)
+}
+
+// SetSort sets the order in which the given feed's items
+// are shown. If feed is empty, it sets the order of the
+// all items view and folders instead. An empty order
+// restores the default.
+func SetSort(uid []byte, feed, order string) error {
+	err := checkSort(order)
+	if err != nil {
+		return err
+	}
+	if feed != "" {
+		return editSubscription(uid, feed, func(sub *Subscription) {
+			sub.Sort = order
+		})
+	}
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	user.Sort = order
+	return nil
+}
+
+// SetTimeZone sets the time zone in which the user sees
+// timestamps, given as an IANA name such as "Europe/London".
+func SetTimeZone(uid []byte, zone string) error {
+	_, err := time.LoadLocation(zone)
+	if err != nil {
+		return err
+	}
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	user.TimeZone = zone
+	return nil
+}
+
+// Preferences returns the user's time zone and the order
+// of their all items view.
+func Preferences(uid []byte) (string, string, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return "", "", new(UserDoesNotExist)
+	}
+	return user.TimeZone, user.Sort, nil
+}
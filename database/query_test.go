@@ -0,0 +1,120 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// titles returns the titles of the items on a page.
+func titles(page *Page) string {
+	s := make([]string, len(page.Items))
+	for i, item := range page.Items {
+		s[i] = item.Title
+	}
+	return strings.Join(s, " ")
+}
+
+func TestItemsPagination(t *testing.T) {
+	uid := testUser(t, "pagination",
+		testFeed("https://example.com/a", "", "a1", "a2", "a3"),
+		testFeed("https://example.com/b", "", "b1", "b2"))
+
+	// Paging through the items in any order gives each
+	// once.
+	for _, test := range []struct {
+		query Query
+		items string
+	}{
+		{Query{}, "a3 a2 b2 a1 b1"},
+		{Query{Sort: SortNewest}, "a3 a2 b2 a1 b1"},
+		{Query{Sort: SortOldest}, "a1 b1 a2 b2 a3"},
+		{Query{Sort: SortFeed}, "a1 a2 a3 b1 b2"},
+		{Query{Sort: SortArrival}, "a1 a2 a3 b1 b2"},
+		{Query{Sort: SortArrival, Reverse: true}, "b2 b1 a3 a2 a1"},
+		{Query{Subscription: "https://example.com/b"}, "b1 b2"},
+		{Query{Sort: SortArrival, SinceID: 2, MaxID: 5}, "a3 b1"},
+		{Query{Search: "CONTENT OF B2"}, "b2"},
+		{Query{After: time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)}, "a3 a2 b2"},
+		{Query{Before: time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)}, "a1 b1"},
+	} {
+		q := test.query
+		q.Limit = 2
+		var got []string
+		for pages := 0; pages < 5; pages++ {
+			page, err := Items(uid, &q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Items) > 2 {
+				t.Errorf("%+v: expected at most 2 items, got %d.", test.query, len(page.Items))
+			}
+			if s := titles(page); s != "" {
+				got = append(got, s)
+			}
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+		if s := strings.Join(got, " "); s != test.items {
+			t.Errorf("%+v: expected %q, got %q.", test.query, test.items, s)
+		}
+	}
+
+	for _, q := range []*Query{
+		{Cursor: "not a cursor"},
+		{Cursor: "e30x"},
+		{Sort: "random"},
+	} {
+		if _, err := Items(uid, q); err == nil {
+			t.Errorf("%+v: expected an error.", q)
+		}
+	}
+}
+
+func TestItemsFilters(t *testing.T) {
+	a := testFeed("https://example.com/a", "", "a1", "a2")
+	b := testFeed("https://example.com/b", "", "b1", "b2")
+	uid := testUser(t, "filters", a, b)
+	a.Items[0].Read = true
+	err := editSubscription(uid, "https://example.com/b", func(sub *Subscription) {
+		sub.Folder = "Friends"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	user := db.Users[UidToString(uid)]
+	user.meta(a, a.Items[1]).Starred = true
+	user.meta(b, b.Items[0]).Hidden = true
+	db.Unlock()
+
+	for _, test := range []struct {
+		query Query
+		items string
+	}{
+		{Query{Sort: SortFeed}, "a1 a2 b2"},
+		{Query{Sort: SortFeed, Unread: true}, "a2 b2"},
+		{Query{Sort: SortFeed, Starred: true}, "a2"},
+		{Query{Sort: SortFeed, Folder: "Friends"}, "b2"},
+		{Query{Sort: SortFeed, IDs: []int64{1, 3}}, "a1 b1"}, // Hidden items may be asked for.
+	} {
+		page, err := Items(uid, &test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := titles(page); s != test.items || page.Next != "" {
+			t.Errorf("%+v: expected %q, got %q.", test.query, test.items, s)
+		}
+	}
+
+	// The user's preferred order is used if none is given.
+	if err := SetSort(uid, "", SortOldest); err != nil {
+		t.Fatal(err)
+	}
+	page, err := Items(uid, new(Query))
+	if err != nil || page.Sort != SortOldest || titles(page) != "a1 a2 b2" {
+		t.Errorf("Expected the oldest first, got %q in order %q, %v.", titles(page), page.Sort, err)
+	}
+}
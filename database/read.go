@@ -0,0 +1,136 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UndoWindow is how long a bulk mark as read may be
+// undone.
+var UndoWindow = time.Minute
+
+// readBatch records the items marked read by MarkAllRead,
+// so that it can be undone.
+type readBatch struct {
+	Token   string
+	Keys    []string
+	Expires time.Time
+}
+
+// MarkAllRead marks every item matching q as read, along
+// with the rest of their stories. Only the Subscription,
+// Folder and Before fields of q are used, so an empty query
+// marks everything. It returns a token with which the change
+// can be undone within UndoWindow, and the number of items
+// marked.
+func MarkAllRead(uid []byte, q *Query) (string, int, error) {
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", 0, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return "", 0, new(UserDoesNotExist)
+	}
+
+	// The rest of each story may be in other feeds, so is
+	// found by key.
+	batch := &readBatch{hex.EncodeToString(b), nil, time.Now().Add(UndoWindow)}
+	var items map[string]feedItem
+	mark := func(key string) {
+		if items == nil {
+			items = user.itemsByKey()
+		}
+		if i, ok := items[key]; ok && markRead(i.feed, i.item) {
+			batch.Keys = append(batch.Keys, key)
+		}
+	}
+	for _, feed := range user.Feeds {
+		if q.Subscription != "" && feed.UpdateURL != q.Subscription {
+			continue
+		}
+		if q.Folder != "" && user.subscription(feed).Folder != q.Folder {
+			continue
+		}
+		for _, item := range feed.Items {
+			key := itemKey(feed, item)
+			meta, ok := user.Items[key]
+			if !ok {
+				meta = new(ItemMeta)
+			}
+			if item.Read || (!q.Before.IsZero() && !published(item, meta).Before(q.Before)) {
+				continue
+			}
+			if markRead(feed, item) {
+				batch.Keys = append(batch.Keys, key)
+			}
+			story := key
+			if meta.Story != "" {
+				story = meta.Story
+				mark(story)
+			}
+			for _, k := range user.Stories[story] {
+				mark(k)
+			}
+		}
+	}
+
+	user.undo = batch
+	publishRead(user, batch.Keys, true)
+	return batch.Token, len(batch.Keys), nil
+}
+
+// UndoMarkAllRead restores the items marked read by the
+// user's last MarkAllRead, given its token. It returns the
+// number of items restored.
+func UndoMarkAllRead(uid []byte, token string) (int, error) {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return 0, new(UserDoesNotExist)
+	}
+	batch := user.undo
+	if batch == nil || time.Now().After(batch.Expires) ||
+		subtle.ConstantTimeCompare([]byte(batch.Token), []byte(token)) != 1 {
+		return 0, new(UndoExpired)
+	}
+
+	items := user.itemsByKey()
+	keys := make([]string, 0, len(batch.Keys))
+	for _, key := range batch.Keys {
+		if i, ok := items[key]; ok && markUnread(i.feed, i.item) {
+			keys = append(keys, key)
+		}
+	}
+	user.undo = nil
+	publishRead(user, keys, false)
+	return len(keys), nil
+}
+
+// ParseAge parses an age such as "12h" or "7d", for use
+// in a query's Before field.
+func ParseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("Error: invalid age %q.", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Error: invalid age %q.", s)
+	}
+	return d, nil
+}
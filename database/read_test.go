@@ -0,0 +1,118 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMarkAllRead(t *testing.T) {
+	noon := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	for i, test := range []struct {
+		query  Query
+		marked int
+		unread string
+	}{
+		{Query{}, 5, ""},
+		{Query{Subscription: "https://example.com/b"}, 2, "a3 a2 a1"},
+		{Query{Folder: "Friends"}, 2, "a3 a2 a1"},
+		{Query{Before: noon}, 2, "a3 a2 b2"},
+		{Query{Subscription: "https://example.com/a", Before: noon}, 1, "a3 a2 b2 b1"},
+		{Query{Subscription: "https://example.com/c"}, 0, "a3 a2 b2 a1 b1"},
+	} {
+		uid := testUser(t, fmt.Sprint("markallread ", i),
+			testFeed("https://example.com/a", "", "a1", "a2", "a3"),
+			testFeed("https://example.com/b", "", "b1", "b2"))
+		err := editSubscription(uid, "https://example.com/b", func(sub *Subscription) {
+			sub.Folder = "Friends"
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, n, err := MarkAllRead(uid, &test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := Items(uid, &Query{Unread: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != test.marked || titles(page) != test.unread {
+			t.Errorf("%+v: expected %d marked, leaving %q, got %d, leaving %q.", test.query, test.marked, test.unread, n, titles(page))
+		}
+
+		// Undoing restores exactly what was marked, once.
+		if _, err := UndoMarkAllRead(uid, "wrong"); err == nil {
+			t.Errorf("%+v: expected the wrong token to be refused.", test.query)
+		}
+		n, err = UndoMarkAllRead(uid, token)
+		if err != nil || n != test.marked {
+			t.Errorf("%+v: expected %d restored, got %d, %v.", test.query, test.marked, n, err)
+		}
+		page, err = Items(uid, &Query{Unread: true})
+		if err != nil || titles(page) != "a3 a2 b2 a1 b1" {
+			t.Errorf("%+v: expected every item to be unread, got %q.", test.query, titles(page))
+		}
+		if _, err := UndoMarkAllRead(uid, token); err == nil {
+			t.Errorf("%+v: expected the token to be used up.", test.query)
+		}
+	}
+}
+
+func TestMarkAllReadStories(t *testing.T) {
+	a := testFeed("https://example.com/a", "", "a1")
+	b := testFeed("https://example.com/b", "", "b1", "b2")
+	uid := testUser(t, "markallread stories", a, b)
+
+	// b1 is a copy of a1, so is marked read with it, and
+	// restored with it. Items already read are left alone.
+	b.Items[1].Read = true
+	db.Lock()
+	user := db.Users[UidToString(uid)]
+	user.meta(b, b.Items[0]).Story = itemKey(a, a.Items[0])
+	user.Stories[itemKey(a, a.Items[0])] = []string{itemKey(b, b.Items[0])}
+	db.Unlock()
+
+	token, n, err := MarkAllRead(uid, &Query{Subscription: "https://example.com/a"})
+	if err != nil || n != 2 || !a.Items[0].Read || !b.Items[0].Read {
+		t.Fatalf("Expected the story to be marked read, got %d, %v.", n, err)
+	}
+	n, err = UndoMarkAllRead(uid, token)
+	if err != nil || n != 2 || a.Items[0].Read || b.Items[0].Read || !b.Items[1].Read {
+		t.Errorf("Expected the story to be restored, got %d, %v.", n, err)
+	}
+
+	// Undo expires.
+	defer func(old time.Duration) { UndoWindow = old }(UndoWindow)
+	UndoWindow = -time.Second
+	token, _, err = MarkAllRead(uid, new(Query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UndoMarkAllRead(uid, token); err == nil {
+		t.Error("Expected undo to have expired.")
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, test := range []struct {
+		in  string
+		age time.Duration
+		ok  bool
+	}{
+		{"12h", 12 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"0d", 0, true},
+		{"-1d", 0, false},
+		{"-3h", 0, false},
+		{"d", 0, false},
+		{"week", 0, false},
+	} {
+		age, err := ParseAge(test.in)
+		if (err == nil) != test.ok || age != test.age {
+			t.Errorf("ParseAge(%q): expected %v, %v, got %v, %v.", test.in, test.age, test.ok, age, err)
+		}
+	}
+}
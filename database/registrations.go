@@ -0,0 +1,260 @@
+package database
+
+import (
+	"crypto/rand"
+	"io"
+	sec "rs3/security"
+	"sort"
+	"time"
+)
+
+// Self-service registration. A new user's account is only
+// created once they follow the link sent to their email
+// address. If registration is by invitation, they must
+// also give an invite code, which an administrator made
+// for them, and which can be used only once.
+var (
+	InviteLife         = 7 * 24 * time.Hour
+	RegistrationLife   = 24 * time.Hour
+	RegistrationResend = 5 * time.Minute // Before another email may be sent to the address.
+	MaxRegistrations   = 1000            // Awaiting verification at once.
+)
+
+// Invite lets one person register an account.
+type Invite struct {
+	ID      string
+	Hash    string // Of the normalised code.
+	Note    string // Who it is for, for administrators.
+	Created time.Time
+	Expires time.Time
+}
+
+// Registration is an account awaiting the verification of
+// its email address.
+type Registration struct {
+	Email    string
+	Nick     string
+	Password string // Hash, made by HashPassword.
+	Invite   string // ID of the invite given, if any.
+	Created  time.Time
+	Expires  time.Time
+}
+
+// NewInvite creates an invite, which expires after the
+// given time. It returns the invite code, in groups of
+// four letters, and a description of the invite.
+func NewInvite(note string, life time.Duration) (string, *Invite, error) {
+	id, err := random(8)
+	if err != nil {
+		return "", nil, err
+	}
+	b := make([]byte, 16)
+	_, err = io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", nil, err
+	}
+	var code []byte
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			code = append(code, '-')
+		}
+		code = append(code, appPasswordLetters[int(c)%len(appPasswordLetters)])
+	}
+
+	now := time.Now()
+	invite := &Invite{id, hashToken(normalisePassword(string(code))), note, now, now.Add(life)}
+	db.Lock()
+	defer db.Unlock()
+	pruneInvites(now)
+	db.Invites[id] = invite
+	c := *invite
+	return string(code), &c, nil
+}
+
+// pruneInvites forgets expired invites. The database must
+// be locked.
+func pruneInvites(now time.Time) {
+	for id, invite := range db.Invites {
+		if now.After(invite.Expires) {
+			delete(db.Invites, id)
+		}
+	}
+}
+
+// Invites returns copies of the unused invites, oldest
+// first.
+func Invites() []*Invite {
+	db.Lock()
+	defer db.Unlock()
+	pruneInvites(time.Now())
+	out := make([]*Invite, 0, len(db.Invites))
+	for _, invite := range db.Invites {
+		c := *invite
+		out = append(out, &c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Created.Before(out[j].Created)
+	})
+	return out
+}
+
+// RevokeInvite deletes an unused invite.
+func RevokeInvite(id string) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.Invites[id]; !ok {
+		return new(InviteDoesNotExist)
+	}
+	delete(db.Invites, id)
+	return nil
+}
+
+// invite returns the unused invite with the code. The
+// database must be locked.
+func invite(code string) (*Invite, bool) {
+	hash := hashToken(normalisePassword(code))
+	now := time.Now()
+	for _, invite := range db.Invites {
+		if invite.Hash == hash && now.Before(invite.Expires) {
+			return invite, true
+		}
+	}
+	return nil, false
+}
+
+// CheckInvite returns an InviteDoesNotExist error unless
+// the invite code can be used.
+func CheckInvite(code string) error {
+	db.RLock()
+	defer db.RUnlock()
+	if _, ok := invite(code); !ok {
+		return new(InviteDoesNotExist)
+	}
+	return nil
+}
+
+// NewRegistration records a new user's details, and
+// returns the token which verifies their email address and
+// creates their account. If the invite code is given, it
+// must be valid, and is used up when the account is
+// created. The password must be strong enough.
+//
+// Registrations from the IP address are throttled, with a
+// *LoginThrottled error. If the email address already has
+// an account, an EmailAlreadyExists error is returned, and
+// if it was registered too recently, a
+// RegistrationThrottled error. If too many registrations
+// are awaiting verification, a TooManyRegistrations error
+// is returned.
+func NewRegistration(email, nick, password, code, ip string) (string, error) {
+	email = NormaliseEmail(email)
+	if nick == "" {
+		nick = email
+	}
+	err := sec.CheckPasswordStrength(password, email, nick)
+	if err != nil {
+		return "", err
+	}
+	err = BeginRegistration(ip)
+	if err != nil {
+		return "", err
+	}
+	hash, err := sec.HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+	token, err := random(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	r := &Registration{Email: email, Nick: nick, Password: hash, Created: now, Expires: now.Add(RegistrationLife)}
+	db.Lock()
+	defer db.Unlock()
+	if code != "" {
+		in, ok := invite(code)
+		if !ok {
+			return "", new(InviteDoesNotExist)
+		}
+		r.Invite = in.ID
+	}
+	if _, salt := account(email); salt != nil {
+		return "", new(EmailAlreadyExists)
+	}
+	for key, old := range db.Registrations {
+		if now.After(old.Expires) {
+			delete(db.Registrations, key)
+		} else if old.Email == email && now.Sub(old.Created) < RegistrationResend {
+			return "", new(RegistrationThrottled)
+		}
+	}
+	if len(db.Registrations) >= MaxRegistrations {
+		return "", new(TooManyRegistrations)
+	}
+	db.Registrations[hashToken(token)] = r
+	return token, nil
+}
+
+// PendingRegistration returns a copy of the registration
+// which the token verifies.
+func PendingRegistration(token string) (*Registration, error) {
+	db.RLock()
+	defer db.RUnlock()
+	r, ok := db.Registrations[hashToken(token)]
+	if !ok || time.Now().After(r.Expires) {
+		return nil, new(RegistrationDoesNotExist)
+	}
+	c := *r
+	return &c, nil
+}
+
+// CompleteRegistration verifies the new user's email
+// address with the token, and creates their account,
+// returning its uid and email address. Each token can be
+// used only once, and its invite must not have been used
+// since it was given.
+func CompleteRegistration(token string) ([]byte, string, error) {
+	key := hashToken(token)
+	db.Lock()
+	r, ok := db.Registrations[key]
+	if !ok || time.Now().After(r.Expires) {
+		delete(db.Registrations, key)
+		db.Unlock()
+		return nil, "", new(RegistrationDoesNotExist)
+	}
+	delete(db.Registrations, key)
+	var used *Invite
+	if r.Invite != "" {
+		used, ok = db.Invites[r.Invite]
+		if !ok || time.Now().After(used.Expires) {
+			db.Unlock()
+			return nil, "", new(InviteDoesNotExist)
+		}
+		delete(db.Invites, r.Invite)
+	}
+	db.Unlock()
+
+	// If the account cannot be created, such as because
+	// the email address was registered in the meantime, the
+	// invite is not wasted.
+	restore := func() {
+		if used != nil {
+			db.Lock()
+			db.Invites[used.ID] = used
+			db.Unlock()
+		}
+	}
+	salt := sec.NewSalt()
+	uid, err := sec.Hash(r.Email, salt)
+	if err != nil {
+		restore()
+		return nil, "", err
+	}
+	err = createUser(uid, salt, r.Password, r.Nick, r.Email)
+	if err != nil {
+		restore()
+		return nil, "", err
+	}
+	return uid, r.Email, nil
+}
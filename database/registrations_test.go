@@ -0,0 +1,58 @@
+package database
+
+import (
+	sec "rs3/security"
+	"testing"
+)
+
+func TestRegistration(t *testing.T) {
+	old := sec.Argon2Cost
+	sec.Argon2Cost.Memory, sec.Argon2Cost.Time = 1024, 1
+	defer func() { sec.Argon2Cost = old }()
+	const password = "quartz pelican 93"
+
+	token, err := NewRegistration("New@Example.com", "", password, "", "192.0.2.30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewRegistration("new@example.com", "", password, "", "192.0.2.31")
+	if _, ok := err.(*RegistrationThrottled); !ok {
+		t.Errorf("Expected a second email to be throttled, got %v.", err)
+	}
+	uid, email, err := CompleteRegistration(token)
+	if err != nil || email != "new@example.com" {
+		t.Fatalf("Expected the account to be created, got %q, %v.", email, err)
+	}
+	if err := CheckUserPassword(uid, password); err != nil {
+		t.Errorf("Expected the password to be set, got %v.", err)
+	}
+	if _, _, err := CompleteRegistration(token); err == nil {
+		t.Error("Expected the token to be used up.")
+	}
+
+	// Registrations are throttled by IP address before the
+	// password is hashed. Weak passwords are refused first.
+	_, err = NewRegistration("weak@example.com", "", "password", "", "192.0.2.30")
+	if _, ok := err.(*sec.WeakPassword); !ok {
+		t.Fatalf("Expected a weak password, got %v.", err)
+	}
+	for i := 1; i < IPFreeRegistrations; i++ {
+		_, err := NewRegistration(string(rune('a'+i))+"@example.com", "", password, "", "192.0.2.30")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = NewRegistration("z@example.com", "", password, "", "192.0.2.30")
+	if _, ok := err.(*LoginThrottled); !ok {
+		t.Errorf("Expected the address to be throttled, got %v.", err)
+	}
+
+	// Only so many may await verification.
+	oldMax := MaxRegistrations
+	defer func() { MaxRegistrations = oldMax }()
+	MaxRegistrations = 0
+	_, err = NewRegistration("full@example.com", "", password, "", "192.0.2.32")
+	if _, ok := err.(*TooManyRegistrations); !ok {
+		t.Errorf("Expected too many registrations, got %v.", err)
+	}
+}
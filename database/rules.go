@@ -0,0 +1,305 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"github.com/SlyMarbo/rss"
+	"regexp"
+	"rs3/sanitise"
+	"strings"
+)
+
+// Rule actions.
+const (
+	ActionRead      = "read"
+	ActionStar      = "star"
+	ActionTag       = "tag"
+	ActionHide      = "hide"
+	ActionHighlight = "highlight"
+)
+
+// Rule is a user-defined filter, applied to new items as
+// their feed refreshes. An item matches if it satisfies
+// every condition which is set. Title and Content are
+// regular expressions; Author and Category are matched
+// case-insensitively. The feed library gives items no
+// author of their own, so Author is the feed's.
+type Rule struct {
+	ID       int
+	Feed     string // Feed URL.
+	Title    string
+	Content  string
+	Author   string
+	Category string
+	Action   string
+	Tag      string // Tag applied by ActionTag.
+}
+
+// Match is an existing item which a rule would match.
+type Match struct {
+	Feed  string
+	Title string
+	Link  string
+}
+
+// Check returns an error if the rule is malformed.
+func (r *Rule) Check() error {
+	switch r.Action {
+	case ActionRead, ActionStar, ActionHide, ActionHighlight:
+	case ActionTag:
+		if r.Tag == "" {
+			return errors.New("Error: tag rules require a tag.")
+		}
+	default:
+		return fmt.Errorf("Error: unknown rule action %q.", r.Action)
+	}
+	if r.Feed == "" && r.Title == "" && r.Content == "" && r.Author == "" && r.Category == "" {
+		return errors.New("Error: rule has no conditions.")
+	}
+	for _, s := range []string{r.Title, r.Content} {
+		if _, err := regexp.Compile(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rule) String() string {
+	parts := make([]string, 0, 6)
+	for _, p := range [][2]string{
+		{"feed", r.Feed},
+		{"title", r.Title},
+		{"content", r.Content},
+		{"author", r.Author},
+		{"category", r.Category},
+	} {
+		if p[1] != "" {
+			parts = append(parts, p[0]+":"+p[1])
+		}
+	}
+	action := r.Action
+	if r.Action == ActionTag {
+		action += ":" + r.Tag
+	}
+	return fmt.Sprintf("%d: %s -> %s", r.ID, strings.Join(parts, " "), action)
+}
+
+// matcher is a rule with its expressions compiled.
+type matcher struct {
+	*Rule
+	title   *regexp.Regexp
+	content *regexp.Regexp
+}
+
+func compile(r *Rule) (*matcher, error) {
+	m := &matcher{Rule: r}
+	var err error
+	if r.Title != "" {
+		m.title, err = regexp.Compile(r.Title)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Content != "" {
+		m.content, err = regexp.Compile(r.Content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *matcher) matches(feed *rss.Feed, item *rss.Item) bool {
+	if m.Feed != "" && m.Feed != feed.UpdateURL {
+		return false
+	}
+	if m.title != nil && !m.title.MatchString(item.Title) {
+		return false
+	}
+	if m.content != nil && !m.content.MatchString(sanitise.Text(item.Content)) {
+		return false
+	}
+	if m.Author != "" && !strings.EqualFold(m.Author, feed.Author) {
+		return false
+	}
+	if m.Category != "" {
+		found := false
+		for _, c := range item.Categories {
+			if strings.EqualFold(m.Category, c) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// apply performs the rule's action on the item. The
+// caller must hold the database lock.
+func (m *matcher) apply(user *User, feed *rss.Feed, item *rss.Item) {
+	switch m.Action {
+	case ActionRead:
+		markRead(feed, item)
+	case ActionStar:
+		user.meta(feed, item).Starred = true
+	case ActionTag:
+		meta := user.meta(feed, item)
+		for _, t := range meta.Tags {
+			if t == m.Tag {
+				return
+			}
+		}
+		meta.Tags = append(meta.Tags, m.Tag)
+	case ActionHide:
+		markRead(feed, item)
+		user.meta(feed, item).Hidden = true
+	case ActionHighlight:
+		user.meta(feed, item).Highlight = true
+	}
+}
+
+// filter applies the user's rules to new items. The
+// caller must hold the database lock.
+func filter(user *User, feed *rss.Feed, items []*rss.Item) {
+	for _, rule := range user.Rules {
+		m, err := compile(rule)
+		if err != nil {
+			fmt.Printf("Failed to compile rule %d:\n", rule.ID)
+			fmt.Println(err)
+			continue
+		}
+		for _, item := range items {
+			if m.matches(feed, item) {
+				m.apply(user, feed, item)
+			}
+		}
+	}
+}
+
+// Rules returns the user's filter rules.
+func Rules(uid []byte) ([]*Rule, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	rules := make([]*Rule, len(user.Rules))
+	for i, r := range user.Rules {
+		rule := *r
+		rules[i] = &rule
+	}
+	return rules, nil
+}
+
+// AddRule checks and stores a new filter rule, returning
+// its ID.
+func AddRule(uid []byte, rule *Rule) (int, error) {
+	err := rule.Check()
+	if err != nil {
+		return 0, err
+	}
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return 0, new(UserDoesNotExist)
+	}
+	r := *rule
+	r.ID = 1
+	for _, other := range user.Rules {
+		if other.ID >= r.ID {
+			r.ID = other.ID + 1
+		}
+	}
+	user.Rules = append(user.Rules, &r)
+	return r.ID, nil
+}
+
+// DeleteRule removes the filter rule with the given ID.
+func DeleteRule(uid []byte, id int) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	for i, r := range user.Rules {
+		if r.ID == id {
+			user.Rules = append(user.Rules[:i], user.Rules[i+1:]...)
+			return nil
+		}
+	}
+	return new(RuleDoesNotExist)
+}
+
+// TestRule returns the user's existing items which the
+// rule would match, without applying its action. The
+// action may be left empty.
+func TestRule(uid []byte, rule *Rule) ([]*Match, error) {
+	r := *rule
+	if r.Action == "" {
+		r.Action = ActionHighlight
+	}
+	rule = &r
+	err := rule.Check()
+	if err != nil {
+		return nil, err
+	}
+	m, err := compile(rule)
+	if err != nil {
+		return nil, err
+	}
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	matches := make([]*Match, 0, 10)
+	for _, feed := range user.Feeds {
+		for _, item := range feed.Items {
+			if m.matches(feed, item) {
+				matches = append(matches, &Match{feed.Title, item.Title, item.Link})
+			}
+		}
+	}
+	return matches, nil
+}
+
+// ParseRule builds a rule from an action and a list of
+// conditions of the form "field:value", as used by the
+// console. The action may be given as "tag:name".
+func ParseRule(action string, conditions []string) (*Rule, error) {
+	rule := new(Rule)
+	rule.Action = action
+	if strings.HasPrefix(action, ActionTag+":") {
+		rule.Action = ActionTag
+		rule.Tag = action[len(ActionTag)+1:]
+	}
+	for _, c := range conditions {
+		i := strings.Index(c, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("Error: condition %q is not of the form field:value.", c)
+		}
+		value := c[i+1:]
+		switch c[:i] {
+		case "feed":
+			rule.Feed = value
+		case "title":
+			rule.Title = value
+		case "content":
+			rule.Content = value
+		case "author":
+			rule.Author = value
+		case "category":
+			rule.Category = value
+		default:
+			return nil, fmt.Errorf("Error: unknown rule field %q.", c[:i])
+		}
+	}
+	return rule, rule.Check()
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"github.com/SlyMarbo/rss"
+	"testing"
+	"time"
+)
+
+// testUser stores a user with the given feeds, returning
+// their uid. Items are numbered in the order given.
+func testUser(t *testing.T, name string, feeds ...*rss.Feed) []byte {
+	uid := []byte(name)
+	user := newUser(uid, nil, nil, name)
+	user.Feeds = append(user.Feeds, feeds...)
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.Users[UidToString(uid)]; ok {
+		t.Fatalf("User %q already exists.", name)
+	}
+	db.Users[UidToString(uid)] = user
+	user.number()
+	return uid
+}
+
+// testFeed returns a feed with the given item titles,
+// published a minute apart, the last first.
+func testFeed(url, author string, titles ...string) *rss.Feed {
+	feed := &rss.Feed{Title: url, Author: author, UpdateURL: url}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, title := range titles {
+		feed.Items = append(feed.Items, &rss.Item{
+			Title:   title,
+			Content: "<p>Content of " + title + ".</p>",
+			Link:    url + "/" + title,
+			ID:      url + "#" + title,
+			Date:    start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	return feed
+}
+
+func TestRuleMatches(t *testing.T) {
+	feed := testFeed("https://example.com/feed", "Alice", "Go 1.22 released")
+	item := feed.Items[0]
+	item.Categories = []string{"Programming", "News"}
+
+	for _, test := range []struct {
+		rule  Rule
+		match bool
+	}{
+		{Rule{Feed: "https://example.com/feed"}, true},
+		{Rule{Feed: "https://example.org/feed"}, false},
+		{Rule{Title: `^Go \d`}, true},
+		{Rule{Title: `^Rust`}, false},
+		{Rule{Content: "Content of Go"}, true},
+		{Rule{Content: "<p>"}, false}, // Content is matched as text.
+		{Rule{Author: "alice"}, true},
+		{Rule{Author: "Bob"}, false},
+		{Rule{Category: "news"}, true},
+		{Rule{Category: "Sport"}, false},
+		{Rule{Title: "Go", Category: "News"}, true},
+		{Rule{Title: "Go", Category: "Sport"}, false},
+	} {
+		test.rule.Action = ActionRead
+		m, err := compile(&test.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.matches(feed, item); got != test.match {
+			t.Errorf("%s: expected %v, got %v.", &test.rule, test.match, got)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	for _, test := range []struct {
+		action     string
+		conditions []string
+		rule       *Rule // Nil if the rule is invalid.
+	}{
+		{"read", []string{"title:^Sponsored"}, &Rule{Title: "^Sponsored", Action: ActionRead}},
+		{"tag:go", []string{"feed:https://example.com/feed", "category:golang"},
+			&Rule{Feed: "https://example.com/feed", Category: "golang", Action: ActionTag, Tag: "go"}},
+		{"star", []string{"author:Alice", "content:a:b"}, &Rule{Author: "Alice", Content: "a:b", Action: ActionStar}},
+		{"read", nil, nil},
+		{"tag:", []string{"title:x"}, nil},
+		{"delete", []string{"title:x"}, nil},
+		{"read", []string{"title"}, nil},
+		{"read", []string{"colour:red"}, nil},
+		{"read", []string{"title:("}, nil},
+	} {
+		rule, err := ParseRule(test.action, test.conditions)
+		switch {
+		case test.rule == nil && err == nil:
+			t.Errorf("%s %v: expected an error.", test.action, test.conditions)
+		case test.rule != nil && err != nil:
+			t.Errorf("%s %v: %v", test.action, test.conditions, err)
+		case test.rule != nil && *rule != *test.rule:
+			t.Errorf("%s %v: expected %+v, got %+v.", test.action, test.conditions, test.rule, rule)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	news := testFeed("https://example.com/news", "Newsroom", "Sponsored: buy now", "Election results")
+	blog := testFeed("https://example.com/blog", "Alice", "Sponsored: my sponsor", "Holiday photos")
+	uid := testUser(t, "rules", news, blog)
+
+	// The preview shows what would match, changing nothing.
+	matches, err := TestRule(uid, &Rule{Title: "^Sponsored", Feed: "https://example.com/news"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Title != "Sponsored: buy now" || matches[0].Feed != "https://example.com/news" {
+		t.Errorf("Unexpected preview %+v.", matches)
+	}
+	matches, err = TestRule(uid, &Rule{Title: "^Sponsored"})
+	if err != nil || len(matches) != 2 {
+		t.Errorf("Expected two matches, got %d, %v.", len(matches), err)
+	}
+	if _, err := TestRule(uid, &Rule{}); err == nil {
+		t.Error("Expected a rule without conditions to be refused.")
+	}
+
+	first, err := AddRule(uid, &Rule{Title: "^Sponsored", Action: ActionHide})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := AddRule(uid, &Rule{Author: "alice", Action: ActionTag, Tag: "friends"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("Expected rules to have different IDs, got %d twice.", first)
+	}
+	if _, err := AddRule(uid, &Rule{Title: "x", Action: "explode"}); err == nil {
+		t.Error("Expected an unknown action to be refused.")
+	}
+
+	// Rules apply to new items as they arrive.
+	db.Lock()
+	user := db.Users[UidToString(uid)]
+	items := []*rss.Item{
+		{Title: "Sponsored: a car", Link: "https://example.com/blog/car", ID: "car"},
+		{Title: "Back home", Link: "https://example.com/blog/home", ID: "home"},
+	}
+	blog.Items = append(blog.Items, items...)
+	filter(user, blog, items)
+	car, home := user.meta(blog, items[0]), user.meta(blog, items[1])
+	db.Unlock()
+	if !car.Hidden || !items[0].Read {
+		t.Error("Expected the sponsored item to be hidden and read.")
+	}
+	if len(car.Tags) != 1 || len(home.Tags) != 1 || home.Tags[0] != "friends" || home.Hidden || items[1].Read {
+		t.Errorf("Expected both items to be tagged, got %v and %v.", car.Tags, home.Tags)
+	}
+
+	if err := DeleteRule(uid, first); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := DeleteRule(uid, first).(*RuleDoesNotExist); !ok {
+		t.Error("Expected the rule to be gone.")
+	}
+	rules, err := Rules(uid)
+	if err != nil || len(rules) != 1 || rules[0].ID != second {
+		t.Errorf("Expected one rule to be left, got %v, %v.", rules, err)
+	}
+}
@@ -0,0 +1,257 @@
+package database
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Session lifetimes. A session expires when it has not
+// been used for SessionIdle, or is SessionMaxAge old,
+// whichever is sooner. Its cookie is replaced every
+// SessionRotate.
+var (
+	SessionIdle   = 14 * 24 * time.Hour
+	SessionMaxAge = 90 * 24 * time.Hour
+	SessionRotate = 24 * time.Hour
+)
+
+// rotationGrace is how long a replaced cookie is still
+// accepted, for requests which were already under way.
+const rotationGrace = time.Minute
+
+// Session is a browser the user has logged in with. Only
+// a hash of its cookie is stored.
+type Session struct {
+	ID        string
+	Hash      string
+	Previous  string    // Hash of the cookie Hash replaced.
+	Rotated   time.Time // When Hash replaced Previous.
+	CSRF      string    // Secret behind the session's form tokens.
+	Created   time.Time
+	LastSeen  time.Time
+	UserAgent string
+	IP        string
+}
+
+// Expires returns when the session expires, unless it is
+// used again.
+func (s *Session) Expires() time.Time {
+	idle := s.LastSeen.Add(SessionIdle)
+	max := s.Created.Add(SessionMaxAge)
+	if idle.Before(max) {
+		return idle
+	}
+	return max
+}
+
+// Expired returns whether the session has expired.
+func (s *Session) Expired() bool {
+	return time.Now().After(s.Expires())
+}
+
+// session finds the user's unexpired session with the
+// cookie, and whether the cookie is one recently replaced.
+// The caller must hold the database lock.
+func (u *User) session(cookie string) (*Session, bool) {
+	hash := hashToken(cookie)
+	var found *Session
+	previous := false
+	for _, s := range u.Sessions {
+		if s.Expired() {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(s.Hash), []byte(hash)) == 1 {
+			found, previous = s, false
+		} else if s.Previous != "" && subtle.ConstantTimeCompare([]byte(s.Previous), []byte(hash)) == 1 &&
+			time.Since(s.Rotated) < rotationGrace {
+			found, previous = s, true
+		}
+	}
+	return found, previous
+}
+
+// NewSession logs the user in from the browser with the
+// given user agent and IP address, returning the session
+// and its cookie.
+func NewSession(uid []byte, agent, ip string) (*Session, string, error) {
+	id, err := random(8)
+	if err != nil {
+		return nil, "", err
+	}
+	cookie, err := random(32)
+	if err != nil {
+		return nil, "", err
+	}
+	csrf, err := random(32)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	s := &Session{ID: id, Hash: hashToken(cookie), Rotated: now, CSRF: csrf, Created: now, LastSeen: now,
+		UserAgent: agent, IP: ip}
+
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, "", new(UserDoesNotExist)
+	}
+	user.expireSessions()
+	user.Sessions = append(user.Sessions, s)
+	return s.copy(), cookie, nil
+}
+
+// CheckSession returns the user's session with the cookie,
+// recording that it has been used from the browser with
+// the given user agent and IP address, if known. It also
+// returns the cookie the browser should use from now on,
+// which is replaced once it is SessionRotate old.
+func CheckSession(uid []byte, cookie, agent, ip string) (*Session, string, error) {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, "", new(AuthenticationError)
+	}
+	s, previous := user.session(cookie)
+	if s == nil {
+		return nil, "", new(AuthenticationError)
+	}
+	s.LastSeen = time.Now()
+	if agent != "" {
+		s.UserAgent = agent
+	}
+	if ip != "" {
+		s.IP = ip
+	}
+	if !previous && time.Since(s.Rotated) > SessionRotate {
+		next, err := random(32)
+		if err != nil {
+			return nil, "", err
+		}
+		s.Previous = s.Hash
+		s.Hash = hashToken(next)
+		s.Rotated = time.Now()
+		cookie = next
+	}
+	return s.copy(), cookie, nil
+}
+
+// Sessions returns the user's unexpired sessions, most
+// recently used first.
+func Sessions(uid []byte) ([]*Session, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	out := make([]*Session, 0, len(user.Sessions))
+	for _, s := range user.Sessions {
+		if !s.Expired() {
+			out = append(out, s.copy())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].LastSeen.After(out[j].LastSeen)
+	})
+	return out, nil
+}
+
+// RevokeSession logs the user out of the session with the
+// given ID.
+func RevokeSession(uid []byte, id string) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	for i, s := range user.Sessions {
+		if s.ID == id {
+			user.Sessions = append(user.Sessions[:i:i], user.Sessions[i+1:]...)
+			return nil
+		}
+	}
+	return new(SessionDoesNotExist)
+}
+
+// RevokeSessions logs the user out everywhere.
+func RevokeSessions(uid []byte) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	user.Sessions = make([]*Session, 0)
+	return nil
+}
+
+// ExpireSessions forgets expired sessions every interval.
+// It does not return.
+func ExpireSessions(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		db.Lock()
+		n := 0
+		for _, user := range db.Users {
+			n += user.expireSessions()
+		}
+		db.Unlock()
+		if n > 0 {
+			fmt.Printf("Expired %d sessions.\n", n)
+		}
+	}
+}
+
+// expireSessions forgets the user's expired sessions,
+// returning how many there were. The caller must hold the
+// database lock.
+func (u *User) expireSessions() int {
+	kept := u.Sessions[:0]
+	for _, s := range u.Sessions {
+		if !s.Expired() {
+			kept = append(kept, s)
+		}
+	}
+	n := len(u.Sessions) - len(kept)
+	for i := len(kept); i < len(u.Sessions); i++ {
+		u.Sessions[i] = nil
+	}
+	u.Sessions = kept
+	return n
+}
+
+// copy returns a copy of the session without its hashes.
+func (s *Session) copy() *Session {
+	c := *s
+	c.Hash = ""
+	c.Previous = ""
+	return &c
+}
+
+// migrateCookies turns the session cookies stored before
+// sessions into sessions. The caller must hold the
+// database lock.
+func (u *User) migrateCookies() {
+	for _, c := range u.Cookies {
+		if !c.Exp.After(time.Now()) {
+			continue
+		}
+		id, err := random(8)
+		if err != nil {
+			continue
+		}
+		csrf, err := random(32)
+		if err != nil {
+			continue
+		}
+		created := c.Exp.Add(-7 * 24 * time.Hour)
+		u.Sessions = append(u.Sessions, &Session{ID: id, Hash: hashToken(c.Cookie), Rotated: created, CSRF: csrf,
+			Created: created, LastSeen: created})
+	}
+	u.Cookies = nil
+}
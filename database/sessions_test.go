@@ -0,0 +1,137 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionExpiry(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		created, lastSeen time.Time
+		expired           bool
+	}{
+		{now, now, false},
+		{now.Add(-SessionMaxAge / 2), now, false},
+		{now.Add(-SessionIdle), now.Add(-SessionIdle + time.Minute), false},
+		{now.Add(-SessionIdle - time.Minute), now.Add(-SessionIdle - time.Minute), true}, // Idle.
+		{now.Add(-SessionMaxAge - time.Minute), now, true},                               // Too old.
+	} {
+		s := &Session{Created: test.created, LastSeen: test.lastSeen}
+		if s.Expired() != test.expired {
+			t.Errorf("Created %v, last seen %v: expected expired to be %v.", test.created, test.lastSeen, test.expired)
+		}
+	}
+}
+
+// ageSession makes the user's session look as though it
+// were created, last used and rotated d ago.
+func ageSession(uid []byte, id string, d time.Duration) {
+	db.Lock()
+	defer db.Unlock()
+	for _, s := range db.Users[UidToString(uid)].Sessions {
+		if s.ID == id {
+			s.Created = s.Created.Add(-d)
+			s.LastSeen = s.LastSeen.Add(-d)
+			s.Rotated = s.Rotated.Add(-d)
+		}
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	uid := testUser(t, "sessions")
+	s, cookie, err := NewSession(uid, "Browser/1", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Hash != "" || s.CSRF == "" {
+		t.Errorf("Expected the session to have a CSRF secret and no hash, got %+v.", s)
+	}
+
+	// The cookie is kept until it is SessionRotate old.
+	got, next, err := CheckSession(uid, cookie, "Browser/2", "192.0.2.2")
+	if err != nil || got.ID != s.ID || next != cookie || got.UserAgent != "Browser/2" || got.IP != "192.0.2.2" {
+		t.Fatalf("Expected the session to be used, got %+v, %v.", got, err)
+	}
+	if _, _, err := CheckSession(uid, "wrong", "", ""); err == nil {
+		t.Error("Expected the wrong cookie to be refused.")
+	}
+
+	ageSession(uid, s.ID, SessionRotate+time.Minute)
+	_, next, err = CheckSession(uid, cookie, "", "")
+	if err != nil || next == cookie {
+		t.Fatalf("Expected the cookie to be replaced, got %v.", err)
+	}
+
+	// The old cookie still works briefly, without being
+	// replaced again, and the new one works.
+	for _, c := range []string{cookie, next} {
+		_, again, err := CheckSession(uid, c, "", "")
+		if err != nil || again != c {
+			t.Errorf("Expected %q to be accepted as it is, got %q, %v.", c, again, err)
+		}
+	}
+	ageSession(uid, s.ID, rotationGrace)
+	if _, _, err := CheckSession(uid, cookie, "", ""); err == nil {
+		t.Error("Expected the replaced cookie to stop working.")
+	}
+	if _, _, err := CheckSession(uid, next, "", ""); err != nil {
+		t.Errorf("Expected the new cookie to work, got %v.", err)
+	}
+}
+
+func TestSessionRevocation(t *testing.T) {
+	uid := testUser(t, "revocation")
+	var ids []string
+	var cookies []string
+	for i := 0; i < 3; i++ {
+		s, cookie, err := NewSession(uid, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, s.ID)
+		cookies = append(cookies, cookie)
+	}
+
+	// Expired sessions are not listed, and are swept when
+	// the user next logs in.
+	ageSession(uid, ids[0], SessionIdle+time.Minute)
+	ageSession(uid, ids[2], time.Minute)
+	sessions, err := Sessions(uid)
+	if err != nil || len(sessions) != 2 || sessions[0].ID != ids[1] || sessions[1].ID != ids[2] {
+		t.Fatalf("Expected two sessions, most recent first, got %v, %v.", sessions, err)
+	}
+	if _, _, err := CheckSession(uid, cookies[0], "", ""); err == nil {
+		t.Error("Expected the expired session to be refused.")
+	}
+	_, _, err = NewSession(uid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.RLock()
+	n := len(db.Users[UidToString(uid)].Sessions)
+	db.RUnlock()
+	if n != 3 {
+		t.Errorf("Expected the expired session to be swept, leaving 3, got %d.", n)
+	}
+
+	if err := RevokeSession(uid, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := RevokeSession(uid, ids[1]).(*SessionDoesNotExist); !ok {
+		t.Error("Expected the session to be gone.")
+	}
+	if _, _, err := CheckSession(uid, cookies[1], "", ""); err == nil {
+		t.Error("Expected the revoked session to be refused.")
+	}
+	if _, _, err := CheckSession(uid, cookies[2], "", ""); err != nil {
+		t.Errorf("Expected the other session to work, got %v.", err)
+	}
+
+	if err := RevokeSessions(uid); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CheckSession(uid, cookies[2], "", ""); err == nil {
+		t.Error("Expected every session to be revoked.")
+	}
+}
@@ -0,0 +1,228 @@
+package database
+
+import (
+	"github.com/SlyMarbo/rss"
+)
+
+// Subscription holds a user's settings for one of
+// their feeds.
+type Subscription struct {
+	NoPrivacy bool // Skip privacy filtering for this feed.
+	Extract   bool // Replace summaries with the full article.
+	Folder    string
+	Sort      string // Order in which items are shown.
+}
+
+// subscription returns the user's settings for the given
+// feed. The result must not be modified.
+func (u *User) subscription(feed *rss.Feed) *Subscription {
+	sub, ok := u.Subscriptions[feed.UpdateURL]
+	if !ok {
+		return new(Subscription)
+	}
+	return sub
+}
+
+// editSubscription applies fn to the user's settings for
+// the feed with the given URL, creating them if necessary.
+func editSubscription(uid []byte, feed string, fn func(*Subscription)) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	found := false
+	for _, f := range user.Feeds {
+		if f.UpdateURL == feed {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return new(FeedDoesNotExist)
+	}
+	sub, ok := user.Subscriptions[feed]
+	if !ok {
+		sub = new(Subscription)
+		user.Subscriptions[feed] = sub
+	}
+	fn(sub)
+	return nil
+}
+
+// SetPrivacy enables or disables privacy filtering of new
+// items from the given feed, for feeds where cleaning links
+// breaks them.
+func SetPrivacy(uid []byte, feed string, enabled bool) error {
+	return editSubscription(uid, feed, func(sub *Subscription) {
+		sub.NoPrivacy = !enabled
+	})
+}
+
+// SetExtraction enables or disables full-article extraction
+// for the given feed. When enabled, articles are extracted
+// for any existing items which lack one.
+func SetExtraction(uid []byte, feed string, enabled bool) error {
+	err := editSubscription(uid, feed, func(sub *Subscription) {
+		sub.Extract = enabled
+	})
+	if err != nil || !enabled {
+		return err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+	user := db.Users[UidToString(uid)]
+	for _, f := range user.Feeds {
+		if f.UpdateURL != feed {
+			continue
+		}
+		items := make([]*rss.Item, 0, len(f.Items))
+		for _, item := range f.Items {
+			if m, ok := user.Items[itemKey(f, item)]; !ok || m.Article == "" {
+				items = append(items, item)
+			}
+		}
+		sub := *user.subscription(f)
+		go extractArticles(user, f, items, &sub)
+	}
+	return nil
+}
+
+// SetFolder moves the given feed into the named folder.
+// An empty name removes it from any folder.
+func SetFolder(uid []byte, feed, folder string) error {
+	return editSubscription(uid, feed, func(sub *Subscription) {
+		sub.Folder = folder
+	})
+}
+
+// Folder returns the name of the folder holding the feed.
+func Folder(uid []byte, feed *rss.Feed) string {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return ""
+	}
+	return user.subscription(feed).Folder
+}
+
+// Settings returns a copy of the user's settings for the
+// feed with the given URL.
+func Settings(uid []byte, feed string) (*Subscription, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	for _, f := range user.Feeds {
+		if f.UpdateURL == feed {
+			sub := *user.subscription(f)
+			return &sub, nil
+		}
+	}
+	return nil, new(FeedDoesNotExist)
+}
+
+// Subscribe fetches the feed at the given URL and adds it
+// to the user's feeds. Unlike AddFeeds, it reports feeds
+// which cannot be fetched, and refuses duplicates.
+func Subscribe(uid []byte, url string) (*rss.Feed, error) {
+	if !Exists(uid) {
+		return nil, new(UserDoesNotExist)
+	}
+	if subscribed(uid, url) {
+		return nil, new(FeedAlreadyExists)
+	}
+	feed, err := rss.Fetch(url)
+	if err != nil {
+		return nil, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	for _, f := range user.Feeds {
+		if f.UpdateURL == feed.UpdateURL {
+			return nil, new(FeedAlreadyExists)
+		}
+	}
+	ingest(user, feed, feed.Items)
+	user.Feeds = append(user.Feeds, feed)
+	user.FeedUrls = append(user.FeedUrls, feed.Link)
+	return feed, nil
+}
+
+// subscribed returns whether the user has the feed with
+// the given URL.
+func subscribed(uid []byte, url string) bool {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return false
+	}
+	for _, f := range user.Feeds {
+		if f.UpdateURL == url {
+			return true
+		}
+	}
+	return false
+}
+
+// Unsubscribe removes the feed with the given URL from the
+// user's feeds, along with its items and settings. Items
+// from other feeds which duplicated its items are shown in
+// their own right again.
+func Unsubscribe(uid []byte, url string) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	for i, feed := range user.Feeds {
+		if feed.UpdateURL != url {
+			continue
+		}
+		for _, item := range feed.Items {
+			key := itemKey(feed, item)
+			for _, dup := range user.Stories[key] {
+				if m, ok := user.Items[dup]; ok {
+					m.Story = ""
+				}
+			}
+			delete(user.Stories, key)
+			if m, ok := user.Items[key]; ok && m.Story != "" {
+				user.Stories[m.Story] = without(user.Stories[m.Story], key)
+			}
+			delete(user.Items, key)
+		}
+		user.Feeds = append(user.Feeds[:i:i], user.Feeds[i+1:]...)
+		if i < len(user.FeedUrls) {
+			user.FeedUrls = append(user.FeedUrls[:i:i], user.FeedUrls[i+1:]...)
+		}
+		delete(user.Subscriptions, url)
+		user.stories = nil
+		publish(user, EventUnread, user.counts())
+		return nil
+	}
+	return new(FeedDoesNotExist)
+}
+
+// without returns list with any copies of s removed.
+func without(list []string, s string) []string {
+	out := list[:0]
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,328 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Login throttling. Failed logins are counted for each
+// account and each client IP address over a sliding
+// window. After the first few, each further attempt must
+// wait twice as long as the last, and after many the
+// account or address is locked out for a while, or until
+// an administrator unlocks it.
+var (
+	LoginWindow     = 15 * time.Minute
+	LoginDelay      = time.Second
+	LoginMaxDelay   = 5 * time.Minute
+	LockoutDuration = time.Hour
+
+	// Failures in the window before logins are slowed, and
+	// before they are locked out. Addresses may be shared,
+	// so are allowed more.
+	AccountFreeAttempts = 3
+	AccountLockout      = 10
+	IPFreeAttempts      = 10
+	IPLockout           = 50
+
+	// Registrations are throttled for each IP address in the
+	// same way, each counting as a failure, as they cost as
+	// much as a login and may send email.
+	IPFreeRegistrations   = 3
+	IPRegistrationLockout = 20
+)
+
+// Throttle counts the recent failed logins for an account
+// or IP address.
+type Throttle struct {
+	Failures []time.Time
+	Locked   time.Time // Until when logins are refused.
+}
+
+// LoginThrottled is the error given when a login must wait.
+type LoginThrottled struct {
+	Until  time.Time
+	Locked bool
+}
+
+func (err *LoginThrottled) Error() string {
+	if err.Locked {
+		return "Too many failed logins; locked until " + err.Until.Format(time.RFC1123)
+	}
+	return "Too many failed logins; try again at " + err.Until.Format(time.RFC1123)
+}
+
+func accountKey(email string) string {
+	return "account:" + NormaliseEmail(email)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func registrationKey(ip string) string {
+	return "register:" + ip
+}
+
+// prune forgets failures outside the window, returning
+// whether nothing remains worth keeping.
+func (t *Throttle) prune(now time.Time) bool {
+	kept := t.Failures[:0]
+	for _, f := range t.Failures {
+		if now.Sub(f) < LoginWindow {
+			kept = append(kept, f)
+		}
+	}
+	t.Failures = kept
+	return len(kept) == 0 && now.After(t.Locked)
+}
+
+// until returns when the next attempt may be made, given
+// the number of failures allowed without delay.
+func (t *Throttle) until(free int) (time.Time, bool) {
+	if time.Now().Before(t.Locked) {
+		return t.Locked, true
+	}
+	n := len(t.Failures) - free
+	if n < 0 {
+		return time.Time{}, false
+	}
+	delay := time.Duration(float64(LoginDelay) * math.Pow(2, float64(n)))
+	if delay > LoginMaxDelay || delay <= 0 {
+		delay = LoginMaxDelay
+	}
+	return t.Failures[len(t.Failures)-1].Add(delay), false
+}
+
+// LoginAttempt is a login which the throttle has let
+// through. It is counted as a failure from the start, so
+// that concurrent guesses cannot all pass the throttle
+// before any of them has failed.
+type LoginAttempt struct {
+	email string
+	ip    string
+	at    time.Time
+}
+
+// BeginLogin returns a *LoginThrottled error if a login to
+// the account from the IP address must wait. Otherwise, it
+// records a failed login, which is withdrawn if the
+// attempt succeeds. It must be called before the password
+// is checked. The email address may be empty if the login
+// names no account.
+func BeginLogin(email, ip string) (*LoginAttempt, error) {
+	db.Lock()
+	defer db.Unlock()
+	now := time.Now()
+	if err := checkThrottle(now, loginKeys(email, ip, AccountFreeAttempts, IPFreeAttempts)); err != nil {
+		return nil, err
+	}
+	loginFailed(email, ip, now)
+	return &LoginAttempt{email, ip, now}, nil
+}
+
+// BeginRegistration returns a *LoginThrottled error if a
+// registration from the IP address must wait, and
+// otherwise records it. It must be called before the new
+// password is hashed.
+func BeginRegistration(ip string) error {
+	db.Lock()
+	defer db.Unlock()
+	now := time.Now()
+	key := registrationKey(ip)
+	if err := checkThrottle(now, map[string]int{key: IPFreeRegistrations}); err != nil {
+		return err
+	}
+	failed(now, map[string]int{key: IPRegistrationLockout})
+	return nil
+}
+
+// Withdraw stops the attempt counting as a failed login,
+// such as when the password was right but a TOTP code is
+// still needed.
+func (a *LoginAttempt) Withdraw() {
+	db.Lock()
+	defer db.Unlock()
+	for _, key := range []string{accountKey(a.email), ipKey(a.ip)} {
+		if t, ok := db.Throttles[key]; ok {
+			t.withdraw(a.at)
+		}
+	}
+}
+
+// Succeeded withdraws the attempt, and forgets the
+// account's failed logins, as LoginSucceeded does.
+func (a *LoginAttempt) Succeeded() {
+	a.Withdraw()
+	LoginSucceeded(a.email)
+}
+
+// withdraw forgets the failure at the given time, and the
+// lockout it caused, if any.
+func (t *Throttle) withdraw(at time.Time) {
+	for i, f := range t.Failures {
+		if f.Equal(at) {
+			t.Failures = append(t.Failures[:i:i], t.Failures[i+1:]...)
+			break
+		}
+	}
+	if t.Locked.Equal(at.Add(LockoutDuration)) {
+		t.Locked = time.Time{}
+	}
+}
+
+// checkThrottle returns an error if an attempt must wait
+// for any of the keys, given the failures allowed for each
+// without delay. The database must be locked.
+func checkThrottle(now time.Time, keys map[string]int) *LoginThrottled {
+	var err *LoginThrottled
+	for key, free := range keys {
+		t, ok := db.Throttles[key]
+		if !ok {
+			continue
+		}
+		if t.prune(now) {
+			delete(db.Throttles, key)
+			continue
+		}
+		until, locked := t.until(free)
+		if now.Before(until) && (err == nil || until.After(err.Until)) {
+			err = &LoginThrottled{until, locked}
+		}
+	}
+	return err
+}
+
+// LoginFailed records a failed login to the account from
+// the IP address, other than a password checked after
+// BeginLogin. The account need not exist.
+func LoginFailed(email, ip string) {
+	db.Lock()
+	defer db.Unlock()
+	loginFailed(email, ip, time.Now())
+}
+
+// loginFailed records a failed login. The database must be
+// locked.
+func loginFailed(email, ip string, now time.Time) {
+	failed(now, loginKeys(email, ip, AccountLockout, IPLockout))
+}
+
+// loginKeys returns the throttle keys for a login to the
+// account from the IP address, each with the given limit.
+// Logins which name no account, such as a Fever client's
+// API key, are throttled by their address alone.
+func loginKeys(email, ip string, account, addr int) map[string]int {
+	keys := map[string]int{ipKey(ip): addr}
+	if email != "" {
+		keys[accountKey(email)] = account
+	}
+	return keys
+}
+
+// failed records a failure for each of the keys, locking
+// them out after the given number. The database must be
+// locked.
+func failed(now time.Time, keys map[string]int) {
+	for key, lockout := range keys {
+		t, ok := db.Throttles[key]
+		if !ok {
+			t = new(Throttle)
+			db.Throttles[key] = t
+		}
+		t.prune(now)
+		t.Failures = append(t.Failures, now)
+		if len(t.Failures) >= lockout && now.After(t.Locked) {
+			t.Locked = now.Add(LockoutDuration)
+			fmt.Printf("Locked out %s after %d failed logins.\n", key, len(t.Failures))
+		}
+	}
+}
+
+// LoginSucceeded forgets the account's failed logins. The
+// IP address's are kept, so that one good account cannot
+// be used to hide guesses at others.
+func LoginSucceeded(email string) {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.Throttles, accountKey(email))
+}
+
+// Unlock forgets the failed logins for the account with
+// the given email address, or the IP address, lifting any
+// lockout.
+func Unlock(name string) error {
+	db.Lock()
+	defer db.Unlock()
+	for _, key := range []string{accountKey(name), ipKey(name)} {
+		if _, ok := db.Throttles[key]; ok {
+			delete(db.Throttles, key)
+			return nil
+		}
+	}
+	return fmt.Errorf("Error: %q has no failed logins.", name)
+}
+
+// Lockout describes the recent failed logins for an
+// account or IP address.
+type Lockout struct {
+	Name     string // Email address or IP address.
+	Account  bool   // Whether Name is an email address.
+	Failures int
+	Locked   time.Time // Until when logins are refused, if they are.
+}
+
+// LoginFailures returns the accounts and IP addresses
+// which are locked out or have recent failed logins.
+func LoginFailures() []*Lockout {
+	db.Lock()
+	defer db.Unlock()
+	now := time.Now()
+	var out []*Lockout
+	for key, t := range db.Throttles {
+		if t.prune(now) {
+			delete(db.Throttles, key)
+			continue
+		}
+		l := &Lockout{Failures: len(t.Failures)}
+		if now.Before(t.Locked) {
+			l.Locked = t.Locked
+		}
+		if strings.HasPrefix(key, "account:") {
+			l.Name, l.Account = strings.TrimPrefix(key, "account:"), true
+		} else if strings.HasPrefix(key, "ip:") {
+			l.Name = strings.TrimPrefix(key, "ip:")
+		} else {
+			continue
+		}
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Account != out[j].Account {
+			return out[i].Account
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Lockouts describes the accounts and IP addresses which
+// are locked out or have recent failed logins.
+func Lockouts() []string {
+	var out []string
+	for _, l := range LoginFailures() {
+		key := ipKey(l.Name)
+		if l.Account {
+			key = accountKey(l.Name)
+		}
+		s := fmt.Sprintf("%-40s %3d failures", key, l.Failures)
+		if !l.Locked.IsZero() {
+			s += ", locked until " + l.Locked.Format(time.RFC3339)
+		}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBeginLoginConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	passed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := BeginLogin("burst@example.com", "192.0.2.20")
+			if err == nil {
+				mutex.Lock()
+				passed++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if passed != AccountFreeAttempts {
+		t.Errorf("Expected %d of a burst of logins to pass, got %d.", AccountFreeAttempts, passed)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	// Failures beyond the free ones double the wait, until
+	// the account or address is locked out.
+	for i, test := range []struct {
+		accounts, failures int // Failures spread over accounts from one address.
+		wait               time.Duration
+		locked             bool
+	}{
+		{1, AccountFreeAttempts - 1, 0, false},
+		{1, AccountFreeAttempts, LoginDelay, false},
+		{1, AccountFreeAttempts + 1, 2 * LoginDelay, false},
+		{1, AccountFreeAttempts + 3, 8 * LoginDelay, false},
+		{1, AccountLockout - 1, LoginDelay << uint(AccountLockout-1-AccountFreeAttempts), false},
+		{1, AccountLockout, LockoutDuration, true},
+		{IPFreeAttempts, IPFreeAttempts - 1, 0, false},
+		{IPFreeAttempts, IPFreeAttempts, LoginDelay, false},
+		{IPLockout, IPLockout, LockoutDuration, true},
+	} {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		email := func(n int) string {
+			return fmt.Sprintf("throttle%d.%d@example.com", i, n%test.accounts)
+		}
+		start := time.Now()
+		for n := 0; n < test.failures; n++ {
+			LoginFailed(email(n), ip)
+		}
+
+		_, err := BeginLogin(email(test.failures), ip)
+		if test.wait == 0 {
+			if err != nil {
+				t.Errorf("%d failures over %d accounts: expected no wait, got %v.", test.failures, test.accounts, err)
+			}
+			continue
+		}
+		throttled, ok := err.(*LoginThrottled)
+		if !ok {
+			t.Errorf("%d failures over %d accounts: expected a wait, got %v.", test.failures, test.accounts, err)
+			continue
+		}
+		if wait := throttled.Until.Sub(start); throttled.Locked != test.locked || wait < test.wait || wait > test.wait+time.Second {
+			t.Errorf("%d failures over %d accounts: expected to wait %v, locked %v, got %v, locked %v.",
+				test.failures, test.accounts, test.wait, test.locked, wait, throttled.Locked)
+		}
+	}
+}
+
+func TestLoginThrottleReset(t *testing.T) {
+	const ip = "198.51.100.10"
+	for n := 0; n < AccountLockout; n++ {
+		LoginFailed("reset@example.com", fmt.Sprint(ip, n%2))
+	}
+	if _, err := BeginLogin("Reset@Example.com", "198.51.100.101"); err == nil {
+		t.Fatal("Expected the account to be locked out from anywhere.")
+	}
+	found := false
+	for _, l := range LoginFailures() {
+		if l.Name == "reset@example.com" && l.Account && l.Failures == AccountLockout && !l.Locked.IsZero() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the lockout to be listed, got %v.", Lockouts())
+	}
+
+	// Unlocking forgets the account's failures, but not the
+	// address's.
+	if err := Unlock("reset@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unlock("reset@example.com"); err == nil {
+		t.Error("Expected the account to have no failures left.")
+	}
+	attempt, err := BeginLogin("reset@example.com", ip+"0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A successful login withdraws its own failure, and
+	// forgets the account's others.
+	LoginFailed("reset@example.com", ip+"0")
+	attempt.Succeeded()
+	for _, l := range LoginFailures() {
+		if l.Name == "reset@example.com" {
+			t.Errorf("Expected the account's failures to be forgotten, got %d.", l.Failures)
+		}
+		if l.Name == ip+"0" && l.Failures != AccountLockout/2+1 {
+			t.Errorf("Expected the address to keep %d failures, got %d.", AccountLockout/2+1, l.Failures)
+		}
+	}
+
+	// Withdrawing an attempt, such as while waiting for a
+	// TOTP code, neither counts nor forgets anything.
+	attempt, err = BeginLogin("withdraw@example.com", "198.51.100.102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempt.Withdraw()
+	for _, l := range LoginFailures() {
+		if l.Name == "withdraw@example.com" || l.Name == "198.51.100.102" {
+			t.Errorf("Expected no failures for %s, got %d.", l.Name, l.Failures)
+		}
+	}
+}
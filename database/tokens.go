@@ -0,0 +1,374 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	sec "rs3/security"
+	"strings"
+	"time"
+)
+
+// Scopes limit what a token or app password may do. Each
+// allows everything the ones before it do.
+const (
+	ScopeRead  = "read"  // Read feeds and items.
+	ScopeWrite = "write" // Also change them.
+	ScopeAdmin = "admin" // Also manage tokens and app passwords.
+)
+
+var scopes = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// Kinds of token.
+const (
+	KindClient   = "client"   // Issued to an app when it logs in.
+	KindToken    = "token"    // Personal API token, sent with each request.
+	KindPassword = "password" // App password, used by apps to log in.
+	KindOAuth    = "oauth"    // Granted to an OAuth client, with a refresh token.
+)
+
+// MaxClients is the number of tokens issued to apps at
+// login which are kept for each user. The oldest are
+// forgotten first.
+var MaxClients = 20
+
+// Token is a credential, other than the user's password,
+// with which apps and scripts act as the user. Only a hash
+// of its secret is stored.
+type Token struct {
+	ID       string
+	Name     string
+	Kind     string
+	Scope    string
+	Hash     string
+	Created  time.Time
+	Expires  time.Time // Zero if it never expires.
+	LastUsed time.Time
+
+	// For OAuth grants, the client, the hash of the refresh
+	// token, and when the access token expires. Expires is
+	// when the refresh token does.
+	Client        string
+	Refresh       string
+	AccessExpires time.Time
+}
+
+// Expired returns whether the token has expired.
+func (t *Token) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+// Allows returns whether a credential with scope have may
+// do what needs scope want.
+func Allows(have, want string) bool {
+	rank := func(s string) int {
+		for i, scope := range scopes {
+			if s == scope {
+				return i
+			}
+		}
+		return len(scopes)
+	}
+	return rank(have) < len(scopes) && rank(have) >= rank(want)
+}
+
+// checkScope returns an error unless s is a scope.
+func checkScope(s string) error {
+	for _, scope := range scopes {
+		if s == scope {
+			return nil
+		}
+	}
+	return fmt.Errorf("Error: unknown scope %q.", s)
+}
+
+// random returns n random bytes in hex.
+func random(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// addToken stores a new token with the given secret,
+// returning a copy of it.
+func addToken(uid []byte, secret string, t *Token) (*Token, error) {
+	if err := checkScope(t.Scope); err != nil {
+		return nil, err
+	}
+	id, err := random(8)
+	if err != nil {
+		return nil, err
+	}
+	t.ID = id
+	t.Hash = hashToken(secret)
+	t.Created = time.Now()
+
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+
+	// Forget expired tokens, and the oldest app logins.
+	clients := 0
+	for _, old := range user.Tokens {
+		if old.Kind == KindClient {
+			clients++
+		}
+	}
+	if t.Kind == KindClient {
+		clients++
+	}
+	kept := make([]*Token, 0, len(user.Tokens)+1)
+	for _, old := range user.Tokens {
+		if old.Expired() {
+			continue
+		}
+		if old.Kind == KindClient && clients > MaxClients {
+			clients--
+			continue
+		}
+		kept = append(kept, old)
+	}
+	user.Tokens = append(kept, t)
+
+	c := *t
+	c.Hash = ""
+	c.Refresh = ""
+	return &c, nil
+}
+
+// NewClientToken returns a new token with which an app
+// which has just logged in can act as the user. The name
+// identifies the app to the user.
+func NewClientToken(uid []byte, name, scope string) (string, error) {
+	secret, err := random(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = addToken(uid, secret, &Token{Name: name, Kind: KindClient, Scope: scope})
+	if err != nil {
+		return "", err
+	}
+	return UidToString(uid) + "." + secret, nil
+}
+
+// NewToken creates a personal API token, returning its
+// secret, which is not stored, and a description of it.
+// A zero expiry means it never expires.
+func NewToken(uid []byte, name, scope string, expires time.Time) (string, *Token, error) {
+	if name == "" {
+		return "", nil, errors.New("Error: tokens need a name.")
+	}
+	secret, err := random(32)
+	if err != nil {
+		return "", nil, err
+	}
+	t, err := addToken(uid, secret, &Token{Name: name, Kind: KindToken, Scope: scope, Expires: expires})
+	if err != nil {
+		return "", nil, err
+	}
+	return UidToString(uid) + "." + secret, t, nil
+}
+
+// appPasswordLetters are those used in app passwords,
+// which users may have to type.
+const appPasswordLetters = "abcdefghijkmnpqrstuvwxyz"
+
+// NewAppPassword creates an app password, which apps may
+// use to log in instead of the user's password. It returns
+// the password, in groups of four letters, and a
+// description of it.
+func NewAppPassword(uid []byte, name, scope string, expires time.Time) (string, *Token, error) {
+	if name == "" {
+		return "", nil, errors.New("Error: app passwords need a name.")
+	}
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", nil, err
+	}
+	var password []byte
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			password = append(password, '-')
+		}
+		password = append(password, appPasswordLetters[int(c)%len(appPasswordLetters)])
+	}
+	t, err := addToken(uid, normalisePassword(string(password)), &Token{Name: name, Kind: KindPassword, Scope: scope, Expires: expires})
+	if err != nil {
+		return "", nil, err
+	}
+	return string(password), t, nil
+}
+
+// normalisePassword removes the separators from an app
+// password, and ignores case, as users may type it.
+func normalisePassword(s string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(s))
+}
+
+// Tokens returns descriptions of the user's tokens and app
+// passwords.
+func Tokens(uid []byte) ([]*Token, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	out := make([]*Token, len(user.Tokens))
+	for i, t := range user.Tokens {
+		c := *t
+		c.Hash = ""
+		c.Refresh = ""
+		out[i] = &c
+	}
+	return out, nil
+}
+
+// RevokeToken deletes the token or app password with the
+// given ID.
+func RevokeToken(uid []byte, id string) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	for i, t := range user.Tokens {
+		if t.ID == id {
+			user.Tokens = append(user.Tokens[:i:i], user.Tokens[i+1:]...)
+			return nil
+		}
+	}
+	return new(TokenDoesNotExist)
+}
+
+// lastUsedInterval is how often a token's LastUsed time is
+// updated, so that most requests need only read the
+// database.
+const lastUsedInterval = time.Minute
+
+// use finds the user's unexpired credential of one of the
+// given kinds with the secret's hash, recording that it
+// was used. The caller must hold the database lock.
+func (u *User) use(hash string, kinds ...string) *Token {
+	found := u.credential(hash, kinds...)
+	if found != nil {
+		found.LastUsed = time.Now()
+	}
+	return found
+}
+
+// credential finds the user's unexpired credential of one
+// of the given kinds with the secret's hash. The caller
+// must hold the database lock, which may be a read lock.
+func (u *User) credential(hash string, kinds ...string) *Token {
+	var found *Token
+	for _, t := range u.Tokens {
+		ok := false
+		for _, kind := range kinds {
+			ok = ok || t.Kind == kind
+		}
+		if ok && subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 && !t.Expired() {
+			if t.Kind != KindOAuth || time.Now().Before(t.AccessExpires) {
+				found = t
+			}
+		}
+	}
+	return found
+}
+
+// ClientUser returns the uid of the user to whom the app
+// token, personal API token or OAuth access token was
+// issued, and its scope.
+func ClientUser(token string) ([]byte, string, error) {
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return nil, "", new(AuthenticationError)
+	}
+	uid, err := StringToUid(token[:i])
+	if err != nil {
+		return nil, "", new(AuthenticationError)
+	}
+	hash := hashToken(token[i+1:])
+
+	// Tokens are checked on every request, so the write lock
+	// is only taken when LastUsed is out of date.
+	db.RLock()
+	var t *Token
+	if user, ok := db.Users[UidToString(uid)]; ok {
+		t = user.credential(hash, KindClient, KindToken, KindOAuth)
+	}
+	var scope string
+	var stale bool
+	if t != nil {
+		scope = t.Scope
+		stale = time.Since(t.LastUsed) > lastUsedInterval
+	}
+	db.RUnlock()
+	if t == nil {
+		return nil, "", new(AuthenticationError)
+	}
+	if stale {
+		db.Lock()
+		t.LastUsed = time.Now()
+		db.Unlock()
+	}
+	return uid, scope, nil
+}
+
+// CheckAppPassword returns the uid of the user with the
+// given email address, for an app logging in with one of
+// their app passwords, and the app password's scope.
+func CheckAppPassword(email, password string) ([]byte, string, error) {
+	email, salt := Account(email)
+	if salt == nil {
+		return nil, "", new(AuthenticationError)
+	}
+	uid, err := sec.Hash(email, salt)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := hashToken(normalisePassword(password))
+
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, "", new(AuthenticationError)
+	}
+	t := user.use(hash, KindPassword)
+	if t == nil {
+		return nil, "", new(AuthenticationError)
+	}
+	return uid, t.Scope, nil
+}
+
+// migrateClients turns the hashes of app tokens stored
+// before tokens had names and scopes into tokens. The
+// caller must hold the database lock.
+func (u *User) migrateClients() {
+	for _, hash := range u.Clients {
+		id, err := random(8)
+		if err != nil {
+			continue
+		}
+		u.Tokens = append(u.Tokens, &Token{ID: id, Name: "App", Kind: KindClient, Scope: ScopeWrite, Hash: hash})
+	}
+	u.Clients = nil
+}
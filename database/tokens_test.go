@@ -0,0 +1,52 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestClientUser(t *testing.T) {
+	uid := testUser(t, "client user")
+	token, _, err := NewToken(uid, "script", ScopeRead, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastUsed := func() time.Time {
+		db.RLock()
+		defer db.RUnlock()
+		return db.Users[UidToString(uid)].Tokens[0].LastUsed
+	}
+	setLastUsed := func(at time.Time) {
+		db.Lock()
+		defer db.Unlock()
+		db.Users[UidToString(uid)].Tokens[0].LastUsed = at
+	}
+
+	got, scope, err := ClientUser(token)
+	if err != nil || !bytes.Equal(got, uid) || scope != ScopeRead {
+		t.Fatalf("Expected the token to be accepted, got %q, %v.", scope, err)
+	}
+	if time.Since(lastUsed()) > time.Minute {
+		t.Errorf("Expected the token's use to be recorded, got %v.", lastUsed())
+	}
+
+	// Recent uses are not recorded again.
+	recent := time.Now().Add(-lastUsedInterval / 2)
+	setLastUsed(recent)
+	ClientUser(token)
+	if !lastUsed().Equal(recent) {
+		t.Errorf("Expected the recent use to be kept, got %v.", lastUsed())
+	}
+	setLastUsed(time.Now().Add(-2 * lastUsedInterval))
+	ClientUser(token)
+	if time.Since(lastUsed()) > lastUsedInterval {
+		t.Errorf("Expected the stale use to be updated, got %v.", lastUsed())
+	}
+
+	for _, bad := range []string{"", "nodot", token + "x", UidToString(uid) + ".wrong"} {
+		if _, _, err := ClientUser(bad); err == nil {
+			t.Errorf("Expected %q to be refused.", bad)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	sec "rs3/security"
+	"sync"
+	"time"
+)
+
+var (
+	SecretKeyPath        = "database/secrets.key" // File holding the key which encrypts TOTP secrets.
+	RecoveryCodes        = 10                     // Number of recovery codes given.
+	PendingLoginLife     = 5 * time.Minute        // Time to enter a code after the password.
+	PendingLoginAttempts = 5                      // Codes which may be tried per password.
+)
+
+// TwoFactor holds a user's TOTP two-factor authentication.
+// The secret is encrypted with the key at SecretKeyPath,
+// so that a copy of the database alone cannot be used to
+// make codes.
+type TwoFactor struct {
+	Secret   string    // Encrypted TOTP secret.
+	Step     int64     // Time step of the last code used.
+	Recovery []string  // Hashes of the unused recovery codes.
+	Enabled  time.Time // Zero until the user confirms a code.
+}
+
+var secretKey []byte
+var secretKeyErr error
+var secretKeyOnce sync.Once
+
+// LoadSecretKey loads the key which encrypts TOTP secrets,
+// creating it if it does not yet exist. It is called at
+// startup, so that a key which cannot be read stops the
+// server, rather than being replaced by one which cannot
+// decrypt the secrets already stored.
+func LoadSecretKey() error {
+	_, err := encryptionKey()
+	return err
+}
+
+// encryptionKey returns the key which encrypts TOTP
+// secrets.
+func encryptionKey() ([]byte, error) {
+	secretKeyOnce.Do(func() {
+		secretKey, secretKeyErr = loadKey(SecretKeyPath)
+	})
+	if secretKey == nil {
+		return nil, secretKeyErr
+	}
+	return secretKey, nil
+}
+
+// loadKey reads the 32-byte key in the named file,
+// creating the file if it does not exist. Any other
+// failure is an error, so that an existing key is never
+// overwritten.
+func loadKey(name string) ([]byte, error) {
+	k, err := ioutil.ReadFile(name)
+	if err == nil {
+		if len(k) != 32 {
+			return nil, fmt.Errorf("Error: %s does not hold a 32-byte key.", name)
+		}
+		return k, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	k = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, k)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(k)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	return k, nil
+}
+
+func (t *TwoFactor) secret() (string, error) {
+	key, err := encryptionKey()
+	if err != nil {
+		return "", err
+	}
+	secret, err := sec.Decrypt(key, t.Secret)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// TwoFactorEnabled returns whether the user logs in with a
+// TOTP code, and how many recovery codes they have left.
+func TwoFactorEnabled(uid []byte) (bool, int, error) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return false, 0, new(UserDoesNotExist)
+	}
+	if user.TwoFactor == nil || user.TwoFactor.Enabled.IsZero() {
+		return false, 0, nil
+	}
+	return true, len(user.TwoFactor.Recovery), nil
+}
+
+// BeginTOTP starts setting up two-factor authentication,
+// returning a secret, and the otpauth URI which gives it
+// to authenticator apps. It is not used for logins until
+// EnableTOTP is given a code made with it, and until then
+// the same secret is returned each time.
+func BeginTOTP(uid []byte, account string) (string, string, error) {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return "", "", new(UserDoesNotExist)
+	}
+	tf := user.TwoFactor
+	if tf != nil && !tf.Enabled.IsZero() {
+		return "", "", errors.New("Error: two-factor authentication is already on.")
+	}
+
+	var secret string
+	var err error
+	if tf != nil {
+		secret, err = tf.secret()
+	}
+	if tf == nil || err != nil {
+		secret, err = sec.NewTOTPSecret()
+		if err != nil {
+			return "", "", err
+		}
+		key, err := encryptionKey()
+		if err != nil {
+			return "", "", err
+		}
+		encrypted, err := sec.Encrypt(key, []byte(secret))
+		if err != nil {
+			return "", "", err
+		}
+		user.TwoFactor = &TwoFactor{Secret: encrypted}
+	}
+	return secret, sec.TOTPURI("RS3", account, secret), nil
+}
+
+// EnableTOTP turns on the two-factor authentication set up
+// by BeginTOTP, once the user shows that their app makes
+// the right codes. It returns their recovery codes, which
+// are shown only once.
+func EnableTOTP(uid []byte, code string) ([]string, error) {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	tf := user.TwoFactor
+	if tf == nil || !tf.Enabled.IsZero() {
+		return nil, errors.New("Error: two-factor authentication is not being set up.")
+	}
+	secret, err := tf.secret()
+	if err != nil {
+		return nil, err
+	}
+	step, ok := sec.CheckTOTP(secret, code, time.Now(), tf.Step)
+	if !ok {
+		return nil, new(AuthenticationError)
+	}
+	codes, err := newRecoveryCodes(tf)
+	if err != nil {
+		return nil, err
+	}
+	tf.Step = step
+	tf.Enabled = time.Now()
+	return codes, nil
+}
+
+// newRecoveryCodes replaces the recovery codes, returning
+// the new ones. They are formatted and matched like app
+// passwords.
+func newRecoveryCodes(tf *TwoFactor) ([]string, error) {
+	codes := make([]string, RecoveryCodes)
+	hashes := make([]string, RecoveryCodes)
+	b := make([]byte, 12)
+	for i := range codes {
+		_, err := io.ReadFull(rand.Reader, b)
+		if err != nil {
+			return nil, err
+		}
+		var code []byte
+		for j, c := range b {
+			if j > 0 && j%4 == 0 {
+				code = append(code, '-')
+			}
+			code = append(code, appPasswordLetters[int(c)%len(appPasswordLetters)])
+		}
+		codes[i] = string(code)
+		hashes[i] = hashToken(normalisePassword(codes[i]))
+	}
+	tf.Recovery = hashes
+	return codes, nil
+}
+
+// checkTwoFactor checks a TOTP code, or uses up a recovery
+// code. The database must be locked.
+func (u *User) checkTwoFactor(code string) error {
+	tf := u.TwoFactor
+	if tf == nil || tf.Enabled.IsZero() {
+		return errors.New("Error: two-factor authentication is off.")
+	}
+	secret, err := tf.secret()
+	if err != nil {
+		return err
+	}
+	if step, ok := sec.CheckTOTP(secret, code, time.Now(), tf.Step); ok {
+		tf.Step = step
+		return nil
+	}
+	hash := []byte(hashToken(normalisePassword(code)))
+	for i, h := range tf.Recovery {
+		if subtle.ConstantTimeCompare([]byte(h), hash) == 1 {
+			tf.Recovery = append(tf.Recovery[:i:i], tf.Recovery[i+1:]...)
+			return nil
+		}
+	}
+	return new(AuthenticationError)
+}
+
+// CheckTOTP returns an error unless the code is a valid
+// TOTP code or unused recovery code for the user. Each
+// code is accepted only once.
+func CheckTOTP(uid []byte, code string) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	return user.checkTwoFactor(code)
+}
+
+// NewRecoveryCodes replaces the user's recovery codes, if
+// they give a valid code.
+func NewRecoveryCodes(uid []byte, code string) ([]string, error) {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return nil, new(UserDoesNotExist)
+	}
+	err := user.checkTwoFactor(code)
+	if err != nil {
+		return nil, err
+	}
+	return newRecoveryCodes(user.TwoFactor)
+}
+
+// DisableTOTP turns off two-factor authentication, if the
+// user gives a valid code.
+func DisableTOTP(uid []byte, code string) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	err := user.checkTwoFactor(code)
+	if err != nil {
+		return err
+	}
+	user.TwoFactor = nil
+	return nil
+}
+
+// ResetTOTP turns off two-factor authentication without a
+// code, for users who have lost their app and recovery
+// codes.
+func ResetTOTP(uid []byte) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.Users[UidToString(uid)]
+	if !ok {
+		return new(UserDoesNotExist)
+	}
+	if user.TwoFactor == nil {
+		return errors.New("Error: two-factor authentication is already off.")
+	}
+	user.TwoFactor = nil
+	return nil
+}
+
+// pendingLogin is a login whose password has been checked,
+// which awaits a TOTP code.
+type pendingLogin struct {
+	Uid      []byte
+	Email    string
+	Expires  time.Time
+	Attempts int
+}
+
+// pending holds the pending logins, by hash. It is guarded
+// by the database lock.
+var pending = make(map[string]*pendingLogin)
+
+// NewPendingLogin records that the user has given their
+// email address and password, returning a token with which
+// to give their TOTP code within PendingLoginLife.
+func NewPendingLogin(uid []byte, email string) (string, error) {
+	token, err := random(32)
+	if err != nil {
+		return "", err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	now := time.Now()
+	for hash, p := range pending {
+		if now.After(p.Expires) {
+			delete(pending, hash)
+		}
+	}
+	pending[hashToken(token)] = &pendingLogin{uid, email, now.Add(PendingLoginLife), 0}
+	return token, nil
+}
+
+// CompletePendingLogin returns the uid of the user whose
+// login the token is for, if the code is valid, and the
+// email address they gave, whether or not it is. Once the
+// code is valid, or after PendingLoginAttempts wrong ones,
+// the token is used up, and a *LoginExpired error is
+// returned for it. So it is if two-factor authentication
+// has been turned off meanwhile, and the user must give
+// their password again.
+func CompletePendingLogin(token, code string) ([]byte, string, error) {
+	db.Lock()
+	defer db.Unlock()
+	hash := hashToken(token)
+	p, ok := pending[hash]
+	if !ok || time.Now().After(p.Expires) {
+		delete(pending, hash)
+		return nil, "", new(LoginExpired)
+	}
+	user, ok := db.Users[UidToString(p.Uid)]
+	if !ok || user.TwoFactor == nil || user.TwoFactor.Enabled.IsZero() {
+		delete(pending, hash)
+		return nil, p.Email, new(LoginExpired)
+	}
+	err := user.checkTwoFactor(code)
+	if err != nil {
+		p.Attempts++
+		if p.Attempts >= PendingLoginAttempts {
+			delete(pending, hash)
+		}
+		return nil, p.Email, err
+	}
+	delete(pending, hash)
+	return p.Uid, p.Email, nil
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	sec "rs3/security"
+	"testing"
+	"time"
+)
+
+func TestLoadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A missing key is created, and then kept.
+	name := filepath.Join(dir, "secrets.key")
+	k, err := loadKey(name)
+	if err != nil || len(k) != 32 {
+		t.Fatalf("Expected a new key, got %d bytes, %v.", len(k), err)
+	}
+	again, err := loadKey(name)
+	if err != nil || !bytes.Equal(k, again) {
+		t.Fatalf("Expected the same key again, got %v.", err)
+	}
+
+	// Keys which cannot be read are never replaced.
+	short := filepath.Join(dir, "short.key")
+	err = ioutil.WriteFile(short, []byte("too short"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKey(short); err == nil {
+		t.Error("Expected a short key to be refused.")
+	}
+	if b, _ := ioutil.ReadFile(short); string(b) != "too short" {
+		t.Errorf("Expected the short key to be left alone, got %q.", b)
+	}
+	if _, err := loadKey(dir); err == nil {
+		t.Error("Expected a directory to be refused.")
+	}
+}
+
+// enableTOTP turns on two-factor authentication for the
+// user, returning their secret and recovery codes. The
+// code for the last time step is used, so that the codes
+// for this step and the next are still to be used.
+func enableTOTP(t *testing.T, uid []byte) (string, []string) {
+	secret, _, err := BeginTOTP(uid, "totp@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := sec.TOTP(secret, sec.TOTPStep(time.Now())-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := EnableTOTP(uid, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret, recovery
+}
+
+func TestPendingLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SecretKeyPath = filepath.Join(dir, "secrets.key")
+	if err := LoadSecretKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	uid := testUser(t, "totp")
+	secret, recovery := enableTOTP(t, uid)
+	if enabled, n, err := TwoFactorEnabled(uid); err != nil || !enabled || n != RecoveryCodes {
+		t.Fatalf("Expected two-factor authentication with %d recovery codes, got %v, %d, %v.", RecoveryCodes, enabled, n, err)
+	}
+	code, err := sec.TOTP(secret, sec.TOTPStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each TOTP code and recovery code works once.
+	for _, test := range []struct {
+		code string
+		ok   bool
+	}{
+		{"000000", false},
+		{code, true},
+		{code, false},
+		{recovery[0], true},
+		{recovery[0], false},
+		{recovery[1], true},
+	} {
+		token, err := NewPendingLogin(uid, "totp@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, email, err := CompletePendingLogin(token, test.code)
+		if email != "totp@example.com" {
+			t.Errorf("%q: expected the email address, got %q.", test.code, email)
+		}
+		if test.ok && (err != nil || !bytes.Equal(got, uid)) {
+			t.Errorf("%q: expected the login to complete, got %v.", test.code, err)
+		}
+		if _, ok := err.(*AuthenticationError); !test.ok && !ok {
+			t.Errorf("%q: expected the code to be refused, got %v.", test.code, err)
+		}
+		if _, _, err := CompletePendingLogin(token, recovery[2]); test.ok && err == nil {
+			t.Errorf("%q: expected the token to be used up.", test.code)
+		}
+	}
+	if _, n, _ := TwoFactorEnabled(uid); n != RecoveryCodes-3 {
+		t.Errorf("Expected %d recovery codes left, got %d.", RecoveryCodes-3, n)
+	}
+
+	// Only so many codes may be tried for each password.
+	token, err := NewPendingLogin(uid, "totp@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < PendingLoginAttempts; i++ {
+		if _, _, err := CompletePendingLogin(token, "000000"); err == nil {
+			t.Fatal("Expected the wrong code to be refused.")
+		}
+	}
+	if _, _, err := CompletePendingLogin(token, recovery[3]); err == nil {
+		t.Fatal("Expected the token to be used up.")
+	} else if _, ok := err.(*LoginExpired); !ok {
+		t.Errorf("Expected the login to have expired, got %v.", err)
+	}
+
+	// Pending logins expire, including when two-factor
+	// authentication is turned off meanwhile.
+	old := PendingLoginLife
+	PendingLoginLife = -time.Second
+	token, err = NewPendingLogin(uid, "totp@example.com")
+	PendingLoginLife = old
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CompletePendingLogin(token, recovery[3]); err == nil {
+		t.Error("Expected the login to have expired.")
+	}
+	token, err = NewPendingLogin(uid, "totp@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ResetTOTP(uid); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CompletePendingLogin(token, recovery[3]); err == nil {
+		t.Error("Expected the login to have expired.")
+	} else if _, ok := err.(*LoginExpired); !ok {
+		t.Errorf("Expected the login to have expired, got %v.", err)
+	}
+}
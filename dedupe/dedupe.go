@@ -0,0 +1,172 @@
+package dedupe
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"rs3/privacy"
+	"strings"
+	"unicode"
+)
+
+// Threshold is the largest simhash distance at which two
+// items are considered near-duplicates.
+var Threshold = 6
+
+// MinWords is the least number of words an item's text
+// must have for its simhash to be meaningful.
+var MinWords = 20
+
+// Canonical returns a normalised form of a link, so that
+// trivially different links to the same page compare equal.
+func Canonical(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || !u.IsAbs() {
+		return ""
+	}
+	u = privacy.Default.URL(u)
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.User = nil
+	u.Host = strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	if u.Scheme == "https" {
+		u.Scheme = "http"
+	}
+	u.Host = strings.TrimSuffix(u.Host, ":80")
+	u.Host = strings.TrimSuffix(u.Host, ":443")
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	if u.RawQuery != "" {
+		// Encode sorts the parameters by key.
+		u.RawQuery = u.Query().Encode()
+	}
+	return u.String()
+}
+
+// words splits text into lower-case words.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Title normalises a title for comparison.
+func Title(title string) string {
+	return strings.Join(words(title), " ")
+}
+
+// Simhash returns a 64-bit simhash of the text, built
+// from three-word shingles, along with the number of
+// words in the text.
+func Simhash(text string) (uint64, int) {
+	w := words(text)
+	var counts [64]int
+	shingles := 0
+	for i := 0; i+3 <= len(w); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(w[i:i+3], " ")))
+		sum := h.Sum64()
+		for b := uint(0); b < 64; b++ {
+			if sum&(1<<b) != 0 {
+				counts[b]++
+			} else {
+				counts[b]--
+			}
+		}
+		shingles++
+	}
+	if shingles == 0 {
+		return 0, len(w)
+	}
+	var hash uint64
+	for b := uint(0); b < 64; b++ {
+		if counts[b] > 0 {
+			hash |= 1 << b
+		}
+	}
+	return hash, len(w)
+}
+
+// Distance returns the number of bits which differ
+// between two simhashes.
+func Distance(a, b uint64) int {
+	n := 0
+	for x := a ^ b; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
+
+// Fingerprint holds what is needed to compare one item
+// with another.
+type Fingerprint struct {
+	Link    string // Canonical link.
+	ID      string
+	Title   string // Normalised title.
+	Simhash uint64
+	Words   int
+}
+
+// New returns the fingerprint of an item. The content
+// should be plain text.
+func New(link, id, title, content string) *Fingerprint {
+	f := &Fingerprint{
+		Link:  Canonical(link),
+		Title: Title(title),
+	}
+
+	// Only GUIDs which look globally unique, such as URLs
+	// and tag URIs, are useful across feeds.
+	if id = strings.TrimSpace(id); strings.Contains(id, ":") {
+		f.ID = id
+	}
+	f.Simhash, f.Words = Simhash(title + " " + content)
+	return f
+}
+
+// Same returns whether two fingerprints describe the
+// same story.
+func (f *Fingerprint) Same(g *Fingerprint) bool {
+	switch {
+	case f.Link != "" && f.Link == g.Link:
+		return true
+	case f.ID != "" && f.ID == g.ID:
+		return true
+	case f.Words >= MinWords && g.Words >= MinWords:
+		return Distance(f.Simhash, g.Simhash) <= Threshold
+	default:
+		return f.Title != "" && f.Title == g.Title
+	}
+}
+
+// Keys returns the keys under which to index the
+// fingerprint. Any fingerprint which is the Same as it
+// shares at least one of them, so items need only be
+// compared with those indexed under their keys.
+func (f *Fingerprint) Keys() []string {
+	var keys []string
+	if f.Link != "" {
+		keys = append(keys, "link:"+f.Link)
+	}
+	if f.ID != "" {
+		keys = append(keys, "id:"+f.ID)
+	}
+	if f.Title != "" {
+		keys = append(keys, "title:"+f.Title)
+	}
+	if f.Words >= MinWords {
+		// Near-duplicates differ in at most Threshold bits,
+		// so are the same in at least one of Threshold+1
+		// bands of bits.
+		bands := Threshold + 1
+		if bands > 64 {
+			bands = 64
+		}
+		for i := 0; i < bands; i++ {
+			lo, hi := uint(64*i/bands), uint(64*(i+1)/bands)
+			band := f.Simhash >> lo & (1<<(hi-lo) - 1)
+			keys = append(keys, fmt.Sprintf("simhash%d:%x", i, band))
+		}
+	}
+	return keys
+}
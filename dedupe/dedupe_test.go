@@ -0,0 +1,103 @@
+package dedupe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	same := []string{
+		"http://example.com/story/1",
+		"https://www.example.com/story/1/",
+		"http://EXAMPLE.com/story/1#comments",
+		"http://example.com/story/1?utm_source=rss",
+		"http://example.com:80/story/1",
+	}
+	want := Canonical(same[0])
+	for _, link := range same[1:] {
+		if got := Canonical(link); got != want {
+			t.Errorf("Canonical(%q) = %q, want %q.", link, got, want)
+		}
+	}
+	if Canonical("http://example.com/story/2") == want {
+		t.Error("Different links have the same canonical form.")
+	}
+	if Canonical("http://example.com/?b=2&a=1") != Canonical("http://example.com/?a=1&b=2") {
+		t.Error("Parameter order changed the canonical form.")
+	}
+}
+
+const story = `The city council voted on Tuesday to approve a new budget for the coming year,
+which includes additional funding for public transport, libraries and parks, while cutting
+spending on administration. The vote passed by seven votes to four after a lengthy debate.`
+
+func TestSame(t *testing.T) {
+	a := New("http://one.example/a", "1", "Council approves budget", story)
+	b := New("http://two.example/b", "1", "Council approves budget",
+		strings.Replace(story, "lengthy", "long", 1))
+	if !a.Same(b) {
+		t.Errorf("Failed to detect near-duplicate: distance %d.", Distance(a.Simhash, b.Simhash))
+	}
+
+	c := New("http://two.example/c", "2", "Local team wins cup",
+		`The local football team won the cup final on Saturday afternoon, beating their rivals by
+		three goals to one in front of a record crowd, with two goals coming in the final ten minutes
+		of a match which had been evenly balanced until then.`)
+	if a.Same(c) {
+		t.Errorf("Detected unrelated items as duplicates: distance %d.", Distance(a.Simhash, c.Simhash))
+	}
+
+	// Numeric GUIDs are not unique across feeds.
+	if New("", "1", "x", "").Same(New("", "1", "y", "")) {
+		t.Error("Matched items on a feed-local GUID.")
+	}
+	if !New("", "tag:example.com,2013:1", "x", "").Same(New("", "tag:example.com,2013:1", "y", "")) {
+		t.Error("Failed to match items on a global GUID.")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	shares := func(f, g *Fingerprint) bool {
+		keys := make(map[string]bool)
+		for _, k := range f.Keys() {
+			keys[k] = true
+		}
+		for _, k := range g.Keys() {
+			if keys[k] {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Near-duplicates share a key however their differing
+	// bits are spread.
+	a := New("http://one.example/a", "1", "Council approves budget", story)
+	for i := uint(0); i < 64; i++ {
+		b := *a
+		b.Link, b.Title = "", ""
+		for j := uint(0); j < uint(Threshold); j++ {
+			b.Simhash ^= 1 << ((i + j*11) % 64)
+		}
+		if Distance(a.Simhash, b.Simhash) > Threshold || !a.Same(&b) {
+			t.Fatalf("Expected a near-duplicate at distance %d.", Distance(a.Simhash, b.Simhash))
+		}
+		if !shares(a, &b) {
+			t.Errorf("Near-duplicate %d shares no key.", i)
+		}
+	}
+
+	for _, g := range []*Fingerprint{
+		New("http://www.one.example/a/", "", "Something else", ""),
+		New("", "", "Council Approves: Budget", ""),
+		New("", "tag:example.com,2013:1", "x", ""),
+	} {
+		f := New("http://one.example/a", "tag:example.com,2013:1", "Council approves budget", "")
+		if !f.Same(g) || !shares(f, g) {
+			t.Errorf("Expected %+v to share a key.", g)
+		}
+	}
+	if shares(New("", "", "One", ""), New("", "", "Two", "")) {
+		t.Error("Unrelated items share a key.")
+	}
+}
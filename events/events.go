@@ -0,0 +1,166 @@
+// Package events fans notifications out to each user's
+// open pages, keeping a short history so that a page which
+// reconnects can catch up on what it missed.
+package events
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxConnections limits the number of streams one user
+// can have open, and MaxTotal the number open in all.
+var (
+	MaxConnections = 8
+	MaxTotal       = 1024
+)
+
+// History is the number of events kept for each user.
+var History = 256
+
+// Buffer is the number of events which may be waiting
+// to be sent on a stream. A stream which falls further
+// behind is closed, and must reconnect.
+var Buffer = 32
+
+// ErrTooManyConnections is returned by Subscribe if the
+// connection limits have been reached.
+var ErrTooManyConnections = errors.New("Error: too many open event streams.")
+
+// Event is a notification for a user. IDs increase by
+// one with each event sent to the same user.
+type Event struct {
+	ID   uint64
+	Type string
+	Data interface{}
+}
+
+// Hub routes events to their users' streams.
+type Hub struct {
+	mutex sync.Mutex
+	users map[string]*user
+	total int
+}
+
+type user struct {
+	last    uint64 // ID of the latest event.
+	history []*Event
+	streams map[*Stream]struct{}
+}
+
+// Stream receives a user's events from the time it was
+// opened. C is closed if the stream is dropped.
+type Stream struct {
+	C <-chan *Event
+
+	// Missed holds the events sent since the ID given to
+	// Subscribe. If some of these are no longer held, Lost
+	// is set and the client must resynchronise. Last is the
+	// ID of the latest event sent before the stream opened.
+	Missed []*Event
+	Lost   bool
+	Last   uint64
+
+	c    chan *Event
+	hub  *Hub
+	user string
+}
+
+// Default is the hub used by the server.
+var Default = NewHub()
+
+// NewHub returns an empty hub.
+func NewHub() *Hub {
+	return &Hub{users: make(map[string]*user)}
+}
+
+// get returns the user's state, creating it if necessary.
+// The caller must hold the hub's lock.
+func (h *Hub) get(uid string) *user {
+	u, ok := h.users[uid]
+	if !ok {
+		// Start from the time, so that IDs from before a
+		// restart are older than any issued after it.
+		u = &user{
+			last:    uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+			streams: make(map[*Stream]struct{}),
+		}
+		h.users[uid] = u
+	}
+	return u
+}
+
+// Publish sends an event to each of the user's streams.
+// It never blocks.
+func (h *Hub) Publish(uid, typ string, data interface{}) *Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	u := h.get(uid)
+	u.last++
+	e := &Event{u.last, typ, data}
+	u.history = append(u.history, e)
+	if len(u.history) > History {
+		u.history = u.history[len(u.history)-History:]
+	}
+	for s := range u.streams {
+		select {
+		case s.c <- e:
+		default:
+			h.drop(u, s)
+		}
+	}
+	return e
+}
+
+// Subscribe opens a stream of the user's events. If
+// after is non-zero, the events since that ID are put in
+// the stream's Missed field.
+func (h *Hub) Subscribe(uid string, after uint64) (*Stream, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	u := h.get(uid)
+	if len(u.streams) >= MaxConnections || h.total >= MaxTotal {
+		return nil, ErrTooManyConnections
+	}
+
+	c := make(chan *Event, Buffer)
+	s := &Stream{C: c, Last: u.last, c: c, hub: h, user: uid}
+	switch {
+	case after == 0, after == u.last:
+	case after > u.last:
+		s.Lost = true
+	default:
+		i := sort.Search(len(u.history), func(i int) bool {
+			return u.history[i].ID > after
+		})
+		if i == 0 && (len(u.history) == 0 || u.history[0].ID != after+1) {
+			s.Lost = true
+		}
+		s.Missed = append([]*Event(nil), u.history[i:]...)
+	}
+	u.streams[s] = struct{}{}
+	h.total++
+	return s, nil
+}
+
+// drop removes the stream and closes its channel. The
+// caller must hold the hub's lock.
+func (h *Hub) drop(u *user, s *Stream) {
+	if _, ok := u.streams[s]; !ok {
+		return
+	}
+	delete(u.streams, s)
+	close(s.c)
+	h.total--
+}
+
+// Close stops the stream. It may be called more than once.
+func (s *Stream) Close() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	if u, ok := s.hub.users[s.user]; ok {
+		s.hub.drop(u, s)
+	}
+}
@@ -0,0 +1,144 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestPublish(t *testing.T) {
+	h := NewHub()
+	a, err := h.Subscribe("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := h.Subscribe("bob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := h.Publish("alice", "unread", 3)
+	if e.ID != a.Last+1 {
+		t.Errorf("Expected ID %d, got %d.", a.Last+1, e.ID)
+	}
+	select {
+	case got := <-a.C:
+		if got != e {
+			t.Errorf("Expected %v, got %v.", e, got)
+		}
+	default:
+		t.Error("Event not delivered.")
+	}
+	select {
+	case got := <-b.C:
+		t.Errorf("Delivered %v to the wrong user.", got)
+	default:
+	}
+}
+
+func TestResume(t *testing.T) {
+	h := NewHub()
+	s, err := h.Subscribe("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	first := h.Publish("alice", "read", 1)
+	h.Publish("alice", "read", 2)
+	h.Publish("alice", "read", 3)
+
+	s, err = h.Subscribe("alice", first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Lost {
+		t.Error("Stream lost events still held.")
+	}
+	if len(s.Missed) != 2 || s.Missed[0].Data != 2 || s.Missed[1].Data != 3 {
+		t.Errorf("Wrong missed events: %v.", s.Missed)
+	}
+
+	s, err = h.Subscribe("alice", first.ID-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Lost || len(s.Missed) != 3 {
+		t.Errorf("Expected 3 missed events, got %d (lost %v).", len(s.Missed), s.Lost)
+	}
+}
+
+func TestLost(t *testing.T) {
+	h := NewHub()
+	old := History
+	History = 2
+	defer func() { History = old }()
+
+	first := h.Publish("alice", "read", 1)
+	h.Publish("alice", "read", 2)
+	h.Publish("alice", "read", 3)
+	h.Publish("alice", "read", 4)
+
+	s, err := h.Subscribe("alice", first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Lost {
+		t.Error("Expected the stream to report lost events.")
+	}
+
+	// An ID from the future, such as one issued before
+	// the user's state was reset.
+	s, err = h.Subscribe("alice", s.Last+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Lost || len(s.Missed) != 0 {
+		t.Error("Expected a future ID to be reported as lost.")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	h := NewHub()
+	for i := 0; i < MaxConnections; i++ {
+		_, err := h.Subscribe("alice", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := h.Subscribe("alice", 0)
+	if err != ErrTooManyConnections {
+		t.Fatalf("Expected ErrTooManyConnections, got %v.", err)
+	}
+
+	_, err = h.Subscribe("bob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = h.Subscribe("bob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s.Close()
+	if h.total != MaxConnections+1 {
+		t.Errorf("Expected %d streams, got %d.", MaxConnections+1, h.total)
+	}
+}
+
+func TestSlowStream(t *testing.T) {
+	h := NewHub()
+	s, err := h.Subscribe("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= Buffer; i++ {
+		h.Publish("alice", "read", i)
+	}
+	n := 0
+	for range s.C {
+		n++
+	}
+	if n != Buffer {
+		t.Errorf("Expected %d events before the stream closed, got %d.", Buffer, n)
+	}
+	if h.total != 0 {
+		t.Errorf("Slow stream not removed.")
+	}
+}
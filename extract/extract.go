@@ -0,0 +1,232 @@
+package extract
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"rs3/proxy"
+	"strings"
+)
+
+// MaxSize is the largest page that will be downloaded.
+var MaxSize int64 = 2 << 20
+
+// MinLength is the least amount of text an extracted
+// article may contain.
+var MinLength = 250
+
+var (
+	positive = regexp.MustCompile(`(?i)article|body|content|entry|hentry|main|page|post|text|blog|story`)
+	negative = regexp.MustCompile(`(?i)comment|meta|footer|footnote|foot|sidebar|sponsor|share|social|nav|menu|related|promo|header|masthead|widget|banner|combx|skyscraper|\bads?\b`)
+)
+
+// junk lists the elements which never hold article content.
+var junk = map[atom.Atom]bool{
+	atom.Aside:    true,
+	atom.Button:   true,
+	atom.Footer:   true,
+	atom.Form:     true,
+	atom.Header:   true,
+	atom.Iframe:   true,
+	atom.Nav:      true,
+	atom.Noscript: true,
+	atom.Script:   true,
+	atom.Style:    true,
+}
+
+// Article fetches the page at the link and returns the
+// HTML of its main article body, and the URL it was found
+// at after any redirects, against which its relative links
+// must be resolved. The result is not sanitised.
+func Article(link string) (string, *url.URL, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := proxy.Client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", nil, fmt.Errorf("Error: received status %d.", resp.StatusCode)
+	}
+	if typ := resp.Header.Get("Content-Type"); typ != "" && !strings.Contains(typ, "html") {
+		return "", nil, fmt.Errorf("Error: content type %q is not HTML.", typ)
+	}
+
+	article, err := Extract(io.LimitReader(resp.Body, MaxSize))
+	if err != nil {
+		return "", nil, err
+	}
+	return article, resp.Request.URL, nil
+}
+
+// Extract returns the HTML of the main article body in
+// the given page, using readability-style scoring.
+func Extract(r io.Reader) (string, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", err
+	}
+	strip(doc)
+
+	// Score the parents of each paragraph by the amount
+	// of text the paragraph holds.
+	scores := make(map[*html.Node]float64)
+	walk(doc, func(n *html.Node) {
+		if n.DataAtom != atom.P && n.DataAtom != atom.Pre && n.DataAtom != atom.Td {
+			return
+		}
+		text := strings.TrimSpace(textOf(n))
+		if len(text) < 25 {
+			return
+		}
+		score := 1 + float64(strings.Count(text, ",")) + minimum(float64(len(text))/100, 3)
+		if p := n.Parent; p != nil && p.Type == html.ElementNode {
+			if _, ok := scores[p]; !ok {
+				scores[p] = weight(p)
+			}
+			scores[p] += score
+			if g := p.Parent; g != nil && g.Type == html.ElementNode {
+				if _, ok := scores[g]; !ok {
+					scores[g] = weight(g)
+				}
+				scores[g] += score / 2
+			}
+		}
+	})
+
+	var best *html.Node
+	bestScore := 0.0
+	for n, score := range scores {
+		score *= 1 - linkDensity(n)
+		if best == nil || score > bestScore {
+			best, bestScore = n, score
+		}
+	}
+	if best == nil || len(strings.TrimSpace(textOf(best))) < MinLength {
+		return "", errors.New("Error: no article found.")
+	}
+
+	buf := new(bytes.Buffer)
+	for c := best.FirstChild; c != nil; c = c.NextSibling {
+		err = html.Render(buf, c)
+		if err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// strip removes elements which never hold content, along
+// with those whose class or id mark them as boilerplate.
+func strip(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.CommentNode ||
+			(c.Type == html.ElementNode && (junk[c.DataAtom] || unlikely(c))) {
+			n.RemoveChild(c)
+		} else {
+			strip(c)
+		}
+		c = next
+	}
+}
+
+// unlikely returns whether the node's class and id suggest
+// it is boilerplate rather than content.
+func unlikely(n *html.Node) bool {
+	if n.DataAtom == atom.Body || n.DataAtom == atom.Html || n.DataAtom == atom.Article {
+		return false
+	}
+	s := attr(n, "class") + " " + attr(n, "id")
+	return negative.MatchString(s) && !positive.MatchString(s)
+}
+
+// weight gives a starting score to a candidate node based
+// on its element, class and id.
+func weight(n *html.Node) float64 {
+	w := 0.0
+	switch n.DataAtom {
+	case atom.Article, atom.Main:
+		w += 10
+	case atom.Div:
+		w += 5
+	case atom.Pre, atom.Td, atom.Blockquote:
+		w += 3
+	case atom.Form, atom.Ol, atom.Ul, atom.Dl, atom.Li:
+		w -= 3
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Th:
+		w -= 5
+	}
+	for _, s := range []string{attr(n, "class"), attr(n, "id")} {
+		if s == "" {
+			continue
+		}
+		if positive.MatchString(s) {
+			w += 25
+		}
+		if negative.MatchString(s) {
+			w -= 25
+		}
+	}
+	return w
+}
+
+// linkDensity returns the proportion of the node's text
+// which sits inside links.
+func linkDensity(n *html.Node) float64 {
+	total := len(textOf(n))
+	if total == 0 {
+		return 0
+	}
+	links := 0
+	walk(n, func(c *html.Node) {
+		if c.DataAtom == atom.A {
+			links += len(textOf(c))
+		}
+	})
+	return float64(links) / float64(total)
+}
+
+func textOf(n *html.Node) string {
+	buf := new(bytes.Buffer)
+	walk(n, func(c *html.Node) {
+		if c.Type == html.TextNode {
+			buf.WriteString(c.Data)
+		}
+	})
+	return buf.String()
+}
+
+func walk(n *html.Node, fn func(*html.Node)) {
+	fn(n)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walk(c, fn)
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func minimum(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
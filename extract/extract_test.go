@@ -0,0 +1,80 @@
+package extract
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rs3/proxy"
+	"strings"
+	"testing"
+)
+
+const page = `<html><head><title>Post</title><script>var x = 1;</script></head>
+<body>
+<div id="header"><a href="/">Home</a> <a href="/about">About</a></div>
+<div class="sidebar"><p>Subscribe to our newsletter, it is really very good, honestly.</p></div>
+<div class="post-content">
+<h1>The title</h1>
+<p>The first paragraph of the article, which goes on for a while, with commas, and clauses, so that it scores well.</p>
+<p>The second paragraph of the article, which also goes on for some time, and has several commas, like this, and this.</p>
+<p>The third paragraph closes the article, having said all it needs to say, with a final flourish, and a full stop.</p>
+</div>
+<div class="comments"><p>First! This is a comment which is long enough to be scored, but should be ignored.</p></div>
+<div id="footer"><p>Copyright, all rights reserved, and so on and so forth for a while.</p></div>
+</body></html>`
+
+func TestExtract(t *testing.T) {
+	out, err := Extract(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first paragraph", "second paragraph", "third paragraph"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Extracted article is missing %q:\n%s", want, out)
+		}
+	}
+	for _, bad := range []string{"newsletter", "First!", "Copyright", "About", "var x"} {
+		if strings.Contains(out, bad) {
+			t.Errorf("Extracted article contains %q:\n%s", bad, out)
+		}
+	}
+}
+
+func TestExtractShort(t *testing.T) {
+	_, err := Extract(strings.NewReader(`<html><body><p>Too short to be an article.</p></body></html>`))
+	if err == nil {
+		t.Error("Extracted an article from a page with none.")
+	}
+}
+
+func TestArticle(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/posts/new", 301)
+		case "/posts/new":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, page)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// The test server is local, so bypass the address check.
+	defer func(old *http.Client) { proxy.Client = old }(proxy.Client)
+	proxy.Client = http.DefaultClient
+
+	// Relative links are resolved against the page found
+	// after redirects.
+	out, base, err := Article(srv.URL + "/old")
+	if err != nil || !strings.Contains(out, "first paragraph") {
+		t.Fatalf("Expected the article, got %v.", err)
+	}
+	if base.String() != srv.URL+"/posts/new" {
+		t.Errorf("Expected the redirected URL, got %v.", base)
+	}
+	if _, _, err := Article(srv.URL + "/missing"); err == nil {
+		t.Error("Expected a missing page to be an error.")
+	}
+}
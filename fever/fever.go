@@ -0,0 +1,436 @@
+// Package fever implements the Fever API, which several
+// mobile clients use.
+//
+// Clients send an api_key of md5("email:password") with
+// each request, where the password is the one the user set
+// for Fever on the settings page. Each request may ask for
+// several kinds of data at once, such as "?api&groups&feeds".
+package fever
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/SlyMarbo/rss"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"rs3/auth"
+	"rs3/database"
+	"rs3/proxy"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix is the path at which the API is served.
+const Prefix = "/fever/"
+
+// Version is the version of the API implemented.
+const Version = 3
+
+// PageSize is the number of items returned at once.
+const PageSize = 50
+
+// blank is the favicon used for feeds whose own can't be
+// fetched: a transparent 1x1 GIF.
+const blank = "image/gif;base64,R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7"
+
+// Serve handles a request to the API.
+func Serve(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if _, ok := r.Form["api"]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Keys are guessed like passwords, so failures are
+	// throttled by the address they come from. Keys name no
+	// account, so cannot be throttled by that.
+	resp := map[string]interface{}{"api_version": Version, "auth": 0}
+	attempt, err := database.BeginLogin("", auth.ClientIP(r))
+	if t, ok := err.(*database.LoginThrottled); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(t.Until).Seconds())+1))
+		serveJSON(w, 429, resp)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	uid, err := database.FeverUser(r.FormValue("api_key"))
+	if err != nil {
+		serveJSON(w, 401, resp)
+		return
+	}
+	attempt.Withdraw()
+	resp["auth"] = 1
+	resp["last_refreshed_on_time"] = time.Now().Unix()
+
+	if r.FormValue("mark") != "" {
+		err = mark(uid, r)
+		if err != nil {
+			resp["error"] = err.Error()
+			serveJSON(w, 200, resp)
+			return
+		}
+	}
+
+	feeds, err := database.Feeds(uid)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	has := func(name string) bool {
+		_, ok := r.Form[name]
+		return ok
+	}
+	if has("groups") {
+		resp["groups"] = groups(uid, feeds)
+	}
+	if has("groups") || has("feeds") {
+		resp["feeds_groups"] = feedsGroups(uid, feeds)
+	}
+	if has("feeds") {
+		resp["feeds"] = feedList(feeds)
+	}
+	if has("favicons") {
+		resp["favicons"] = favicons(feeds)
+	}
+	if has("items") {
+		list, err := items(uid, r)
+		if err != nil {
+			resp["error"] = err.Error()
+		} else {
+			resp["items"] = list
+		}
+		total := 0
+		for _, feed := range feeds {
+			total += len(feed.Items)
+		}
+		resp["total_items"] = total
+	}
+	if has("links") {
+		resp["links"] = []struct{}{}
+	}
+	if has("unread_item_ids") || r.FormValue("mark") != "" {
+		ids, err := itemIDs(uid, &database.Query{Unread: true})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		resp["unread_item_ids"] = ids
+	}
+	if has("saved_item_ids") || r.FormValue("mark") != "" {
+		ids, err := itemIDs(uid, &database.Query{Starred: true})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		resp["saved_item_ids"] = ids
+	}
+	serveJSON(w, 200, resp)
+}
+
+// serveJSON writes v as a JSON response with the status.
+func serveJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Failed to marshal response.")
+		fmt.Println(err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// id returns a stable numeric ID for a feed URL or folder
+// name. Zero is reserved for the group of all feeds.
+func id(s string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	n := int64(h.Sum32() & 0x7fffffff)
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// join formats IDs as Fever's comma-separated lists.
+func join(ids []int64) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(s, ",")
+}
+
+type group struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+// groups returns the user's folders.
+func groups(uid []byte, feeds []*rss.Feed) []*group {
+	out := make([]*group, 0, 5)
+	seen := make(map[string]bool)
+	for _, feed := range feeds {
+		folder := database.Folder(uid, feed)
+		if folder != "" && !seen[folder] {
+			seen[folder] = true
+			out = append(out, &group{id(folder), folder})
+		}
+	}
+	return out
+}
+
+type feedsGroup struct {
+	GroupID int64  `json:"group_id"`
+	FeedIDs string `json:"feed_ids"`
+}
+
+func feedsGroups(uid []byte, feeds []*rss.Feed) []*feedsGroup {
+	out := make([]*feedsGroup, 0, 5)
+	index := make(map[string]*feedsGroup)
+	for _, feed := range feeds {
+		folder := database.Folder(uid, feed)
+		if folder == "" {
+			continue
+		}
+		g, ok := index[folder]
+		if !ok {
+			g = &feedsGroup{GroupID: id(folder)}
+			index[folder] = g
+			out = append(out, g)
+		} else {
+			g.FeedIDs += ","
+		}
+		g.FeedIDs += strconv.FormatInt(id(feed.UpdateURL), 10)
+	}
+	return out
+}
+
+type feed struct {
+	ID                int64  `json:"id"`
+	FaviconID         int64  `json:"favicon_id"`
+	Title             string `json:"title"`
+	URL               string `json:"url"`
+	SiteURL           string `json:"site_url"`
+	IsSpark           int    `json:"is_spark"`
+	LastUpdatedOnTime int64  `json:"last_updated_on_time"`
+}
+
+func feedList(feeds []*rss.Feed) []*feed {
+	out := make([]*feed, len(feeds))
+	for i, f := range feeds {
+		n := id(f.UpdateURL)
+		out[i] = &feed{n, n, f.Title, f.UpdateURL, f.Link, 0, time.Now().Unix()}
+	}
+	return out
+}
+
+type favicon struct {
+	ID   int64  `json:"id"`
+	Data string `json:"data"`
+}
+
+// favicons returns each feed's site icon, fetched through
+// the image proxy so that it is checked and cached.
+func favicons(feeds []*rss.Feed) []*favicon {
+	out := make([]*favicon, len(feeds))
+	for i, f := range feeds {
+		out[i] = &favicon{id(f.UpdateURL), blank}
+		site, err := url.Parse(f.Link)
+		if err != nil || (site.Scheme != "http" && site.Scheme != "https") {
+			continue
+		}
+		icon := &url.URL{Scheme: site.Scheme, Host: site.Host, Path: "/favicon.ico"}
+		data, typ, err := proxy.Get(icon.String())
+		if err != nil {
+			continue
+		}
+		out[i].Data = typ + ";base64," + base64.StdEncoding.EncodeToString(data)
+	}
+	return out
+}
+
+type item struct {
+	ID            int64  `json:"id"`
+	FeedID        int64  `json:"feed_id"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	HTML          string `json:"html"`
+	URL           string `json:"url"`
+	IsSaved       int    `json:"is_saved"`
+	IsRead        int    `json:"is_read"`
+	CreatedOnTime int64  `json:"created_on_time"`
+}
+
+// items returns a page of items. Clients page forwards
+// with since_id, backwards with max_id, or ask for
+// particular items with with_ids.
+func items(uid []byte, r *http.Request) ([]*item, error) {
+	q := &database.Query{Sort: database.SortArrival, Limit: PageSize}
+	switch {
+	case r.FormValue("with_ids") != "":
+		for _, s := range strings.Split(r.FormValue("with_ids"), ",") {
+			n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Error: invalid item ID %q.", s)
+			}
+			q.IDs = append(q.IDs, n)
+		}
+		if len(q.IDs) > PageSize {
+			q.IDs = q.IDs[:PageSize]
+		}
+	case r.FormValue("max_id") != "":
+		n, err := strconv.ParseInt(r.FormValue("max_id"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error: invalid max_id %q.", r.FormValue("max_id"))
+		}
+		q.MaxID = n
+		q.Reverse = true
+	case r.FormValue("since_id") != "":
+		n, err := strconv.ParseInt(r.FormValue("since_id"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error: invalid since_id %q.", r.FormValue("since_id"))
+		}
+		q.SinceID = n
+	}
+
+	page, err := database.Items(uid, q)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*item, len(page.Items))
+	for i, v := range page.Items {
+		out[i] = &item{
+			ID:            v.ID,
+			FeedID:        id(v.FeedURL),
+			Title:         v.Title,
+			HTML:          v.Content,
+			URL:           v.Link,
+			CreatedOnTime: v.Published.Unix(),
+		}
+		if v.Starred {
+			out[i].IsSaved = 1
+		}
+		if v.Read {
+			out[i].IsRead = 1
+		}
+	}
+	return out, nil
+}
+
+// itemIDs returns the IDs of all items matching q.
+func itemIDs(uid []byte, q *database.Query) (string, error) {
+	var ids []int64
+	q.Sort = database.SortArrival
+	q.Limit = database.MaxLimit
+	for {
+		page, err := database.Items(uid, q)
+		if err != nil {
+			return "", err
+		}
+		for _, v := range page.Items {
+			ids = append(ids, v.ID)
+		}
+		if page.Next == "" {
+			return join(ids), nil
+		}
+		q.Cursor = page.Next
+	}
+}
+
+// mark changes the read or saved state of an item, or
+// marks a feed or group as read.
+func mark(uid []byte, r *http.Request) error {
+	n, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Error: invalid id %q.", r.FormValue("id"))
+	}
+	as := r.FormValue("as")
+
+	switch r.FormValue("mark") {
+	case "item":
+		page, err := database.Items(uid, &database.Query{IDs: []int64{n}})
+		if err != nil {
+			return err
+		}
+		if len(page.Items) == 0 {
+			return new(database.ItemDoesNotExist)
+		}
+		key := page.Items[0].Key
+		switch as {
+		case "read":
+			return database.MarkRead(uid, key)
+		case "unread":
+			return database.MarkUnread(uid, key)
+		case "saved":
+			return database.SetStarred(uid, key, true)
+		case "unsaved":
+			return database.SetStarred(uid, key, false)
+		}
+		return fmt.Errorf("Error: cannot mark an item as %q.", as)
+
+	case "feed", "group":
+		if as != "read" {
+			return fmt.Errorf("Error: cannot mark a %s as %q.", r.FormValue("mark"), as)
+		}
+		q := new(database.Query)
+		if before := r.FormValue("before"); before != "" {
+			t, err := strconv.ParseInt(before, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Error: invalid before %q.", before)
+			}
+			q.Before = time.Unix(t, 0)
+		}
+
+		if r.FormValue("mark") == "group" {
+			// Group 0 is all feeds, and -1 is the Sparks
+			// group, which we never have.
+			if n < 0 {
+				return nil
+			}
+			if n > 0 {
+				q.Folder = folder(uid, n)
+				if q.Folder == "" {
+					return fmt.Errorf("Error: no group %d.", n)
+				}
+			}
+		} else {
+			q.Subscription = feedURL(uid, n)
+			if q.Subscription == "" {
+				return new(database.FeedDoesNotExist)
+			}
+		}
+		_, _, err := database.MarkAllRead(uid, q)
+		return err
+	}
+	return fmt.Errorf("Error: cannot mark a %q.", r.FormValue("mark"))
+}
+
+// feedURL returns the URL of the feed with the given ID.
+func feedURL(uid []byte, n int64) string {
+	feeds, _ := database.Feeds(uid)
+	for _, f := range feeds {
+		if id(f.UpdateURL) == n {
+			return f.UpdateURL
+		}
+	}
+	return ""
+}
+
+// folder returns the name of the group with the given ID.
+func folder(uid []byte, n int64) string {
+	feeds, _ := database.Feeds(uid)
+	for _, f := range feeds {
+		if name := database.Folder(uid, f); name != "" && id(name) == n {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,309 @@
+package fever
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"rs3/database"
+	"rs3/proxy"
+	"rs3/security"
+	"strings"
+	"testing"
+)
+
+const feedXML = `<?xml version="1.0"?>
+<rss version="2.0">
+<channel>
+	<title>Example Feed</title>
+	<link>%s/</link>
+	<item>
+		<title>First post</title>
+		<link>http://example.com/1</link>
+		<guid>tag:example.com,2013:1</guid>
+		<pubDate>Mon, 01 Apr 2013 10:00:00 +0000</pubDate>
+	</item>
+	<item>
+		<title>Second post</title>
+		<link>http://example.com/2</link>
+		<guid>tag:example.com,2013:2</guid>
+		<pubDate>Tue, 02 Apr 2013 10:00:00 +0000</pubDate>
+	</item>
+	<item>
+		<title>Third post</title>
+		<link>http://example.com/3</link>
+		<guid>tag:example.com,2013:3</guid>
+		<pubDate>Wed, 03 Apr 2013 10:00:00 +0000</pubDate>
+	</item>
+</channel>
+</rss>`
+
+var icon = []byte{0, 0, 1, 0, 1, 0}
+
+// setup creates a user with a Fever password, subscribed
+// to a three-item feed in the folder "Tech". It returns the
+// user's API key and the feed's URL.
+func setup(t *testing.T, email string) (string, string) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/favicon.ico":
+			w.Header().Set("Content-Type", "image/x-icon")
+			w.Write(icon)
+		default:
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprintf(w, feedXML, srv.URL)
+		}
+	}))
+	feed := srv.URL + "/feed.xml"
+
+	dir, err := ioutil.TempDir("", "fever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.CachePath = dir
+	proxy.KeyPath = dir + "/proxy.key"
+	proxy.Client = http.DefaultClient
+
+	salt := security.NewSalt()
+	uid, err := security.Hash(email, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwd, err := security.Hash("password", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AddUser(uid, pwd, salt, "Reader", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AddFeeds(uid, "", feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.SetFolder(uid, feed, "Tech")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.SetFeverPassword(uid, email, "fever reader key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	})
+
+	sum := md5.Sum([]byte(email + ":fever reader key"))
+	return hex.EncodeToString(sum[:]), feed
+}
+
+// request makes an API request from the IP address.
+func request(key, query, ip string, form url.Values) *httptest.ResponseRecorder {
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set("api_key", key)
+	r := httptest.NewRequest("POST", Prefix+"?api&"+query, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	Serve(w, r)
+	return w
+}
+
+// call makes an API request, returning the decoded response.
+func call(t *testing.T, key, query string, form url.Values) map[string]interface{} {
+	w := request(key, query, "192.0.2.1", form)
+	if w.Code != 200 {
+		t.Fatalf("%s: expected status 200, got %d.", query, w.Code)
+	}
+	resp := make(map[string]interface{})
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp["error"] != nil {
+		t.Fatalf("%s: %v", query, resp["error"])
+	}
+	return resp
+}
+
+// titles returns the titles of the items in a response.
+func titles(resp map[string]interface{}) string {
+	var out []string
+	list, _ := resp["items"].([]interface{})
+	for _, v := range list {
+		out = append(out, v.(map[string]interface{})["title"].(string))
+	}
+	return strings.Join(out, ", ")
+}
+
+func TestAuth(t *testing.T) {
+	key, _ := setup(t, "auth@example.com")
+	resp := call(t, key, "", nil)
+	if resp["auth"] != 1.0 || resp["api_version"] != 3.0 {
+		t.Errorf("Expected auth with a valid key, got %v.", resp)
+	}
+	resp = call(t, strings.ToUpper(key), "", nil)
+	if resp["auth"] != 1.0 {
+		t.Error("Expected keys to be case-insensitive.")
+	}
+	w := request("0123456789abcdef0123456789abcdef", "items", "192.0.2.2", nil)
+	if w.Code != 401 || !strings.Contains(w.Body.String(), `"auth":0`) || strings.Contains(w.Body.String(), "items") {
+		t.Errorf("Expected no auth with an invalid key, got %d: %s", w.Code, w.Body)
+	}
+
+	// Wrong keys are throttled by address, even for the
+	// right key.
+	for i := 1; i < database.IPFreeAttempts; i++ {
+		request("0123456789abcdef0123456789abcdef", "", "192.0.2.2", nil)
+	}
+	w = request(key, "", "192.0.2.2", nil)
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected to be throttled, got %d.", w.Code)
+	}
+	if w := request(key, "", "192.0.2.3", nil); w.Code != 200 {
+		t.Errorf("Expected another address to be let in, got %d.", w.Code)
+	}
+
+	// The key is made from the normalised email address,
+	// however it was typed when the password was set.
+	uid, err := database.FeverUser(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := database.SetFeverPassword(uid, "auth@example.com", "fever").(*security.WeakPassword); !ok {
+		t.Error("Expected a weak password to be refused.")
+	}
+	err = database.SetFeverPassword(uid, " Auth@Example.COM ", "fever reader key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = call(t, key, "", nil)
+	if resp["auth"] != 1.0 {
+		t.Errorf("Expected the key to use the normalised email address, got %v.", resp)
+	}
+
+	r := httptest.NewRequest("GET", Prefix, nil)
+	w = httptest.NewRecorder()
+	Serve(w, r)
+	if w.Code != 404 {
+		t.Errorf("Expected 404 without ?api, got %d.", w.Code)
+	}
+}
+
+func TestGroupsAndFeeds(t *testing.T) {
+	key, feed := setup(t, "groups@example.com")
+	resp := call(t, key, "groups&feeds&favicons", nil)
+
+	groups := resp["groups"].([]interface{})
+	if len(groups) != 1 || groups[0].(map[string]interface{})["title"] != "Tech" {
+		t.Fatalf("Expected the Tech group, got %v.", groups)
+	}
+	group := int64(groups[0].(map[string]interface{})["id"].(float64))
+	feeds := resp["feeds"].([]interface{})
+	if len(feeds) != 1 || feeds[0].(map[string]interface{})["url"] != feed {
+		t.Fatalf("Expected the feed, got %v.", feeds)
+	}
+	id := int64(feeds[0].(map[string]interface{})["id"].(float64))
+	fg := resp["feeds_groups"].([]interface{})[0].(map[string]interface{})
+	if int64(fg["group_id"].(float64)) != group || fg["feed_ids"] != fmt.Sprint(id) {
+		t.Errorf("Wrong feeds_groups: %v.", fg)
+	}
+
+	favicons := resp["favicons"].([]interface{})
+	data := favicons[0].(map[string]interface{})["data"]
+	if data != "image/x-icon;base64,AAABAAEA" {
+		t.Errorf("Wrong favicon: %v.", data)
+	}
+}
+
+func TestItems(t *testing.T) {
+	key, _ := setup(t, "items@example.com")
+	for _, test := range []struct {
+		query, titles string
+	}{
+		{"items", "First post, Second post, Third post"},
+		{"items&since_id=0", "First post, Second post, Third post"},
+		{"items&since_id=2", "Third post"},
+		{"items&since_id=3", ""},
+		{"items&max_id=0", "Third post, Second post, First post"},
+		{"items&max_id=3", "Second post, First post"},
+		{"items&with_ids=3,1", "First post, Third post"},
+	} {
+		got := titles(call(t, key, test.query, nil))
+		if got != test.titles {
+			t.Errorf("%s: expected %q, got %q.", test.query, test.titles, got)
+		}
+	}
+	resp := call(t, key, "items", nil)
+	if resp["total_items"] != 3.0 {
+		t.Errorf("Expected 3 total items, got %v.", resp["total_items"])
+	}
+}
+
+func TestMark(t *testing.T) {
+	key, _ := setup(t, "mark@example.com")
+
+	resp := call(t, key, "", url.Values{"mark": {"item"}, "as": {"read"}, "id": {"2"}})
+	if resp["unread_item_ids"] != "1,3" {
+		t.Errorf("Expected unread 1,3, got %v.", resp["unread_item_ids"])
+	}
+	call(t, key, "", url.Values{"mark": {"item"}, "as": {"saved"}, "id": {"3"}})
+	resp = call(t, key, "saved_item_ids&items&with_ids=2,3", nil)
+	if resp["saved_item_ids"] != "3" {
+		t.Errorf("Expected saved 3, got %v.", resp["saved_item_ids"])
+	}
+	items := resp["items"].([]interface{})
+	if items[0].(map[string]interface{})["is_read"] != 1.0 || items[1].(map[string]interface{})["is_saved"] != 1.0 {
+		t.Errorf("Item state not reported: %v.", items)
+	}
+
+	call(t, key, "", url.Values{"mark": {"item"}, "as": {"unread"}, "id": {"2"}})
+	call(t, key, "", url.Values{"mark": {"item"}, "as": {"unsaved"}, "id": {"3"}})
+	resp = call(t, key, "unread_item_ids&saved_item_ids", nil)
+	if resp["unread_item_ids"] != "1,2,3" || resp["saved_item_ids"] != "" {
+		t.Errorf("Expected unread 1,2,3 and nothing saved, got %v.", resp)
+	}
+
+	// Everything published before the third item.
+	resp = call(t, key, "", url.Values{"mark": {"group"}, "as": {"read"}, "id": {"0"}, "before": {"1364983200"}})
+	if resp["unread_item_ids"] != "3" {
+		t.Errorf("Expected unread 3, got %v.", resp["unread_item_ids"])
+	}
+	uid, err := database.FeverUser(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := database.Unread(uid)
+	if err != nil || n != 1 {
+		t.Errorf("Expected the database to count 1 unread item, got %d (%v).", n, err)
+	}
+}
+
+func TestMarkFeed(t *testing.T) {
+	key, _ := setup(t, "feed@example.com")
+	feeds := call(t, key, "feeds", nil)["feeds"].([]interface{})
+	id := fmt.Sprint(int64(feeds[0].(map[string]interface{})["id"].(float64)))
+	resp := call(t, key, "", url.Values{"mark": {"feed"}, "as": {"read"}, "id": {id}})
+	if resp["unread_item_ids"] != "" {
+		t.Errorf("Expected no unread items, got %v.", resp["unread_item_ids"])
+	}
+
+	r := httptest.NewRequest("POST", Prefix+"?api", strings.NewReader(url.Values{
+		"api_key": {key}, "mark": {"feed"}, "as": {"read"}, "id": {"1"},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	Serve(w, r)
+	if !strings.Contains(w.Body.String(), `"error"`) {
+		t.Errorf("Expected an error for an unknown feed, got %s.", w.Body)
+	}
+}
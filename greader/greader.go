@@ -0,0 +1,283 @@
+// Package greader implements the parts of the Google
+// Reader API used by third-party clients such as Reeder,
+// NetNewsWire and FeedMe.
+//
+// Clients log in at LoginPath with the user's email and
+// either their password or an app password, and send the
+// token they receive in an "Authorization: GoogleLogin
+// auth=<token>" header. Personal API tokens may be sent in
+// the header instead.
+package greader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"rs3/auth"
+	"rs3/database"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoginPath and Prefix are the paths under which the API
+// is served.
+const (
+	LoginPath = "/accounts/ClientLogin"
+	Prefix    = "/reader/api/0/"
+)
+
+// Serve handles a request to the API.
+func Serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == LoginPath {
+		clientLogin(w, r)
+		return
+	}
+	uid, token, scope, ok := authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "GoogleLogin")
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, Prefix)
+	if writes[path] && !database.Allows(scope, database.ScopeWrite) {
+		http.Error(w, "Forbidden: read-only token.", 403)
+		return
+	}
+	switch {
+	case path == "token":
+		// Requests are authenticated by header, so they are
+		// not open to forgery, and the token is not checked.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		sum := sha256.Sum256([]byte("greader:" + token))
+		fmt.Fprint(w, hex.EncodeToString(sum[:]))
+
+	case path == "user-info":
+		userInfo(w, r, uid)
+
+	case path == "subscription/list":
+		subscriptionList(w, r, uid)
+
+	case path == "tag/list":
+		tagList(w, r, uid)
+
+	case path == "unread-count":
+		unreadCount(w, r, uid)
+
+	case path == "stream/items/ids":
+		streamItemIDs(w, r, uid)
+
+	case path == "stream/items/contents":
+		streamItemContents(w, r, uid)
+
+	case path == "stream/contents", strings.HasPrefix(path, "stream/contents/"):
+		streamContents(w, r, uid, strings.TrimPrefix(strings.TrimPrefix(path, "stream/contents"), "/"))
+
+	case path == "edit-tag":
+		editTag(w, r, uid)
+
+	case path == "mark-all-as-read":
+		markAllAsRead(w, r, uid)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writes are the endpoints which change the user's data,
+// and so need a token with write access.
+var writes = map[string]bool{
+	"edit-tag":         true,
+	"mark-all-as-read": true,
+}
+
+// clientLogin checks the user's email and password, or an
+// app password, responding with a token for later requests.
+func clientLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	uid, scope, err := auth.ClientLogin(r.FormValue("Email"), r.FormValue("Passwd"), auth.ClientIP(r))
+	if t, ok := err.(*database.LoginThrottled); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(t.Until).Seconds())+1))
+		w.WriteHeader(429)
+		fmt.Fprint(w, "Error=BadAuthentication\n")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(403)
+		fmt.Fprint(w, "Error=BadAuthentication\n")
+		return
+	}
+	token, err := database.NewClientToken(uid, appName(r), scope)
+	if err != nil {
+		fmt.Println("Failed to create client token:")
+		fmt.Println(err)
+		http.Error(w, "Error=Unknown", 500)
+		return
+	}
+	fmt.Fprintf(w, "SID=%s\nLSID=%s\nAuth=%s\n", token, token, token)
+}
+
+// appName names the app logging in, for the user's list
+// of tokens.
+func appName(r *http.Request) string {
+	for _, s := range []string{r.FormValue("client"), r.FormValue("source"), r.UserAgent()} {
+		if s != "" {
+			return s
+		}
+	}
+	return "Google Reader app"
+}
+
+// authenticate checks the request's client token or
+// personal API token, returning the user's uid, the token
+// and its scope.
+func authenticate(r *http.Request) ([]byte, string, string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "GoogleLogin auth=") {
+		return nil, "", "", false
+	}
+	token := strings.TrimPrefix(header, "GoogleLogin auth=")
+	uid, scope, err := database.ClientUser(token)
+	if err != nil {
+		return nil, "", "", false
+	}
+	return uid, token, scope, true
+}
+
+// serveJSON writes v as a JSON response.
+func serveJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Failed to marshal response.")
+		fmt.Println(err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
+
+// serveOK writes the response clients expect from edits.
+func serveOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "OK")
+}
+
+// checkPost returns whether the request is a POST,
+// rejecting it if not.
+func checkPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", 405)
+		return false
+	}
+	return true
+}
+
+func userInfo(w http.ResponseWriter, r *http.Request, uid []byte) {
+	nick, err := database.ClientNickname(uid)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	id := database.UidToString(uid)
+	serveJSON(w, map[string]string{
+		"userId":        id,
+		"userName":      nick,
+		"userProfileId": id,
+	})
+}
+
+type category struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+type subscription struct {
+	ID         string      `json:"id"`
+	Title      string      `json:"title"`
+	Categories []*category `json:"categories"`
+	URL        string      `json:"url"`
+	HTMLURL    string      `json:"htmlUrl"`
+	IconURL    string      `json:"iconUrl"`
+}
+
+func subscriptionList(w http.ResponseWriter, r *http.Request, uid []byte) {
+	feeds, err := database.Feeds(uid)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	subs := make([]*subscription, 0, len(feeds))
+	for _, feed := range feeds {
+		sub := &subscription{
+			ID:         feedPrefix + feed.UpdateURL,
+			Title:      feed.Title,
+			Categories: make([]*category, 0, 1),
+			URL:        feed.UpdateURL,
+			HTMLURL:    feed.Link,
+		}
+		if folder := database.Folder(uid, feed); folder != "" {
+			sub.Categories = append(sub.Categories, &category{labelPrefix + folder, folder})
+		}
+		subs = append(subs, sub)
+	}
+	serveJSON(w, map[string]interface{}{"subscriptions": subs})
+}
+
+type tag struct {
+	ID   string `json:"id"`
+	Type string `json:"type,omitempty"`
+}
+
+func tagList(w http.ResponseWriter, r *http.Request, uid []byte) {
+	feeds, err := database.Feeds(uid)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	tags := []*tag{{ID: starred}}
+	seen := make(map[string]bool)
+	for _, feed := range feeds {
+		folder := database.Folder(uid, feed)
+		if folder != "" && !seen[folder] {
+			seen[folder] = true
+			tags = append(tags, &tag{labelPrefix + folder, "folder"})
+		}
+	}
+	serveJSON(w, map[string]interface{}{"tags": tags})
+}
+
+type unread struct {
+	ID    string `json:"id"`
+	Count int    `json:"count"`
+}
+
+func unreadCount(w http.ResponseWriter, r *http.Request, uid []byte) {
+	feeds, err := database.Feeds(uid)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	counts, err := database.UnreadCounts(uid)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	folders := make(map[string]int)
+	list := []*unread{{readingList, counts.Unread}}
+	for _, feed := range feeds {
+		n := counts.Feeds[feed.UpdateURL]
+		list = append(list, &unread{feedPrefix + feed.UpdateURL, n})
+		if folder := database.Folder(uid, feed); folder != "" {
+			folders[folder] += n
+		}
+	}
+	for folder, n := range folders {
+		list = append(list, &unread{labelPrefix + folder, n})
+	}
+	serveJSON(w, map[string]interface{}{"max": counts.Unread, "unreadcounts": list})
+}
@@ -0,0 +1,297 @@
+package greader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"rs3/database"
+	"rs3/security"
+	"strings"
+	"testing"
+	"time"
+)
+
+const password = "correct horse"
+
+const feedXML = `<?xml version="1.0"?>
+<rss version="2.0">
+<channel>
+	<title>Example Feed</title>
+	<link>http://example.com/</link>
+	<item>
+		<title>First post</title>
+		<link>http://example.com/1</link>
+		<guid>tag:example.com,2013:1</guid>
+		<description>One</description>
+		<pubDate>Mon, 01 Apr 2013 10:00:00 +0000</pubDate>
+	</item>
+	<item>
+		<title>Second post</title>
+		<link>http://example.com/2</link>
+		<guid>tag:example.com,2013:2</guid>
+		<description>Two</description>
+		<pubDate>Tue, 02 Apr 2013 10:00:00 +0000</pubDate>
+	</item>
+	<item>
+		<title>Third post</title>
+		<link>http://example.com/3</link>
+		<guid>tag:example.com,2013:3</guid>
+		<description>Three</description>
+		<pubDate>Wed, 03 Apr 2013 10:00:00 +0000</pubDate>
+	</item>
+</channel>
+</rss>`
+
+// setup creates a user subscribed to a three-item feed in
+// the folder "Tech", returning the feed's URL.
+func setup(t *testing.T, email string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		io.WriteString(w, feedXML)
+	}))
+	feed := srv.URL + "/feed.xml"
+
+	salt := security.NewSalt()
+	uid, err := security.Hash(email, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwd, err := security.Hash(password, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AddUser(uid, pwd, salt, "Reader", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AddFeeds(uid, "", feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.SetFolder(uid, feed, "Tech")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	return feed
+}
+
+// expect describes the response to one recorded request.
+type expect struct {
+	status   int
+	contains []string
+}
+
+// replay sends the requests recorded from a client in
+// testdata, checking each response. The recordings use
+// placeholders for the values which vary between runs.
+func replay(t *testing.T, name string, expected []expect) {
+	email := name + "@example.com"
+	feed := setup(t, email)
+
+	f, err := os.Open("testdata/" + name + ".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	in := bufio.NewReader(f)
+
+	auth, token := "", ""
+	for i := 0; ; i++ {
+		r, err := http.ReadRequest(in)
+		if err == io.EOF {
+			if i != len(expected) {
+				t.Errorf("%s: expected %d requests, found %d.", name, len(expected), i)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s: request %d: %v", name, i+1, err)
+		}
+		if i >= len(expected) {
+			t.Fatalf("%s: unexpected request %d.", name, i+1)
+		}
+
+		subst := strings.NewReplacer(
+			"{{email}}", url.QueryEscape(email),
+			"{{password}}", url.QueryEscape(password),
+			"{{feed}}", url.QueryEscape(feed),
+			"{{token}}", token,
+		)
+		r.RequestURI = subst.Replace(r.RequestURI)
+		r.URL, err = url.ParseRequestURI(r.RequestURI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := r.Header.Get("Authorization"); h != "" {
+			r.Header.Set("Authorization", strings.Replace(h, "{{auth}}", auth, 1))
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = []byte(subst.Replace(string(body)))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+
+		w := httptest.NewRecorder()
+		Serve(w, r)
+		got := w.Body.String()
+
+		e := expected[i]
+		if w.Code != e.status {
+			t.Errorf("%s: %s %s: expected status %d, got %d: %s", name, r.Method, r.URL, e.status, w.Code, got)
+			continue
+		}
+		for _, s := range e.contains {
+			s = strings.Replace(s, "{{feed}}", feed, -1)
+			if !strings.Contains(got, s) {
+				t.Errorf("%s: %s %s: expected response to contain %s, got %s", name, r.Method, r.URL, s, got)
+			}
+		}
+
+		switch r.URL.Path {
+		case LoginPath:
+			for _, line := range strings.Split(got, "\n") {
+				if strings.HasPrefix(line, "Auth=") {
+					auth = strings.TrimPrefix(line, "Auth=")
+				}
+			}
+		case Prefix + "token":
+			token = got
+		}
+	}
+}
+
+func TestNetNewsWire(t *testing.T) {
+	replay(t, "netnewswire", []expect{
+		{200, []string{"SID=", "Auth="}},
+		{200, []string{`"userName":"Reader"`}},
+		{200, []string{`"id":"user/-/state/com.google/starred"`, `"id":"user/-/label/Tech","type":"folder"`}},
+		{200, []string{`"id":"feed/{{feed}}"`, `"title":"Example Feed"`, `"label":"Tech"`, `"htmlUrl":"http://example.com/"`}},
+		{200, []string{`"id":"1"`, `"id":"2"`, `"id":"3"`}},
+		{200, []string{`"itemRefs":[]`}},
+		{200, []string{`"id":"tag:google.com,2005:reader/item/0000000000000001"`, `"title":"Second post"`, `"streamId":"feed/{{feed}}"`}},
+		{200, []string{"OK"}},
+		{200, []string{"OK"}},
+		{200, []string{`"itemRefs":[{"id":"2"`}},
+		{200, []string{`{"id":"user/-/state/com.google/reading-list","count":2}`, `{"id":"user/-/label/Tech","count":2}`}},
+	})
+}
+
+func TestReeder(t *testing.T) {
+	replay(t, "reeder", []expect{
+		{200, []string{"Auth="}},
+		{200, nil},
+		{200, []string{`"Third post"`, `"Second post"`, `"continuation"`}},
+		{200, []string{`"First post"`, `"id":"feed/{{feed}}"`}},
+		{200, []string{"OK"}},
+		{200, []string{`{"id":"user/-/state/com.google/reading-list","count":1}`}},
+	})
+}
+
+func TestFeedMe(t *testing.T) {
+	replay(t, "feedme", []expect{
+		{200, []string{"Auth="}},
+		{200, []string{`"title":"Example Feed"`}},
+		{200, []string{`"First post"`, `"Second post"`, `"Third post"`}},
+		{200, []string{"OK"}},
+		{200, []string{`"itemRefs":[{"id":"2"`}},
+		{200, []string{"OK"}},
+		{200, []string{`"id":"3"`}},
+		{401, nil},
+	})
+}
+
+func TestClientLogin(t *testing.T) {
+	setup(t, "login@example.com")
+	for _, test := range []struct {
+		email, password string
+		status          int
+	}{
+		{"login@example.com", password, 200},
+		{"login@example.com", "wrong", 403},
+		{"nobody@example.com", password, 403},
+	} {
+		form := url.Values{"Email": {test.email}, "Passwd": {test.password}}
+		r, _ := http.NewRequest("POST", LoginPath, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		Serve(w, r)
+		if w.Code != test.status {
+			t.Errorf("Login as %s with %q: expected %d, got %d.", test.email, test.password, test.status, w.Code)
+		}
+	}
+}
+
+func TestIDs(t *testing.T) {
+	for _, id := range []int64{1, 255, 1 << 40} {
+		long := itemID(id)
+		got, err := parseID(long)
+		if err != nil || got != id {
+			t.Errorf("parseID(%q): expected %d, got %d (%v).", long, id, got, err)
+		}
+		got, err = parseID(fmt.Sprint(id))
+		if err != nil || got != id {
+			t.Errorf("parseID(%d): expected %d, got %d (%v).", id, id, got, err)
+		}
+	}
+	if _, err := parseID("bogus"); err == nil {
+		t.Error("parseID accepted an invalid ID.")
+	}
+	if s := normalise("user/01234567890123456789/state/com.google/read"); s != read {
+		t.Errorf("normalise: expected %q, got %q.", read, s)
+	}
+}
+
+func TestAppPassword(t *testing.T) {
+	setup(t, "app@example.com")
+	uid, err := database.CheckPassword("app@example.com", password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := database.NewAppPassword(uid, "Reeder", database.ScopeRead, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"Email": {"app@example.com"}, "Passwd": {secret}}
+	r, _ := http.NewRequest("POST", LoginPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	Serve(w, r)
+	if w.Code != 200 {
+		t.Fatalf("Expected to log in with the app password, got %d.", w.Code)
+	}
+	auth := ""
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "Auth=") {
+			auth = strings.TrimPrefix(line, "Auth=")
+		}
+	}
+
+	// The app password is read-only, so the app can read
+	// but not mark items as read.
+	for _, test := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", Prefix + "subscription/list", 200},
+		{"POST", Prefix + "edit-tag?i=1&a=" + url.QueryEscape(read), 403},
+		{"POST", Prefix + "mark-all-as-read?s=" + url.QueryEscape(readingList), 403},
+	} {
+		r, _ := http.NewRequest(test.method, test.path, nil)
+		r.Header.Set("Authorization", "GoogleLogin auth="+auth)
+		w := httptest.NewRecorder()
+		Serve(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d.", test.method, test.path, test.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package greader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"rs3/database"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stream and item ID forms.
+const (
+	readingList = "user/-/state/com.google/reading-list"
+	read        = "user/-/state/com.google/read"
+	starred     = "user/-/state/com.google/starred"
+	keptUnread  = "user/-/state/com.google/kept-unread"
+	labelPrefix = "user/-/label/"
+	feedPrefix  = "feed/"
+	itemPrefix  = "tag:google.com,2005:reader/item/"
+)
+
+// Limits on the number of items returned at once.
+const (
+	maxContents = 1000
+	maxIDs      = 10000
+)
+
+// normalise replaces the user ID in a user stream with
+// "-", as some clients send their own ID.
+func normalise(stream string) string {
+	if !strings.HasPrefix(stream, "user/") {
+		return stream
+	}
+	parts := strings.SplitN(stream, "/", 3)
+	if len(parts) < 3 {
+		return stream
+	}
+	return "user/-/" + parts[2]
+}
+
+// itemID returns the long form of an item's ID.
+func itemID(id int64) string {
+	return fmt.Sprintf("%s%016x", itemPrefix, uint64(id))
+}
+
+// parseID parses an item ID in either its long form or
+// its short, decimal, form.
+func parseID(s string) (int64, error) {
+	if strings.HasPrefix(s, itemPrefix) {
+		n, err := strconv.ParseUint(strings.TrimPrefix(s, itemPrefix), 16, 64)
+		return int64(n), err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// query builds a database query from a stream ID and the
+// usual request parameters.
+func query(r *http.Request, stream string) (*database.Query, error) {
+	q := new(database.Query)
+	switch s := normalise(stream); {
+	case s == "", s == readingList:
+	case s == starred:
+		q.Starred = true
+	case strings.HasPrefix(s, feedPrefix):
+		q.Subscription = strings.TrimPrefix(s, feedPrefix)
+	case strings.HasPrefix(s, labelPrefix):
+		q.Folder = strings.TrimPrefix(s, labelPrefix)
+	default:
+		return nil, fmt.Errorf("Error: unsupported stream %q.", stream)
+	}
+
+	for _, xt := range r.Form["xt"] {
+		if normalise(xt) == read {
+			q.Unread = true
+		}
+	}
+	for _, it := range r.Form["it"] {
+		if normalise(it) == starred {
+			q.Starred = true
+		}
+	}
+	q.Sort = database.SortNewest
+	if r.FormValue("r") == "o" {
+		q.Sort = database.SortOldest
+	}
+	if ot := r.FormValue("ot"); ot != "" {
+		n, err := strconv.ParseInt(ot, 10, 64)
+		if err != nil {
+			return nil, errors.New("Error: invalid ot.")
+		}
+		q.After = time.Unix(n, 0)
+	}
+	if nt := r.FormValue("nt"); nt != "" {
+		n, err := strconv.ParseInt(nt, 10, 64)
+		if err != nil {
+			return nil, errors.New("Error: invalid nt.")
+		}
+		q.Before = time.Unix(n, 0)
+	}
+	q.Cursor = r.FormValue("c")
+	return q, nil
+}
+
+// count returns the number of items requested, within
+// the given bounds.
+func count(r *http.Request, def, max int) int {
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n <= 0 {
+		return def
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// items returns up to n items matching q, along with the
+// continuation for the rest, if any.
+func items(uid []byte, q *database.Query, n int) ([]*database.ItemView, string, error) {
+	var out []*database.ItemView
+	if n <= 0 {
+		return out, "", nil
+	}
+	for {
+		q.Limit = n - len(out)
+		page, err := database.Items(uid, q)
+		if err != nil {
+			return nil, "", err
+		}
+		out = append(out, page.Items...)
+		if page.Next == "" || len(out) >= n {
+			return out, page.Next, nil
+		}
+		q.Cursor = page.Next
+	}
+}
+
+// ids parses the request's item IDs.
+func ids(r *http.Request) ([]int64, error) {
+	out := make([]int64, 0, len(r.Form["i"]))
+	for _, s := range r.Form["i"] {
+		id, err := parseID(s)
+		if err != nil {
+			return nil, fmt.Errorf("Error: invalid item ID %q.", s)
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+type itemRef struct {
+	ID              string   `json:"id"`
+	DirectStreamIDs []string `json:"directStreamIds"`
+	TimestampUsec   string   `json:"timestampUsec"`
+}
+
+func streamItemIDs(w http.ResponseWriter, r *http.Request, uid []byte) {
+	r.ParseForm()
+	q, err := query(r, r.FormValue("s"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	list, next, err := items(uid, q, count(r, 1000, maxIDs))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	refs := make([]*itemRef, len(list))
+	for i, item := range list {
+		refs[i] = &itemRef{
+			ID:              strconv.FormatInt(item.ID, 10),
+			DirectStreamIDs: []string{},
+			TimestampUsec:   strconv.FormatInt(item.Published.UnixNano()/1000, 10),
+		}
+	}
+	v := map[string]interface{}{"itemRefs": refs}
+	if next != "" {
+		v["continuation"] = next
+	}
+	serveJSON(w, v)
+}
+
+func streamContents(w http.ResponseWriter, r *http.Request, uid []byte, stream string) {
+	r.ParseForm()
+	if stream == "" {
+		stream = r.FormValue("s")
+	}
+	q, err := query(r, stream)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	list, next, err := items(uid, q, count(r, 20, maxContents))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if stream == "" {
+		stream = readingList
+	}
+	serveItems(w, stream, list, next)
+}
+
+func streamItemContents(w http.ResponseWriter, r *http.Request, uid []byte) {
+	r.ParseForm()
+	list, err := ids(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	q := &database.Query{IDs: list, Sort: database.SortNewest}
+	views, _, err := items(uid, q, len(list))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	serveItems(w, readingList, views, "")
+}
+
+type link struct {
+	Href string `json:"href"`
+	Type string `json:"type,omitempty"`
+}
+
+type content struct {
+	Direction string `json:"direction"`
+	Content   string `json:"content"`
+}
+
+type origin struct {
+	StreamID string `json:"streamId"`
+	Title    string `json:"title"`
+}
+
+type item struct {
+	ID            string   `json:"id"`
+	CrawlTimeMsec string   `json:"crawlTimeMsec"`
+	TimestampUsec string   `json:"timestampUsec"`
+	Published     int64    `json:"published"`
+	Updated       int64    `json:"updated"`
+	Title         string   `json:"title"`
+	Canonical     []*link  `json:"canonical"`
+	Alternate     []*link  `json:"alternate"`
+	Summary       *content `json:"summary"`
+	Categories    []string `json:"categories"`
+	Origin        *origin  `json:"origin"`
+}
+
+func serveItems(w http.ResponseWriter, stream string, list []*database.ItemView, next string) {
+	out := make([]*item, len(list))
+	for i, v := range list {
+		categories := []string{readingList}
+		if v.Read {
+			categories = append(categories, read)
+		}
+		if v.Starred {
+			categories = append(categories, starred)
+		}
+		if v.Folder != "" {
+			categories = append(categories, labelPrefix+v.Folder)
+		}
+		out[i] = &item{
+			ID:            itemID(v.ID),
+			CrawlTimeMsec: strconv.FormatInt(v.Published.UnixNano()/int64(time.Millisecond), 10),
+			TimestampUsec: strconv.FormatInt(v.Published.UnixNano()/1000, 10),
+			Published:     v.Published.Unix(),
+			Updated:       v.Updated.Unix(),
+			Title:         v.Title,
+			Canonical:     []*link{{Href: v.Link}},
+			Alternate:     []*link{{v.Link, "text/html"}},
+			Summary:       &content{"ltr", v.Content},
+			Categories:    categories,
+			Origin:        &origin{feedPrefix + v.FeedURL, v.Feed},
+		}
+	}
+	resp := map[string]interface{}{
+		"id":      stream,
+		"updated": time.Now().Unix(),
+		"items":   out,
+	}
+	if next != "" {
+		resp["continuation"] = next
+	}
+	serveJSON(w, resp)
+}
+
+// editTag adds and removes the read and starred states
+// of items. Other tags are ignored.
+func editTag(w http.ResponseWriter, r *http.Request, uid []byte) {
+	if !checkPost(w, r) {
+		return
+	}
+	r.ParseForm()
+	list, err := ids(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(list) == 0 {
+		http.Error(w, "Error: no items given.", 400)
+		return
+	}
+	views, _, err := items(uid, &database.Query{IDs: list}, len(list))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	for _, v := range views {
+		for _, a := range r.Form["a"] {
+			switch normalise(a) {
+			case read:
+				err = database.MarkRead(uid, v.Key)
+			case keptUnread:
+				err = database.MarkUnread(uid, v.Key)
+			case starred:
+				err = database.SetStarred(uid, v.Key, true)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		for _, rm := range r.Form["r"] {
+			switch normalise(rm) {
+			case read:
+				err = database.MarkUnread(uid, v.Key)
+			case starred:
+				err = database.SetStarred(uid, v.Key, false)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+	}
+	serveOK(w)
+}
+
+// markAllAsRead marks a stream's items as read. If ts is
+// given, in microseconds, only older items are marked.
+func markAllAsRead(w http.ResponseWriter, r *http.Request, uid []byte) {
+	if !checkPost(w, r) {
+		return
+	}
+	r.ParseForm()
+	q, err := query(r, r.FormValue("s"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if q.Starred {
+		http.Error(w, "Error: cannot mark starred items as read.", 400)
+		return
+	}
+	q.Before = time.Time{}
+	if ts := r.FormValue("ts"); ts != "" {
+		n, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			http.Error(w, "Error: invalid ts.", 400)
+			return
+		}
+		q.Before = time.Unix(0, n*1000)
+	}
+	_, _, err = database.MarkAllRead(uid, q)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	serveOK(w)
+}
@@ -0,0 +1,194 @@
+// Package mail sends email, such as the messages which
+// verify the addresses of new users.
+//
+// Messages are sent by a Sender: SMTP, for a mail server,
+// or Outbox, which writes them to files in a directory,
+// for tests and for servers which cannot send mail.
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender sends messages.
+type Sender interface {
+	Send(m *Message) error
+}
+
+// Default sends RS3's messages. It is nil if mail has not
+// been configured.
+var Default Sender
+
+// format returns the message in RFC 5322 form, from the
+// given address.
+func (m *Message) format(from string) ([]byte, error) {
+	for _, s := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(s, "\r\n") {
+			return nil, errors.New("Error: mail header contains a line break.")
+		}
+	}
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = strings.Trim(from[i+1:], "<> ")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(strings.Replace(m.Body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return b.Bytes(), nil
+}
+
+// Outbox writes each message to a file in a directory,
+// rather than sending it.
+type Outbox struct {
+	Path string
+	From string
+}
+
+func (o *Outbox) Send(m *Message) error {
+	data, err := m.format(o.From)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(o.Path, 0700)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), hex.EncodeToString(suffix))
+	return ioutil.WriteFile(filepath.Join(o.Path, name), data, 0600)
+}
+
+// Messages returns the messages in an outbox, oldest
+// first, in RFC 5322 form.
+func (o *Outbox) Messages() ([]string, error) {
+	files, err := ioutil.ReadDir(o.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".eml") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(o.Path, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, string(data))
+	}
+	return out, nil
+}
+
+// SMTP sends messages through a mail server, using
+// STARTTLS if the server supports it. The username and
+// password are only sent over TLS, or to localhost.
+type SMTP struct {
+	Addr     string // Host and port, such as "mail.example.com:587".
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(m *Message) error {
+	data, err := m.format(s.From)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, address(s.From), []string{address(m.To)}, data)
+}
+
+// address returns the bare address from one which may
+// include a name, such as "RS3 <rs3@example.com>".
+func address(s string) string {
+	if i := strings.LastIndex(s, "<"); i >= 0 {
+		return strings.TrimSuffix(s[i+1:], ">")
+	}
+	return s
+}
+
+// Config chooses a Sender. Give Outbox to write messages
+// to that directory, or SMTP to send them.
+type Config struct {
+	From   string // Such as "RS3 <rs3@example.com>".
+	Outbox string
+	SMTP   *SMTP
+}
+
+// Load reads a Config from a JSON file, and returns its
+// Sender.
+func Load(path string) (Sender, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.From == "" {
+		return nil, errors.New("Error: mail From address not given.")
+	}
+	switch {
+	case c.Outbox != "" && c.SMTP != nil:
+		return nil, errors.New("Error: give either a mail outbox or an SMTP server, not both.")
+	case c.Outbox != "":
+		return &Outbox{Path: c.Outbox, From: c.From}, nil
+	case c.SMTP != nil:
+		if c.SMTP.Addr == "" {
+			return nil, errors.New("Error: SMTP server address not given.")
+		}
+		c.SMTP.From = c.From
+		return c.SMTP, nil
+	}
+	return nil, errors.New("Error: no mail outbox or SMTP server given.")
+}
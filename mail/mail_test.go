@@ -0,0 +1,86 @@
+package mail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rs3-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &Outbox{Path: filepath.Join(dir, "outbox"), From: "RS3 <rs3@example.com>"}
+	messages, err := o.Messages()
+	if err != nil || len(messages) != 0 {
+		t.Fatalf("Expected an empty outbox, got %q, %v.", messages, err)
+	}
+
+	for _, subject := range []string{"First", "Zweite Nachricht für dich"} {
+		err = o.Send(&Message{To: "alice@example.com", Subject: subject, Body: "Hello,\n\nThis is a test.\n"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err = o.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d.", len(messages))
+	}
+	for _, s := range []string{
+		"From: RS3 <rs3@example.com>\r\n",
+		"To: alice@example.com\r\n",
+		"Subject: First\r\n",
+		"@example.com>\r\n",
+		"\r\n\r\nHello,\r\n\r\nThis is a test.\r\n",
+	} {
+		if !strings.Contains(messages[0], s) {
+			t.Errorf("Expected %q in message:\n%s", s, messages[0])
+		}
+	}
+	if !strings.Contains(messages[1], "Subject: =?utf-8?q?Zweite_Nachricht_f=C3=BCr_dich?=\r\n") {
+		t.Errorf("Expected an encoded subject in message:\n%s", messages[1])
+	}
+
+	err = o.Send(&Message{To: "alice@example.com\r\nBcc: eve@example.com", Subject: "Hello"})
+	if err == nil {
+		t.Error("Expected a line break in a header to be refused.")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rs3-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.json")
+
+	for config, ok := range map[string]bool{
+		`{"From": "rs3@example.com", "Outbox": "/var/lib/rs3/outbox"}`:                                   true,
+		`{"From": "rs3@example.com", "SMTP": {"Addr": "localhost:25"}}`:                                  true,
+		`{"Outbox": "/var/lib/rs3/outbox"}`:                                                              false,
+		`{"From": "rs3@example.com"}`:                                                                    false,
+		`{"From": "rs3@example.com", "SMTP": {}}`:                                                        false,
+		`{"From": "rs3@example.com", "Outbox": "/var/lib/rs3/outbox", "SMTP": {"Addr": "localhost:25"}}`: false,
+	} {
+		err = ioutil.WriteFile(path, []byte(config), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(path)
+		if ok && err != nil {
+			t.Errorf("%s: %v", config, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("Expected %s to be refused.", config)
+		}
+	}
+}
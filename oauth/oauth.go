@@ -0,0 +1,267 @@
+// Package oauth lets RS3 act as an OAuth 2.0 provider, so
+// that apps can be given scoped access to a user's feeds
+// without handling the user's password.
+//
+// Clients are registered by administrators at the console.
+// They send the user to AuthorizePath, where the user logs
+// in as usual and consents, and then exchange the code they
+// are given at TokenPath for an access token and a refresh
+// token. Only the authorization code grant is supported,
+// and clients must use PKCE with the S256 method.
+//
+// Access tokens are used as bearer tokens with the API.
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"rs3/database"
+	"strings"
+)
+
+// AuthorizePath and TokenPath are the paths at which the
+// endpoints are served.
+const (
+	AuthorizePath = "/oauth/authorize"
+	TokenPath     = "/oauth/token"
+)
+
+// ConsentTemplate is the page which asks the user whether
+// to grant a client access.
+var ConsentTemplate = "server/content/html/consent.html"
+
+// Consent is the data for ConsentTemplate.
+type Consent struct {
+	Client      string
+	Scope       string
+	Description string
+	Redirect    string // Host the user will be sent to.
+	CSRF        string
+	Params      map[string]string // Echoed back by the form.
+}
+
+// descriptions tell the user what each scope allows.
+var descriptions = map[string]string{
+	database.ScopeRead:  "read your feeds and items",
+	database.ScopeWrite: "read your feeds and items, subscribe and unsubscribe, and mark items as read",
+	database.ScopeAdmin: "do anything you can, including managing your API tokens and app passwords",
+}
+
+// parseScope returns the scope a client asked for, as a
+// space-separated list. The widest scope asked for is
+// granted; none means read access.
+func parseScope(s string) (string, bool) {
+	scope := database.ScopeRead
+	for _, f := range strings.Fields(s) {
+		if _, ok := descriptions[f]; !ok {
+			return "", false
+		}
+		if database.Allows(f, scope) {
+			scope = f
+		}
+	}
+	return scope, true
+}
+
+// Authorize handles a request to AuthorizePath from the
+// logged-in user with the given uid. csrf is the token the
+// consent form must carry, which the caller checks when
+// the form is submitted.
+func Authorize(w http.ResponseWriter, r *http.Request, uid []byte, csrf string) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid request.", 400)
+		return
+	}
+
+	// Until the client and redirect URI are known to be
+	// good, errors are shown to the user rather than
+	// sent to the client.
+	client, err := database.FindOAuthClient(r.Form.Get("client_id"))
+	if err != nil {
+		http.Error(w, "Unknown client.", 400)
+		return
+	}
+	// Clients with one redirect URI need not give it, and
+	// then need not give it again for the code either.
+	given := r.Form.Get("redirect_uri")
+	redirect := given
+	if redirect == "" && len(client.RedirectURIs) == 1 {
+		redirect = client.RedirectURIs[0]
+	}
+	if !client.Redirects(redirect) {
+		http.Error(w, "Invalid redirect URI.", 400)
+		return
+	}
+	target, err := url.Parse(redirect)
+	if err != nil {
+		http.Error(w, "Invalid redirect URI.", 400)
+		return
+	}
+
+	state := r.Form.Get("state")
+	fail := func(code, description string) {
+		q := target.Query()
+		q.Set("error", code)
+		q.Set("error_description", description)
+		if state != "" {
+			q.Set("state", state)
+		}
+		target.RawQuery = q.Encode()
+		http.Redirect(w, r, target.String(), 303)
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		fail("unsupported_response_type", "Only the code response type is supported.")
+		return
+	}
+	challenge := r.Form.Get("code_challenge")
+	if challenge == "" || r.Form.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "A code challenge using S256 is required.")
+		return
+	}
+	scope, ok := parseScope(r.Form.Get("scope"))
+	if !ok {
+		fail("invalid_scope", "Scopes are read, write and admin.")
+		return
+	}
+
+	if r.Method != "POST" {
+		consent := &Consent{
+			Client:      client.Name,
+			Scope:       scope,
+			Description: descriptions[scope],
+			Redirect:    target.Host,
+			CSRF:        csrf,
+			Params: map[string]string{
+				"client_id":             client.ID,
+				"redirect_uri":          given,
+				"response_type":         "code",
+				"code_challenge":        challenge,
+				"code_challenge_method": "S256",
+				"scope":                 scope,
+				"state":                 state,
+			},
+		}
+		if consent.Redirect == "" {
+			consent.Redirect = target.Scheme + ":"
+		}
+		t, err := template.ParseFiles(ConsentTemplate)
+		if err != nil {
+			fmt.Println("Failed to parse templates.")
+			fmt.Println(err)
+			http.Error(w, "Internal error.", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Frame-Options", "DENY")
+		err = t.Execute(w, consent)
+		if err != nil {
+			fmt.Println("Failed to execute template.")
+			fmt.Println(err)
+		}
+		return
+	}
+
+	if r.Form.Get("action") != "allow" {
+		fail("access_denied", "The user denied access.")
+		return
+	}
+	code, err := database.NewAuthCode(uid, client.ID, given, scope, challenge)
+	if err != nil {
+		fmt.Println("Failed to issue authorization code.")
+		fmt.Println(err)
+		fail("server_error", "Could not issue a code.")
+		return
+	}
+	q := target.Query()
+	q.Set("code", code)
+	if state != "" {
+		q.Set("state", state)
+	}
+	target.RawQuery = q.Encode()
+	http.Redirect(w, r, target.String(), 303)
+}
+
+// grant is a successful response from TokenPath.
+type grant struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// tokenError is an error response from TokenPath.
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// Token handles a request to TokenPath, exchanging an
+// authorization code or a refresh token for new tokens.
+// Confidential clients authenticate with HTTP Basic
+// authentication or with the client_secret parameter.
+func Token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	reply := func(status int, v interface{}) {
+		w.WriteHeader(status)
+		err := json.NewEncoder(w).Encode(v)
+		if err != nil {
+			fmt.Println("Failed to send OAuth token response.")
+			fmt.Println(err)
+		}
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		reply(405, &tokenError{"invalid_request", "Tokens must be requested with POST."})
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		reply(400, &tokenError{"invalid_request", "Invalid form."})
+		return
+	}
+	client, secret, ok := r.BasicAuth()
+	if ok {
+		client, _ = url.QueryUnescape(client)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		client = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	var g *database.OAuthGrant
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		g, err = database.ExchangeAuthCode(client, secret, r.PostForm.Get("code"),
+			r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	case "refresh_token":
+		g, err = database.RefreshOAuth(client, secret, r.PostForm.Get("refresh_token"))
+	default:
+		reply(400, &tokenError{"unsupported_grant_type", "Grants are authorization_code and refresh_token."})
+		return
+	}
+	if err != nil {
+		if e, ok := err.(*database.OAuthError); ok {
+			status := 400
+			if e.Code == "invalid_client" {
+				status = 401
+				w.Header().Set("WWW-Authenticate", `Basic realm="RS3"`)
+			}
+			reply(status, &tokenError{e.Code, e.Description})
+			return
+		}
+		fmt.Println("Failed to issue OAuth tokens.")
+		fmt.Println(err)
+		reply(500, &tokenError{"server_error", "Could not issue tokens."})
+		return
+	}
+	reply(200, &grant{g.Access, "Bearer", int(g.Expires.Seconds()), g.Refresh, g.Scope})
+}
@@ -0,0 +1,277 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"rs3/database"
+	"rs3/security"
+	"strings"
+	"testing"
+)
+
+const verifier = "dBjftJeZ4CVP-mJ92K1qUdEE8DHJTyL2I9ySoRkRsM0"
+
+func init() {
+	ConsentTemplate = "../server/content/html/consent.html"
+}
+
+// setup creates a user and a client, returning the
+// user's uid, the client and its secret, if any.
+func setup(t *testing.T, email string, confidential bool) ([]byte, *database.OAuthClient, string) {
+	salt := security.NewSalt()
+	uid, err := security.Hash(email, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwd, err := security.Hash("password", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AddUser(uid, pwd, salt, "Reader", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, secret, err := database.RegisterOAuthClient("Phone", confidential, []string{"https://app.example.com/callback", "http://127.0.0.1/done"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uid, client, secret
+}
+
+func challenge() string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorize asks for a code with the given parameters,
+// answering the consent form with action.
+func authorize(t *testing.T, uid []byte, params url.Values, action string) *url.URL {
+	r := httptest.NewRequest("GET", AuthorizePath+"?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	Authorize(w, r, uid, "csrf-token")
+	if w.Code != 200 {
+		t.Fatalf("Expected the consent page, got %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "Phone") || !strings.Contains(w.Body.String(), "csrf-token") {
+		t.Fatalf("Expected the consent page to name the client, got %s", w.Body)
+	}
+
+	params.Set("action", action)
+	r = httptest.NewRequest("POST", AuthorizePath, strings.NewReader(params.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	Authorize(w, r, uid, "csrf-token")
+	if w.Code != 303 {
+		t.Fatalf("Expected a redirect, got %d: %s", w.Code, w.Body)
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func token(t *testing.T, form url.Values, status int) *grant {
+	r := httptest.NewRequest("POST", TokenPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	Token(w, r)
+	if w.Code != status {
+		t.Fatalf("Expected %d, got %d: %s", status, w.Code, w.Body)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("Expected token responses not to be cached.")
+	}
+	g := new(grant)
+	err := json.NewDecoder(w.Body).Decode(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func codeParams(client *database.OAuthClient, redirect string) url.Values {
+	return url.Values{
+		"client_id":             {client.ID},
+		"redirect_uri":          {redirect},
+		"response_type":         {"code"},
+		"code_challenge":        {challenge()},
+		"code_challenge_method": {"S256"},
+		"scope":                 {"read write"},
+		"state":                 {"xyz"},
+	}
+}
+
+func TestAuthorizationCode(t *testing.T) {
+	uid, client, _ := setup(t, "oauth@example.com", false)
+	u := authorize(t, uid, codeParams(client, "https://app.example.com/callback"), "allow")
+	if u.Host != "app.example.com" || u.Query().Get("state") != "xyz" || u.Query().Get("code") == "" {
+		t.Fatalf("Unexpected redirect %s", u)
+	}
+	code := u.Query().Get("code")
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"code":          {code},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"code_verifier": {"wrong"},
+	}
+	if g := token(t, exchange, 400); g.AccessToken != "" {
+		t.Fatal("Expected no token without the code verifier.")
+	}
+	exchange.Set("code_verifier", verifier)
+	g := token(t, exchange, 200)
+	if g.TokenType != "Bearer" || g.Scope != database.ScopeWrite || g.ExpiresIn != 3600 || g.RefreshToken == "" {
+		t.Fatalf("Unexpected grant %+v", g)
+	}
+	got, scope, err := database.ClientUser(g.AccessToken)
+	if err != nil || string(got) != string(uid) || scope != database.ScopeWrite {
+		t.Fatalf("Expected the access token to act as the user, got %v.", err)
+	}
+
+	// Refreshing rotates both tokens.
+	refresh := url.Values{"grant_type": {"refresh_token"}, "client_id": {client.ID}, "refresh_token": {g.RefreshToken}}
+	g2 := token(t, refresh, 200)
+	if g2.AccessToken == g.AccessToken || g2.RefreshToken == g.RefreshToken {
+		t.Fatal("Expected new tokens.")
+	}
+	if _, _, err := database.ClientUser(g.AccessToken); err == nil {
+		t.Error("Expected the old access token to stop working.")
+	}
+	token(t, refresh, 400)
+	if _, _, err := database.ClientUser(g2.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	// Using the code again revokes what it granted.
+	token(t, exchange, 400)
+	if _, _, err := database.ClientUser(g2.AccessToken); err == nil {
+		t.Error("Expected a replayed code to revoke the grant.")
+	}
+}
+
+func TestRedirectURI(t *testing.T) {
+	uid, _, _ := setup(t, "redirect@example.com", false)
+	client, _, err := database.RegisterOAuthClient("Phone", false, []string{"https://app.example.com/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The redirect URI must be given to exchange the code
+	// only if it was given to ask for it.
+	for _, test := range []struct {
+		authorize, exchange string
+		status              int
+	}{
+		{"", "", 200},
+		{"", "https://app.example.com/callback", 200},
+		{"https://app.example.com/callback", "https://app.example.com/callback", 200},
+		{"https://app.example.com/callback", "", 400},
+		{"https://app.example.com/callback", "https://app.example.com/other", 400},
+	} {
+		params := codeParams(client, test.authorize)
+		if test.authorize == "" {
+			params.Del("redirect_uri")
+		}
+		u := authorize(t, uid, params, "allow")
+		if u.Host != "app.example.com" || u.Query().Get("code") == "" {
+			t.Fatalf("Unexpected redirect %s", u)
+		}
+		exchange := url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {client.ID},
+			"code":          {u.Query().Get("code")},
+			"code_verifier": {verifier},
+		}
+		if test.exchange != "" {
+			exchange.Set("redirect_uri", test.exchange)
+		}
+		token(t, exchange, test.status)
+	}
+}
+
+func TestConfidentialClient(t *testing.T) {
+	uid, client, secret := setup(t, "confidential@example.com", true)
+
+	// Loopback redirects match on any port.
+	u := authorize(t, uid, codeParams(client, "http://127.0.0.1:8123/done"), "allow")
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"code":          {u.Query().Get("code")},
+		"redirect_uri":  {"http://127.0.0.1:8123/done"},
+		"code_verifier": {verifier},
+	}
+	token(t, exchange, 401)
+	exchange.Set("client_secret", secret)
+	token(t, exchange, 200)
+
+	list, err := database.Tokens(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Kind != database.KindOAuth || list[0].Name != "Phone" {
+		t.Fatalf("Expected the grant to be listed, got %+v.", list)
+	}
+	err = database.RemoveOAuthClient(client.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _ = database.Tokens(uid)
+	if len(list) != 0 {
+		t.Error("Expected removing the client to revoke its grants.")
+	}
+}
+
+func TestAuthorizeErrors(t *testing.T) {
+	uid, client, _ := setup(t, "denied@example.com", false)
+
+	u := authorize(t, uid, codeParams(client, "https://app.example.com/callback"), "deny")
+	if u.Query().Get("error") != "access_denied" || u.Query().Get("state") != "xyz" {
+		t.Fatalf("Expected access to be denied, got %s", u)
+	}
+
+	// Errors about the client or redirect are shown to the
+	// user, and others are sent to the client.
+	for _, test := range []struct {
+		name, value string
+		status      int
+		err         string
+	}{
+		{"client_id", "unknown", 400, ""},
+		{"redirect_uri", "https://evil.example.com/callback", 400, ""},
+		{"redirect_uri", "http://localhost.evil.example.com/done", 400, ""},
+		{"response_type", "token", 303, "unsupported_response_type"},
+		{"code_challenge_method", "plain", 303, "invalid_request"},
+		{"scope", "everything", 303, "invalid_scope"},
+	} {
+		params := codeParams(client, "https://app.example.com/callback")
+		params.Set(test.name, test.value)
+		r := httptest.NewRequest("GET", AuthorizePath+"?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		Authorize(w, r, uid, "csrf-token")
+		if w.Code != test.status {
+			t.Errorf("%s=%s: expected %d, got %d.", test.name, test.value, test.status, w.Code)
+			continue
+		}
+		if test.err != "" {
+			u, _ := url.Parse(w.Header().Get("Location"))
+			if u.Host != "app.example.com" || u.Query().Get("error") != test.err {
+				t.Errorf("%s=%s: expected error %s, got %s.", test.name, test.value, test.err, u)
+			}
+		}
+	}
+
+	r := httptest.NewRequest("GET", TokenPath, nil)
+	w := httptest.NewRecorder()
+	Token(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be refused, got %d.", w.Code)
+	}
+	token(t, url.Values{"grant_type": {"password"}}, 400)
+}
@@ -0,0 +1,437 @@
+// Package oidc lets users log in to RS3 through an OpenID
+// Connect identity provider, such as a company's single
+// sign-on service, instead of with a password.
+//
+// The provider is described by a JSON file of Config, and
+// its endpoints and signing keys are found by discovery from
+// its issuer URL. Users are sent to it with the
+// authorization code flow and PKCE, and the ID token it
+// returns is checked against its published keys before the
+// identity in it is trusted.
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginPath starts a login with the provider, and
+// CallbackPath is where the provider returns the user.
+const (
+	LoginPath    = "/login/oidc"
+	CallbackPath = "/login/oidc/callback"
+)
+
+var (
+	FlowLife  = 10 * time.Minute // Time the user has to log in with the provider.
+	ClockSkew = time.Minute      // Allowed difference between our clock and the provider's.
+	KeyRetry  = time.Minute      // Minimum time between fetches of the provider's keys.
+)
+
+// Default is the configured provider, or nil if single
+// sign-on is off.
+var Default *Provider
+
+// Config describes an identity provider. Issuer, ClientID
+// and RedirectURL are required; the rest have defaults.
+type Config struct {
+	Name         string   // Shown on the login page, such as "Okta".
+	Issuer       string   // The provider's issuer URL, used for discovery.
+	ClientID     string   // Issued to this server by the provider.
+	ClientSecret string   // Empty for public clients.
+	RedirectURL  string   // The URL of CallbackPath on this server.
+	Scopes       []string // Requested as well as openid. Defaults to email and profile.
+
+	// Claims from which the user's email address and
+	// nickname are taken. They default to email and name.
+	EmailClaim string
+	NameClaim  string
+
+	// CreateUsers creates accounts for users the provider
+	// vouches for who do not yet have one. TrustEmails treats
+	// their email addresses as verified, for providers which
+	// do not send email_verified.
+	CreateUsers bool
+	TrustEmails bool
+}
+
+// Identity is a user, as described by the provider.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Flow is a login with the provider which is in progress.
+type Flow struct {
+	Next     string // Page to return the user to.
+	Link     []byte // The uid of the user linking their account, or nil if logging in.
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// Provider is an identity provider users can log in with.
+type Provider struct {
+	*Config
+	Client *http.Client
+
+	mutex   sync.Mutex
+	meta    *metadata
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	flows   map[string]*Flow // By state.
+}
+
+// metadata is the part of the provider's discovery
+// document which is used.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Load reads a provider's Config from a JSON file.
+func Load(path string) (*Provider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Config)
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, err
+	}
+	return New(c)
+}
+
+// New returns a Provider for the Config. The provider is
+// not contacted until it is first used.
+func New(c *Config) (*Provider, error) {
+	switch {
+	case c.Issuer == "":
+		return nil, errors.New("Error: OIDC issuer not given.")
+	case c.ClientID == "":
+		return nil, errors.New("Error: OIDC client ID not given.")
+	case c.RedirectURL == "":
+		return nil, errors.New("Error: OIDC redirect URL not given.")
+	}
+	if c.Name == "" {
+		c.Name = "single sign-on"
+	}
+	if c.Scopes == nil {
+		c.Scopes = []string{"email", "profile"}
+	}
+	if c.EmailClaim == "" {
+		c.EmailClaim = "email"
+	}
+	if c.NameClaim == "" {
+		c.NameClaim = "name"
+	}
+	p := &Provider{
+		Config: c,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		flows:  make(map[string]*Flow),
+	}
+	return p, nil
+}
+
+func random() (string, error) {
+	b := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// fetch gets a JSON document from the provider.
+func (p *Provider) fetch(u string, v interface{}) error {
+	resp, err := p.Client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Error: %s returned %s.", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider's metadata, fetching it
+// the first time. The provider's lock must be held.
+func (p *Provider) discover() (*metadata, error) {
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	meta := new(metadata)
+	err := p.fetch(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", meta)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Issuer != p.Issuer {
+		return nil, fmt.Errorf("Error: provider claims to be issuer %q, not %q.", meta.Issuer, p.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("Error: provider discovery document is incomplete.")
+	}
+	p.meta = meta
+	return meta, nil
+}
+
+// key returns the provider's signing key with the ID,
+// fetching the keys again if it is unknown, as the
+// provider may have rotated them. The provider's lock must
+// be held.
+func (p *Provider) key(kid string) (crypto.PublicKey, error) {
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+	if time.Since(p.fetched) < KeyRetry {
+		return nil, fmt.Errorf("Error: unknown signing key %q.", kid)
+	}
+	p.fetched = time.Now()
+	var raw json.RawMessage
+	err := p.fetch(p.meta.JWKSURI, &raw)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("Error: unknown signing key %q.", kid)
+}
+
+// lookup finds a key by ID. Tokens without a key ID may
+// be used only if the provider has one key.
+func (p *Provider) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+	k, ok := p.keys[kid]
+	return k, ok
+}
+
+// Begin starts a login, returning the URL at the provider
+// to which the user should be sent, and the state which
+// identifies the login when they return. The state should
+// also be given to the user's browser, and checked when
+// they return, so that logins cannot be completed in
+// another browser. If link is set, the identity is linked
+// to that user, rather than logged in.
+func (p *Provider) Begin(next string, link []byte) (string, string, error) {
+	state, err := random()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := random()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := random()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	meta, err := p.discover()
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	for s, f := range p.flows {
+		if now.After(f.expires) {
+			delete(p.flows, s)
+		}
+	}
+	p.flows[state] = &Flow{next, link, nonce, verifier, now.Add(FlowLife)}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(append([]string{"openid"}, p.Scopes...), " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", b64.EncodeToString(sum[:]))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + v.Encode(), state, nil
+}
+
+// Complete finishes the login with the state, exchanging
+// the code the provider gave for an ID token, and returns
+// the identity in it, if it is valid.
+func (p *Provider) Complete(state, code string) (*Identity, *Flow, error) {
+	p.mutex.Lock()
+	flow, ok := p.flows[state]
+	delete(p.flows, state)
+	meta := p.meta
+	p.mutex.Unlock()
+	if !ok || time.Now().After(flow.expires) {
+		return nil, nil, errors.New("Error: unknown or expired login.")
+	}
+
+	token, err := p.exchange(meta, code, flow.verifier)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mutex.Lock()
+	payload, err := verifyJWT(token, p.key)
+	p.mutex.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := p.identity(payload, flow.nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, flow, nil
+}
+
+// exchange redeems the code at the token endpoint,
+// returning the ID token.
+func (p *Provider) exchange(meta *metadata, code, verifier string) (string, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("code_verifier", verifier)
+	if p.ClientSecret == "" {
+		v.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequest("POST", meta.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("Error: invalid token response: %v.", err)
+	}
+	if body.Error != "" {
+		return "", fmt.Errorf("Error: provider refused code: %s %s", body.Error, body.Description)
+	}
+	if resp.StatusCode != 200 || body.IDToken == "" {
+		return "", fmt.Errorf("Error: provider gave no ID token (%s).", resp.Status)
+	}
+	return body.IDToken, nil
+}
+
+// identity checks the ID token's claims, and maps them to
+// an Identity.
+func (p *Provider) identity(payload []byte, nonce string) (*Identity, error) {
+	var claims map[string]interface{}
+	err := json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, errors.New("Error: malformed token claims.")
+	}
+	str := func(name string) string {
+		s, _ := claims[name].(string)
+		return s
+	}
+	num := func(name string) (time.Time, bool) {
+		n, ok := claims[name].(float64)
+		return time.Unix(int64(n), 0), ok
+	}
+
+	if str("iss") != p.Issuer {
+		return nil, fmt.Errorf("Error: token issued by %q.", str("iss"))
+	}
+	var audience []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	found := false
+	for _, a := range audience {
+		if a == p.ClientID {
+			found = true
+		}
+	}
+	if !found || (len(audience) > 1 && str("azp") != p.ClientID) {
+		return nil, errors.New("Error: token is not for this client.")
+	}
+	now := time.Now()
+	if exp, ok := num("exp"); !ok || now.After(exp.Add(ClockSkew)) {
+		return nil, errors.New("Error: token has expired.")
+	}
+	if iat, ok := num("iat"); ok && iat.After(now.Add(ClockSkew)) {
+		return nil, errors.New("Error: token issued in the future.")
+	}
+	if nbf, ok := num("nbf"); ok && nbf.After(now.Add(ClockSkew)) {
+		return nil, errors.New("Error: token not yet valid.")
+	}
+	if str("nonce") != nonce {
+		return nil, errors.New("Error: token nonce does not match.")
+	}
+	if str("sub") == "" {
+		return nil, errors.New("Error: token has no subject.")
+	}
+
+	id := &Identity{
+		Issuer:  p.Issuer,
+		Subject: str("sub"),
+		Email:   str(p.EmailClaim),
+		Name:    str(p.NameClaim),
+	}
+	id.EmailVerified = p.TrustEmails
+	if p.EmailClaim == "email" {
+		switch v := claims["email_verified"].(type) {
+		case bool:
+			id.EmailVerified = v
+		case string:
+			id.EmailVerified = v == "true"
+		}
+	}
+	return id, nil
+}
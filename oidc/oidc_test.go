@@ -0,0 +1,178 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/url"
+	"rs3/oidc/oidctest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// login follows the provider's redirect back to us, as a
+// browser would, returning the state and code.
+func login(t *testing.T, authURL string) (string, string) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	u, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(u.String(), "https://rs3.example.com/login/oidc/callback?") {
+		t.Fatalf("Expected a redirect to the callback, got %d %q.", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if e := u.Query().Get("error"); e != "" {
+		t.Fatalf("Provider returned %q.", e)
+	}
+	return u.Query().Get("state"), u.Query().Get("code")
+}
+
+func newProvider(t *testing.T, mock *oidctest.Provider) *Provider {
+	p, err := New(&Config{
+		Name:         "Mock",
+		Issuer:       mock.URL(),
+		ClientID:     mock.ClientID,
+		ClientSecret: mock.ClientSecret,
+		RedirectURL:  "https://rs3.example.com/login/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLogin(t *testing.T) {
+	for _, secret := range []string{"secret", ""} {
+		mock := oidctest.NewProvider("rs3", secret)
+		mock.Claims = map[string]interface{}{
+			"sub":            "alice",
+			"email":          "alice@example.com",
+			"email_verified": true,
+			"name":           "Alice",
+		}
+		p := newProvider(t, mock)
+
+		authURL, state, err := p.Begin("/settings", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotState, code := login(t, authURL)
+		if gotState != state {
+			t.Fatalf("Expected state %q, got %q.", state, gotState)
+		}
+		id, flow, err := p.Complete(state, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Identity{mock.URL(), "alice", "alice@example.com", true, "Alice"}
+		if *id != want {
+			t.Errorf("Expected %+v, got %+v.", want, *id)
+		}
+		if flow.Next != "/settings" || flow.Link != nil {
+			t.Errorf("Expected the flow to be returned, got %+v.", flow)
+		}
+
+		// Each login can be completed only once.
+		if _, _, err := p.Complete(state, code); err == nil {
+			t.Error("Expected a used state to be refused.")
+		}
+		mock.Close()
+	}
+}
+
+func TestWrongClient(t *testing.T) {
+	mock := oidctest.NewProvider("rs3", "secret")
+	defer mock.Close()
+	mock.ClientSecret = "other"
+	p := newProvider(t, mock)
+	p.ClientSecret = "secret"
+	authURL, _, err := p.Begin("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, code := login(t, authURL)
+	if _, _, err := p.Complete(state, code); err == nil {
+		t.Error("Expected the wrong client secret to be refused.")
+	}
+}
+
+func TestIDTokens(t *testing.T) {
+	mock := oidctest.NewProvider("rs3", "secret")
+	defer mock.Close()
+	p := newProvider(t, mock)
+	p.mutex.Lock()
+	_, err := p.discover()
+	p.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": mock.URL(), "aud": "rs3", "sub": "alice", "nonce": "n", "exp": now + 60, "iat": now,
+		}
+	}
+	check := func(token string) error {
+		p.mutex.Lock()
+		payload, err := verifyJWT(token, p.key)
+		p.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		_, err = p.identity(payload, "n")
+		return err
+	}
+	if err := check(mock.IDToken(valid())); err != nil {
+		t.Fatalf("Expected a valid token, got %v.", err)
+	}
+
+	tests := map[string]func(map[string]interface{}){
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"no azp":         func(c map[string]interface{}) { c["aud"] = []string{"rs3", "other"} },
+		"expired":        func(c map[string]interface{}) { c["exp"] = now - 3600 },
+		"no expiry":      func(c map[string]interface{}) { delete(c, "exp") },
+		"future":         func(c map[string]interface{}) { c["iat"] = now + 3600 },
+		"wrong nonce":    func(c map[string]interface{}) { c["nonce"] = "m" },
+		"no subject":     func(c map[string]interface{}) { delete(c, "sub") },
+	}
+	for name, edit := range tests {
+		claims := valid()
+		edit(claims)
+		if err := check(mock.IDToken(claims)); err == nil {
+			t.Errorf("%s: expected the token to be refused.", name)
+		}
+	}
+
+	token := mock.IDToken(valid())
+	parts := strings.Split(token, ".")
+	if err := check(parts[0] + "." + b64.EncodeToString([]byte(`{"sub":"mallory"}`)) + "." + parts[2]); err == nil {
+		t.Error("Expected a tampered token to be refused.")
+	}
+	none := b64.EncodeToString([]byte(`{"alg":"none"}`))
+	if err := check(none + "." + parts[1] + "."); err == nil {
+		t.Error("Expected an unsigned token to be refused.")
+	}
+
+	// Keys the provider rotates to are fetched, but not
+	// more than once per KeyRetry.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.Key, mock.KeyID = key, "rotated"
+	if err := check(mock.IDToken(valid())); err == nil {
+		t.Error("Expected keys not to be fetched again so soon.")
+	}
+	KeyRetry = 0
+	defer func() { KeyRetry = time.Minute }()
+	if err := check(mock.IDToken(valid())); err != nil {
+		t.Errorf("Expected the rotated key to be fetched, got %v.", err)
+	}
+}
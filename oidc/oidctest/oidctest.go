@@ -0,0 +1,229 @@
+// Package oidctest provides a local OpenID Connect provider
+// for testing single sign-on without a real one.
+//
+// The provider logs in whoever it is told to, without
+// asking: its authorization endpoint redirects straight back
+// to the client with a code for the identity in Claims. It
+// checks client credentials, redirect URIs and PKCE as a
+// real provider would, and signs ID tokens with RS256.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// Provider is a running mock provider. Its issuer URL is
+// Server.URL.
+type Provider struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	// Claims are those of the user who logs in next, such
+	// as sub and email. iss, aud, exp, iat and nonce are
+	// added to them.
+	Claims map[string]interface{}
+
+	// Key signs ID tokens. KeyID is sent with them.
+	Key   *rsa.PrivateKey
+	KeyID string
+
+	mutex sync.Mutex
+	codes map[string]*grant
+}
+
+type grant struct {
+	redirect  string
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+// NewProvider starts a provider which accepts the client.
+// Use an empty secret for a public client. Close it when
+// done.
+func NewProvider(clientID, clientSecret string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Claims:       map[string]interface{}{"sub": "user"},
+		Key:          key,
+		KeyID:        "test",
+		codes:        make(map[string]*grant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// URL returns the provider's issuer URL.
+func (p *Provider) URL() string {
+	return p.Server.URL
+}
+
+// Close stops the provider.
+func (p *Provider) Close() {
+	p.Server.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"issuer":                                p.URL(),
+		"authorization_endpoint":                p.URL() + "/authorize",
+		"token_endpoint":                        p.URL() + "/token",
+		"jwks_uri":                              p.URL() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	key, kid := &p.Key.PublicKey, p.KeyID
+	p.mutex.Unlock()
+	writeJSON(w, 200, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   b64.EncodeToString(key.N.Bytes()),
+			"e":   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if q.Get("client_id") != p.ClientID || err != nil || !redirect.IsAbs() {
+		http.Error(w, "Unknown client or redirect URI.", 400)
+		return
+	}
+	v := redirect.Query()
+	v.Set("state", q.Get("state"))
+	switch {
+	case q.Get("response_type") != "code":
+		v.Set("error", "unsupported_response_type")
+	case q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256":
+		v.Set("error", "invalid_request")
+	default:
+		code := random()
+		p.mutex.Lock()
+		claims := make(map[string]interface{})
+		for k, c := range p.Claims {
+			claims[k] = c
+		}
+		p.codes[code] = &grant{q.Get("redirect_uri"), q.Get("code_challenge"), q.Get("nonce"), claims}
+		p.mutex.Unlock()
+		v.Set("code", code)
+	}
+	redirect.RawQuery = v.Encode()
+	http.Redirect(w, r, redirect.String(), 302)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		writeJSON(w, 400, map[string]string{"error": code})
+	}
+	if r.Method != "POST" {
+		fail("invalid_request")
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostFormValue("client_id")
+	}
+	if id != p.ClientID || secret != p.ClientSecret {
+		writeJSON(w, 401, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		fail("unsupported_grant_type")
+		return
+	}
+
+	p.mutex.Lock()
+	g, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mutex.Unlock()
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || g.redirect != r.PostFormValue("redirect_uri") || b64.EncodeToString(sum[:]) != g.challenge {
+		fail("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   p.URL(),
+		"aud":   p.ClientID,
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": g.nonce,
+	}
+	for k, c := range g.claims {
+		claims[k] = c
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"access_token": random(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     p.IDToken(claims),
+	})
+}
+
+// IDToken signs the claims as an ID token, as given by the
+// token endpoint, so that tests can make invalid ones.
+func (p *Provider) IDToken(claims map[string]interface{}) string {
+	p.mutex.Lock()
+	key, kid := p.Key, p.KeyID
+	p.mutex.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func random() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,252 @@
+package privacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"golang.org/x/net/html"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// Rules describes the tracking which is removed from
+// items and the links they contain.
+type Rules struct {
+	Params      []*Param
+	Redirectors []*Redirector
+	Trackers    []string // Host and optional path prefix of tracking images.
+}
+
+// Param identifies a tracking query parameter. If Prefix
+// is set, any parameter beginning with Name matches. If
+// Host is set, the rule applies only to that host and its
+// subdomains.
+type Param struct {
+	Name   string
+	Prefix bool
+	Host   string
+}
+
+// Redirector identifies a redirect wrapper, which holds
+// the real destination in the query parameter Param.
+type Redirector struct {
+	Host  string
+	Path  string
+	Param string
+}
+
+// Default holds the rules applied to ingested items.
+var Default = DefaultRules()
+
+// DefaultRules returns the built-in set of rules.
+func DefaultRules() *Rules {
+	return &Rules{
+		Params: []*Param{
+			{Name: "utm_", Prefix: true},
+			{Name: "fbclid"},
+			{Name: "gclid"},
+			{Name: "dclid"},
+			{Name: "msclkid"},
+			{Name: "yclid"},
+			{Name: "igshid"},
+			{Name: "mc_cid"},
+			{Name: "mc_eid"},
+			{Name: "_hsenc"},
+			{Name: "_hsmi"},
+			{Name: "mkt_tok"},
+			{Name: "oly_anon_id"},
+			{Name: "oly_enc_id"},
+			{Name: "vero_id"},
+			{Name: "wt_mc"},
+			{Name: "ref_src", Host: "twitter.com"},
+		},
+		Redirectors: []*Redirector{
+			{Host: "www.google.com", Path: "/url", Param: "q"},
+			{Host: "www.google.com", Path: "/url", Param: "url"},
+			{Host: "l.facebook.com", Path: "/l.php", Param: "u"},
+			{Host: "lm.facebook.com", Path: "/l.php", Param: "u"},
+			{Host: "out.reddit.com", Path: "/", Param: "url"},
+			{Host: "t.umblr.com", Path: "/redirect", Param: "z"},
+			{Host: "www.youtube.com", Path: "/redirect", Param: "q"},
+			{Host: "away.vk.com", Path: "/away.php", Param: "to"},
+			{Host: "exit.sc", Path: "/", Param: "url"},
+		},
+		Trackers: []string{
+			"feeds.feedburner.com/~r/",
+			"feeds.wordpress.com/1.0/",
+			"pixel.wp.com",
+			"stats.wordpress.com",
+			"www.google-analytics.com",
+			"pixel.quantserve.com",
+			"ad.doubleclick.net",
+			"pi.feedsportal.com",
+			"rss.feedsportal.com/c/",
+			"feedads.g.doubleclick.net",
+			"www.facebook.com/tr",
+			"pixel.mathtag.com",
+			"sb.scorecardresearch.com",
+		},
+	}
+}
+
+// Load reads a set of rules from a JSON file, which
+// replaces the built-in rules entirely.
+func Load(path string) (*Rules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := new(Rules)
+	err = json.Unmarshal(data, rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// URL returns a copy of u with any redirect wrappers and
+// tracking parameters removed.
+func (r *Rules) URL(u *url.URL) *url.URL {
+	out := *u
+
+	// Unwrap nested redirectors, within reason.
+	for i := 0; i < 5; i++ {
+		next := r.unwrap(&out)
+		if next == nil {
+			break
+		}
+		out = *next
+	}
+
+	if out.RawQuery == "" {
+		return &out
+	}
+	query := out.Query()
+	changed := false
+	for name := range query {
+		for _, p := range r.Params {
+			if p.matches(name, out.Host) {
+				query.Del(name)
+				changed = true
+				break
+			}
+		}
+	}
+	if changed {
+		out.RawQuery = query.Encode()
+	}
+	return &out
+}
+
+// String is a convenience wrapper around URL for links
+// held as strings. Unparseable links are returned as is.
+func (r *Rules) String(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() {
+		return s
+	}
+	return r.URL(u).String()
+}
+
+// Tracker returns whether the image at u is a known
+// tracking image.
+func (r *Rules) Tracker(u *url.URL) bool {
+	for _, t := range r.Trackers {
+		host, path := t, ""
+		if i := strings.Index(t, "/"); i >= 0 {
+			host, path = t[:i], t[i:]
+		}
+		if strings.EqualFold(u.Host, host) && strings.HasPrefix(u.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTML removes tracking images from a sanitised HTML
+// fragment, and cleans the links and sources it contains.
+func (r *Rules) HTML(s string) string {
+	buf := new(bytes.Buffer)
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		t := z.Token()
+		switch tt {
+		case html.TextToken:
+			buf.WriteString(html.EscapeString(t.Data))
+			continue
+		case html.CommentToken, html.DoctypeToken:
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if t.Data == "img" && r.pixel(t.Attr) {
+				continue
+			}
+			for i, a := range t.Attr {
+				if a.Key == "href" || a.Key == "src" {
+					t.Attr[i].Val = r.String(a.Val)
+				}
+			}
+		}
+		buf.WriteString(t.String())
+	}
+	return buf.String()
+}
+
+// pixel returns whether the image with the given
+// attributes is a tracking image.
+func (r *Rules) pixel(attr []html.Attribute) bool {
+	width, height := "", ""
+	for _, a := range attr {
+		switch a.Key {
+		case "src":
+			u, err := url.Parse(a.Val)
+			if err == nil && r.Tracker(u) {
+				return true
+			}
+		case "width":
+			width = strings.TrimSuffix(strings.TrimSpace(a.Val), "px")
+		case "height":
+			height = strings.TrimSuffix(strings.TrimSpace(a.Val), "px")
+		}
+	}
+	tiny := func(s string) bool {
+		return s == "0" || s == "1"
+	}
+	return tiny(width) && tiny(height)
+}
+
+func (r *Redirector) target(u *url.URL) *url.URL {
+	if !strings.EqualFold(u.Host, r.Host) || u.Path != r.Path {
+		return nil
+	}
+	dest, err := url.Parse(u.Query().Get(r.Param))
+	if err != nil || !dest.IsAbs() || (dest.Scheme != "http" && dest.Scheme != "https") {
+		return nil
+	}
+	return dest
+}
+
+func (r *Rules) unwrap(u *url.URL) *url.URL {
+	for _, red := range r.Redirectors {
+		if dest := red.target(u); dest != nil {
+			return dest
+		}
+	}
+	return nil
+}
+
+func (p *Param) matches(name, host string) bool {
+	if p.Host != "" {
+		host = strings.ToLower(host)
+		if host != p.Host && !strings.HasSuffix(host, "."+p.Host) {
+			return false
+		}
+	}
+	if p.Prefix {
+		return strings.HasPrefix(name, p.Name)
+	}
+	return name == p.Name
+}
@@ -0,0 +1,40 @@
+package privacy
+
+import (
+	"testing"
+)
+
+func TestURL(t *testing.T) {
+	rules := DefaultRules()
+	tests := map[string]string{
+		"http://example.com/a?utm_source=rss&utm_medium=feed":                   "http://example.com/a",
+		"http://example.com/a?id=3&fbclid=abc":                                  "http://example.com/a?id=3",
+		"http://example.com/a?id=3":                                             "http://example.com/a?id=3",
+		"https://www.google.com/url?q=http%3A%2F%2Fexample.com%2Fb%3Fgclid%3D1": "http://example.com/b",
+		"https://l.facebook.com/l.php?u=https%3A%2F%2Fexample.com%2Fc&h=xyz":    "https://example.com/c",
+		"https://l.facebook.com/l.php?u=javascript%3Aalert(1)":                  "https://l.facebook.com/l.php?u=javascript%3Aalert(1)",
+		"https://twitter.com/x?ref_src=twsrc":                                   "https://twitter.com/x",
+		"https://example.com/x?ref_src=twsrc":                                   "https://example.com/x?ref_src=twsrc",
+	}
+	for in, want := range tests {
+		if out := rules.String(in); out != want {
+			t.Errorf("Failed to clean %q:\n\tgot  %q\n\twant %q", in, out, want)
+		}
+	}
+}
+
+func TestHTML(t *testing.T) {
+	rules := DefaultRules()
+	tests := map[string]string{
+		`<p>a<img src="http://example.com/p.gif" width="1" height="1"/>b</p>`:          `<p>ab</p>`,
+		`<p>a<img src="http://feeds.feedburner.com/~r/x/~4/y"/>b</p>`:                  `<p>ab</p>`,
+		`<p>a<img src="http://example.com/photo.jpg" width="1" height="300"/>b</p>`:    `<p>a<img src="http://example.com/photo.jpg" width="1" height="300"/>b</p>`,
+		`<a href="http://example.com/?utm_campaign=x" rel="noopener noreferrer">x</a>`: `<a href="http://example.com/" rel="noopener noreferrer">x</a>`,
+		`<p>1 &lt; 2 &amp; 3</p>`: `<p>1 &lt; 2 &amp; 3</p>`,
+	}
+	for in, want := range tests {
+		if out := rules.HTML(in); out != want {
+			t.Errorf("Failed to filter %q:\n\tgot  %q\n\twant %q", in, out, want)
+		}
+	}
+}
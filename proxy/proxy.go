@@ -0,0 +1,400 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Prefix is the path under which proxied resources are served.
+const Prefix = "/proxy/"
+
+var (
+	CachePath       = "database/proxy_cache" // Directory holding cached resources.
+	KeyPath         = "database/proxy.key"   // File holding the URL signing key.
+	MaxSize   int64 = 5 << 20                // Largest resource that will be proxied.
+	MaxCache  int64 = 256 << 20              // Most the cache may hold, in bytes.
+)
+
+// types lists the content types which may be proxied.
+// SVG is excluded, as it can carry script.
+var types = map[string]bool{
+	"image/avif":               true,
+	"image/bmp":                true,
+	"image/gif":                true,
+	"image/jpeg":               true,
+	"image/png":                true,
+	"image/webp":               true,
+	"image/x-icon":             true,
+	"image/vnd.microsoft.icon": true,
+}
+
+var key []byte
+var keyErr error
+var keyOnce sync.Once
+
+// LoadKey loads the URL signing key, creating it if it
+// does not yet exist. It is called at startup, so that a
+// key which cannot be kept, and so would not survive a
+// restart, is refused before any URLs are signed with it.
+// A key which exists but cannot be read is an error, and
+// is never replaced, as that would break every URL signed
+// with it.
+func LoadKey() error {
+	signingKey()
+	return keyErr
+}
+
+// signingKey returns the URL signing key, or nil if it
+// could not be loaded.
+func signingKey() []byte {
+	keyOnce.Do(func() {
+		key, keyErr = loadKey(KeyPath)
+	})
+	return key
+}
+
+// loadKey reads the 32-byte key in the named file, or
+// creates the file with a new key if it does not exist.
+func loadKey(name string) ([]byte, error) {
+	k, err := ioutil.ReadFile(name)
+	if err == nil {
+		if len(k) != 32 {
+			return nil, fmt.Errorf("Error: %s does not hold a 32-byte key.", name)
+		}
+		return k, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	k = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, k)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(k)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	return k, nil
+}
+
+func sign(s string) string {
+	mac := hmac.New(sha256.New, signingKey())
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the signed proxy path for the remote
+// resource at s. Only http and https URLs are proxied.
+func URL(s string) string {
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		return s
+	}
+	if signingKey() == nil {
+		return s
+	}
+	return Prefix + sign(s) + "/" + base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// Rewrite returns a copy of a sanitised HTML fragment in
+// which images are loaded through the proxy. Proxy URLs
+// are relative, and served only to logged in users, so
+// content is rewritten as it is shown in the web
+// interface, not as it is stored.
+func Rewrite(s string) string {
+	return rewrite(s, URL)
+}
+
+// Restore returns a copy of an HTML fragment in which
+// images loaded through the proxy are loaded from their
+// original URLs again.
+func Restore(s string) string {
+	return rewrite(s, func(v string) string {
+		if !strings.HasPrefix(v, Prefix) {
+			return v
+		}
+		original, err := parse(v)
+		if err != nil {
+			return v
+		}
+		return original
+	})
+}
+
+// rewrite returns a copy of an HTML fragment in which
+// the URLs of images are replaced by fn.
+func rewrite(s string, fn func(string) string) string {
+	buf := new(bytes.Buffer)
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		t := z.Token()
+		switch tt {
+		case html.TextToken:
+			buf.WriteString(html.EscapeString(t.Data))
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken:
+			for i, a := range t.Attr {
+				if (t.Data == "img" && a.Key == "src") || (t.Data == "video" && a.Key == "poster") {
+					t.Attr[i].Val = fn(a.Val)
+				}
+			}
+		}
+		buf.WriteString(t.String())
+	}
+	return buf.String()
+}
+
+// parse checks the signature on a proxy path, returning
+// the remote URL it refers to.
+func parse(path string) (string, error) {
+	path = strings.TrimPrefix(path, Prefix)
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Error: malformed proxy path.")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	s := string(b)
+	if signingKey() == nil || !hmac.Equal([]byte(sign(s)), []byte(parts[0])) {
+		return "", errors.New("Error: invalid proxy signature.")
+	}
+	return s, nil
+}
+
+// Client fetches remote content on behalf of users. It
+// refuses to connect to local or private addresses.
+var Client = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: public,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+}
+
+func public(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("Error: refusing to connect to %s.", host)
+	}
+	return nil
+}
+
+// fetch retrieves a remote resource, checking its type
+// and size.
+func fetch(s string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", s, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "image/*")
+	resp, err := Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("Error: received status %d.", resp.StatusCode)
+	}
+	typ := strings.ToLower(strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0]))
+	if !types[typ] {
+		return nil, "", fmt.Errorf("Error: content type %q not permitted.", typ)
+	}
+	if resp.ContentLength > MaxSize {
+		return nil, "", errors.New("Error: resource too large.")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > MaxSize {
+		return nil, "", errors.New("Error: resource too large.")
+	}
+	return data, typ, nil
+}
+
+// cached returns the cached copy of the resource at s,
+// fetching and storing it if necessary.
+func cached(s string) ([]byte, string, error) {
+	sum := sha256.Sum256([]byte(s))
+	name := filepath.Join(CachePath, hex.EncodeToString(sum[:]))
+
+	data, err := ioutil.ReadFile(name)
+	if err == nil {
+		typ, err := ioutil.ReadFile(name + ".type")
+		if err == nil && types[string(typ)] {
+			// Resources are evicted by when they were last
+			// used.
+			now := time.Now()
+			os.Chtimes(name, now, now)
+			return data, string(typ), nil
+		}
+	}
+
+	data, typ, err := fetch(s)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Failing to cache is not fatal.
+	err = os.MkdirAll(CachePath, 0700)
+	if err == nil {
+		err = write(name, data)
+	}
+	if err == nil {
+		err = write(name+".type", []byte(typ))
+	}
+	if err == nil {
+		err = trim(int64(len(data) + len(typ)))
+	}
+	if err != nil {
+		fmt.Println("Failed to cache", s)
+		fmt.Println(err)
+	}
+	return data, typ, nil
+}
+
+var cacheMutex sync.Mutex
+var cacheSize int64 = -1 // Bytes in the cache, or -1 until counted.
+
+// trim records that n bytes were added to the cache. If
+// it then holds more than MaxCache, the least recently
+// used resources are removed until it holds no more than
+// nine tenths of that, so that it is not trimmed again by
+// every resource added.
+func trim(n int64) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if cacheSize >= 0 {
+		cacheSize += n
+		if cacheSize <= MaxCache {
+			return nil
+		}
+	}
+
+	infos, err := ioutil.ReadDir(CachePath)
+	if err != nil {
+		return err
+	}
+	cacheSize = 0
+	sizes := make(map[string]int64)
+	var resources []os.FileInfo
+	for _, info := range infos {
+		cacheSize += info.Size()
+		sizes[info.Name()] = info.Size()
+		if !strings.HasSuffix(info.Name(), ".type") && !strings.HasPrefix(info.Name(), "tmp") {
+			resources = append(resources, info)
+		}
+	}
+	if cacheSize <= MaxCache {
+		return nil
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].ModTime().Before(resources[j].ModTime())
+	})
+	for _, info := range resources {
+		if cacheSize <= MaxCache*9/10 {
+			break
+		}
+		name := filepath.Join(CachePath, info.Name())
+		err = os.Remove(name)
+		if err != nil {
+			return err
+		}
+		os.Remove(name + ".type")
+		cacheSize -= sizes[info.Name()] + sizes[info.Name()+".type"]
+	}
+	return nil
+}
+
+// write atomically replaces the named file.
+func write(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Get returns the resource at s and its content type,
+// from the cache if possible. Only permitted image types
+// are returned.
+func Get(s string) ([]byte, string, error) {
+	return cached(s)
+}
+
+// Serve handles a request for a proxied resource. The
+// caller is responsible for authenticating the request.
+func Serve(w http.ResponseWriter, r *http.Request) {
+	s, err := parse(r.URL.Path)
+	if err != nil {
+		http.Error(w, "Invalid proxy URL.", 403)
+		return
+	}
+
+	data, typ, err := cached(s)
+	if err != nil {
+		fmt.Println("Failed to proxy", s)
+		fmt.Println(err)
+		http.Error(w, "Failed to fetch resource.", 502)
+		return
+	}
+
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Cache-Control", "private, max-age=604800")
+	_, err = w.Write(data)
+	if err != nil {
+		fmt.Println("Failed to send", s)
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setup(t *testing.T) *httptest.Server {
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	CachePath = filepath.Join(dir, "cache")
+	KeyPath = filepath.Join(dir, "proxy.key")
+	MaxSize = 1024
+	MaxCache = 1 << 20
+	cacheSize = -1
+
+	// The test server is local, so bypass the address check.
+	Client = http.DefaultClient
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("PNG DATA"))
+		case "/image.svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte("<svg><script>alert(1)</script></svg>"))
+		case "/large.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(make([]byte, 2048))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func get(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", path, nil)
+	Serve(w, r)
+	return w
+}
+
+func TestProxy(t *testing.T) {
+	remote := setup(t)
+	defer remote.Close()
+	defer os.RemoveAll(filepath.Dir(KeyPath))
+
+	w := get(URL(remote.URL + "/image.png"))
+	if w.Code != 200 || w.Body.String() != "PNG DATA" || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Failed to proxy image: %d %q.", w.Code, w.Body.String())
+	}
+
+	// Served from the cache once the remote has gone.
+	path := URL(remote.URL + "/image.png")
+	remote.Close()
+	w = get(path)
+	if w.Code != 200 || w.Body.String() != "PNG DATA" {
+		t.Errorf("Failed to serve cached image: %d %q.", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyLimits(t *testing.T) {
+	remote := setup(t)
+	defer remote.Close()
+	defer os.RemoveAll(filepath.Dir(KeyPath))
+
+	if w := get(URL(remote.URL + "/image.svg")); w.Code != 502 {
+		t.Errorf("Proxied forbidden content type: %d.", w.Code)
+	}
+	if w := get(URL(remote.URL + "/large.png")); w.Code != 502 {
+		t.Errorf("Proxied oversized image: %d.", w.Code)
+	}
+
+	// Tampered and unsigned URLs are rejected.
+	path := URL(remote.URL + "/image.png")
+	if w := get(strings.Replace(path, Prefix, Prefix+"x", 1)); w.Code != 403 {
+		t.Errorf("Accepted tampered signature: %d.", w.Code)
+	}
+	if w := get(Prefix + "sig/aHR0cDovL2V4YW1wbGUuY29tLw"); w.Code != 403 {
+		t.Errorf("Accepted unsigned URL: %d.", w.Code)
+	}
+}
+
+func TestProxyCacheLimit(t *testing.T) {
+	remote := setup(t)
+	defer remote.Close()
+	defer os.RemoveAll(filepath.Dir(KeyPath))
+
+	// Each image takes 8 bytes, and its type 9.
+	MaxCache = 40
+	name := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return filepath.Join(CachePath, hex.EncodeToString(sum[:]))
+	}
+	fetch := func(s string) {
+		if w := get(URL(s)); w.Code != 200 {
+			t.Fatalf("Failed to proxy image: %d.", w.Code)
+		}
+	}
+	var images []string
+	for i := 0; i < 3; i++ {
+		images = append(images, fmt.Sprintf("%s/image.png?%d", remote.URL, i))
+	}
+	for i, s := range images[:2] {
+		fetch(s)
+		then := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(name(s), then, then)
+	}
+
+	// Using the first image again keeps it, so the second
+	// is evicted when the third no longer fits.
+	fetch(images[0])
+	fetch(images[2])
+	for i, evicted := range []bool{false, true, false} {
+		_, err := os.Stat(name(images[i]))
+		if os.IsNotExist(err) != evicted {
+			t.Errorf("Image %d: expected evicted to be %v.", i, evicted)
+		}
+		_, err = os.Stat(name(images[i]) + ".type")
+		if os.IsNotExist(err) != evicted {
+			t.Errorf("Image %d: expected its type's eviction to be %v.", i, evicted)
+		}
+	}
+	if cacheSize > MaxCache {
+		t.Errorf("Expected the cache to hold at most %d bytes, got %d.", MaxCache, cacheSize)
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "proxy.key")
+	k, err := loadKey(name)
+	if err != nil || len(k) != 32 {
+		t.Fatalf("Expected a new key, got %d bytes, %v.", len(k), err)
+	}
+	if again, err := loadKey(name); err != nil || string(again) != string(k) {
+		t.Errorf("Expected the same key again, got %v.", err)
+	}
+
+	// A short key is refused, not replaced.
+	err = ioutil.WriteFile(name, []byte("short"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKey(name); err == nil {
+		t.Error("Expected a short key to be refused.")
+	}
+	if b, _ := ioutil.ReadFile(name); string(b) != "short" {
+		t.Errorf("Expected the short key to be left alone, got %q.", b)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	in := `<p><img src="http://example.com/a.png" alt="a"/><a href="http://example.com/">x</a></p>`
+	out := Rewrite(in)
+	if !strings.Contains(out, `src="`+URL("http://example.com/a.png")+`"`) {
+		t.Errorf("Failed to rewrite image: %q.", out)
+	}
+	if !strings.Contains(out, `href="http://example.com/"`) {
+		t.Errorf("Rewrote link: %q.", out)
+	}
+	if back := Restore(out); back != in {
+		t.Errorf("Failed to restore images: expected %q, got %q.", in, back)
+	}
+	forged := `<img src="` + Prefix + `sig/aHR0cDovL2V4YW1wbGUuY29tLw">`
+	if back := Restore(forged); back != forged {
+		t.Errorf("Restored unsigned URL: %q.", back)
+	}
+}
@@ -5,15 +5,29 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"rs3/auth"
 	"rs3/database"
+	"rs3/mail"
+	"rs3/oidc"
+	"rs3/privacy"
+	"rs3/proxy"
 	"rs3/server"
+	"time"
 )
 
 type Config struct {
-	Domain     string
-	CertPath   string
-	KeyPath    string
-	BackupPath string
+	Domain      string
+	CertPath    string
+	KeyPath     string
+	BackupPath  string
+	PrivacyPath string // Optional JSON file of privacy rules.
+	ProxyPath   string // Optional directory for the image proxy cache.
+	SecretPath  string // Optional file holding the key which encrypts TOTP secrets.
+	OIDCPath    string // Optional JSON file configuring single sign-on.
+	AuthPath    string // Optional JSON file configuring authentication backends.
+	CertsPath   string // Optional JSON file configuring client certificates.
+	MailPath    string // Optional JSON file configuring outgoing mail.
+	Register    string // Optional: "open" or "invite" to let users register.
 }
 
 func (c *Config) ListenAndServe() error {
@@ -25,6 +39,75 @@ func (c *Config) ListenAndServe() error {
 		return errors.New("Error: key path not given.")
 	}
 
+	if c.PrivacyPath != "" {
+		rules, err := privacy.Load(c.PrivacyPath)
+		if err != nil {
+			return err
+		}
+		privacy.Default = rules
+	}
+
+	if c.ProxyPath != "" {
+		proxy.CachePath = c.ProxyPath
+	}
+	err := proxy.LoadKey()
+	if err != nil {
+		return err
+	}
+
+	if c.OIDCPath != "" {
+		p, err := oidc.Load(c.OIDCPath)
+		if err != nil {
+			return err
+		}
+		oidc.Default = p
+	}
+
+	if c.AuthPath != "" {
+		chain, err := auth.Load(c.AuthPath)
+		if err != nil {
+			return err
+		}
+		auth.Default = chain
+	}
+
+	var certs *auth.Certificates
+	if c.CertsPath != "" {
+		var err error
+		certs, err = auth.LoadCertificates(c.CertsPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.MailPath != "" {
+		sender, err := mail.Load(c.MailPath)
+		if err != nil {
+			return err
+		}
+		mail.Default = sender
+	}
+
+	switch c.Register {
+	case server.RegistrationOff:
+	case server.RegistrationOpen, server.RegistrationInvite:
+		if mail.Default == nil {
+			return errors.New("Error: registration needs mail to be configured.")
+		}
+		server.Registration = c.Register
+		server.Origin = "https://" + c.Domain
+	default:
+		return fmt.Errorf("Error: unknown registration mode %q.", c.Register)
+	}
+
+	if c.SecretPath != "" {
+		database.SecretKeyPath = c.SecretPath
+	}
+	err = database.LoadSecretKey()
+	if err != nil {
+		return err
+	}
+
 	if c.BackupPath != "" {
 		_, err := os.Stat(c.BackupPath)
 		if err == nil {
@@ -46,8 +129,12 @@ func (c *Config) ListenAndServe() error {
 		}
 	}()
 
+	go database.ExpireSessions(time.Hour)
 	go server.ServeHTTP(c.Domain)
 	go server.ServeHTTPS(c.Domain, c.CertPath, c.KeyPath)
+	if certs != nil {
+		go server.ServeMTLS(c.CertPath, c.KeyPath, certs)
+	}
 	fmt.Println("Serving " + c.Domain)
 	database.Console()
 	return nil
@@ -0,0 +1,311 @@
+package sanitise
+
+import (
+	"bytes"
+	"golang.org/x/net/html"
+	"net/url"
+	"strings"
+)
+
+// elements lists the elements which may appear in sanitised
+// content, along with the attributes each may carry.
+var elements = map[string][]string{
+	"a":          {"href", "title"},
+	"abbr":       {"title"},
+	"audio":      {"src", "controls"},
+	"b":          nil,
+	"blockquote": {"cite"},
+	"br":         nil,
+	"caption":    nil,
+	"cite":       nil,
+	"code":       nil,
+	"dd":         nil,
+	"del":        {"cite", "datetime"},
+	"details":    nil,
+	"dfn":        nil,
+	"div":        nil,
+	"dl":         nil,
+	"dt":         nil,
+	"em":         nil,
+	"figcaption": nil,
+	"figure":     nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"hr":         nil,
+	"i":          nil,
+	"img":        {"src", "alt", "title", "width", "height"},
+	"ins":        {"cite", "datetime"},
+	"kbd":        nil,
+	"li":         nil,
+	"mark":       nil,
+	"ol":         {"start"},
+	"p":          nil,
+	"pre":        nil,
+	"q":          {"cite"},
+	"s":          nil,
+	"samp":       nil,
+	"small":      nil,
+	"source":     {"src", "type"},
+	"span":       nil,
+	"strike":     nil,
+	"strong":     nil,
+	"sub":        nil,
+	"summary":    nil,
+	"sup":        nil,
+	"table":      nil,
+	"tbody":      nil,
+	"td":         {"colspan", "rowspan", "align"},
+	"tfoot":      nil,
+	"th":         {"colspan", "rowspan", "align"},
+	"thead":      nil,
+	"time":       {"datetime"},
+	"tr":         nil,
+	"u":          nil,
+	"ul":         nil,
+	"video":      {"src", "controls", "poster", "width", "height"},
+}
+
+// globals lists the attributes permitted on any allowed element.
+var globals = []string{"lang", "dir"}
+
+// dropped lists the elements which are removed along with
+// everything inside them. Any other element not in elements
+// is removed, but its content is kept.
+var dropped = map[string]bool{
+	"applet":   true,
+	"base":     true,
+	"embed":    true,
+	"form":     true,
+	"frame":    true,
+	"frameset": true,
+	"head":     true,
+	"iframe":   true,
+	"link":     true,
+	"math":     true,
+	"meta":     true,
+	"noembed":  true,
+	"noframes": true,
+	"noscript": true,
+	"object":   true,
+	"script":   true,
+	"select":   true,
+	"style":    true,
+	"svg":      true,
+	"template": true,
+	"textarea": true,
+	"title":    true,
+	"xmp":      true,
+}
+
+// void lists the elements which have no closing tag.
+var void = map[string]bool{
+	"base":   true,
+	"br":     true,
+	"embed":  true,
+	"frame":  true,
+	"hr":     true,
+	"img":    true,
+	"link":   true,
+	"meta":   true,
+	"source": true,
+}
+
+// urls lists the attributes whose values are URLs.
+var urls = map[string]bool{
+	"cite":   true,
+	"href":   true,
+	"poster": true,
+	"src":    true,
+}
+
+// HTML returns a sanitised copy of the given HTML fragment.
+// Only allowlisted elements and attributes are kept, event
+// handlers and unsafe URLs are removed, and relative URLs
+// are resolved against base, which may be nil.
+func HTML(s string, base *url.URL) string {
+	buf := new(bytes.Buffer)
+	z := html.NewTokenizer(strings.NewReader(s))
+	open := make([]string, 0, 10)
+	skip := ""
+	depth := 0
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		t := z.Token()
+
+		// Skip the contents of dropped elements.
+		if skip != "" {
+			switch {
+			case tt == html.StartTagToken && t.Data == skip:
+				depth++
+			case tt == html.EndTagToken && t.Data == skip:
+				depth--
+				if depth == 0 {
+					skip = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			buf.WriteString(html.EscapeString(t.Data))
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if dropped[t.Data] {
+				if tt == html.StartTagToken && !void[t.Data] {
+					skip = t.Data
+					depth = 1
+				}
+				continue
+			}
+			allowed, ok := elements[t.Data]
+			if !ok {
+				continue
+			}
+			t.Attr = attributes(t.Attr, allowed, base)
+			if t.Data == "a" {
+				t.Attr = append(t.Attr, html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+			}
+			if void[t.Data] {
+				t.Type = html.SelfClosingTagToken
+			} else {
+				t.Type = html.StartTagToken
+				open = append(open, t.Data)
+			}
+			buf.WriteString(t.String())
+
+		case html.EndTagToken:
+			if _, ok := elements[t.Data]; !ok || void[t.Data] {
+				continue
+			}
+
+			// Close everything opened since the matching
+			// start tag, ignoring stray end tags.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != t.Data {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					buf.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+
+	// Close any elements left open.
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString("</" + open[i] + ">")
+	}
+
+	return buf.String()
+}
+
+// Text returns the text content of the given HTML fragment,
+// with all markup removed. The result is not escaped.
+func Text(s string) string {
+	buf := new(bytes.Buffer)
+	z := html.NewTokenizer(strings.NewReader(s))
+	skip := ""
+	depth := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		t := z.Token()
+		switch {
+		case skip != "":
+			if tt == html.StartTagToken && t.Data == skip {
+				depth++
+			} else if tt == html.EndTagToken && t.Data == skip {
+				depth--
+				if depth == 0 {
+					skip = ""
+				}
+			}
+		case tt == html.StartTagToken && dropped[t.Data] && !void[t.Data]:
+			skip = t.Data
+			depth = 1
+		case tt == html.TextToken:
+			buf.WriteString(t.Data)
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// attributes filters attr down to those in allowed or
+// globals, checking and resolving any URLs.
+func attributes(attr []html.Attribute, allowed []string, base *url.URL) []html.Attribute {
+	out := make([]html.Attribute, 0, len(attr))
+	seen := make(map[string]bool)
+	for _, a := range attr {
+		key := strings.ToLower(a.Key)
+		if a.Namespace != "" || seen[key] || !(contains(allowed, key) || contains(globals, key)) {
+			continue
+		}
+		if urls[key] {
+			u, ok := URL(a.Val, base)
+			if !ok || (key != "href" && u.Scheme == "mailto") {
+				continue
+			}
+			a.Val = u.String()
+		}
+		seen[key] = true
+		out = append(out, html.Attribute{Key: key, Val: a.Val})
+	}
+	return out
+}
+
+// URL parses and checks a URL taken from feed content,
+// resolving it against base if it is relative. Only http,
+// https and mailto URLs are accepted.
+func URL(s string, base *url.URL) (*url.URL, bool) {
+
+	// Browsers ignore surrounding whitespace and control
+	// characters, and tabs and newlines anywhere.
+	s = strings.TrimFunc(s, func(r rune) bool {
+		return r <= ' '
+	})
+	s = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, s)
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, false
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "mailto":
+		return u, true
+	case "":
+		// Relative URL with no base to resolve against.
+		return u, u.Opaque == ""
+	}
+	return nil, false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
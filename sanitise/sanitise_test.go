@@ -0,0 +1,144 @@
+package sanitise
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var base, _ = url.Parse("http://example.com/blog/post.html")
+
+// vectors is a corpus of known XSS vectors. None of the
+// sanitised output may contain any of the forbidden strings.
+var vectors = []string{
+	`<script>alert(1)</script>`,
+	`<SCRIPT SRC=http://evil.example/xss.js></SCRIPT>`,
+	`<scr<script>ipt>alert(1)</script>`,
+	`<img src=x onerror=alert(1)>`,
+	`<img src="x" ONERROR="alert(1)">`,
+	`<img src=x onerror="alert(1)"/>`,
+	`<img """><script>alert(1)</script>">`,
+	`<img src="javascript:alert(1)">`,
+	`<img src=JaVaScRiPt:alert(1)>`,
+	`<img src="jav	ascript:alert(1);">`,
+	`<img src="jav&#x09;ascript:alert(1);">`,
+	`<img src="&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;alert(1)">`,
+	`<img src=" &#14;  javascript:alert(1);">`,
+	`<a href="javascript:alert(1)">click</a>`,
+	`<a href="  javascript:alert(1)">click</a>`,
+	`<a href="java&#x0A;script:alert(1)">click</a>`,
+	`<a href="vbscript:msgbox(1)">click</a>`,
+	`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">click</a>`,
+	`<a href="#" onclick="alert(1)">click</a>`,
+	`<a href="#" onmouseover=alert(1)>hover</a>`,
+	`<body onload=alert(1)>`,
+	`<svg onload=alert(1)>`,
+	`<svg><script>alert(1)</script></svg>`,
+	`<math><mtext><script>alert(1)</script></mtext></math>`,
+	`<iframe src="javascript:alert(1)"></iframe>`,
+	`<iframe srcdoc="<script>alert(1)</script>"></iframe>`,
+	`<object data="javascript:alert(1)"></object>`,
+	`<embed src="javascript:alert(1)">`,
+	`<form action="javascript:alert(1)"><button>go</button></form>`,
+	`<input onfocus=alert(1) autofocus>`,
+	`<details open ontoggle=alert(1)>`,
+	`<video><source onerror="alert(1)"></video>`,
+	`<video poster=javascript:alert(1)></video>`,
+	`<div style="background:url(javascript:alert(1))">x</div>`,
+	`<div style="width: expression(alert(1))">x</div>`,
+	`<style>body{background:url("javascript:alert(1)")}</style>`,
+	`<link rel="stylesheet" href="javascript:alert(1)">`,
+	`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+	`<base href="javascript:alert(1)//">`,
+	`<table background="javascript:alert(1)"></table>`,
+	`<p>unclosed <b>tags</p></li></ul><script>alert(1)</script>`,
+	`<!--<script>alert(1)</script>-->`,
+	`<noscript><p title="</noscript><img src=x onerror=alert(1)>">`,
+	`<textarea><script>alert(1)</script></textarea>`,
+	`<title><script>alert(1)</script></title>`,
+	`<a href="http://example.com/" target="_blank" rel="opener">ok</a>`,
+	`<img src="x` + "`" + `onerror=alert(1)` + "`" + `>`,
+	`"><script>alert(1)</script>`,
+	`</p></div></li><script>alert(1)</script>`,
+}
+
+var forbidden = []string{
+	"<script",
+	"javascript:",
+	"vbscript:",
+	"data:",
+	"onerror",
+	"onload",
+	"onclick",
+	"onmouseover",
+	"onfocus",
+	"ontoggle",
+	"<iframe",
+	"<object",
+	"<embed",
+	"<svg",
+	"<math",
+	"<form",
+	"<input",
+	"<style",
+	"<link",
+	"<meta",
+	"<base",
+	"style=",
+	"target=",
+	`rel="opener`,
+	"srcdoc",
+	"background",
+	"<body",
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		out := strings.ToLower(HTML(v, base))
+		for _, f := range forbidden {
+			if strings.Contains(out, f) {
+				t.Errorf("Sanitising %q produced %q, which contains %q.", v, out, f)
+			}
+		}
+	}
+}
+
+func TestBalanced(t *testing.T) {
+	in := `</li></ul><p>a <b>b</p><i>c`
+	out := HTML(in, base)
+	if out != `<p>a <b>b</b></p><i>c</i>` {
+		t.Errorf("Failed to balance tags: got %q.", out)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	in := `<p lang="en">Hello <a href="http://example.com/a" title="t">world</a><br/><img src="https://example.com/i.png" alt="i"></p>`
+	out := HTML(in, base)
+	want := `<p lang="en">Hello <a href="http://example.com/a" title="t" rel="noopener noreferrer">world</a><br/><img src="https://example.com/i.png" alt="i"/></p>`
+	if out != want {
+		t.Errorf("Failed to keep allowed content:\n\tgot  %q\n\twant %q", out, want)
+	}
+}
+
+func TestRelative(t *testing.T) {
+	tests := map[string]string{
+		`<a href="other.html">x</a>`:            `<a href="http://example.com/blog/other.html" rel="noopener noreferrer">x</a>`,
+		`<a href="/about">x</a>`:                `<a href="http://example.com/about" rel="noopener noreferrer">x</a>`,
+		`<img src="../img/a.png">`:              `<img src="http://example.com/img/a.png"/>`,
+		`<img src="//cdn.example.net/a.png">`:   `<img src="http://cdn.example.net/a.png"/>`,
+		`<a href="mailto:me@example.com">x</a>`: `<a href="mailto:me@example.com" rel="noopener noreferrer">x</a>`,
+		`<img src="mailto:me@example.com">`:     `<img/>`,
+	}
+	for in, want := range tests {
+		if out := HTML(in, base); out != want {
+			t.Errorf("Failed to resolve %q:\n\tgot  %q\n\twant %q", in, out, want)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	in := `Tom &amp; Jerry <script>alert(1)</script><b>return</b>`
+	if out := Text(in); out != "Tom & Jerry return" {
+		t.Errorf("Failed to extract text: got %q.", out)
+	}
+}
@@ -0,0 +1,178 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"strings"
+)
+
+// Password hashing algorithms.
+const (
+	Argon2id = "argon2id"
+	Scrypt   = "scrypt"
+)
+
+// Argon2Params are the costs of an argon2id hash.
+type Argon2Params struct {
+	Memory  uint32 // In KiB.
+	Time    uint32
+	Threads uint8
+	KeyLen  uint32
+}
+
+// ScryptParams are the costs of an scrypt hash.
+type ScryptParams struct {
+	LogN   uint8 // N is 2^LogN.
+	R      int
+	P      int
+	KeyLen int
+}
+
+// The algorithm and costs with which new passwords are
+// hashed. Hashes made with others still verify, but
+// CheckPassword reports that they should be replaced.
+var (
+	Algorithm  = Argon2id
+	Argon2Cost = Argon2Params{Memory: 64 * 1024, Time: 3, Threads: 2, KeyLen: 32}
+	ScryptCost = ScryptParams{LogN: 15, R: 8, P: 1, KeyLen: 32}
+)
+
+// MaxHashing is how many passwords may be hashed at once.
+// Each argon2id hash uses Argon2Cost.Memory, so this bounds
+// the memory a burst of logins can take. Others wait their
+// turn.
+const MaxHashing = 4
+
+var hashing = make(chan struct{}, MaxHashing)
+
+// passwordSaltLen is the length of the random salt in
+// each password hash.
+const passwordSaltLen = 16
+
+var b64 = base64.RawStdEncoding
+
+var errInvalidHash = errors.New("Error: invalid password hash.")
+
+// HashPassword hashes the password with the current
+// algorithm and costs. The result records both, along with
+// a random salt, in the PHC string format, such as:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return "", err
+	}
+	hashing <- struct{}{}
+	defer func() { <-hashing }()
+	switch Algorithm {
+	case Argon2id:
+		p := Argon2Cost
+		key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version, p.Memory, p.Time, p.Threads,
+			b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case Scrypt:
+		p := ScryptCost
+		key, err := scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, p.KeyLen)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$%s$ln=%d,r=%d,p=%d$%s$%s", Scrypt, p.LogN, p.R, p.P,
+			b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	}
+	return "", fmt.Errorf("Error: unknown password hashing algorithm %q.", Algorithm)
+}
+
+// CheckPassword returns whether the password matches the
+// hash made by HashPassword, taking the same time whatever
+// it is compared against. If it matches but the hash was
+// not made with the current algorithm and costs, rehash
+// is true, and the password should be hashed again.
+func CheckPassword(password, hash string) (ok, rehash bool, err error) {
+	hashing <- struct{}{}
+	defer func() { <-hashing }()
+	fields := strings.Split(hash, "$")
+	if len(fields) < 2 || fields[0] != "" {
+		return false, false, errInvalidHash
+	}
+	var key, salt, want []byte
+	switch fields[1] {
+	case Argon2id:
+		if len(fields) != 6 {
+			return false, false, errInvalidHash
+		}
+		var version int
+		var p Argon2Params
+		_, err = fmt.Sscanf(fields[2], "v=%d", &version)
+		if err != nil || version != argon2.Version {
+			return false, false, errInvalidHash
+		}
+		_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+		if err != nil || p.Time == 0 || p.Threads == 0 {
+			return false, false, errInvalidHash
+		}
+		salt, want, err = decodeKey(fields[4], fields[5])
+		if err != nil {
+			return false, false, err
+		}
+		p.KeyLen = uint32(len(want))
+		key = argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+		rehash = Algorithm != Argon2id || p != Argon2Cost
+	case Scrypt:
+		if len(fields) != 5 {
+			return false, false, errInvalidHash
+		}
+		var p ScryptParams
+		_, err = fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P)
+		if err != nil || p.LogN == 0 || p.LogN > 30 {
+			return false, false, errInvalidHash
+		}
+		salt, want, err = decodeKey(fields[3], fields[4])
+		if err != nil {
+			return false, false, err
+		}
+		p.KeyLen = len(want)
+		key, err = scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, p.KeyLen)
+		if err != nil {
+			return false, false, errInvalidHash
+		}
+		rehash = Algorithm != Scrypt || p != ScryptCost
+	default:
+		return false, false, fmt.Errorf("Error: unknown password hashing algorithm %q.", fields[1])
+	}
+	if subtle.ConstantTimeCompare(key, want) != 1 {
+		return false, false, nil
+	}
+	return true, rehash, nil
+}
+
+func decodeKey(salt, key string) ([]byte, []byte, error) {
+	s, err := b64.DecodeString(salt)
+	if err != nil {
+		return nil, nil, errInvalidHash
+	}
+	k, err := b64.DecodeString(key)
+	if err != nil || len(k) == 0 {
+		return nil, nil, errInvalidHash
+	}
+	return s, k, nil
+}
+
+// CheckLegacyPassword returns whether the password matches
+// a hash made by Hash, taking the same time whatever it is
+// compared against. Such hashes should be replaced with
+// ones made by HashPassword.
+func CheckLegacyPassword(password string, salt *Salt, hash []byte) (bool, error) {
+	h, err := Hash(password, salt)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(h, hash) == 1, nil
+}
@@ -0,0 +1,115 @@
+package security
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPassword(t *testing.T) {
+	for _, algorithm := range []string{Argon2id, Scrypt} {
+		Algorithm = algorithm
+		hash, err := HashPassword("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(hash, "$"+algorithm+"$") {
+			t.Errorf("Expected a %s hash, got %q.", algorithm, hash)
+		}
+		other, err := HashPassword("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other == hash {
+			t.Error("Expected hashes to be salted.")
+		}
+
+		ok, rehash, err := CheckPassword("correct horse", hash)
+		if err != nil || !ok || rehash {
+			t.Errorf("%s: expected the password to match, got %v, %v, %v.", algorithm, ok, rehash, err)
+		}
+		ok, _, err = CheckPassword("battery staple", hash)
+		if err != nil || ok {
+			t.Errorf("%s: expected the wrong password not to match.", algorithm)
+		}
+	}
+
+	// Hashes with other algorithms or costs still match,
+	// but should be replaced.
+	Algorithm = Scrypt
+	hash, _ := HashPassword("correct horse")
+	Algorithm = Argon2id
+	ok, rehash, err := CheckPassword("correct horse", hash)
+	if err != nil || !ok || !rehash {
+		t.Errorf("Expected an scrypt hash to need rehashing, got %v, %v, %v.", ok, rehash, err)
+	}
+	old := Argon2Cost
+	Argon2Cost.Time = 1
+	hash, _ = HashPassword("correct horse")
+	Argon2Cost = old
+	ok, rehash, err = CheckPassword("correct horse", hash)
+	if err != nil || !ok || !rehash {
+		t.Errorf("Expected a cheaper hash to need rehashing, got %v, %v, %v.", ok, rehash, err)
+	}
+
+	for _, bad := range []string{"", "plain", "$md5$abc", "$argon2id$v=19$m=65536,t=3,p=2$salt", "$scrypt$ln=x,r=8,p=1$c2FsdA$a2V5"} {
+		if _, _, err := CheckPassword("correct horse", bad); err == nil {
+			t.Errorf("Expected %q to be invalid.", bad)
+		}
+	}
+}
+
+func TestLegacyPassword(t *testing.T) {
+	salt := NewSalt()
+	hash, err := Hash("password", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := CheckLegacyPassword("password", salt, hash); err != nil || !ok {
+		t.Error("Expected the legacy password to match.")
+	}
+	if ok, _ := CheckLegacyPassword("wrong", salt, hash); ok {
+		t.Error("Expected the wrong password not to match.")
+	}
+}
+
+func BenchmarkHashPassword(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, err := HashPassword("password")
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestPasswordStrength(t *testing.T) {
+	for _, password := range []string{
+		"correct horse battery staple",
+		"Tr0ub4dor&3x",
+		"alice-and-the-walrus",
+		"ünïcødé pässwörd",
+	} {
+		if err := CheckPasswordStrength(password, "alice@example.com", "Alice"); err != nil {
+			t.Errorf("Expected %q to be strong enough, got %v.", password, err)
+		}
+	}
+	for _, password := range []string{
+		"short",
+		"aaaaaaaaaaaa",
+		"abababababab",
+		"1234567890",
+		"zyxwvutsrqpo",
+		"qwertyuiop",
+		"1qaz2wsx3edc",
+		"Password123!",
+		"P@ssw0rd2024",
+		"!!letmein!!",
+		"alice@example.com",
+		"Alice1234567",
+		strings.Repeat("long password ", 100),
+	} {
+		err := CheckPasswordStrength(password, "alice@example.com", "Alice")
+		if _, ok := err.(*WeakPassword); !ok {
+			t.Errorf("Expected %q to be refused, got %v.", password, err)
+		}
+	}
+}
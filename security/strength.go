@@ -0,0 +1,121 @@
+package security
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the length of new passwords, in characters.
+var (
+	MinPasswordLength = 10
+	MaxPasswordLength = 1024
+)
+
+// WeakPassword is the error given for a password which is
+// too easy to guess. Its Reason is meant for the user.
+type WeakPassword struct {
+	Reason string
+}
+
+func (err *WeakPassword) Error() string {
+	return "Error: weak password: " + err.Reason
+}
+
+// commonWords are the stems of the most common passwords,
+// which people make long enough by adding numbers and
+// symbols.
+var commonWords = []string{
+	"password", "passw0rd", "p@ssword", "p@ssw0rd", "qwerty", "qwertyuiop", "asdfgh", "zxcvbn", "letmein",
+	"welcome", "iloveyou", "admin", "administrator", "login", "dragon", "monkey", "football", "baseball",
+	"soccer", "hockey", "sunshine", "princess", "superman", "batman", "starwars", "trustno", "whatever",
+	"master", "shadow", "michael", "jennifer", "charlie", "computer", "internet", "changeme", "secret",
+	"freedom", "flower", "hello", "abc", "test", "default", "rs3",
+}
+
+// sequences are runs of characters which are easy to type.
+var sequences = []string{
+	"abcdefghijklmnopqrstuvwxyz",
+	"01234567890",
+	"qwertyuiopasdfghjklzxcvbnm",
+	"1q2w3e4r5t6y7u8i9o0p",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p",
+}
+
+// CheckPasswordStrength returns a *WeakPassword error if
+// the password is too short or too easy to guess. The
+// personal strings, such as the user's email address and
+// name, are things others may know about them, which the
+// password should not be made of.
+func CheckPasswordStrength(password string, personal ...string) error {
+	n := utf8.RuneCountInString(password)
+	if n < MinPasswordLength {
+		return &WeakPassword{"it must be at least " + strconv.Itoa(MinPasswordLength) + " characters long."}
+	}
+	if n > MaxPasswordLength {
+		return &WeakPassword{"it must be at most " + strconv.Itoa(MaxPasswordLength) + " characters long."}
+	}
+
+	lower := strings.ToLower(password)
+	distinct := make(map[rune]bool)
+	for _, r := range lower {
+		distinct[r] = true
+	}
+	if len(distinct) < 5 {
+		return &WeakPassword{"it repeats too few different characters."}
+	}
+	if sequence(lower) {
+		return &WeakPassword{"it is a simple sequence of characters."}
+	}
+
+	// Common passwords, with only numbers and symbols
+	// added.
+	stem := strings.TrimFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, w := range commonWords {
+		if stem == w {
+			return &WeakPassword{"it is too similar to a common password."}
+		}
+	}
+
+	// Passwords made mostly of the personal strings.
+	rest := lower
+	for _, p := range personal {
+		p = strings.ToLower(strings.TrimSpace(p))
+		parts := []string{p}
+		if i := strings.Index(p, "@"); i > 0 {
+			parts = append(parts, p[:i])
+		}
+		for _, part := range parts {
+			if utf8.RuneCountInString(part) >= 3 {
+				rest = strings.Replace(rest, part, "", -1)
+			}
+		}
+	}
+	if utf8.RuneCountInString(rest) < MinPasswordLength/2 || sequence(rest) {
+		return &WeakPassword{"it is too similar to your email address or name."}
+	}
+	return nil
+}
+
+// sequence returns whether s is part of one of the
+// sequences, forwards or backwards.
+func sequence(s string) bool {
+	for _, seq := range sequences {
+		if strings.Contains(seq, s) || strings.Contains(reverse(seq), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverse returns s backwards.
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
@@ -0,0 +1,104 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP codes, as described in RFC 6238, with the
+// parameters authenticator apps expect.
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30 // In seconds.
+	TOTPSkew   = 1  // Steps either side of now which are accepted.
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random TOTP secret, in the
+// base32 form in which users enter it.
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(b), nil
+}
+
+// TOTPStep returns the time step of t.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// TOTP returns the code for the secret at the time step.
+func TOTP(secret string, step int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(strings.Replace(secret, " ", "", -1)))
+	if err != nil {
+		return "", errors.New("Error: invalid TOTP secret.")
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, n%mod), nil
+}
+
+// CheckTOTP returns the time step at which the code is
+// valid for the secret, if it is within TOTPSkew steps of
+// t and after the step last, so that each code is used
+// only once.
+func CheckTOTP(secret, code string, t time.Time, last int64) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	now := TOTPStep(t)
+	var step int64
+	found := 0
+	for s := now - TOTPSkew; s <= now+TOTPSkew; s++ {
+		want, err := TOTP(secret, s)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 && s > last {
+			step = s
+			found = 1
+		}
+	}
+	return step, found == 1
+}
+
+// TOTPURI returns the otpauth URI with which authenticator
+// apps are given the secret, usually by QR code.
+func TOTPURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	v.Set("period", fmt.Sprint(TOTPPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,76 @@
+package security
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors from RFC 6238, truncated to six
+// digits.
+var totpTests = []struct {
+	Unix int64
+	Code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTP(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	for _, test := range totpTests {
+		code, err := TOTP(secret, TOTPStep(time.Unix(test.Unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.Code {
+			t.Errorf("At %d, expected %s, got %s.", test.Unix, test.Code, code)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	step, ok := CheckTOTP(secret, "005924", now, 0)
+	if !ok || step != TOTPStep(now) {
+		t.Errorf("Expected the code to be valid, got %d, %v.", step, ok)
+	}
+	if _, ok := CheckTOTP(secret, "005924", now.Add(TOTPPeriod*time.Second), 0); !ok {
+		t.Error("Expected the previous step's code to be valid.")
+	}
+	if _, ok := CheckTOTP(secret, "005924", now.Add(3*TOTPPeriod*time.Second), 0); ok {
+		t.Error("Expected an old code to be invalid.")
+	}
+	if _, ok := CheckTOTP(secret, "005924", now, step); ok {
+		t.Error("Expected a used code to be invalid.")
+	}
+	if _, ok := CheckTOTP(secret, "000000", now, 0); ok {
+		t.Error("Expected the wrong code to be invalid.")
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil || len(secret) != 32 {
+		t.Errorf("Expected a 32-letter secret, got %q, %v.", secret, err)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	ciphertext, err := Encrypt(key, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := Decrypt(key, ciphertext)
+	if err != nil || string(plaintext) != "secret" {
+		t.Errorf("Expected %q, got %q, %v.", "secret", plaintext, err)
+	}
+	other := bytes.Repeat([]byte{8}, 32)
+	if _, err := Decrypt(other, ciphertext); err == nil {
+		t.Error("Expected decryption with the wrong key to fail.")
+	}
+	if _, err := Encrypt(key[:16], []byte("secret")); err == nil {
+		t.Error("Expected a short key to be refused.")
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"rs3/auth"
+	"rs3/database"
+	"time"
+)
+
+// authenticate checks the request's uid and auth cookies,
+// returning the user's uid and session. If the cookie has
+// been replaced, the new one is sent to the client, with
+// the session's new expiry.
+//
+// Requests from a trusted proxy which names the user are
+// given a session for that user, if they have none.
+func authenticate(w http.ResponseWriter, r *http.Request) ([]byte, *database.Session, bool) {
+	uid, session, ok := authenticateCookies(w, r)
+	account, err := auth.Default.AuthenticateRequest(r)
+	if err != nil {
+		fmt.Println("Failed to authenticate request:")
+		fmt.Println(err)
+		return nil, nil, false
+	}
+	if account == nil {
+		return uid, session, ok
+	}
+	proxied, err := auth.Provision(account)
+	if err != nil {
+		fmt.Println("Failed to authenticate request:")
+		fmt.Println(err)
+		return nil, nil, false
+	}
+	if ok && bytes.Equal(uid, proxied) {
+		return uid, session, ok
+	}
+
+	session, cookie, err := database.NewSession(proxied, r.UserAgent(), clientIP(r))
+	if err != nil {
+		fmt.Println("Failed to create session:")
+		fmt.Println(err)
+		return nil, nil, false
+	}
+	setSessionCookies(w, database.UidToString(proxied), cookie, session.Expires())
+	return proxied, session, true
+}
+
+// authenticateCookies checks the uid and auth cookies, as
+// described for authenticate.
+func authenticateCookies(w http.ResponseWriter, r *http.Request) ([]byte, *database.Session, bool) {
+	uid, err := r.Cookie("uid")
+	if err != nil {
+		return nil, nil, false
+	}
+	uidBytes, err := database.StringToUid(uid.Value)
+	if err != nil {
+		fmt.Println("failed to parse cookie")
+		return nil, nil, false
+	}
+	auth, err := r.Cookie("auth")
+	if err != nil {
+		fmt.Println("no auth cookie")
+		return nil, nil, false
+	}
+
+	session, cookie, err := database.CheckSession(uidBytes, auth.Value, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return nil, nil, false
+	}
+
+	if cookie != auth.Value {
+		setSessionCookies(w, uid.Value, cookie, session.Expires())
+	}
+
+	return uidBytes, session, true
+}
+
+// setSessionCookies sends the uid and auth cookies which
+// identify the user's session, until expiry.
+func setSessionCookies(w http.ResponseWriter, uid, cookie string, expiry time.Time) {
+	expires := expiry.UTC().Format(http.TimeFormat)
+	w.Header().Add("Set-Cookie", fmt.Sprintf("uid=%q; Path=/; Expires=%s; Secure; HttpOnly; SameSite=Lax", uid, expires))
+	w.Header().Add("Set-Cookie", fmt.Sprintf("auth=%q; Path=/; Expires=%s; Secure; HttpOnly; SameSite=Lax", cookie, expires))
+}
+
+// clearSessionCookies tells the browser to forget the uid
+// and auth cookies.
+func clearSessionCookies(w http.ResponseWriter) {
+	expires := time.Unix(0, 0).UTC().Format(http.TimeFormat)
+	for _, name := range []string{"uid", "auth"} {
+		w.Header().Add("Set-Cookie", fmt.Sprintf("%s=\"\"; Path=/; Max-Age=0; Expires=%s; Secure; HttpOnly; SameSite=Lax",
+			name, expires))
+	}
+}
+
+// clientIP returns the address the request came from.
+func clientIP(r *http.Request) string {
+	return auth.ClientIP(r)
+}
+
+// csrfToken returns the token which forms must carry to
+// show they were served to the session. It outlives the
+// session's cookie, which is replaced from time to time.
+func csrfToken(session *database.Session) string {
+	sum := sha256.Sum256([]byte("csrf:" + session.CSRF))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkCSRF returns whether the submitted form carries
+// the token for the given session.
+func checkCSRF(r *http.Request, session *database.Session) bool {
+	token := r.FormValue("csrf")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken(session))) == 1
+}
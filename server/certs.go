@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"rs3/api"
+	"rs3/auth"
+	"strings"
+)
+
+// CertificateNexus serves clients with client certificates,
+// such as scripts and administrators' tools. It serves only
+// the API, as the user a certificate acts as, and the admin
+// endpoints, to certificates with the admin role.
+type CertificateNexus struct {
+	Certificates *auth.Certificates
+}
+
+func (n CertificateNexus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+
+	u, err := n.Certificates.Identify(r)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Unknown client certificate.", 403)
+		return
+	}
+
+	switch {
+	case r.URL.Path == api.Prefix, strings.HasPrefix(r.URL.Path, api.Prefix+"/"):
+		// Certificates which act as no one may still use
+		// the API with a token.
+		if u.Uid == nil {
+			api.Serve(w, r)
+		} else {
+			api.ServeAs(w, r, u.Uid, u.Scope)
+		}
+
+	case r.URL.Path == api.AdminPrefix, strings.HasPrefix(r.URL.Path, api.AdminPrefix+"/"):
+		if !u.Admin {
+			http.Error(w, "This certificate may not use the admin endpoints.", 403)
+			return
+		}
+		fmt.Printf("Admin request by %q: %s %s\n", u.Subject, r.Method, r.URL.Path)
+		api.ServeAdmin(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ServeMTLS listens for clients with certificates, on the
+// address given by c.
+func ServeMTLS(cert, key string, c *auth.Certificates) {
+	s := &http.Server{
+		Addr:      c.Address,
+		Handler:   CertificateNexus{c},
+		TLSConfig: c.TLSConfig(),
+	}
+	err := s.ListenAndServeTLS(cert, key)
+	if err != nil {
+		log.Panic(err)
+	}
+}
@@ -1,37 +1,66 @@
+var escapeHTML = function escapeHTML(s) {
+	return $('<div/>').text(s).html().replace(/"/g, '&quot;');
+}
+
 var refresh = function refresh() {
-	$(".invis").on('activate', function() {
+	$(".invis").off('activate').on('activate', function() {
 		var id = $("li.active").attr('id').substring(5);
 	  $('#' + id).addClass('read');
-		var item = data[currentFeed][parseInt(id, 10)];
-		if (!item.Read) {
+		var item = items[parseInt(id, 10)];
+		if (item && !item.Read) {
 			item.Read = true;
+			$.post('/items/read', {item: item.Key, csrf: csrf}, setCounts, 'json');
 			--unread;
-			if (unread == 0) $('#unread').html(unread).removeClass('unread').addClass('unread_zero');
-			else $('#unread').html(unread);
+			showUnread();
 		}
 	});
+	$('#main_body').scrollspy('refresh');
 }
 
-var data = %s;
-var currentFeed = %q;
-var unread = %d;
-$('.feed').click(function() {
-	var feed = $(this)[0].innerText.replace(/\s\s*$/, '');
-	currentFeed = feed;
+// showUnread updates the navbar's unread counter.
+var showUnread = function showUnread() {
+	if (unread == 0) $('#unread').html(unread).removeClass('unread').addClass('unread_zero');
+	else $('#unread').html(unread).removeClass('unread_zero').addClass('unread');
+}
+
+// setCounts updates the unread counters from the server.
+var setCounts = function setCounts(counts) {
+	unread = counts.Unread;
+	showUnread();
+	var feeds = counts.Feeds || {};
+	$('.feed').each(function() {
+		var n = feeds[$(this).attr('data-url')] || 0;
+		$(this).find('.feed-unread').html(n ? n.toString() : '');
+	});
+}
+
+// render appends a page of items to the list.
+var render = function render(page) {
 	var out = [];
 	var invis = [];
-	var len = data[feed].length;
-	for (var i = 0; i < len; ++i) {
-		var item = data[feed][i]
-		if (item['Read']) continue;
-		out.push('<li><div class="item"><h3>')
-		out.push(item['Title'])
+	for (var k = 0; k < page.length; ++k) {
+		var item = page[k];
+		var i = items.length;
+		items.push(item);
+		out.push('<li><div class="item')
+		if (item['Highlight']) out.push(' highlight')
+		if (item['Read']) out.push(' read')
+		out.push('" id="')
+		out.push(i.toString())
+		out.push('"><h3>')
+		out.push(escapeHTML(item['Title']))
 		out.push('</h3><p>')
 		out.push(item['Content'])
 		out.push('</p><p class="text-right"><small>')
-		out.push(item['Source'])
+		if (item['When']) out.push(escapeHTML(item['When']) + ' &middot; ')
+		out.push(escapeHTML(item['Feed']))
+		var sources = item['Sources'] || [];
+		for (var j = 0; j < sources.length; ++j) {
+			out.push(' &middot; <a href="' + escapeHTML(sources[j]['Link']) + '" rel="noopener noreferrer">')
+			out.push(escapeHTML(sources[j]['Feed']) + '</a>')
+		}
 		out.push('</small></p></div></li>')
-		
+
 		invis.push('<li id="node_');
 		invis.push(i.toString());
 		invis.push('"><a href="#');
@@ -40,14 +69,133 @@ $('.feed').click(function() {
 		invis.push(i.toString());
 		invis.push('</a></li>');
 	}
-	$('#items').html(out.join(''));
-	$('#invisinsert').html(invis.join(''));
+	$('#items').append(out.join(''));
+	$('#invisinsert').append(invis.join(''));
+	refresh();
+}
+
+// load fetches the next page of the current view.
+var load = function load() {
+	if (loading || next === null) return;
+	loading = true;
+	var query = {cursor: next};
+	if (currentFolder) query.folder = currentFolder;
+	else query.subscription = currentFeed;
+	$.getJSON('/items', query, function(page) {
+		next = page.Next || null;
+		showSort(page.Sort);
+		render(page.Items || []);
+	}).always(function() {
+		loading = false;
+	});
+}
+
+// showSort marks the current view's sort order.
+var showSort = function showSort(order) {
+	$('#sort .btn').removeClass('btn-info');
+	$('#sort .btn[data-sort=' + order + ']').addClass('btn-info');
+}
+
+// show switches to a new view and loads its first page.
+var show = function show(elem, feed, folder) {
+	currentView = elem;
+	currentFeed = feed;
+	currentFolder = folder;
+	items = [];
+	next = '';
+	$('#items').html('');
+	$('#invisinsert').html('');
 	$('.active').removeClass('active')
-	$(this).addClass('active')
-	$('.item').each(function () {
-	  $(this).scrollspy('refresh')
+	$(elem).addClass('active')
+	$('#main_body').scrollTop(0);
+	load();
+}
+
+var csrf = $('meta[name=csrf]').attr('content');
+var first = %s;
+var currentFeed = %s;
+var currentFolder = '';
+var unread = %d;
+var currentView = $('.feed.active')[0];
+var items = first.Items || [];
+var next = first.Next || null;
+var loading = false;
+var undoToken = '';
+var undoTimer = null;
+
+$('.feed').click(function() {
+	show(this, $(this).attr('data-url'), '');
+});
+$('.folder').click(function() {
+	show(this, '', $(this).attr('data-folder'));
+});
+$('.all').click(function() {
+	show(this, '', '');
+});
+$('#sort .btn').click(function() {
+	var order = $(this).attr('data-sort');
+	$.post('/items/sort', {subscription: currentFeed, sort: order, csrf: csrf}, function() {
+		show(currentView, currentFeed, currentFolder);
 	});
-	$('#items').scrollTop(0);
-	refresh();
 });
-refresh();
\ No newline at end of file
+$('#markread .btn').click(function() {
+	var query = {older: $(this).attr('data-older'), csrf: csrf};
+	if (currentFolder) query.folder = currentFolder;
+	else query.subscription = currentFeed;
+	$.post('/items/read-all', query, function(res) {
+		setCounts(res);
+		show(currentView, currentFeed, currentFolder);
+		undoToken = res.Token;
+		$('#undo-text').text('Marked ' + res.Marked + ' items as read.');
+		$('#undo').show();
+		clearTimeout(undoTimer);
+		undoTimer = setTimeout(function() {
+			$('#undo').hide();
+		}, res.Undo * 1000);
+	}, 'json');
+});
+$('#undo-link').click(function(e) {
+	e.preventDefault();
+	$('#undo').hide();
+	$.post('/items/undo', {token: undoToken, csrf: csrf}, function(counts) {
+		setCounts(counts);
+		show(currentView, currentFeed, currentFolder);
+	}, 'json');
+});
+$('#newitems-link').click(function(e) {
+	e.preventDefault();
+	$('#newitems').hide();
+	show(currentView, currentFeed, currentFolder);
+});
+showSort(first.Sort);
+
+// Live updates from the server, including changes made
+// on other devices.
+if (window.EventSource) {
+	var source = new EventSource('/events');
+	source.addEventListener('unread', function(e) {
+		setCounts(JSON.parse(e.data));
+	});
+	source.addEventListener('read', function(e) {
+		var change = JSON.parse(e.data);
+		var keys = {};
+		for (var k = 0; k < change.Keys.length; ++k) keys[change.Keys[k]] = true;
+		for (var i = 0; i < items.length; ++i) {
+			if (keys[items[i].Key]) {
+				items[i].Read = change.Read;
+				if (change.Read) $('#' + i).addClass('read');
+				else $('#' + i).removeClass('read');
+			}
+		}
+	});
+	source.addEventListener('items', function(e) {
+		var update = JSON.parse(e.data);
+		if (currentFeed && update.Feed != currentFeed) return;
+		$('#newitems-text').text(update.Count + ' new items from ' + update.Title + '.');
+		$('#newitems').show();
+	});
+}
+$('#main_body').scroll(function() {
+	if (this.scrollTop + this.clientHeight >= this.scrollHeight - 400) load();
+});
+refresh();
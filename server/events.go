@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"rs3/database"
+	"rs3/events"
+	"strconv"
+	"time"
+)
+
+// Heartbeat is how often an idle event stream is sent a
+// comment, so that proxies don't close it.
+var Heartbeat = 30 * time.Second
+
+// ServeEvents streams the user's events to the page as
+// Server-Sent Events. A client which reconnects with the
+// Last-Event-ID header is sent the events it missed, or
+// its current counts if they are no longer held.
+func ServeEvents(w http.ResponseWriter, r *http.Request) {
+	uid, _, ok := authenticate(w, r)
+	if !ok {
+		http.Error(w, "Not logged in.", 403)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported.", 500)
+		return
+	}
+
+	var after uint64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		var err error
+		after, err = strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			// Treat it as lost, and resynchronise.
+			after = ^uint64(0)
+		}
+	}
+	stream, err := events.Default.Subscribe(database.UidToString(uid), after)
+	if err != nil {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many open pages.", 429)
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	fmt.Fprint(w, "retry: 5000\n\n")
+
+	// A new client, or one which has missed too much, is
+	// sent its current counts, carrying the latest ID so
+	// that it can resume from there.
+	if after == 0 || stream.Lost {
+		counts, err := database.UnreadCounts(uid)
+		if err != nil {
+			fmt.Println("Failed to count unread items.")
+			fmt.Println(err)
+			return
+		}
+		err = writeEvent(w, &events.Event{ID: stream.Last, Type: database.EventUnread, Data: counts})
+		if err != nil {
+			return
+		}
+	}
+	for _, e := range stream.Missed {
+		if writeEvent(w, e) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-stream.C:
+			if !ok {
+				// Dropped for falling behind. The client will
+				// reconnect and catch up.
+				return
+			}
+			if writeEvent(w, e) != nil {
+				return
+			}
+		case <-ticker.C:
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes an event in the text/event-stream
+// format.
+func writeEvent(w http.ResponseWriter, e *events.Event) error {
+	b, err := json.Marshal(e.Data)
+	if err != nil {
+		fmt.Println("Failed to marshal event.")
+		fmt.Println(err)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+	return err
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"rs3/database"
+	"rs3/proxy"
+	"strconv"
+	"time"
+)
+
+// ServeItems serves a page of the user's items as JSON.
+// The query may be narrowed with the subscription, folder
+// and unread parameters, ordered with sort, and continued
+// with the cursor from the previous page.
+func ServeItems(w http.ResponseWriter, r *http.Request) {
+	uid, _, ok := authenticate(w, r)
+	if !ok {
+		http.Error(w, "Not logged in.", 403)
+		return
+	}
+
+	q := &database.Query{
+		Subscription: r.FormValue("subscription"),
+		Folder:       r.FormValue("folder"),
+		Unread:       r.FormValue("unread") == "1" || r.FormValue("unread") == "true",
+		Sort:         r.FormValue("sort"),
+		Cursor:       r.FormValue("cursor"),
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, "Invalid limit.", 400)
+			return
+		}
+		q.Limit = n
+	}
+	page, err := database.Items(uid, q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	for _, item := range page.Items {
+		item.Content = proxy.Rewrite(item.Content)
+	}
+	serveJSON(w, page)
+}
+
+// ServeMarkRead marks an item, and the rest of its
+// story, as read, and responds with the new counts.
+func ServeMarkRead(w http.ResponseWriter, r *http.Request) {
+	uid, session, ok := authenticate(w, r)
+	if !ok {
+		http.Error(w, "Not logged in.", 403)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", 405)
+		return
+	}
+	if !checkCSRF(r, session) {
+		http.Error(w, "Invalid form submission.", 403)
+		return
+	}
+
+	err := database.MarkRead(uid, r.FormValue("item"))
+	if err != nil {
+		fmt.Println("Failed to mark item read:")
+		fmt.Println(err)
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	serveCounts(w, uid)
+}
+
+// ServeSort stores the order in which the user wants to
+// see a feed, or their all items view if no feed is given.
+func ServeSort(w http.ResponseWriter, r *http.Request) {
+	uid, session, ok := authenticate(w, r)
+	if !ok {
+		http.Error(w, "Not logged in.", 403)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", 405)
+		return
+	}
+	if !checkCSRF(r, session) {
+		http.Error(w, "Invalid form submission.", 403)
+		return
+	}
+
+	err := database.SetSort(uid, r.FormValue("subscription"), r.FormValue("sort"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// ReadAll is the response to a bulk mark as read.
+type ReadAll struct {
+	Token  string // For undoing the change.
+	Undo   int    // Seconds in which the change can be undone.
+	Marked int
+	*database.Counts
+}
+
+// serveCounts responds with the user's unread counts, so
+// that the page can update without reloading.
+func serveCounts(w http.ResponseWriter, uid []byte) {
+	c, err := database.UnreadCounts(uid)
+	if err != nil {
+		fmt.Println("Failed to count unread items.")
+		fmt.Println(err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	serveJSON(w, c)
+}
+
+// ServeMarkAllRead marks every item in the given
+// subscription, folder, or all subscriptions, as read. If
+// older is given, such as "24h" or "7d", only items older
+// than that are marked. The response includes a token for
+// /items/undo.
+func ServeMarkAllRead(w http.ResponseWriter, r *http.Request) {
+	uid, session, ok := authenticate(w, r)
+	if !ok {
+		http.Error(w, "Not logged in.", 403)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", 405)
+		return
+	}
+	if !checkCSRF(r, session) {
+		http.Error(w, "Invalid form submission.", 403)
+		return
+	}
+
+	q := &database.Query{
+		Subscription: r.FormValue("subscription"),
+		Folder:       r.FormValue("folder"),
+	}
+	if older := r.FormValue("older"); older != "" {
+		age, err := database.ParseAge(older)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		q.Before = time.Now().Add(-age)
+	}
+	token, n, err := database.MarkAllRead(uid, q)
+	if err != nil {
+		fmt.Println("Failed to mark items read:")
+		fmt.Println(err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	c, err := database.UnreadCounts(uid)
+	if err != nil {
+		fmt.Println("Failed to count unread items.")
+		fmt.Println(err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	serveJSON(w, &ReadAll{token, int(database.UndoWindow / time.Second), n, c})
+}
+
+// ServeUndo reverses the user's last bulk mark as read,
+// given its token, and responds with the new counts.
+func ServeUndo(w http.ResponseWriter, r *http.Request) {
+	uid, session, ok := authenticate(w, r)
+	if !ok {
+		http.Error(w, "Not logged in.", 403)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", 405)
+		return
+	}
+	if !checkCSRF(r, session) {
+		http.Error(w, "Invalid form submission.", 403)
+		return
+	}
+
+	_, err := database.UndoMarkAllRead(uid, r.FormValue("token"))
+	if err != nil {
+		http.Error(w, "Too late to undo.", 410)
+		return
+	}
+	serveCounts(w, uid)
+}
+
+// serveJSON writes v as an uncacheable JSON response.
+func serveJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Failed to marshal response.")
+		fmt.Println(err)
+		http.Error(w, "Internal server error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
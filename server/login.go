@@ -2,38 +2,53 @@ package server
 
 import (
 	"fmt"
-	"io/ioutil"
+	"html/template"
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
+	"rs3/auth"
 	"rs3/database"
-	"rs3/security"
+	rs3mail "rs3/mail"
+	"rs3/oidc"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func serveLogin(w http.ResponseWriter, r *http.Request, failed bool) {
+type LoginTemplate struct {
+	Error     string
+	Username  string
+	Next      string
+	TwoFactor bool   // Whether to ask for a TOTP code.
+	SSO       string // Name of the single sign-on provider, if any.
+	Register  bool   // Whether users may register.
+}
+
+// serveLogin shows the login page with the given status
+// and template, which may be nil.
+func serveLogin(w http.ResponseWriter, r *http.Request, status int, Template *LoginTemplate) {
 	
 	// Remove any existing cookies.
-	w.Header().Add("Set-Cookie", fmt.Sprintf("uid=\"\"; Expires=%s; Secure; HttpOnly",
-		new(time.Time).UTC().Format(http.TimeFormat)))
-	w.Header().Add("Set-Cookie", fmt.Sprintf("auth=\"\"; Expires=%s; Secure; HttpOnly",
-		new(time.Time).UTC().Format(http.TimeFormat)))
-	
-	var path string
-	if failed {
-		path = "server/content/html/failed_login.html"
-	} else {
-		path = "server/content/html/login.html"
-	}
-	data, err := ioutil.ReadFile(path)
+	clearSessionCookies(w)
+	
+	if Template == nil {
+		Template = new(LoginTemplate)
+	}
+	if oidc.Default != nil {
+		Template.SSO = oidc.Default.Name
+	}
+	Template.Register = Registration != RegistrationOff && rs3mail.Default != nil
+	
+	t, err := template.ParseFiles("server/content/html/login.html")
 	if err != nil {
-		fmt.Println("Failed to open login.html:")
+		fmt.Println("Failed to parse login.html:")
 		fmt.Println(err)
 		return
 	}
 	
-	_, err = w.Write(data)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err = t.Execute(w, Template)
 	if err != nil {
 		fmt.Println("Failed to send login.html:")
 		fmt.Println(err)
@@ -41,8 +56,26 @@ func serveLogin(w http.ResponseWriter, r *http.Request, failed bool) {
 	}
 }
 
+// Login logs the user in with the email address and
+// password posted from the login page. Any other request,
+// such as for a page which needs the user to be logged in,
+// is shown the login page, which returns them to the page
+// afterwards.
 func Login(w http.ResponseWriter, r *http.Request) {
-	b, err := ioutil.ReadAll(r.Body)
+	Template := new(LoginTemplate)
+	
+	if r.Method != "POST" || r.URL.Path != "/login" {
+		if r.URL.Path == "/login" {
+			Template.Next = safeNext(r.URL.Query().Get("next"))
+		} else if r.Method == "GET" {
+			Template.Next = safeNext(r.URL.RequestURI())
+		}
+		serveLogin(w, r, 200, Template)
+		return
+	}
+	
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginSize)
+	err := r.ParseForm()
 	if err != nil {
 		fmt.Println("Error reading from login request:")
 		fmt.Println(err)
@@ -50,75 +83,219 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	if len(b) == 0 {
-		serveLogin(w, r, false)
+	Template.Next = safeNext(r.PostFormValue("next"))
+	if _, ok := r.PostForm["code"]; ok {
+		loginTwoFactor(w, r, Template)
 		return
 	}
 	
-	body, err := url.QueryUnescape(string(b))
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		http.Error(w, "Failed to process login.", 500)
+	username := database.NormaliseEmail(r.PostFormValue("u"))
+	password := r.PostFormValue("p")
+	Template.Username = username
+	if username == "" || password == "" {
+		Template.Error = "Enter your email address and password."
+		serveLogin(w, r, 400, Template)
 		return
 	}
 	
-	regex := regexp.MustCompile(`u=([\w\.\@]+)\&p=([\w]+)`)
-	matches := regex.FindAllStringSubmatch(body, -1)
-	if matches == nil {
-		serveLogin(w, r, false)
+	ip := clientIP(r)
+	
+	// Guesses are slowed, and then refused, whether or not
+	// the account exists. The attempt counts as a failure
+	// until the password is found to be right.
+	attempt, err := database.BeginLogin(username, ip)
+	if t, ok := err.(*database.LoginThrottled); ok {
+		fmt.Printf("Refused login to %q from %s: %v\n", username, ip, t)
+		wait := time.Until(t.Until)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		if t.Locked {
+			Template.Error = "Too many failed logins. Try again later."
+		} else {
+			Template.Error = "Too many failed logins. Try again in " + waitString(wait) + "."
+		}
+		serveLogin(w, r, 429, Template)
 		return
 	}
 	
-	username := matches[0][1]
-	password := matches[0][2]
-	salt := database.Salt(username)
-	if salt == nil {
-		fmt.Printf("User %q does not exist.\n", username)
-		w.WriteHeader(401)
-		serveLogin(w, r, true)
+	// Each authentication backend is tried in turn. Users
+	// from backends other than the database are given an
+	// account the first time they log in.
+	account, err := auth.Default.Authenticate(username, password)
+	if _, ok := err.(*database.AuthenticationError); ok {
+		Template.Error = "Incorrect email address or password."
+		serveLogin(w, r, 401, Template)
+		return
+	}
+	if err != nil {
+		attempt.Withdraw()
+		fmt.Fprintln(os.Stderr, err.Error())
+		http.Error(w, "Failed to process login.", 500)
+		return
+	}
+	uid, err := auth.Provision(account)
+	if _, ok := err.(*auth.LinkRefused); ok {
+		attempt.Withdraw()
+		fmt.Println(err)
+		Template.Error = "An account already exists with your email address. Log in with its password instead."
+		serveLogin(w, r, 403, Template)
 		return
 	}
-	uid, err := security.Hash(username, salt)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		http.Error(w, "Failed to process login.", 500)
 		return
 	}
 	
-	pwd, err := security.Hash(password, salt)
+	// Users with two-factor authentication are asked for a
+	// code next. Until they give it, the password is not
+	// counted as a success, so that a stolen password cannot
+	// be used to guess codes without being throttled, but
+	// nor is it a failure.
+	enabled, _, err := database.TwoFactorEnabled(uid)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		http.Error(w, "Failed to process login.", 500)
 		return
 	}
+	if enabled {
+		attempt.Withdraw()
+		askForCode(w, r, uid, username, Template)
+		return
+	}
 	
-	cookie, expiry, err := database.Login(uid, pwd)
+	attempt.Succeeded()
+	startSession(w, r, uid, Template.Next)
+}
+
+// askForCode asks a user with two-factor authentication
+// for their TOTP code or a recovery code, once they have
+// given their password or logged in with single sign-on.
+func askForCode(w http.ResponseWriter, r *http.Request, uid []byte, username string, Template *LoginTemplate) {
+	token, err := database.NewPendingLogin(uid, username)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
-		http.Error(w, "Invalid login details.", 401)
+		http.Error(w, "Failed to process login.", 500)
+		return
+	}
+	w.Header().Add("Set-Cookie", fmt.Sprintf("pending=%q; Path=/login; Max-Age=%d; Secure; HttpOnly; SameSite=Strict",
+		token, int(database.PendingLoginLife.Seconds())))
+	Template.TwoFactor = true
+	serveLogin(w, r, 200, Template)
+}
+
+// loginTwoFactor completes a login with the TOTP code or
+// recovery code the user was asked for after their
+// password.
+func loginTwoFactor(w http.ResponseWriter, r *http.Request, Template *LoginTemplate) {
+	c, err := r.Cookie("pending")
+	if err != nil {
+		Template.Error = "Your login has expired. Please log in again."
+		serveLogin(w, r, 401, Template)
 		return
 	}
 	
-	uidBytes := database.UidToString(uid)
+	uid, username, err := database.CompletePendingLogin(c.Value, r.PostFormValue("code"))
+	switch err.(type) {
+	case nil:
+	case *database.AuthenticationError:
+		database.LoginFailed(username, clientIP(r))
+		Template.Error = "Incorrect code."
+		Template.TwoFactor = true
+		serveLogin(w, r, 401, Template)
+		return
+	case *database.LoginExpired:
+		w.Header().Add("Set-Cookie", "pending=\"\"; Path=/login; Max-Age=0; Secure; HttpOnly; SameSite=Strict")
+		Template.Error = "Your login has expired. Please log in again."
+		serveLogin(w, r, 401, Template)
+		return
+	default:
+		fmt.Fprintln(os.Stderr, err.Error())
+		http.Error(w, "Failed to process login.", 500)
+		return
+	}
 	
-	// Add the uid and auth cookies.
-	w.Header().Add("Set-Cookie", fmt.Sprintf("uid=%q; Expires=%s; Secure; HttpOnly",
-		uidBytes, expiry.UTC().Format(http.TimeFormat)))
-	w.Header().Add("Set-Cookie", fmt.Sprintf("auth=%q; Expires=%s; Secure; HttpOnly", cookie,
-		expiry.UTC().Format(http.TimeFormat)))
+	database.LoginSucceeded(username)
+	w.Header().Add("Set-Cookie", "pending=\"\"; Path=/login; Max-Age=0; Secure; HttpOnly; SameSite=Strict")
+	startSession(w, r, uid, Template.Next)
+}
+
+// startSession logs the user in, and sends them on to
+// next, or to the main page.
+func startSession(w http.ResponseWriter, r *http.Request, uid []byte, next string) {
+	session, cookie, err := database.NewSession(uid, r.UserAgent(), clientIP(r))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		http.Error(w, "Failed to process login.", 500)
+		return
+	}
 	
-	r.Header.Add("Set-Cookie", fmt.Sprintf("uid=%q; Expires=%s; Secure; HttpOnly",
-		uidBytes, expiry.UTC().Format(http.TimeFormat)))
-	r.Header.Add("Set-Cookie", fmt.Sprintf("auth=%q; Expires=%s; Secure; HttpOnly", cookie,
-		expiry.UTC().Format(http.TimeFormat)))
+	// Add the uid and auth cookies.
+	setSessionCookies(w, database.UidToString(uid), cookie, session.Expires())
 	
-	if r.URL.Path == "/" || r.URL.Path == "/index.html" {
-		ServeMain(w, r)
+	if next == "" {
+		next = "/"
+	}
+	http.Redirect(w, r, next, 303)
+}
+
+// maxLoginSize limits the size of login requests.
+const maxLoginSize = 1 << 16
+
+// safeNext returns the page to which the user should be
+// sent after logging in, if it is one of ours, or "".
+// Absolute URLs, and those which browsers may treat as
+// such, are refused, so that the login page cannot be used
+// to send users elsewhere.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return ""
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return ""
+	}
+	switch u.Path {
+	case "/", "/index.html", "/login", "/logout":
+		return ""
+	}
+	return next
+}
+
+// waitString describes how long the user must wait, to
+// the minute, or in seconds if less.
+func waitString(d time.Duration) string {
+	if d < time.Minute {
+		return strconv.Itoa(int(d.Seconds())+1) + " seconds"
+	}
+	if m := int(d.Minutes() + 0.5); m != 1 {
+		return strconv.Itoa(m) + " minutes"
+	}
+	return "a minute"
+}
+
+// Logout ends the user's session, so that its cookie can
+// no longer be used, and returns them to the login page.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Log out with POST.", 405)
 		return
 	}
+	uid, session, ok := authenticate(w, r)
+	if ok {
+		if !checkCSRF(r, session) {
+			http.Error(w, "Invalid form submission.", 403)
+			return
+		}
+		err := database.RevokeSession(uid, session.ID)
+		if err != nil {
+			fmt.Println("Failed to end session:")
+			fmt.Println(err)
+		}
+	}
 	
-	url := r.URL
-	url.Path = "/"
-	http.Redirect(w, r, url.String(), 307)
-	return
+	// authenticate may have sent a replacement cookie.
+	w.Header().Del("Set-Cookie")
+	clearSessionCookies(w)
+	http.Redirect(w, r, "/login", 303)
 }
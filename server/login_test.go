@@ -0,0 +1,251 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"rs3/database"
+	sec "rs3/security"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Templates are found relative to the repository.
+	os.Chdir("..")
+}
+
+// addUser creates an account with the password, returning
+// its uid.
+func addUser(t *testing.T, email, password string) []byte {
+	salt := sec.NewSalt()
+	uid, err := sec.Hash(email, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwd, err := sec.Hash(password, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AddUser(uid, pwd, salt, email, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uid
+}
+
+// post sends the form to the handler from the IP address,
+// with the cookies, if any.
+func post(handler http.HandlerFunc, path, ip string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = ip + ":1234"
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestLogin(t *testing.T) {
+	old := sec.Argon2Cost
+	sec.Argon2Cost.Memory, sec.Argon2Cost.Time = 1024, 1
+	defer func() { sec.Argon2Cost = old }()
+	addUser(t, "login@example.com", "correct horse")
+
+	for _, test := range []struct {
+		email, password string
+		status          int
+	}{
+		{"login@example.com", "correct horse", 303},
+		{" Login@Example.COM ", "correct horse", 303},
+		{"login@example.com", "wrong", 401},
+		{"nobody@example.com", "correct horse", 401},
+		{"login@example.com", "", 400},
+	} {
+		form := url.Values{"u": {test.email}, "p": {test.password}, "next": {"/settings"}}
+		w := post(Login, "/login", "203.0.113.1", form)
+		if w.Code != test.status {
+			t.Errorf("%q, %q: expected %d, got %d.", test.email, test.password, test.status, w.Code)
+			continue
+		}
+		if test.status == 303 && (w.Header().Get("Location") != "/settings" || !strings.Contains(w.Header().Get("Set-Cookie"), "uid=")) {
+			t.Errorf("%q: expected a session, got %v.", test.email, w.Header())
+		}
+	}
+
+	// Repeated failures are slowed, even with the right
+	// password, and then locked out.
+	for i := 0; i < database.AccountFreeAttempts; i++ {
+		post(Login, "/login", "203.0.113.2", url.Values{"u": {"login@example.com"}, "p": {"wrong"}})
+	}
+	w := post(Login, "/login", "203.0.113.3", url.Values{"u": {"login@example.com"}, "p": {"correct horse"}})
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "Try again in") {
+		t.Errorf("Expected the login to be throttled, got %d: %v.", w.Code, w.Header())
+	}
+}
+
+// enableTOTP turns on two-factor authentication for the
+// user, returning the code for this time step and their
+// recovery codes.
+func enableTOTP(t *testing.T, uid []byte) (string, []string) {
+	dir, err := ioutil.TempDir("", "totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	database.SecretKeyPath = filepath.Join(dir, "secrets.key")
+	if err := database.LoadSecretKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, _, err := database.BeginTOTP(uid, "totp@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := sec.TOTP(secret, sec.TOTPStep(time.Now())-1)
+	recovery, err := database.EnableTOTP(uid, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ = sec.TOTP(secret, sec.TOTPStep(time.Now()))
+	return code, recovery
+}
+
+// pendingCookie returns the response's pending login
+// cookie, if any.
+func pendingCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "pending" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	uid := addUser(t, "totp@example.com", "password")
+	code, recovery := enableTOTP(t, uid)
+
+	// The password leads to the code step, not a session.
+	pending := func() *http.Cookie {
+		w := post(Login, "/login", "203.0.113.5", url.Values{"u": {"totp@example.com"}, "p": {"password"}})
+		c := pendingCookie(w)
+		if c == nil {
+			t.Fatalf("Expected to be asked for a code, got %d: %v.", w.Code, w.Header())
+		}
+		return c
+	}
+	c := pending()
+	for _, test := range []struct {
+		code   string
+		status int
+		body   string
+	}{
+		{"000000", 401, "Incorrect code."},
+		{code, 303, ""},
+		{code, 401, "Your login has expired."}, // Used up.
+	} {
+		w := post(Login, "/login", "203.0.113.5", url.Values{"code": {test.code}, "next": {"/settings"}}, c)
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("%q: expected %d, got %d: %s", test.code, test.status, w.Code, w.Body)
+		}
+		if w.Code == 303 && w.Header().Get("Location") != "/settings" {
+			t.Errorf("%q: expected to be sent on, got %v.", test.code, w.Header())
+		}
+	}
+	if w := post(Login, "/login", "203.0.113.5", url.Values{"code": {code}}); w.Code != 401 {
+		t.Errorf("Expected a code without a pending login to be refused, got %d.", w.Code)
+	}
+
+	// Turning two-factor authentication off meanwhile sends
+	// the user back to their password.
+	c = pending()
+	if err := database.ResetTOTP(uid); err != nil {
+		t.Fatal(err)
+	}
+	w := post(Login, "/login", "203.0.113.5", url.Values{"code": {recovery[0]}}, c)
+	if w.Code != 401 || !strings.Contains(w.Body.String(), "Your login has expired.") {
+		t.Errorf("Expected the login to have expired, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	uid := addUser(t, "logout@example.com", "password")
+	session, cookie, err := database.NewSession(uid, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := []*http.Cookie{
+		{Name: "uid", Value: database.UidToString(uid)},
+		{Name: "auth", Value: cookie},
+	}
+
+	// Logging out needs the session's CSRF token.
+	w := post(Logout, "/logout", "203.0.113.4", url.Values{"csrf": {"wrong"}}, cookies...)
+	if w.Code != 403 {
+		t.Errorf("Expected a forged logout to be refused, got %d.", w.Code)
+	}
+	if _, _, err := database.CheckSession(uid, cookie, "", ""); err != nil {
+		t.Fatalf("Expected the session to survive, got %v.", err)
+	}
+	r := httptest.NewRequest("GET", "/logout", nil)
+	w = httptest.NewRecorder()
+	Logout(w, r)
+	if w.Code != 405 {
+		t.Errorf("Expected GET to be refused, got %d.", w.Code)
+	}
+
+	w = post(Logout, "/logout", "203.0.113.4", url.Values{"csrf": {csrfToken(session)}}, cookies...)
+	if w.Code != 303 || w.Header().Get("Location") != "/login" {
+		t.Fatalf("Expected to be sent to the login page, got %d.", w.Code)
+	}
+	if set := strings.Join(w.Header()["Set-Cookie"], "\n"); !strings.Contains(set, `auth=""`) || !strings.Contains(set, `uid=""`) {
+		t.Errorf("Expected the cookies to be cleared, got %q.", set)
+	}
+	if _, _, err := database.CheckSession(uid, cookie, "", ""); err == nil {
+		t.Error("Expected the session to be revoked.")
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	for _, test := range []struct {
+		next, safe string
+	}{
+		{"/settings", "/settings"},
+		{"/items?feed=x#top", "/items?feed=x#top"},
+		{"", ""},
+		{"/", ""},
+		{"/login", ""},
+		{"/logout", ""},
+		{"settings", ""},
+		{"//evil.example.com/", ""},
+		{"/\\evil.example.com/", ""},
+		{"https://evil.example.com/", ""},
+	} {
+		if got := safeNext(test.next); got != test.safe {
+			t.Errorf("safeNext(%q): expected %q, got %q.", test.next, test.safe, got)
+		}
+	}
+}
+
+func TestWaitString(t *testing.T) {
+	for _, test := range []struct {
+		wait time.Duration
+		s    string
+	}{
+		{30 * time.Second, "31 seconds"},
+		{time.Minute, "a minute"},
+		{90 * time.Second, "2 minutes"},
+		{time.Hour, "60 minutes"},
+	} {
+		if got := waitString(test.wait); got != test.s {
+			t.Errorf("waitString(%v): expected %q, got %q.", test.wait, test.s, got)
+		}
+	}
+}
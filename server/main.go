@@ -9,47 +9,26 @@ import (
 	"io/ioutil"
   "net/http"
   "rs3/database"
+  "rs3/proxy"
+  "sort"
   "strings"
   "time"
 )
 
 func ServeMain(w http.ResponseWriter, r *http.Request) {
-  uid, err := r.Cookie("uid")
-  if err != nil {
-    Login(w, r)
-    return
-  }
-  uidBytes, err := database.StringToUid(uid.Value)
-  if err != nil {
-    fmt.Println("failed to parse cookie")
-    Login(w, r)
-    return
-  }
-  auth, err := r.Cookie("auth")
-  if err != nil {
-    fmt.Println("no auth cookie")
-    Login(w, r)
-    return
-  }
-
-  valid, cookie, expiry := database.Validate(auth.Value, uidBytes)
-  if !valid {
+  uidBytes, session, ok := authenticate(w, r)
+  if !ok {
     Login(w, r)
     return
   }
 
-  if cookie != auth.Value {
-    w.Header().Add("Set-Cookie", fmt.Sprintf("auth=%q; Expires=%s; Secure; HttpOnly", cookie,
-      expiry.UTC().Format(http.TimeFormat)))
-    r.Header.Add("Set-Cookie", fmt.Sprintf("auth=%q; Expires=%s; Secure; HttpOnly", cookie,
-      expiry.UTC().Format(http.TimeFormat)))
-  }
-
   // Create template struct
   Template := new(MainTemplate)
+  Template.CSRF = csrfToken(session)
 
   // Get nickname.
-  Template.Nickname, err = database.Nickname(uidBytes, auth.Value)
+  var err error
+  Template.Nickname, err = database.ClientNickname(uidBytes)
   if err != nil {
     fmt.Println("Failed to get nickname.")
     Template.Nickname = "[UNKNOWN]"
@@ -63,34 +42,63 @@ func ServeMain(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  // Go through the user's feeds.
-	var first string
+  // Go through the user's feeds, grouping them by folder.
+  var first string
   feeds, err := database.Feeds(uidBytes)
   if err != nil {
     fmt.Println("Failed to get feeds.")
     Template.UnreadZero = "unread_zero"
   } else {
-    feedItems := make([]*FeedListItem, 0, len(feeds))
-    itemItems := make([]*ItemListItem, 0, 10)
-    jsData := new(JSData)
-    jsData.Items = make(map[string][]*JSItem)
-    unread := 0
-    for i, feed := range feeds {
-      unread += int(feed.Unread)
-      if i == 0 {
-				first = feed.Title
-        feedItems = append(feedItems, &FeedListItem{feed.Title, " active"})
-      } else {
-        feedItems = append(feedItems, &FeedListItem{feed.Title, ""})
+    feedItems := make([]*FeedListItem, 0, len(feeds)+1)
+    feedItems = append(feedItems, &FeedListItem{"All items", "", "", "", true, 0})
+    folders := make(map[string][]*FeedListItem)
+    names := make([]string, 0, 5)
+    counts, err := database.UnreadCounts(uidBytes)
+    if err != nil {
+      fmt.Println("Failed to count unread items.")
+      counts = new(database.Counts)
+    }
+    unread := counts.Unread
+    for _, feed := range feeds {
+      item := &FeedListItem{feed.Title, feed.UpdateURL, "", "", false, counts.Feeds[feed.UpdateURL]}
+      folder := database.Folder(uidBytes, feed)
+      if folder == "" {
+        feedItems = append(feedItems, item)
+        continue
+      }
+      if _, ok := folders[folder]; !ok {
+        names = append(names, folder)
       }
-      jsItems := make([]*JSItem, 0, 10)
-      for j, item := range feed.Items {
-        if i == 0 {
-          itemItems = append(itemItems, &ItemListItem{item.Title, item.Content, feed.Title, j})
-        }
-        jsItems = append(jsItems, &JSItem{item.Title, item.Content, feed.Title, false})
+      folders[folder] = append(folders[folder], item)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+      feedItems = append(feedItems, &FeedListItem{name, "", name, "", false, 0})
+      feedItems = append(feedItems, folders[name]...)
+    }
+    for _, feed := range feedItems {
+      if feed.URL != "" {
+        first = feed.URL
+        feed.Active = " active"
+        break
       }
-      jsData.Items[feed.Title] = jsItems
+    }
+
+    // Load the first page of the active feed. Later pages,
+    // and other feeds, are fetched by main.js.
+    page := new(database.Page)
+    if first != "" {
+      page, err = database.Items(uidBytes, &database.Query{Subscription: first})
+      if err != nil {
+        fmt.Println("Failed to get items.")
+        fmt.Println(err)
+        page = new(database.Page)
+      }
+    }
+    itemItems := make([]*ItemListItem, 0, len(page.Items))
+    for i, item := range page.Items {
+      // Content is sanitised when the item is ingested.
+      itemItems = append(itemItems, &ItemListItem{item.Title, template.HTML(proxy.Rewrite(item.Content)), item.Feed, i, item.Highlight, item.Sources, item.When})
     }
     Template.Unread = unread
     buf := new(bytes.Buffer)
@@ -146,7 +154,7 @@ func ServeMain(w http.ResponseWriter, r *http.Request) {
     buf.Reset()
 
     // Construct JS data.
-    b, err := json.Marshal(jsData.Items)
+    b, err := json.Marshal(page)
     if err != nil {
       fmt.Println("Failed to parse item list items.")
     } else {
@@ -156,7 +164,10 @@ func ServeMain(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "Internal server error", 500)
 				return
 			}
-      Template.JSData = template.JS(fmt.Sprintf(string(jsDataBytes), string(b), first, Template.Unread))
+			// Marshal the feed URL too, as %q does not escape
+			// HTML-significant characters such as "</script>".
+			firstBytes, _ := json.Marshal(first)
+      Template.JSData = template.JS(fmt.Sprintf(string(jsDataBytes), string(b), string(firstBytes), Template.Unread))
     }
   }
 
@@ -185,6 +196,7 @@ func ServeMain(w http.ResponseWriter, r *http.Request) {
 
 type MainTemplate struct {
   Nickname   string
+  CSRF       string
   Unread     int
   UnreadZero string
   FeedsList  template.HTML
@@ -195,25 +207,21 @@ type MainTemplate struct {
 
 type FeedListItem struct {
   Name   string
+  URL    string
+  Folder string
   Active string
+  All    bool
+  Unread int
 }
 
 type ItemListItem struct {
-  Title  string
-  Desc   string
-  Source string
-  Index  int
-}
-
-type JSData struct {
-  Items map[string][]*JSItem
-}
-
-type JSItem struct {
-  Title   string
-  Content string
-  Source  string
-	Read    bool
+  Title     string
+  Desc      template.HTML
+  Source    string
+  Index     int
+  Highlight bool
+  Sources   []*database.Source
+  When      string
 }
 
 var files = []string{"server/content/html/main.html",
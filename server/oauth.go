@@ -0,0 +1,22 @@
+package server
+
+import (
+	"net/http"
+	"rs3/oauth"
+)
+
+// ServeAuthorize shows the OAuth consent page to the
+// logged-in user, and handles their answer. Users who are
+// not logged in are asked to, and then returned here.
+func ServeAuthorize(w http.ResponseWriter, r *http.Request) {
+	uid, session, ok := authenticate(w, r)
+	if !ok {
+		Login(w, r)
+		return
+	}
+	if r.Method == "POST" && !checkCSRF(r, session) {
+		http.Error(w, "Invalid form submission.", 403)
+		return
+	}
+	oauth.Authorize(w, r, uid, csrfToken(session))
+}
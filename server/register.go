@@ -0,0 +1,211 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"rs3/database"
+	rs3mail "rs3/mail"
+	sec "rs3/security"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Registration modes.
+const (
+	RegistrationOff    = ""
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+)
+
+// Registration is whether anyone may register an account,
+// or only those with invite codes. It is off by default.
+var Registration = RegistrationOff
+
+// Origin is the scheme and host of links in email, such as
+// "https://rs3.example.com".
+var Origin string
+
+type RegisterTemplate struct {
+	Error      string
+	InviteOnly bool
+	Invite     string
+	Email      string
+	Nickname   string
+	Sent       bool   // Whether the verification email has been sent.
+	Token      string // Verification token, to confirm the registration.
+}
+
+// serveRegister shows the registration page with the given
+// status and template.
+func serveRegister(w http.ResponseWriter, r *http.Request, status int, Template *RegisterTemplate) {
+	Template.InviteOnly = Registration == RegistrationInvite
+	t, err := template.ParseFiles("server/content/html/register.html")
+	if err != nil {
+		fmt.Println("Failed to parse register.html:")
+		fmt.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err = t.Execute(w, Template)
+	if err != nil {
+		fmt.Println("Failed to send register.html:")
+		fmt.Println(err)
+		return
+	}
+}
+
+// ServeRegister shows the registration page, and handles
+// its form. The new user is sent an email with a link to
+// verify their address, which creates their account.
+//
+// Whether the email address already has an account is not
+// revealed, and no email is sent if it does.
+func ServeRegister(w http.ResponseWriter, r *http.Request) {
+	if Registration == RegistrationOff || rs3mail.Default == nil {
+		NotFound(w, r)
+		return
+	}
+
+	Template := new(RegisterTemplate)
+	if r.Method != "POST" {
+		Template.Invite = r.URL.Query().Get("invite")
+		serveRegister(w, r, 200, Template)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginSize)
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Could not read request body.", 400)
+		return
+	}
+	Template.Invite = strings.TrimSpace(r.PostFormValue("invite"))
+	Template.Email = database.NormaliseEmail(r.PostFormValue("email"))
+	Template.Nickname = strings.TrimSpace(r.PostFormValue("nickname"))
+	password := r.PostFormValue("password")
+
+	if a, err := mail.ParseAddress(Template.Email); err != nil || a.Address != Template.Email || a.Name != "" {
+		Template.Error = "Enter a valid email address."
+		serveRegister(w, r, 400, Template)
+		return
+	}
+	if password != r.PostFormValue("confirm") {
+		Template.Error = "The passwords do not match."
+		serveRegister(w, r, 400, Template)
+		return
+	}
+	code := ""
+	if Registration == RegistrationInvite {
+		code = Template.Invite
+		if code == "" {
+			Template.Error = "Enter your invite code."
+			serveRegister(w, r, 400, Template)
+			return
+		}
+	}
+
+	token, err := database.NewRegistration(Template.Email, Template.Nickname, password, code, clientIP(r))
+	switch err := err.(type) {
+	case nil:
+	case *sec.WeakPassword:
+		Template.Error = "Choose a stronger password: " + err.Reason
+		serveRegister(w, r, 400, Template)
+		return
+	case *database.LoginThrottled:
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(err.Until).Seconds())+1))
+		Template.Error = "Too many registrations. Try again later."
+		serveRegister(w, r, 429, Template)
+		return
+	case *database.TooManyRegistrations:
+		Template.Error = "Registration is busy. Try again later."
+		serveRegister(w, r, 503, Template)
+		return
+	case *database.InviteDoesNotExist:
+		Template.Error = "That invite code is not valid. It may have expired or been used."
+		serveRegister(w, r, 403, Template)
+		return
+	case *database.EmailAlreadyExists, *database.RegistrationThrottled:
+		Template.Sent = true
+		serveRegister(w, r, 200, Template)
+		return
+	default:
+		fmt.Fprintln(os.Stderr, err.Error())
+		http.Error(w, "Failed to process registration.", 500)
+		return
+	}
+
+	link := Origin + "/register/verify?token=" + url.QueryEscape(token)
+	err = rs3mail.Default.Send(&rs3mail.Message{
+		To:      Template.Email,
+		Subject: "Verify your email address for RS3",
+		Body: "Someone, hopefully you, registered an RS3 account with this email address.\n\n" +
+			"To create your account, follow this link within a day:\n\n" + link + "\n\n" +
+			"If you did not register, you can ignore this email.\n",
+	})
+	if err != nil {
+		fmt.Println("Failed to send verification email:")
+		fmt.Println(err)
+		http.Error(w, "Failed to send email. Please try again later.", 502)
+		return
+	}
+	Template.Sent = true
+	serveRegister(w, r, 200, Template)
+}
+
+// ServeVerify completes a registration with the token from
+// the verification email, and logs the new user in. As
+// mail scanners may follow links, the account is only
+// created once the user confirms with a POST.
+func ServeVerify(w http.ResponseWriter, r *http.Request) {
+	if Registration == RegistrationOff {
+		NotFound(w, r)
+		return
+	}
+
+	Template := new(RegisterTemplate)
+	expired := "This link has expired or been used. Please register again."
+	if r.Method != "POST" {
+		Template.Token = r.URL.Query().Get("token")
+		reg, err := database.PendingRegistration(Template.Token)
+		if err != nil {
+			Template.Token = ""
+			Template.Error = expired
+			serveRegister(w, r, 410, Template)
+			return
+		}
+		Template.Email = reg.Email
+		serveRegister(w, r, 200, Template)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginSize)
+	uid, email, err := database.CompleteRegistration(r.PostFormValue("token"))
+	switch err.(type) {
+	case nil:
+	case *database.RegistrationDoesNotExist:
+		Template.Error = expired
+		serveRegister(w, r, 410, Template)
+		return
+	case *database.InviteDoesNotExist:
+		Template.Error = "Your invite code has expired or been used. Please ask for another."
+		serveRegister(w, r, 403, Template)
+		return
+	case *database.EmailAlreadyExists:
+		serveLogin(w, r, 409, &LoginTemplate{Error: "That email address already has an account. Please log in."})
+		return
+	default:
+		fmt.Fprintln(os.Stderr, err.Error())
+		http.Error(w, "Failed to process registration.", 500)
+		return
+	}
+	fmt.Printf("Registered user %q.\n", email)
+	startSession(w, r, uid, "/")
+}
@@ -7,7 +7,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"rs3/api"
 	"rs3/database"
+	"rs3/fever"
+	"rs3/greader"
+	"rs3/oauth"
+	"rs3/oidc"
+	"rs3/proxy"
 	"strings"
 	"time"
 )
@@ -25,7 +31,7 @@ func (_ HTTPRedirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func ServeHTTP(domain string) {
 	for {
 		err := http.ListenAndServe(domain + ":80", HTTPRedirector{})
-		fmt.Fprintf(os.Stderr, err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
 		time.Sleep(10 * time.Second)
 	}
 }
@@ -38,6 +44,9 @@ func (_ Nexus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Add HSTS.
 	w.Header().Add("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
 	
+	// Don't leak our URLs to the sites items link to.
+	w.Header().Add("Referrer-Policy", "no-referrer")
+	
 	// Re-route request.
 	switch {
 	case r.URL.Path == "/", r.URL.Path == "/index.html":
@@ -46,6 +55,63 @@ func (_ Nexus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case r.URL.Path == "/login":
 		Login(w, r)
 		
+	case r.URL.Path == "/logout":
+		Logout(w, r)
+		
+	case r.URL.Path == "/register":
+		ServeRegister(w, r)
+		
+	case r.URL.Path == "/register/verify":
+		ServeVerify(w, r)
+		
+	case r.URL.Path == oidc.LoginPath:
+		ServeOIDCLogin(w, r)
+		
+	case r.URL.Path == oidc.CallbackPath:
+		ServeOIDCCallback(w, r)
+		
+	case r.URL.Path == "/items":
+		ServeItems(w, r)
+		
+	case r.URL.Path == "/items/read":
+		ServeMarkRead(w, r)
+		
+	case r.URL.Path == "/items/sort":
+		ServeSort(w, r)
+		
+	case r.URL.Path == "/items/read-all":
+		ServeMarkAllRead(w, r)
+		
+	case r.URL.Path == "/items/undo":
+		ServeUndo(w, r)
+		
+	case r.URL.Path == "/events":
+		ServeEvents(w, r)
+		
+	case r.URL.Path == greader.LoginPath, strings.HasPrefix(r.URL.Path, greader.Prefix):
+		greader.Serve(w, r)
+		
+	case r.URL.Path == fever.Prefix, r.URL.Path == "/fever":
+		fever.Serve(w, r)
+		
+	case r.URL.Path == api.Prefix, strings.HasPrefix(r.URL.Path, api.Prefix+"/"):
+		api.Serve(w, r)
+		
+	case r.URL.Path == oauth.AuthorizePath:
+		ServeAuthorize(w, r)
+		
+	case r.URL.Path == oauth.TokenPath:
+		oauth.Token(w, r)
+		
+	case r.URL.Path == "/settings", strings.HasPrefix(r.URL.Path, "/settings/"):
+		ServeSettings(w, r)
+		
+	case r.URL.Path == "/sessions":
+		ServeSessions(w, r)
+		
+	case strings.HasPrefix(r.URL.Path, proxy.Prefix):
+		serveProxy(w, r)
+		
 	case strings.HasSuffix(r.URL.Path, "favicon.ico"):
 		http.ServeFile(w, r, "server/content/images/favicon.ico")
 		
@@ -180,6 +246,14 @@ func serveJS(w http.ResponseWriter, r *http.Request, s string) {
 	}
 }
 
+func serveProxy(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := authenticate(w, r); !ok {
+		http.Error(w, "Not logged in.", 403)
+		return
+	}
+	proxy.Serve(w, r)
+}
+
 func serveImage(w http.ResponseWriter, r *http.Request, s string) {
 	file, err := os.Open(s)
 	if err != nil {
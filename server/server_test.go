@@ -5,9 +5,10 @@ import (
 )
 
 func TestServer(t *testing.T) {
-	err := ListenAndServe(":2000", "gibberish.pem", "gibberish.key")
-	if err == nil {
-		t.Error("Failed to detect non-existant certificate.")
-		t.Fail()
-	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Failed to detect non-existant certificate.")
+		}
+	}()
+	ServeHTTPS("localhost", "gibberish.pem", "gibberish.key")
 }
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"rs3/database"
+)
+
+type SessionsTemplate struct {
+	Nickname string
+	CSRF     string
+	Error    string
+	Current  string
+	Sessions []*database.Session
+}
+
+// ServeSessions lists the browsers the user is logged in
+// with, and logs them out of one or all of them.
+func ServeSessions(w http.ResponseWriter, r *http.Request) {
+	uid, session, ok := authenticate(w, r)
+	if !ok {
+		Login(w, r)
+		return
+	}
+
+	Template := new(SessionsTemplate)
+	Template.CSRF = csrfToken(session)
+	Template.Current = session.ID
+
+	if r.Method == "POST" {
+		if !checkCSRF(r, session) {
+			http.Error(w, "Invalid form submission.", 403)
+			return
+		}
+		var err error
+		switch r.FormValue("action") {
+		case "revoke":
+			err = database.RevokeSession(uid, r.FormValue("id"))
+		case "all":
+			err = database.RevokeSessions(uid)
+			if err == nil {
+				serveLogin(w, r, 200, nil)
+				return
+			}
+		default:
+			http.Error(w, "Invalid form submission.", 400)
+			return
+		}
+		if err == nil {
+			http.Redirect(w, r, "/sessions", 303)
+			return
+		}
+		Template.Error = err.Error()
+	}
+
+	var err error
+	Template.Nickname, err = database.ClientNickname(uid)
+	if err != nil {
+		fmt.Println("Failed to get nickname.")
+		Template.Nickname = "[UNKNOWN]"
+	}
+	Template.Sessions, err = database.Sessions(uid)
+	if err != nil {
+		fmt.Println("Failed to get sessions.")
+		fmt.Println(err)
+	}
+
+	t, err := template.ParseFiles("server/content/html/sessions.html")
+	if err != nil {
+		fmt.Println("Failed to parse templates.")
+		fmt.Println(err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	err = t.Execute(w, Template)
+	if err != nil {
+		fmt.Println("Failed to execute template.")
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"rs3/database"
+	"rs3/oidc"
+	sec "rs3/security"
+	"rsc.io/qr"
+	"strconv"
+	"time"
+)
+
+type SettingsTemplate struct {
+	Nickname string
+	CSRF     string
+	Error    string
+	Rules    []*database.Rule
+	Feeds    []*FeedOption
+	Test     *database.Rule
+	Matches  []*database.Match
+	TimeZone string
+	Sort     string
+	Tokens   []*database.Token
+	Secret   *NewSecret
+
+	TwoFactor     bool       // Whether two-factor authentication is on.
+	RecoveryLeft  int        // Unused recovery codes.
+	Setup         *TOTPSetup // Two-factor authentication being set up.
+	RecoveryCodes []string   // New recovery codes, shown only once.
+
+	SSO        string // Name of the single sign-on provider, if any.
+	Identities []*database.Identity
+}
+
+// NewSecret is a token or app password which has just been
+// created. Its secret is shown only once.
+type NewSecret struct {
+	Name   string
+	Kind   string
+	Secret string
+}
+
+// TOTPSetup is shown while the user sets up two-factor
+// authentication.
+type TOTPSetup struct {
+	Secret string
+	QR     template.URL // PNG data URI of the otpauth URI.
+}
+
+type FeedOption struct {
+	Title string
+	URL   string
+}
+
+// ServeSettings shows the settings page, and handles the
+// forms it submits.
+func ServeSettings(w http.ResponseWriter, r *http.Request) {
+	uid, session, ok := authenticate(w, r)
+	if !ok {
+		Login(w, r)
+		return
+	}
+
+	Template := new(SettingsTemplate)
+	Template.CSRF = csrfToken(session)
+
+	if r.Method == "POST" {
+		if !checkCSRF(r, session) {
+			http.Error(w, "Invalid form submission.", 403)
+			return
+		}
+		switch r.URL.Path {
+		case "/settings/rules":
+			Template.Error = editRules(r, uid, Template)
+		case "/settings/preferences":
+			Template.Error = editPreferences(r, uid)
+		case "/settings/fever":
+			Template.Error = editFever(r, uid)
+		case "/settings/tokens":
+			Template.Error = editTokens(r, uid, Template)
+		case "/settings/2fa":
+			Template.Error = editTwoFactor(r, uid, Template)
+		case "/settings/sso":
+			Template.Error = editIdentities(r, uid)
+		default:
+			NotFound(w, r)
+			return
+		}
+		if Template.Error == "" && Template.Test == nil && Template.Secret == nil && Template.Setup == nil &&
+			Template.RecoveryCodes == nil {
+			http.Redirect(w, r, "/settings", 303)
+			return
+		}
+	}
+
+	var err error
+	Template.Nickname, err = database.ClientNickname(uid)
+	if err != nil {
+		fmt.Println("Failed to get nickname.")
+		Template.Nickname = "[UNKNOWN]"
+	}
+	Template.Rules, err = database.Rules(uid)
+	if err != nil {
+		fmt.Println("Failed to get rules.")
+		fmt.Println(err)
+	}
+	Template.TimeZone, Template.Sort, err = database.Preferences(uid)
+	if err != nil {
+		fmt.Println("Failed to get preferences.")
+		fmt.Println(err)
+	}
+	Template.Tokens, err = database.Tokens(uid)
+	if err != nil {
+		fmt.Println("Failed to get tokens.")
+		fmt.Println(err)
+	}
+	Template.TwoFactor, Template.RecoveryLeft, err = database.TwoFactorEnabled(uid)
+	if err != nil {
+		fmt.Println("Failed to get two-factor authentication.")
+		fmt.Println(err)
+	}
+	if oidc.Default != nil {
+		Template.SSO = oidc.Default.Name
+		Template.Identities, err = database.Identities(uid)
+		if err != nil {
+			fmt.Println("Failed to get identities.")
+			fmt.Println(err)
+		}
+	}
+	feeds, err := database.Feeds(uid)
+	if err != nil {
+		fmt.Println("Failed to get feeds.")
+		fmt.Println(err)
+	}
+	for _, feed := range feeds {
+		Template.Feeds = append(Template.Feeds, &FeedOption{feed.Title, feed.UpdateURL})
+	}
+
+	t, err := template.ParseFiles("server/content/html/settings.html")
+	if err != nil {
+		fmt.Println("Failed to parse templates.")
+		fmt.Println(err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	err = t.Execute(w, Template)
+	if err != nil {
+		fmt.Println("Failed to execute template.")
+		fmt.Println(err)
+	}
+}
+
+// editRules handles the filter rule forms, returning a
+// message for the user if the edit failed.
+func editRules(r *http.Request, uid []byte, Template *SettingsTemplate) string {
+	switch r.FormValue("action") {
+	case "add", "test":
+		rule := &database.Rule{
+			Feed:     r.FormValue("feed"),
+			Title:    r.FormValue("title"),
+			Content:  r.FormValue("content"),
+			Author:   r.FormValue("author"),
+			Category: r.FormValue("category"),
+			Action:   r.FormValue("rule_action"),
+			Tag:      r.FormValue("tag"),
+		}
+		if r.FormValue("action") == "test" {
+			matches, err := database.TestRule(uid, rule)
+			if err != nil {
+				return err.Error()
+			}
+			Template.Test = rule
+			Template.Matches = matches
+			return ""
+		}
+		_, err := database.AddRule(uid, rule)
+		if err != nil {
+			return err.Error()
+		}
+
+	case "delete":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return "Invalid rule."
+		}
+		err = database.DeleteRule(uid, id)
+		if err != nil {
+			return err.Error()
+		}
+
+	default:
+		return "Unknown action."
+	}
+	return ""
+}
+
+// editPreferences handles the preferences form, returning
+// a message for the user if the edit failed.
+func editPreferences(r *http.Request, uid []byte) string {
+	err := database.SetTimeZone(uid, r.FormValue("timezone"))
+	if err != nil {
+		return "Unknown time zone."
+	}
+	err = database.SetSort(uid, "", r.FormValue("sort"))
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// editFever handles the Fever password form, returning a
+// message for the user if the edit failed.
+func editFever(r *http.Request, uid []byte) string {
+	err := database.SetFeverPassword(uid, r.FormValue("email"), r.FormValue("password"))
+	switch err := err.(type) {
+	case nil:
+		return ""
+	case *sec.WeakPassword:
+		return "Choose a stronger password: " + err.Reason
+	case *database.AuthenticationError:
+		return "That email address does not belong to this account."
+	default:
+		fmt.Println("Failed to set Fever password:")
+		fmt.Println(err)
+		return "Failed to set the Fever password."
+	}
+}
+
+// editTokens handles the forms which create and revoke
+// API tokens and app passwords, returning a message for
+// the user if the edit failed.
+func editTokens(r *http.Request, uid []byte, Template *SettingsTemplate) string {
+	switch r.FormValue("action") {
+	case "create":
+		var expires time.Time
+		if days := r.FormValue("days"); days != "" {
+			n, err := strconv.Atoi(days)
+			if err != nil || n <= 0 {
+				return "Invalid expiry."
+			}
+			expires = time.Now().AddDate(0, 0, n)
+		}
+		name := r.FormValue("name")
+		scope := r.FormValue("scope")
+		var secret string
+		var err error
+		switch kind := r.FormValue("kind"); kind {
+		case database.KindToken:
+			secret, _, err = database.NewToken(uid, name, scope, expires)
+		case database.KindPassword:
+			secret, _, err = database.NewAppPassword(uid, name, scope, expires)
+		default:
+			return "Unknown kind of token."
+		}
+		if err != nil {
+			return err.Error()
+		}
+		Template.Secret = &NewSecret{name, r.FormValue("kind"), secret}
+
+	case "revoke":
+		err := database.RevokeToken(uid, r.FormValue("id"))
+		if err != nil {
+			return err.Error()
+		}
+
+	default:
+		return "Unknown action."
+	}
+	return ""
+}
+
+// editTwoFactor handles the forms which set up and turn
+// off two-factor authentication, and which replace the
+// recovery codes, returning a message for the user if the
+// edit failed.
+func editTwoFactor(r *http.Request, uid []byte, Template *SettingsTemplate) string {
+	var err error
+	code := r.FormValue("code")
+	switch r.FormValue("action") {
+	case "begin":
+		Template.Setup, err = totpSetup(uid)
+		if err != nil {
+			return err.Error()
+		}
+
+	case "enable":
+		Template.RecoveryCodes, err = database.EnableTOTP(uid, code)
+		if _, ok := err.(*database.AuthenticationError); ok {
+			Template.Setup, err = totpSetup(uid)
+			if err != nil {
+				return err.Error()
+			}
+			return "That code is incorrect. Check the time on your device is right, and try again."
+		}
+		if err != nil {
+			return err.Error()
+		}
+
+	case "codes":
+		Template.RecoveryCodes, err = database.NewRecoveryCodes(uid, code)
+		if _, ok := err.(*database.AuthenticationError); ok {
+			return "That code is incorrect."
+		}
+		if err != nil {
+			return err.Error()
+		}
+
+	case "disable":
+		err = database.DisableTOTP(uid, code)
+		if _, ok := err.(*database.AuthenticationError); ok {
+			return "That code is incorrect."
+		}
+		if err != nil {
+			return err.Error()
+		}
+
+	default:
+		return "Unknown action."
+	}
+	return ""
+}
+
+// totpSetup starts setting up two-factor authentication,
+// returning the secret and a QR code of it for the user's
+// authenticator app.
+func totpSetup(uid []byte) (*TOTPSetup, error) {
+	nickname, err := database.ClientNickname(uid)
+	if err != nil {
+		return nil, err
+	}
+	secret, uri, err := database.BeginTOTP(uid, nickname)
+	if err != nil {
+		return nil, err
+	}
+	code, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		return nil, err
+	}
+	data := "data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())
+	return &TOTPSetup{secret, template.URL(data)}, nil
+}
+
+// editIdentities handles the form which unlinks single
+// sign-on accounts, returning a message for the user if the
+// edit failed. Accounts are linked through ServeOIDCLogin.
+func editIdentities(r *http.Request, uid []byte) string {
+	switch r.FormValue("action") {
+	case "unlink":
+		err := database.UnlinkIdentity(uid, r.FormValue("issuer"), r.FormValue("subject"))
+		if err != nil {
+			return err.Error()
+		}
+
+	default:
+		return "Unknown action."
+	}
+	return ""
+}
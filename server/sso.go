@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"rs3/database"
+	"rs3/oidc"
+)
+
+// ServeOIDCLogin sends the user to the identity provider
+// to log in. A logged-in user may instead POST here from
+// the settings page to link their account to the provider.
+func ServeOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	p := oidc.Default
+	if p == nil {
+		NotFound(w, r)
+		return
+	}
+
+	next := safeNext(r.URL.Query().Get("next"))
+	var link []byte
+	if r.Method == "POST" {
+		uid, session, ok := authenticate(w, r)
+		if !ok {
+			Login(w, r)
+			return
+		}
+		if !checkCSRF(r, session) {
+			http.Error(w, "Invalid form submission.", 403)
+			return
+		}
+		link, next = uid, "/settings"
+	}
+
+	authURL, state, err := p.Begin(next, link)
+	if err != nil {
+		fmt.Println("Failed to start single sign-on:")
+		fmt.Println(err)
+		serveLogin(w, r, 502, &LoginTemplate{Error: "Single sign-on is unavailable. Please try again later.", Next: next})
+		return
+	}
+
+	// The state is also kept by the browser, so that the
+	// login can only be completed in the browser which began
+	// it. It must be sent when the provider redirects back,
+	// so cannot be SameSite=Strict.
+	w.Header().Add("Set-Cookie", fmt.Sprintf("oidc=%q; Path=%s; Max-Age=%d; Secure; HttpOnly; SameSite=Lax",
+		state, oidc.LoginPath, int(oidc.FlowLife.Seconds())))
+	http.Redirect(w, r, authURL, 303)
+}
+
+// ServeOIDCCallback completes a login with the identity
+// provider. The user is logged in to the account linked to
+// their identity, or to a new one if the provider is
+// trusted to create them.
+func ServeOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p := oidc.Default
+	if p == nil {
+		NotFound(w, r)
+		return
+	}
+	w.Header().Add("Set-Cookie", fmt.Sprintf("oidc=\"\"; Path=%s; Max-Age=0; Secure; HttpOnly; SameSite=Lax",
+		oidc.LoginPath))
+
+	Template := new(LoginTemplate)
+	query := r.URL.Query()
+	state := query.Get("state")
+	c, err := r.Cookie("oidc")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		Template.Error = "Your login has expired. Please try again."
+		serveLogin(w, r, 400, Template)
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		fmt.Printf("Single sign-on refused: %s %s\n", e, query.Get("error_description"))
+		Template.Error = "You were not logged in with " + p.Name + "."
+		serveLogin(w, r, 401, Template)
+		return
+	}
+
+	id, flow, err := p.Complete(state, query.Get("code"))
+	if err != nil {
+		fmt.Println("Failed to complete single sign-on:")
+		fmt.Println(err)
+		Template.Error = "You could not be logged in with " + p.Name + ". Please try again."
+		serveLogin(w, r, 401, Template)
+		return
+	}
+	Template.Next = flow.Next
+
+	if flow.Link != nil {
+		uid, _, ok := authenticate(w, r)
+		if !ok || !bytes.Equal(uid, flow.Link) {
+			Template.Error = "Your session has ended. Please log in again."
+			serveLogin(w, r, 401, Template)
+			return
+		}
+		err = database.LinkIdentity(uid, id.Issuer, id.Subject, id.Email)
+		if err != nil {
+			http.Error(w, "That "+p.Name+" account is already linked to another RS3 account.", 409)
+			return
+		}
+		http.Redirect(w, r, "/settings", 303)
+		return
+	}
+
+	uid, err := database.IdentityUser(id.Issuer, id.Subject)
+	if _, ok := err.(*database.IdentityDoesNotExist); ok {
+		var msg string
+		uid, msg = createIdentityUser(p, id)
+		if msg != "" {
+			Template.Error = msg
+			serveLogin(w, r, 403, Template)
+			return
+		}
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		http.Error(w, "Failed to process login.", 500)
+		return
+	}
+
+	// The provider stands in for the password, so users
+	// with two-factor authentication still give their code.
+	enabled, _, err := database.TwoFactorEnabled(uid)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		http.Error(w, "Failed to process login.", 500)
+		return
+	}
+	if enabled {
+		askForCode(w, r, uid, id.Email, Template)
+		return
+	}
+	startSession(w, r, uid, flow.Next)
+}
+
+// createIdentityUser creates an account for a user who has
+// none, if the provider is trusted to, returning a message
+// for the user if not.
+func createIdentityUser(p *oidc.Provider, id *oidc.Identity) ([]byte, string) {
+	refused := fmt.Sprintf("No account is linked to your %s login. Log in with your password, and link it on "+
+		"the settings page.", p.Name)
+	if !p.CreateUsers || id.Email == "" || !id.EmailVerified {
+		return nil, refused
+	}
+
+	// Accounts are never linked just because the provider
+	// gives the same email address, as the provider may
+	// not own that address.
+	if _, salt := database.Account(id.Email); salt != nil {
+		return nil, refused
+	}
+	uid, err := database.CreateIdentityUser(id.Email, id.Name, id.Issuer, id.Subject)
+	if err != nil {
+		fmt.Println("Failed to create user for single sign-on:")
+		fmt.Println(err)
+		return nil, refused
+	}
+	fmt.Printf("Created user %q for single sign-on.\n", id.Email)
+	return uid, ""
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"rs3/database"
+	"rs3/oidc"
+	"rs3/oidc/oidctest"
+	"testing"
+)
+
+func TestOIDCTwoFactor(t *testing.T) {
+	mock := oidctest.NewProvider("rs3", "secret")
+	defer mock.Close()
+	mock.Claims = map[string]interface{}{"sub": "sso", "email": "sso@example.com", "email_verified": true}
+	p, err := oidc.New(&oidc.Config{
+		Name:         "Mock",
+		Issuer:       mock.URL(),
+		ClientID:     mock.ClientID,
+		ClientSecret: mock.ClientSecret,
+		RedirectURL:  "https://rs3.example.com" + oidc.CallbackPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oidc.Default = p
+	defer func() { oidc.Default = nil }()
+
+	uid := addUser(t, "sso@example.com", "password")
+	err = database.LinkIdentity(uid, mock.URL(), "sso", "sso@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := enableTOTP(t, uid)
+
+	// Log in with the provider, as a browser would.
+	w := httptest.NewRecorder()
+	ServeOIDCLogin(w, httptest.NewRequest("GET", oidc.LoginPath+"?next=/settings", nil))
+	state := w.Result().Cookies()[0]
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	r := httptest.NewRequest("GET", resp.Header.Get("Location"), nil)
+	r.AddCookie(state)
+	w = httptest.NewRecorder()
+	ServeOIDCCallback(w, r)
+
+	// The user is asked for their code, not logged in.
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "auth" && c.Value != "" {
+			t.Fatal("Expected not to be logged in yet.")
+		}
+	}
+	c := pendingCookie(w)
+	if w.Code != 200 || c == nil {
+		t.Fatalf("Expected to be asked for a code, got %d: %v.", w.Code, w.Header())
+	}
+	w = post(Login, "/login", "203.0.113.6", url.Values{"code": {code}, "next": {"/settings"}}, c)
+	if w.Code != 303 || w.Header().Get("Location") != "/settings" {
+		t.Errorf("Expected to be logged in, got %d: %v.", w.Code, w.Header())
+	}
+}